@@ -0,0 +1,279 @@
+package connpool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shell909090/goproxy/cryptconn"
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+type StreamInfo struct {
+	Id     uint16
+	Status string
+	Target string
+	Recv   int64
+	Sent   int64
+	// Interactive streams are sent before bulk ones.
+	Interactive bool
+}
+
+type SessionInfo struct {
+	Id      uint64
+	Name    string
+	Local   string
+	Remote  string
+	Uptime  float64
+	Recv    int64
+	Sent    int64
+	Streams []StreamInfo
+}
+
+func NewSessionInfo(id uint64, tun tunnel.Tunnel) (si *SessionInfo) {
+	si = &SessionInfo{
+		Id:     id,
+		Name:   tun.String(),
+		Uptime: tun.Uptime().Seconds(),
+	}
+	if fab, ok := tun.(interface {
+		LocalAddr() net.Addr
+		RemoteAddr() net.Addr
+	}); ok {
+		si.Local = fab.LocalAddr().String()
+		si.Remote = fab.RemoteAddr().String()
+	}
+
+	for _, c := range tun.GetConnections() {
+		st := StreamInfo{
+			Id:     c.GetStreamId(),
+			Status: c.GetStatusString(),
+			Target: c.GetTarget(),
+			Recv:   c.GetBytesRecv(),
+			Sent:   c.GetBytesSent(),
+
+			Interactive: c.IsInteractive(),
+		}
+		si.Recv += st.Recv
+		si.Sent += st.Sent
+		si.Streams = append(si.Streams, st)
+	}
+	return
+}
+
+// PoolStatus counts sessions and streams in them.
+type PoolStatus struct {
+	Sessions int
+	Streams  int
+}
+
+func (pool *Pool) Status() (ps PoolStatus) {
+	for _, tun := range pool.GetTunnels() {
+		ps.Sessions++
+		ps.Streams += len(tun.GetConnections())
+	}
+	return
+}
+
+func (pool *Pool) findTunnel(id uint64) (tun tunnel.Tunnel) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+	for m, e := range pool.members {
+		if t, ok := m.(tunnel.Tunnel); ok && e.id == id {
+			return t
+		}
+	}
+	return
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (pool *Pool) HandlerSessions(w http.ResponseWriter, req *http.Request) {
+	sessions := make([]*SessionInfo, 0)
+	for _, tun := range pool.GetTunnels() {
+		sessions = append(sessions, NewSessionInfo(pool.GetId(tun), tun))
+	}
+	writeJson(w, sessions)
+	return
+}
+
+// HandlerKill closes a session with Id in parameter sess, or just one
+// stream in it with parameter id.
+func (pool *Pool) HandlerKill(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	q := req.URL.Query()
+	sessid, err := strconv.ParseUint(q.Get("sess"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid session id"))
+		return
+	}
+	tun := pool.findTunnel(sessid)
+	if tun == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("session not found"))
+		return
+	}
+
+	strid := q.Get("id")
+	if strid == "" {
+		logger.Noticef("session %s killed by admin.", tun.String())
+		tun.Close()
+		return
+	}
+
+	id, err := strconv.ParseUint(strid, 10, 16)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid stream id"))
+		return
+	}
+	for _, c := range tun.GetConnections() {
+		if c.GetStreamId() == uint16(id) {
+			c.Kill()
+			return
+		}
+	}
+	w.WriteHeader(404)
+	w.Write([]byte("stream not found"))
+	return
+}
+
+// KillUser closes all sessions of user.
+func (server *Server) KillUser(username string) (n int) {
+	for _, tun := range server.Pool.GetTunnels() {
+		if ts, ok := tun.(*tunnel.TunnelServer); ok && ts.Username == username {
+			tun.Close()
+			n++
+		}
+	}
+	logger.Noticef("%d session(s) of user %s killed.", n, username)
+	return
+}
+
+func (server *Server) HandlerUsers(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, server.Users.List())
+	return
+}
+
+// HandlerUserModify changes user with parameter user by action in path:
+// set (with password and optional totp), disable, enable or delete.
+// With kill=1, sessions of user are closed after disable or delete.
+func (server *Server) HandlerUserModify(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	username := req.FormValue("user")
+	if username == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("no user"))
+		return
+	}
+
+	var err error
+	action := strings.TrimPrefix(req.URL.Path, "/api/users/")
+	switch action {
+	case "set":
+		err = server.Users.Set(
+			username, req.FormValue("password"), req.FormValue("totp"))
+	case "disable":
+		err = server.Users.SetDisabled(username, true)
+	case "enable":
+		err = server.Users.SetDisabled(username, false)
+	case "delete":
+		err = server.Users.Delete(username)
+	default:
+		w.WriteHeader(404)
+		return
+	}
+	switch err {
+	case nil:
+	case ErrUserNotFound:
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	default:
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logger.Noticef("user %s %s by admin.", username, action)
+
+	if (action == "disable" || action == "delete") && req.FormValue("kill") == "1" {
+		server.KillUser(username)
+	}
+	return
+}
+
+// HandlerBanned lists hosts banned, POST with parameter host unbans it.
+func (server *Server) HandlerBanned(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		host := req.FormValue("host")
+		if host == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("no host"))
+			return
+		}
+		server.Banner.Unban(host)
+		logger.Noticef("%s unbanned by admin.", host)
+		return
+	}
+	writeJson(w, server.Banner.GetBanned())
+	return
+}
+
+// HandlerCipher shows cipher chosen by auto method, null if not used.
+func HandlerCipher(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, cryptconn.GetCipherChoice())
+	return
+}
+
+// WriteSessionMetrics writes bytes of each session in pool.
+func (pool *Pool) WriteSessionMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP goproxy_session_bytes_total Bytes of msocks streams by session.")
+	fmt.Fprintln(w, "# TYPE goproxy_session_bytes_total counter")
+	for _, tun := range pool.GetTunnels() {
+		fab, ok := tun.(interface {
+			GetBytesSent() int64
+			GetBytesRecv() int64
+		})
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "goproxy_session_bytes_total{session=%q,direction=\"sent\"} %d\n",
+			tun.String(), fab.GetBytesSent())
+		fmt.Fprintf(w, "goproxy_session_bytes_total{session=%q,direction=\"recv\"} %d\n",
+			tun.String(), fab.GetBytesRecv())
+	}
+}
+
+func (pool *Pool) HandlerMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	tunnel.DefaultHostStats.WriteMetrics(w)
+	netutil.DefaultDialStats.WriteMetrics(w)
+	pool.WriteSessionMetrics(w)
+	pool.lock.RLock()
+	metrics := pool.metrics
+	pool.lock.RUnlock()
+	for _, f := range metrics {
+		f(w)
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package connpool
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerSessions(t *testing.T) {
+	pool := NewPool()
+	// sessions may have the same name, but never the same id.
+	a := &fakeTunnel{name: "same"}
+	b := &fakeTunnel{name: "same"}
+	pool.Add(a)
+	pool.Add(b)
+
+	w := httptest.NewRecorder()
+	pool.HandlerSessions(w, httptest.NewRequest("GET", "/api/sessions", nil))
+	if w.Code != 200 {
+		t.Fatalf("status: %d", w.Code)
+	}
+	var sessions []SessionInfo
+	err := json.Unmarshal(w.Body.Bytes(), &sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("sessions: %+v", sessions)
+	}
+	if sessions[0].Id == 0 || sessions[0].Id == sessions[1].Id {
+		t.Fatalf("session ids not unique: %d %d", sessions[0].Id, sessions[1].Id)
+	}
+	if sessions[0].Name != "same" {
+		t.Fatalf("session name: %s", sessions[0].Name)
+	}
+}
+
+func TestHandlerKill(t *testing.T) {
+	pool := NewPool()
+	a := &fakeTunnel{name: "same"}
+	b := &fakeTunnel{name: "same"}
+	pool.Add(a)
+	pool.Add(b)
+	id := pool.GetId(b)
+
+	for _, c := range []struct {
+		method string
+		query  string
+		code   int
+	}{
+		{"GET", fmt.Sprintf("sess=%d", id), 405},
+		{"POST", "sess=same", 400},
+		{"POST", "sess=100", 404},
+		{"POST", fmt.Sprintf("sess=%d&id=abc", id), 400},
+		{"POST", fmt.Sprintf("sess=%d&id=1", id), 404},
+	} {
+		w := httptest.NewRecorder()
+		pool.HandlerKill(w, httptest.NewRequest(c.method, "/api/kill?"+c.query, nil))
+		if w.Code != c.code {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.query, w.Code, c.code)
+		}
+	}
+	if a.closed || b.closed {
+		t.Fatal("session closed by bad request")
+	}
+
+	w := httptest.NewRecorder()
+	pool.HandlerKill(w, httptest.NewRequest("POST",
+		fmt.Sprintf("/api/kill?sess=%d", id), nil))
+	if w.Code != 200 {
+		t.Fatalf("status: %d", w.Code)
+	}
+	if a.closed || !b.closed {
+		t.Fatal("wrong session killed")
+	}
+}
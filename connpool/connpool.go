@@ -0,0 +1,355 @@
+package connpool
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const MAX_IDLE_CONNS = 4
+
+type idleConn struct {
+	ConnMember
+	key     string
+	created time.Time
+	since   time.Time
+}
+
+// ConnPool keeps idle connections by destination, dialing the same
+// network and address later takes one of them instead of a new one.
+// Connection goes back to pool when closed, unless it has seen any error.
+type ConnPool struct {
+	dialer netutil.Dialer
+	// idles are kept in a Pool, in order they are put back.
+	idles    *Pool
+	lock     sync.Mutex
+	draining bool
+	inuse    map[*PooledConn]struct{}
+	// MaxIdle is max idle connections kept for each destination.
+	MaxIdle int
+	// IdleTimeout drops connections idle for that long.
+	// Zero means never.
+	IdleTimeout time.Duration
+	// Order is lifo (default) to take the latest idle connection, or
+	// fifo to take the oldest.
+	Order string
+	// FlushWindow closes idle connections created within that long of
+	// one failed with reset, they are likely dead too (eg. server
+	// restarted). Zero means never.
+	FlushWindow time.Duration
+	Stats       *PoolStats
+}
+
+func NewConnPool(dialer netutil.Dialer) (cp *ConnPool) {
+	return &ConnPool{
+		dialer:  dialer,
+		idles:   NewPool(),
+		inuse:   make(map[*PooledConn]struct{}, 0),
+		MaxIdle: MAX_IDLE_CONNS,
+		Stats:   NewPoolStats("conn"),
+	}
+}
+
+func poolKey(network, address string) string {
+	return network + "!" + address
+}
+
+func ofKey(key string) func(Member) bool {
+	return func(m Member) bool {
+		return m.(*idleConn).key == key
+	}
+}
+
+func (cp *ConnPool) expired(ic *idleConn, now time.Time) bool {
+	return cp.IdleTimeout != 0 && now.Sub(ic.since) > cp.IdleTimeout
+}
+
+// getIdle takes an idle connection of key by order, closing expired ones.
+func (cp *ConnPool) getIdle(key string) (ic *idleConn) {
+	order := cp.Order
+	if order == "" {
+		order = ORDER_LIFO
+	}
+	now := time.Now()
+	for {
+		m := cp.idles.pick(ofKey(key), order, true)
+		if m == nil {
+			return nil
+		}
+		ic = m.(*idleConn)
+		if !cp.expired(ic, now) {
+			return
+		}
+		cp.Stats.Discard("expired")
+		ic.Conn.Close()
+	}
+}
+
+// put makes ic idle, unless pool is draining or full for its key.
+func (cp *ConnPool) put(ic *idleConn) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if cp.draining {
+		cp.Stats.Discard("drain")
+		ic.Conn.Close()
+		return
+	}
+	if cp.idles.count(ofKey(ic.key)) >= cp.MaxIdle {
+		cp.Stats.Discard("full")
+		ic.Conn.Close()
+		return
+	}
+	cp.idles.Add(ic)
+}
+
+// closeIdle closes idle connections passed check.
+func (cp *ConnPool) closeIdle(check func(*idleConn) bool, reason string) {
+	for _, m := range cp.idles.GetMembers() {
+		if cp.idles.removeIf(m, func(m Member) bool {
+			return check(m.(*idleConn))
+		}) {
+			cp.Stats.Discard(reason)
+			m.Close()
+		}
+	}
+}
+
+// flush closes idle connections of key created within FlushWindow
+// around created.
+func (cp *ConnPool) flush(key string, created time.Time) {
+	cp.closeIdle(func(ic *idleConn) bool {
+		d := ic.created.Sub(created)
+		if d < 0 {
+			d = -d
+		}
+		return ic.key == key && d <= cp.FlushWindow
+	}, "flush")
+}
+
+// Preconnect dials destination until it has n idle connections.
+func (cp *ConnPool) Preconnect(network, address string, n int) (err error) {
+	key := poolKey(network, address)
+	for {
+		size := cp.idles.count(ofKey(key))
+		if size >= n || size >= cp.MaxIdle {
+			return
+		}
+		var conn net.Conn
+		conn, err = cp.dialer.Dial(network, address)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		cp.put(&idleConn{ConnMember{conn}, key, now, now})
+	}
+}
+
+// CloseIdle closes all idle connections, or only expired ones.
+func (cp *ConnPool) CloseIdle(expiredOnly bool) {
+	now := time.Now()
+	cp.closeIdle(func(ic *idleConn) bool {
+		return !expiredOnly || cp.expired(ic, now)
+	}, "expired")
+}
+
+// CheckIdle closes idle connections expired or failed in validation.
+// Call it from time to time, so dead connections won't stay in pool.
+func (cp *ConnPool) CheckIdle() {
+	cp.CloseIdle(true)
+
+	// members are taken out while checking, then put back in order.
+	members := cp.idles.takeAll(func(Member) bool { return true })
+	checkMembers(members, func(m Member, err error) {
+		logger.Infof("idle connection %s: %s, close it.", m.String(), err.Error())
+		cp.Stats.Discard("unhealthy")
+		m.Close()
+		m.(*idleConn).Conn = nil
+	})
+	for _, m := range members {
+		ic := m.(*idleConn)
+		if ic.Conn != nil {
+			cp.put(ic)
+		}
+	}
+}
+
+// WriteMetrics writes stats of pool, size counts connections in use
+// and idle.
+func (cp *ConnPool) WriteMetrics(w io.Writer) {
+	idle := cp.idles.GetSize()
+	cp.lock.Lock()
+	size := len(cp.inuse) + idle
+	cp.lock.Unlock()
+	cp.Stats.WriteMetrics(w, size, idle)
+}
+
+// Drain stops giving out connections, closes idle ones now, and the
+// others once they are returned. Connections still in use after grace
+// are closed. It returns when all connections closed.
+func (cp *ConnPool) Drain(grace time.Duration) {
+	cp.lock.Lock()
+	cp.draining = true
+	cp.lock.Unlock()
+	cp.closeIdle(func(*idleConn) bool { return true }, "drain")
+
+	deadline := time.Now().Add(grace)
+	for {
+		cp.lock.Lock()
+		var inuse []*PooledConn
+		for pc := range cp.inuse {
+			inuse = append(inuse, pc)
+		}
+		cp.lock.Unlock()
+		if len(inuse) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, pc := range inuse {
+				pc.Discard()
+			}
+		}
+		time.Sleep(DRAIN_CHECK)
+	}
+}
+
+func (cp *ConnPool) Dial(network, address string) (conn net.Conn, err error) {
+	cp.lock.Lock()
+	draining := cp.draining
+	cp.lock.Unlock()
+	if draining {
+		return nil, ErrDraining
+	}
+
+	start := time.Now()
+	key := poolKey(network, address)
+	for {
+		ic := cp.getIdle(key)
+		if ic == nil {
+			break
+		}
+		if ic.Validate() == nil {
+			logger.Debugf("reuse connection to %s.", address)
+			cp.Stats.Hit()
+			return cp.checkout(ic.Conn, key, ic.created, start), nil
+		}
+		cp.Stats.Discard("dead")
+		ic.Conn.Close()
+	}
+
+	cp.Stats.Miss()
+	raw, err := cp.dialer.Dial(network, address)
+	if err != nil {
+		cp.Stats.Fail()
+		return
+	}
+	return cp.checkout(raw, key, time.Now(), start), nil
+}
+
+// DialContext is Dial, but gives up when ctx is done. Connection dialed
+// after that goes into pool as idle.
+func (cp *ConnPool) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := cp.Dial(network, address)
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (cp *ConnPool) checkout(raw net.Conn, key string, created, start time.Time) (pc *PooledConn) {
+	cp.Stats.Checkout(time.Since(start))
+	pc = &PooledConn{Conn: raw, pool: cp, key: key, created: created}
+	cp.lock.Lock()
+	cp.inuse[pc] = struct{}{}
+	cp.lock.Unlock()
+	return
+}
+
+// PooledConn goes back to its pool when closed.
+type PooledConn struct {
+	net.Conn
+	pool    *ConnPool
+	key     string
+	created time.Time
+	lock    sync.Mutex
+	failure string // class of first error, empty if none
+	closed  bool
+}
+
+func (pc *PooledConn) setFailure(class string) {
+	pc.lock.Lock()
+	if pc.failure == "" {
+		pc.failure = class
+	}
+	pc.lock.Unlock()
+}
+
+func (pc *PooledConn) Read(b []byte) (n int, err error) {
+	n, err = pc.Conn.Read(b)
+	if err != nil {
+		pc.setFailure(ClassifyError(err))
+	}
+	return
+}
+
+func (pc *PooledConn) Write(b []byte) (n int, err error) {
+	n, err = pc.Conn.Write(b)
+	if err != nil {
+		pc.setFailure(ClassifyError(err))
+	}
+	return
+}
+
+// Discard makes connection closed for real, not back to pool.
+func (pc *PooledConn) Discard() {
+	pc.setFailure("discarded")
+	pc.Close()
+}
+
+// Fail closes connection found broken by user, such as a bad response.
+// err is classified as errors in Read and Write.
+func (pc *PooledConn) Fail(err error) {
+	pc.setFailure(ClassifyError(err))
+	pc.Close()
+}
+
+func (pc *PooledConn) Close() (err error) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	pc.pool.lock.Lock()
+	delete(pc.pool.inuse, pc)
+	pc.pool.lock.Unlock()
+	if pc.failure != "" {
+		pc.pool.Stats.Discard(pc.failure)
+		if pc.failure == CLASS_RESET && pc.pool.FlushWindow != 0 {
+			pc.pool.flush(pc.key, pc.created)
+		}
+		return pc.Conn.Close()
+	}
+	pc.Conn.SetDeadline(time.Time{})
+	pc.pool.put(&idleConn{ConnMember{pc.Conn}, pc.key, pc.created, time.Now()})
+	return
+}
@@ -0,0 +1,196 @@
+package connpool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// echoServer runs a server echoes everything back.
+func echoServer(t *testing.T) (addr string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestConnPool(t *testing.T) {
+	addr := echoServer(t)
+	cp := NewConnPool(netutil.DefaultTcpDialer)
+	conn1, err := cp.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := conn1.LocalAddr().String()
+	conn1.Close()
+
+	conn2, err := cp.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn2.LocalAddr().String() != local {
+		t.Fatal("idle connection not reused")
+	}
+	conn2.(*PooledConn).Discard()
+
+	conn3, err := cp.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn3.Close()
+	if conn3.LocalAddr().String() == local {
+		t.Fatal("discarded connection reused")
+	}
+
+	if err = cp.Preconnect("tcp", addr, 2); err != nil {
+		t.Fatal(err)
+	}
+	if cp.idles.count(ofKey(poolKey("tcp", addr))) != 2 {
+		t.Fatal("preconnect not filled pool")
+	}
+	cp.CheckIdle()
+	if cp.idles.count(ofKey(poolKey("tcp", addr))) != 2 {
+		t.Fatal("live connection closed in check")
+	}
+
+	var buf bytes.Buffer
+	cp.WriteMetrics(&buf)
+	for _, line := range []string{
+		`goproxy_pool_size{pool="conn"} 3`,
+		`goproxy_pool_checkouts_total{pool="conn",result="hit"} 1`,
+		`goproxy_pool_checkouts_total{pool="conn",result="miss"} 2`,
+		`goproxy_pool_discards_total{pool="conn",reason="discarded"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("metrics without %s:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestConnPoolOrder(t *testing.T) {
+	addr := echoServer(t)
+	for _, c := range []struct {
+		order string
+		first bool
+	}{
+		{"", false},
+		{ORDER_LIFO, false},
+		{ORDER_FIFO, true},
+	} {
+		cp := NewConnPool(netutil.DefaultTcpDialer)
+		cp.Order = c.order
+		conn1, err := cp.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn2, err := cp.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := conn2.LocalAddr().String()
+		if c.first {
+			want = conn1.LocalAddr().String()
+		}
+		conn1.Close()
+		conn2.Close()
+
+		conn, err := cp.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.LocalAddr().String() != want {
+			t.Errorf("order %q: wrong connection reused", c.order)
+		}
+		conn.Close()
+		cp.Drain(0)
+	}
+}
+
+type blockDialer struct{}
+
+func (bd blockDialer) Dial(network, address string) (net.Conn, error) {
+	time.Sleep(time.Second)
+	return nil, io.EOF
+}
+
+func TestConnPoolContext(t *testing.T) {
+	cp := NewConnPool(blockDialer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := cp.DialContext(ctx, "tcp", "127.0.0.1:1")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("dial not timeout: %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("dial blocked after deadline")
+	}
+}
+
+func TestConnPoolFlush(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// reset connection when anything received.
+				var b [1]byte
+				conn.Read(b[:])
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	cp := NewConnPool(netutil.DefaultTcpDialer)
+	cp.FlushWindow = time.Minute
+	conn1, err := cp.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := cp.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2.Close()
+
+	conn1.Write([]byte("r"))
+	var b [1]byte
+	_, err = conn1.Read(b[:])
+	if class := ClassifyError(err); class != CLASS_RESET {
+		t.Fatalf("error %v classified as %s", err, class)
+	}
+	conn1.Close()
+	if cp.idles.count(ofKey(poolKey("tcp", addr))) != 0 {
+		t.Fatal("sibling not flushed")
+	}
+}
@@ -1,9 +1,12 @@
 package connpool
 
 import (
+	"context"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
@@ -12,16 +15,35 @@ import (
 
 type Dialer struct {
 	*Pool
-	MinSess  int
-	MaxConn  int
+	MinSess int
+	MaxConn int
+	// MaxIdle closes sessions without any stream for that long.
+	// MaxAge stops new streams going into sessions older than that,
+	// and closes them after their streams are done. Zero means no limit.
+	MaxIdle time.Duration
+	MaxAge  time.Duration
+	// ValidateIdle pings session idle for that long before giving it
+	// out. Zero means never.
+	ValidateIdle time.Duration
+	// MaxWait limits time Dial waits for a session. Zero means no limit.
+	MaxWait time.Duration
+	// Order picks session for stream, least streams in it if empty.
+	// fifo picks the session picked earliest, streams go to all sessions
+	// in turn. lifo picks the latest one till it's full, others idle out.
+	Order string
+	// FlushWindow pings sessions created within that long of one
+	// closed by peer. Zero means never.
+	FlushWindow time.Duration
+	Stats       *PoolStats
+	draining    int32
+	// retired is unix nano when creators replaced, sessions created
+	// before are not used any more.
+	retired  int64
 	lock     sync.Mutex
 	creators []*tunnel.DialerCreator
 }
 
 func NewDialer(MinSess, MaxConn int) (dialer *Dialer) {
-	if MinSess == 0 {
-		MinSess = 0
-	}
 	if MaxConn == 0 {
 		MaxConn = 64
 	}
@@ -29,7 +51,9 @@ func NewDialer(MinSess, MaxConn int) (dialer *Dialer) {
 		Pool:    NewPool(),
 		MinSess: MinSess,
 		MaxConn: MaxConn,
+		Stats:   NewPoolStats("msocks"),
 	}
+	dialer.AddMetrics(dialer.WriteMetrics)
 	go dialer.loop()
 	return
 }
@@ -40,11 +64,26 @@ func (dialer *Dialer) AddDialerCreator(orig *tunnel.DialerCreator) {
 	dialer.creators = append(dialer.creators, orig)
 }
 
+// SetDialerCreators replaces creators, when servers changed. Sessions
+// created before are retired as expired by MaxAge, no new stream goes
+// into them, and they are closed once their streams are done.
+func (dialer *Dialer) SetDialerCreators(creators []*tunnel.DialerCreator) {
+	dialer.lock.Lock()
+	defer dialer.lock.Unlock()
+	dialer.creators = creators
+	atomic.StoreInt64(&dialer.retired, time.Now().UnixNano())
+}
+
 // CAUTION: balance should run after loop begin
 // because creators are added one by one, it will take a while.
 func (dialer *Dialer) loop() {
 	for {
-		time.Sleep(60 * time.Second)
+		time.Sleep(PING_INTERVAL * time.Second)
+		if dialer.Draining() {
+			return
+		}
+		dialer.checkHealth(dialer.GetTunnels(), "unhealthy")
+		dialer.reap()
 		err := dialer.balance()
 		if err != nil {
 			logger.Error(err.Error())
@@ -52,9 +91,155 @@ func (dialer *Dialer) loop() {
 	}
 }
 
+// checkHealth pings sessions at the same time. Sessions don't answer
+// will be closed, and their streams with them. balance refill the pool.
+func (dialer *Dialer) checkHealth(tuns TunSlice, reason string) {
+	members := make([]Member, len(tuns))
+	for i, tun := range tuns {
+		members[i] = tun
+	}
+	checkMembers(members, func(m Member, err error) {
+		logger.Errorf("session %s %s: %s, close it.",
+			m.String(), reason, err.Error())
+		dialer.discard(m.(tunnel.Tunnel), reason)
+	})
+}
+
+// checkSiblings pings sessions created within FlushWindow around the
+// one closed by peer, they are likely dead too if server restarted.
+// Sessions with streams are not closed blindly, only if ping fails.
+func (dialer *Dialer) checkSiblings(closed tunnel.Tunnel) {
+	created := time.Now().Add(-closed.Uptime())
+	var siblings TunSlice
+	for _, tun := range dialer.GetTunnels() {
+		d := time.Now().Add(-tun.Uptime()).Sub(created)
+		if d < 0 {
+			d = -d
+		}
+		if d <= dialer.FlushWindow {
+			siblings = append(siblings, tun)
+		}
+	}
+	if len(siblings) == 0 {
+		return
+	}
+	logger.Infof("session %s closed, check %d sibling(s).",
+		closed.String(), len(siblings))
+	dialer.checkHealth(siblings, "flush")
+}
+
+func (dialer *Dialer) usable(tun tunnel.Tunnel) bool {
+	uptime := tun.Uptime()
+	retired := atomic.LoadInt64(&dialer.retired)
+	if retired != 0 && time.Since(time.Unix(0, retired)) <= uptime {
+		return false
+	}
+	return dialer.MaxAge == 0 || uptime < dialer.MaxAge
+}
+
+func (dialer *Dialer) countUsable() (n int) {
+	for _, tun := range dialer.GetTunnels() {
+		if dialer.usable(tun) {
+			n++
+		}
+	}
+	return
+}
+
+// reap closes sessions idle too long, and sessions too old which have
+// no stream left. They are checked and removed from pool in its lock,
+// so no one will pick them while closing.
+func (dialer *Dialer) reap() {
+	for _, tun := range dialer.GetTunnels() {
+		switch {
+		case dialer.removeIf(tun, dialer.idleTooLong):
+			logger.Infof("session %s idle for %s, close it.",
+				tun.String(), tun.Idle())
+			dialer.Stats.Discard("idle")
+			tun.Close()
+		case dialer.removeIf(tun, dialer.expired):
+			logger.Infof("session %s expired, close it.", tun.String())
+			dialer.Stats.Discard("expired")
+			tun.Close()
+		}
+	}
+}
+
+func (dialer *Dialer) idleTooLong(m Member) bool {
+	tun := m.(tunnel.Tunnel)
+	return dialer.MaxIdle != 0 && tun.Idle() > dialer.MaxIdle
+}
+
+func (dialer *Dialer) expired(m Member) bool {
+	tun := m.(tunnel.Tunnel)
+	return !dialer.usable(tun) && tun.GetSize() == 0
+}
+
+// discard removes session from pool and closes it. Session removed
+// already is closing by someone else.
+func (dialer *Dialer) discard(tun tunnel.Tunnel, reason string) {
+	if dialer.Remove(tun) != nil {
+		return
+	}
+	dialer.Stats.Discard(reason)
+	tun.Close()
+}
+
+func (dialer *Dialer) Draining() bool {
+	return atomic.LoadInt32(&dialer.draining) != 0
+}
+
+// Drain stops giving out sessions, closes idle ones now, and the others
+// once their streams are done. Sessions left after grace are closed with
+// their streams. It returns when all sessions closed.
+func (dialer *Dialer) Drain(grace time.Duration) {
+	atomic.StoreInt32(&dialer.draining, 1)
+	deadline := time.Now().Add(grace)
+	for {
+		tuns := dialer.GetTunnels()
+		if len(tuns) == 0 {
+			return
+		}
+		timeout := time.Now().After(deadline)
+		for _, tun := range tuns {
+			if timeout || tun.GetSize() == 0 {
+				dialer.discard(tun, "drain")
+			}
+		}
+		time.Sleep(DRAIN_CHECK)
+	}
+}
+
+// WriteMetrics writes stats of sessions, idle means no stream in it.
+func (dialer *Dialer) WriteMetrics(w io.Writer) {
+	tuns := dialer.GetTunnels()
+	idle := 0
+	for _, tun := range tuns {
+		if tun.GetSize() == 0 {
+			idle++
+		}
+	}
+	dialer.Stats.WriteMetrics(w, len(tuns), idle)
+}
+
+// Warmup creates MinSess sessions now instead of waiting for loop, so
+// the first requests don't pay for handshake. loop keeps them topped up.
+// Call it after all creators added.
+func (dialer *Dialer) Warmup() {
+	go func() {
+		start := time.Now()
+		err := dialer.balance()
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		logger.Noticef("pool warmed up with %d session(s) in %s.",
+			dialer.GetSize(), time.Since(start))
+	}()
+}
+
 func (dialer *Dialer) balance() (err error) {
-	tsize := dialer.GetSize()
-	if tsize < dialer.MinSess {
+	for tsize := dialer.countUsable(); tsize < dialer.MinSess; tsize++ {
 		logger.Info("create tunnel because tsize < minsess.")
 		err = dialer.newTunnel(false)
 		if err != nil {
@@ -62,7 +247,7 @@ func (dialer *Dialer) balance() (err error) {
 		}
 	}
 
-	_, fsize := dialer.getMinimum()
+	_, fsize := dialer.getMinimum(dialer.usable)
 	if fsize > dialer.MaxConn {
 		logger.Info("create tunnel because fsize > maxconn.")
 		err = dialer.newTunnel(false)
@@ -73,16 +258,58 @@ func (dialer *Dialer) balance() (err error) {
 	return
 }
 
-// Get one or create one.
+// Get one or create one. Session dead in validation is thrown away,
+// and try another one.
 func (dialer *Dialer) Get() (tun tunnel.Tunnel, err error) {
-	if dialer.GetSize() == 0 {
+	if dialer.Draining() {
+		return nil, ErrDraining
+	}
+	start := time.Now()
+	for i := 0; i <= DIAL_RETRY; i++ {
+		tun, err = dialer.pick()
+		if err != nil {
+			return
+		}
+		if dialer.validate(tun) {
+			dialer.Stats.Checkout(time.Since(start))
+			return
+		}
+	}
+	return nil, ErrNoSession
+}
+
+// validate checks session idle too long, drop it if failed.
+func (dialer *Dialer) validate(tun tunnel.Tunnel) bool {
+	if dialer.ValidateIdle == 0 || tun.Idle() < dialer.ValidateIdle {
+		return true
+	}
+	err := tun.Validate()
+	if err == nil {
+		return true
+	}
+	logger.Errorf("session %s failed in validation: %s, close it.",
+		tun.String(), err.Error())
+	dialer.discard(tun, "validation")
+	return false
+}
+
+func (dialer *Dialer) pick() (tun tunnel.Tunnel, err error) {
+	if dialer.countUsable() == 0 {
+		dialer.Stats.Miss()
 		err = dialer.newTunnel(true)
 		if err != nil {
 			return
 		}
+	} else {
+		dialer.Stats.Hit()
 	}
 
-	tun, _ = dialer.getMinimum()
+	if dialer.Order != "" {
+		tun = dialer.pickOrder()
+	}
+	if tun == nil {
+		tun, _ = dialer.getMinimum(dialer.usable)
+	}
 	if tun == nil {
 		err = ErrNoSession
 		return
@@ -90,6 +317,18 @@ func (dialer *Dialer) Get() (tun tunnel.Tunnel, err error) {
 	return
 }
 
+// pickOrder picks session usable and not full by Order.
+func (dialer *Dialer) pickOrder() (tun tunnel.Tunnel) {
+	m := dialer.Pool.pick(func(m Member) bool {
+		t := m.(tunnel.Tunnel)
+		return dialer.usable(t) && t.GetSize() < dialer.MaxConn
+	}, dialer.Order, false)
+	if m != nil {
+		tun = m.(tunnel.Tunnel)
+	}
+	return
+}
+
 // Randomly select a server, try to connect with it. If it is failed, try next.
 // Repeat for DIAL_RETRY times.
 // Each time it will take 2 ^ (net.ipv4.tcp_syn_retries + 1) - 1 second(s).
@@ -97,7 +336,7 @@ func (dialer *Dialer) Get() (tun tunnel.Tunnel, err error) {
 func (dialer *Dialer) newTunnel(create bool) (err error) {
 	var tun tunnel.Tunnel
 	dialer.lock.Lock()
-	if create && (dialer.GetSize() != 0) {
+	if create && (dialer.countUsable() != 0) {
 		dialer.lock.Unlock()
 		logger.Debug("create first tunnel but already have one.")
 		return
@@ -117,6 +356,7 @@ func (dialer *Dialer) newTunnel(create bool) (err error) {
 		tun, err = orig.Create()
 		if err != nil {
 			logger.Error(err.Error())
+			dialer.Stats.Fail()
 			continue
 		}
 		break
@@ -141,8 +381,16 @@ func (dialer *Dialer) newTunnel(create bool) (err error) {
 // but we can think that as over max_conn line just happened.
 func (dialer *Dialer) sessRun(tun tunnel.Tunnel) {
 	defer func() {
+		// discarded session has been removed already.
 		err := dialer.Remove(tun)
-		if err != nil {
+		switch err {
+		case nil:
+			dialer.Stats.Discard("closed")
+			if dialer.FlushWindow != 0 {
+				go dialer.checkSiblings(tun)
+			}
+		case ErrSessionNotFound:
+		default:
 			logger.Error(err.Error())
 		}
 	}()
@@ -152,8 +400,38 @@ func (dialer *Dialer) sessRun(tun tunnel.Tunnel) {
 	return
 }
 
+// GetContext is Get, but gives up when ctx is done. Session created
+// after that stays in pool for others.
+func (dialer *Dialer) GetContext(ctx context.Context) (tun tunnel.Tunnel, err error) {
+	type result struct {
+		tun tunnel.Tunnel
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		tun, err := dialer.Get()
+		ch <- result{tun, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.tun, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
-	tun, err := dialer.Get()
+	if dialer.MaxWait == 0 {
+		return dialer.DialContext(context.Background(), network, address)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialer.MaxWait)
+	defer cancel()
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (dialer *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	tun, err := dialer.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -161,5 +439,5 @@ func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
 	if !ok {
 		panic("tunnel not a dialer in client side.")
 	}
-	return d.Dial(network, address)
+	return netutil.DialContext(ctx, d, network, address)
 }
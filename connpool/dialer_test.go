@@ -0,0 +1,230 @@
+package connpool
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+type fakeTunnel struct {
+	name   string
+	size   int
+	uptime time.Duration
+	idle   time.Duration
+	closed bool
+	dead   bool
+}
+
+func (ft *fakeTunnel) String() string                   { return ft.name }
+func (ft *fakeTunnel) GetSize() int                     { return ft.size }
+func (ft *fakeTunnel) GetConnections() tunnel.ConnSlice { return nil }
+func (ft *fakeTunnel) Uptime() time.Duration            { return ft.uptime }
+func (ft *fakeTunnel) Idle() time.Duration              { return ft.idle }
+func (ft *fakeTunnel) Loop()                            {}
+func (ft *fakeTunnel) Validate() error {
+	if ft.dead {
+		return tunnel.ErrPingTimeout
+	}
+	return nil
+}
+func (ft *fakeTunnel) Close() error { ft.closed = true; return nil }
+
+func TestReap(t *testing.T) {
+	dialer := &Dialer{
+		Pool:    NewPool(),
+		MaxIdle: time.Minute,
+		MaxAge:  time.Hour,
+		Stats:   NewPoolStats("test"),
+	}
+	idle := &fakeTunnel{name: "idle", idle: 2 * time.Minute}
+	busy := &fakeTunnel{name: "busy", size: 1, uptime: 2 * time.Hour}
+	old := &fakeTunnel{name: "old", uptime: 2 * time.Hour}
+	fresh := &fakeTunnel{name: "fresh", size: 2}
+	for _, tun := range []*fakeTunnel{idle, busy, old, fresh} {
+		dialer.Add(tun)
+	}
+
+	dialer.reap()
+	if !idle.closed || !old.closed {
+		t.Fatal("idle or expired session not closed")
+	}
+	if busy.closed || fresh.closed {
+		t.Fatal("session with streams closed")
+	}
+	if dialer.GetSize() != 2 || dialer.countUsable() != 1 {
+		t.Fatalf("wrong pool size: %d, usable %d",
+			dialer.GetSize(), dialer.countUsable())
+	}
+
+	tun, err := dialer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun != fresh {
+		t.Fatalf("expired session picked: %s", tun.String())
+	}
+}
+
+// pickedTunnel is picked by someone while its idle checked, and a
+// stream opened in it if picked.
+type pickedTunnel struct {
+	*fakeTunnel
+	dialer *Dialer
+	once   sync.Once
+}
+
+func (pt *pickedTunnel) Idle() time.Duration {
+	idle := pt.idle
+	pt.once.Do(func() {
+		ch := make(chan tunnel.Tunnel, 1)
+		go func() {
+			tun, _ := pt.dialer.getMinimum(nil)
+			ch <- tun
+		}()
+		select {
+		case tun := <-ch:
+			if tun == pt {
+				pt.size, pt.idle = 1, 0
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+	return idle
+}
+
+func TestReapPicked(t *testing.T) {
+	dialer := &Dialer{
+		Pool:    NewPool(),
+		MaxIdle: time.Minute,
+		Stats:   NewPoolStats("test"),
+	}
+	pt := &pickedTunnel{
+		fakeTunnel: &fakeTunnel{name: "idle", idle: 2 * time.Minute},
+		dialer:     dialer,
+	}
+	dialer.Add(pt)
+	dialer.reap()
+	if pt.closed && pt.size != 0 {
+		t.Fatal("session closed with stream")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dialer := &Dialer{
+		Pool:         NewPool(),
+		ValidateIdle: time.Minute,
+		Stats:        NewPoolStats("test"),
+	}
+	dead := &fakeTunnel{name: "dead", idle: 2 * time.Minute, dead: true}
+	alive := &fakeTunnel{name: "alive", size: 1}
+	dialer.Add(dead)
+	dialer.Add(alive)
+
+	tun, err := dialer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun != alive {
+		t.Fatalf("wrong session picked: %s", tun.String())
+	}
+	if !dead.closed || dialer.GetSize() != 1 {
+		t.Fatal("dead session not thrown away")
+	}
+}
+
+func TestOrder(t *testing.T) {
+	dialer := &Dialer{
+		Pool:    NewPool(),
+		MaxConn: 4,
+		Stats:   NewPoolStats("test"),
+	}
+	a := &fakeTunnel{name: "a", size: 2}
+	b := &fakeTunnel{name: "b", size: 1}
+	c := &fakeTunnel{name: "c", size: 3}
+	full := &fakeTunnel{name: "full", size: 4}
+	for _, tun := range []*fakeTunnel{a, b, c, full} {
+		dialer.Add(tun)
+	}
+
+	for _, want := range []*fakeTunnel{b, b} {
+		if tun, _ := dialer.Get(); tun != want {
+			t.Fatalf("least streams picked %s", tun.String())
+		}
+	}
+
+	// sessions in turn, the one picked earliest first.
+	dialer.Order = ORDER_FIFO
+	for _, want := range []*fakeTunnel{a, b, c, a} {
+		if tun, _ := dialer.Get(); tun != want {
+			t.Fatalf("fifo picked %s, want %s", tun.String(), want.String())
+		}
+	}
+
+	// the one picked latest till it's full.
+	dialer.Order = ORDER_LIFO
+	for _, want := range []*fakeTunnel{a, a} {
+		if tun, _ := dialer.Get(); tun != want {
+			t.Fatalf("lifo picked %s, want %s", tun.String(), want.String())
+		}
+	}
+	a.size = 4
+	if tun, _ := dialer.Get(); tun != c {
+		t.Fatalf("lifo picked %s after full", tun.String())
+	}
+}
+
+func TestDrain(t *testing.T) {
+	dialer := &Dialer{
+		Pool:  NewPool(),
+		Stats: NewPoolStats("test"),
+	}
+	idle := &fakeTunnel{name: "idle"}
+	busy := &fakeTunnel{name: "busy", size: 1}
+	dialer.Add(idle)
+	dialer.Add(busy)
+
+	done := make(chan struct{})
+	go func() {
+		dialer.Drain(200 * time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if !idle.closed || busy.closed {
+		t.Fatal("idle session not closed first")
+	}
+	if _, err := dialer.Get(); err != ErrDraining {
+		t.Fatalf("session given out while draining: %v", err)
+	}
+	<-done
+	if !busy.closed {
+		t.Fatal("busy session not closed after grace")
+	}
+}
+
+func TestSetDialerCreators(t *testing.T) {
+	dialer := &Dialer{
+		Pool:  NewPool(),
+		Stats: NewPoolStats("test"),
+	}
+	idle := &fakeTunnel{name: "idle", uptime: time.Minute}
+	busy := &fakeTunnel{name: "busy", size: 1, uptime: time.Minute}
+	dialer.Add(idle)
+	dialer.Add(busy)
+
+	dialer.SetDialerCreators(nil)
+	fresh := &fakeTunnel{name: "fresh"}
+	dialer.Add(fresh)
+	dialer.reap()
+	if !idle.closed || busy.closed {
+		t.Fatal("retired session not closed once idle")
+	}
+	tun, err := dialer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun != fresh {
+		t.Fatalf("retired session picked: %s", tun.String())
+	}
+}
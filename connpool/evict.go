@@ -0,0 +1,34 @@
+package connpool
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Classes of connection errors.
+const (
+	CLASS_RESET    = "reset"
+	CLASS_TIMEOUT  = "timeout"
+	CLASS_EOF      = "eof"
+	CLASS_PROTOCOL = "protocol"
+)
+
+// ClassifyError tells why a connection failed. reset means peer aborted
+// it, which often comes with a server restart. Errors not from network
+// are protocol errors.
+func ClassifyError(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return CLASS_RESET
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return CLASS_EOF
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return CLASS_TIMEOUT
+	}
+	return CLASS_PROTOCOL
+}
@@ -0,0 +1,61 @@
+package connpool
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const ALIVE_TIMEOUT = time.Millisecond
+
+var ErrConnDead = errors.New("idle connection has data or closed.")
+
+// Member is what a pool keeps, a msocks session, a tls or tcp connection.
+// Validate checks if it's still usable, it should be cheap enough to run
+// before each reuse. tunnel.Tunnel is a Member.
+type Member interface {
+	String() string
+	Validate() error
+	Close() error
+}
+
+// ConnMember makes a plain or tls connection a pool member.
+type ConnMember struct {
+	net.Conn
+}
+
+func (cm ConnMember) String() string {
+	return fmt.Sprintf("%s->%s", cm.LocalAddr(), cm.RemoteAddr())
+}
+
+// Validate reads with a short deadline. An idle connection should have
+// nothing to read, data or EOF means it's unusable.
+func (cm ConnMember) Validate() (err error) {
+	var b [1]byte
+	cm.SetReadDeadline(time.Now().Add(ALIVE_TIMEOUT))
+	_, err = cm.Read(b[:])
+	cm.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return ErrConnDead
+}
+
+// checkMembers validates members at the same time, and calls fail with
+// those failed.
+func checkMembers(members []Member, fail func(Member, error)) {
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func(m Member) {
+			defer wg.Done()
+			err := m.Validate()
+			if err != nil {
+				fail(m, err)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
@@ -2,113 +2,255 @@ package connpool
 
 import (
 	"errors"
+	"io"
 	"net/http"
 	"net/http/pprof"
 	"sort"
 	"sync"
+	"time"
 
 	logging "github.com/op/go-logging"
 	"github.com/shell909090/goproxy/tunnel"
 )
 
 const (
-	BALANCE_INTERVAL = 60
-	DIAL_RETRY       = 2
-	AUTH_TIMEOUT     = 10
+	PING_INTERVAL = 15
+	DIAL_RETRY    = 2
+	AUTH_TIMEOUT  = 10
 )
 
+// Checkout orders. LIFO keeps a small hot set alive and lets others idle
+// out, FIFO spreads load and keeps all connections fresh.
+const (
+	ORDER_LIFO = "lifo"
+	ORDER_FIFO = "fifo"
+)
+
+// DRAIN_CHECK is interval to check if connections in use are done
+// while draining.
+const DRAIN_CHECK = 100 * time.Millisecond
+
 var (
 	ErrNoSession       = errors.New("session in pool but can't pick one.")
 	ErrSessionNotFound = errors.New("session not found.")
 	ErrNoCreator       = errors.New("can't create tunnel with no creator.")
+	ErrOrder           = errors.New("checkout order should be lifo or fifo.")
+	ErrDraining        = errors.New("pool is draining.")
 )
 
 var (
 	logger = logging.MustGetLogger("connpool")
 )
 
+// Pool keeps members, msocks sessions or idle connections. Each member
+// has an id never reused, and a sequence of last time it's picked, by
+// which members are picked in lifo or fifo order.
 type Pool struct {
 	lock    sync.RWMutex // sess pool locker
-	tunpool map[tunnel.Tunnel]struct{}
+	seq     uint64
+	members map[Member]*poolEntry
+	metrics []func(io.Writer)
+}
+
+type poolEntry struct {
+	id   uint64
+	used uint64 // seq when added or picked last time
 }
 
 func NewPool() (pool *Pool) {
 	pool = &Pool{
-		tunpool: make(map[tunnel.Tunnel]struct{}, 0),
+		members: make(map[Member]*poolEntry, 0),
 	}
 	return
 }
 
+// AddMetrics adds a writer of metrics shown in /metrics, such as
+// WriteMetrics of a Dialer or a ConnPool.
+func (pool *Pool) AddMetrics(f func(io.Writer)) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.metrics = append(pool.metrics, f)
+}
+
 func (pool *Pool) CutAll() {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
-	for t, _ := range pool.tunpool {
-		t.Close()
+	for m, _ := range pool.members {
+		m.Close()
 	}
-	pool.tunpool = make(map[tunnel.Tunnel]struct{}, 0)
+	pool.members = make(map[Member]*poolEntry, 0)
 }
 
 func (pool *Pool) GetSize() int {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
-	return len(pool.tunpool)
+	return len(pool.members)
 }
 
-func (pool *Pool) getMinimum() (tun tunnel.Tunnel, size int) {
-	size = -1
+// CheckOrder returns ErrOrder if order is not empty, lifo or fifo.
+func CheckOrder(order string) (err error) {
+	switch order {
+	case "", ORDER_LIFO, ORDER_FIFO:
+		return
+	}
+	return ErrOrder
+}
+
+// pick returns a member usable, the latest picked one by lifo, the
+// earliest one by fifo. With remove, it's taken out of pool.
+func (pool *Pool) pick(usable func(Member) bool, order string, remove bool) (m Member) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var picked *poolEntry
+	for member, e := range pool.members {
+		if usable != nil && !usable(member) {
+			continue
+		}
+		switch {
+		case picked == nil:
+		case order == ORDER_LIFO && e.used < picked.used:
+			continue
+		case order != ORDER_LIFO && e.used > picked.used:
+			continue
+		}
+		m, picked = member, e
+	}
+	switch {
+	case picked == nil:
+	case remove:
+		delete(pool.members, m)
+	default:
+		pool.seq++
+		picked.used = pool.seq
+	}
+	return
+}
+
+// count returns number of members usable.
+func (pool *Pool) count(usable func(Member) bool) (n int) {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
-	for t, _ := range pool.tunpool {
-		n := t.GetSize()
-		if size == -1 || n < size {
-			tun = t
-			size = n
+	for m, _ := range pool.members {
+		if usable(m) {
+			n++
 		}
 	}
 	return
 }
 
-type TunSlice []tunnel.Tunnel
+// takeAll takes members usable out of pool, the earliest picked first.
+// Adding them back in that order keeps their order.
+func (pool *Pool) takeAll(usable func(Member) bool) (members []Member) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for m, _ := range pool.members {
+		if usable(m) {
+			members = append(members, m)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return pool.members[members[i]].used < pool.members[members[j]].used
+	})
+	for _, m := range members {
+		delete(pool.members, m)
+	}
+	return
+}
+
+type MemberSlice []Member
 
-func (ts TunSlice) Len() int      { return len(ts) }
-func (ts TunSlice) Swap(i, j int) { ts[i], ts[j] = ts[j], ts[i] }
-func (ts TunSlice) Less(i, j int) bool {
-	return ts[i].String() < ts[j].String()
+func (ms MemberSlice) Len() int      { return len(ms) }
+func (ms MemberSlice) Swap(i, j int) { ms[i], ms[j] = ms[j], ms[i] }
+func (ms MemberSlice) Less(i, j int) bool {
+	return ms[i].String() < ms[j].String()
 }
 
+func (pool *Pool) GetMembers() (members MemberSlice) {
+	pool.lock.RLock()
+	for m, _ := range pool.members {
+		members = append(members, m)
+	}
+	pool.lock.RUnlock()
+	sort.Sort(members)
+	return
+}
+
+type TunSlice []tunnel.Tunnel
+
+// GetTunnels returns members which are msocks sessions.
 func (pool *Pool) GetTunnels() (tuns TunSlice) {
-	tuns = func() (tuns []tunnel.Tunnel) {
-		pool.lock.RLock()
-		defer pool.lock.RUnlock()
-		for t, _ := range pool.tunpool {
-			tuns = append(tuns, t)
+	for _, m := range pool.GetMembers() {
+		if tun, ok := m.(tunnel.Tunnel); ok {
+			tuns = append(tuns, tun)
 		}
-		return
-	}()
-	sort.Sort(tuns)
+	}
 	return
 }
 
-func (pool *Pool) Add(tun tunnel.Tunnel) {
+// getMinimum returns tunnel with least streams, in tunnels usable if
+// usable is not nil.
+func (pool *Pool) getMinimum(usable func(tunnel.Tunnel) bool) (tun tunnel.Tunnel, size int) {
+	size = -1
+	for _, t := range pool.GetTunnels() {
+		if usable != nil && !usable(t) {
+			continue
+		}
+		n := t.GetSize()
+		if size == -1 || n < size {
+			tun = t
+			size = n
+		}
+	}
+	return
+}
+
+func (pool *Pool) Add(m Member) {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
-	pool.tunpool[tun] = struct{}{}
+	pool.seq++
+	pool.members[m] = &poolEntry{id: pool.seq, used: pool.seq}
 }
 
-func (pool *Pool) Remove(tun tunnel.Tunnel) (err error) {
+func (pool *Pool) Remove(m Member) (err error) {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
-	if _, ok := pool.tunpool[tun]; !ok {
+	if _, ok := pool.members[m]; !ok {
 		return ErrSessionNotFound
 	}
-	delete(pool.tunpool, tun)
+	delete(pool.members, m)
 	return
 }
 
+// removeIf removes m if check passes. Check is done in lock, so m
+// can't be picked in between.
+func (pool *Pool) removeIf(m Member, check func(Member) bool) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if _, ok := pool.members[m]; !ok || !check(m) {
+		return false
+	}
+	delete(pool.members, m)
+	return true
+}
+
+// GetId returns id of m, 0 if not in pool.
+func (pool *Pool) GetId(m Member) uint64 {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+	if e, ok := pool.members[m]; ok {
+		return e.id
+	}
+	return 0
+}
+
 func (pool *Pool) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/", pool.HandlerMain)
 	mux.HandleFunc("/lookup", HandlerLookup)
 	mux.HandleFunc("/cutoff", pool.HandlerCutoff)
+	mux.HandleFunc("/api/sessions", pool.HandlerSessions)
+	mux.HandleFunc("/api/kill", pool.HandlerKill)
+	mux.HandleFunc("/api/cipher", HandlerCipher)
+	mux.HandleFunc("/metrics", pool.HandlerMetrics)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
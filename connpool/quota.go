@@ -0,0 +1,456 @@
+package connpool
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/store"
+)
+
+const (
+	SAVE_INTERVAL = 60
+	SYNC_INTERVAL = 5
+)
+
+var (
+	ErrQuotaExceeded = errors.New("user quota exceeded.")
+)
+
+// Quota limits bytes a user can transfer, in both directions.
+// Zero means no limit.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+type Usage struct {
+	Username string
+	Day      string
+	Daily    int64
+	Month    string
+	Monthly  int64
+	Total    int64
+	pending  pendingBytes
+}
+
+// pendingBytes are bytes not synced to store, of each counter, as
+// some of them may be pushed while others failed.
+type pendingBytes struct {
+	daily   int64
+	monthly int64
+	total   int64
+}
+
+func (p *pendingBytes) add(o pendingBytes) {
+	p.daily += o.daily
+	p.monthly += o.monthly
+	p.total += o.total
+}
+
+// renew clears counters which belong to a passed day or month.
+func (u *Usage) renew(now time.Time) {
+	day := now.Format("2006-01-02")
+	if u.Day != day {
+		u.Day = day
+		u.Daily = 0
+	}
+	month := now.Format("2006-01")
+	if u.Month != month {
+		u.Month = month
+		u.Monthly = 0
+	}
+}
+
+func (u *Usage) exceed(q Quota) bool {
+	if q.Daily != 0 && u.Daily >= q.Daily {
+		return true
+	}
+	if q.Monthly != 0 && u.Monthly >= q.Monthly {
+		return true
+	}
+	return false
+}
+
+type UsageSlice []Usage
+
+func (us UsageSlice) Len() int           { return len(us) }
+func (us UsageSlice) Swap(i, j int)      { us[i], us[j] = us[j], us[i] }
+func (us UsageSlice) Less(i, j int) bool { return us[i].Username < us[j].Username }
+
+// Accounting counts bytes for each user, and keep counters in file
+// across restarts. With a store, counters are shared by all servers
+// using the same store.
+type Accounting struct {
+	lock   sync.Mutex
+	file   string
+	store  store.Store
+	dirty  bool
+	quotas map[string]Quota
+	usages map[string]*Usage
+}
+
+func NewAccounting(quotas map[string]Quota, file string, st store.Store) (acct *Accounting, err error) {
+	acct = &Accounting{
+		file:   file,
+		store:  st,
+		quotas: quotas,
+		usages: make(map[string]*Usage, 0),
+	}
+
+	if file != "" {
+		err = acct.Load()
+		if err != nil {
+			return
+		}
+	}
+	if file != "" || st != nil {
+		go acct.loop()
+	}
+	return
+}
+
+func (acct *Accounting) Load() (err error) {
+	data, err := ioutil.ReadFile(acct.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	var usages []Usage
+	err = json.Unmarshal(data, &usages)
+	if err != nil {
+		return
+	}
+
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	for i := range usages {
+		acct.usages[usages[i].Username] = &usages[i]
+	}
+	logger.Infof("%d user usage(s) loaded from %s.", len(usages), acct.file)
+	return
+}
+
+func (acct *Accounting) Save() (err error) {
+	acct.lock.Lock()
+	acct.dirty = false
+	usages := acct.getUsages()
+	acct.lock.Unlock()
+
+	data, err := json.Marshal(usages)
+	if err != nil {
+		return
+	}
+
+	// write to temp file and rename, never leave a broken file.
+	tmpfile := acct.file + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmpfile, acct.file)
+}
+
+func (acct *Accounting) loop() {
+	tick_save := time.Tick(SAVE_INTERVAL * time.Second)
+	tick_sync := time.Tick(SYNC_INTERVAL * time.Second)
+	for {
+		var err error
+		select {
+		case <-tick_sync:
+			if acct.store == nil {
+				continue
+			}
+			err = acct.Sync()
+		case <-tick_save:
+			acct.lock.Lock()
+			dirty := acct.dirty
+			acct.lock.Unlock()
+			if acct.file == "" || !dirty {
+				continue
+			}
+			err = acct.Save()
+		}
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// Flush pushes bytes counted to store and saves usages to file, used
+// before quit so nothing counted since last tick is lost.
+func (acct *Accounting) Flush() (err error) {
+	if acct.store != nil {
+		err = acct.Sync()
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if acct.file != "" {
+		err1 := acct.Save()
+		if err1 != nil {
+			err = err1
+		}
+	}
+	return
+}
+
+func usageKeys(username string, u *Usage) (day, month, total string) {
+	prefix := "goproxy:usage:" + username
+	return prefix + ":day:" + u.Day, prefix + ":month:" + u.Month, prefix + ":total"
+}
+
+// Sync pushes bytes counted here to store, and takes totals of all
+// servers back.
+func (acct *Accounting) Sync() (err error) {
+	pendings := make(map[string]Usage)
+	acct.lock.Lock()
+	for username, u := range acct.usages {
+		if u.pending != (pendingBytes{}) {
+			pendings[username] = *u
+			u.pending = pendingBytes{}
+		}
+	}
+	acct.lock.Unlock()
+
+	for username, u := range pendings {
+		var synced Usage
+		synced, u.pending, err = acct.incrStore(username, &u, u.pending)
+		if err != nil {
+			// keep counters not pushed only.
+			pendings[username] = u
+			break
+		}
+		delete(pendings, username)
+		acct.setSynced(username, &synced)
+	}
+	if err != nil {
+		// put back all not pushed, try next time.
+		acct.lock.Lock()
+		for username, u := range pendings {
+			acct.getUsage(username).pending.add(u.pending)
+		}
+		acct.lock.Unlock()
+	}
+	return
+}
+
+// incrStore pushes p to counters in store, left is what not pushed if
+// any failed.
+func (acct *Accounting) incrStore(username string, u *Usage, p pendingBytes) (synced Usage, left pendingBytes, err error) {
+	kday, kmonth, ktotal := usageKeys(username, u)
+	synced = Usage{Username: username, Day: u.Day, Month: u.Month}
+	left = p
+	synced.Daily, err = acct.store.IncrBy(kday, p.daily)
+	if err != nil {
+		return
+	}
+	left.daily = 0
+	synced.Monthly, err = acct.store.IncrBy(kmonth, p.monthly)
+	if err != nil {
+		return
+	}
+	left.monthly = 0
+	synced.Total, err = acct.store.IncrBy(ktotal, p.total)
+	if err != nil {
+		return
+	}
+	left.total = 0
+	return
+}
+
+// setSynced replaces local counters with the ones from store,
+// keeping bytes counted since then.
+func (acct *Accounting) setSynced(username string, synced *Usage) {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	u := acct.getUsage(username)
+	if u.Day == synced.Day {
+		u.Daily = synced.Daily + u.pending.daily
+	}
+	if u.Month == synced.Month {
+		u.Monthly = synced.Monthly + u.pending.monthly
+	}
+	u.Total = synced.Total + u.pending.total
+	acct.dirty = true
+}
+
+// refresh takes counters of user from store.
+func (acct *Accounting) refresh(username string) (err error) {
+	acct.lock.Lock()
+	u := *acct.getUsage(username)
+	acct.lock.Unlock()
+
+	synced, _, err := acct.incrStore(username, &u, pendingBytes{})
+	if err != nil {
+		return
+	}
+	acct.setSynced(username, &synced)
+	return
+}
+
+// lock must be held.
+func (acct *Accounting) getUsage(username string) (u *Usage) {
+	u, ok := acct.usages[username]
+	if !ok {
+		u = &Usage{Username: username}
+		acct.usages[username] = u
+	}
+	u.renew(time.Now())
+	return
+}
+
+// Check returns ErrQuotaExceeded if user can't transfer any more.
+func (acct *Accounting) Check(username string) (err error) {
+	q, ok := acct.quotas[username]
+	if !ok {
+		return
+	}
+
+	if acct.store != nil {
+		err = acct.refresh(username)
+		if err != nil {
+			// store down, let it go with counters we have.
+			logger.Error(err.Error())
+			err = nil
+		}
+	}
+
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	if acct.getUsage(username).exceed(q) {
+		return ErrQuotaExceeded
+	}
+	return
+}
+
+// Add counts n bytes for user, and check the quota after that.
+func (acct *Accounting) Add(username string, n int) (err error) {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	u := acct.getUsage(username)
+	u.Daily += int64(n)
+	u.Monthly += int64(n)
+	u.Total += int64(n)
+	u.pending.add(pendingBytes{int64(n), int64(n), int64(n)})
+	acct.dirty = true
+
+	if q, ok := acct.quotas[username]; ok && u.exceed(q) {
+		return ErrQuotaExceeded
+	}
+	return
+}
+
+func (acct *Accounting) Reset(username string) (err error) {
+	acct.lock.Lock()
+	u := *acct.getUsage(username)
+	delete(acct.usages, username)
+	acct.dirty = true
+	acct.lock.Unlock()
+	logger.Noticef("usage of user %s reset.", username)
+
+	if acct.store == nil {
+		return
+	}
+	kday, kmonth, ktotal := usageKeys(username, &u)
+	for _, key := range []string{kday, kmonth, ktotal} {
+		err = acct.store.Del(key)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// lock must be held.
+func (acct *Accounting) getUsages() (usages UsageSlice) {
+	now := time.Now()
+	for _, u := range acct.usages {
+		u.renew(now)
+		usages = append(usages, *u)
+	}
+	sort.Sort(usages)
+	return
+}
+
+func (acct *Accounting) GetUsages() (usages UsageSlice) {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	return acct.getUsages()
+}
+
+func (acct *Accounting) HandlerUsage(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(acct.GetUsages())
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
+func (acct *Accounting) HandlerReset(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	users, ok := req.URL.Query()["user"]
+	if !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("no user"))
+		return
+	}
+	for _, username := range users {
+		err := acct.Reset(username)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	return
+}
+
+// AcctConn counts all bytes in and out for one user.
+// Read and write fail once the user exceeded quota.
+type AcctConn struct {
+	net.Conn
+	acct     *Accounting
+	username string
+}
+
+func NewAcctConn(conn net.Conn, acct *Accounting, username string) (ac *AcctConn) {
+	return &AcctConn{
+		Conn:     conn,
+		acct:     acct,
+		username: username,
+	}
+}
+
+func (ac *AcctConn) Read(b []byte) (n int, err error) {
+	n, err = ac.Conn.Read(b)
+	if n > 0 {
+		if e := ac.acct.Add(ac.username, n); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (ac *AcctConn) Write(b []byte) (n int, err error) {
+	n, err = ac.Conn.Write(b)
+	if n > 0 {
+		if e := ac.acct.Add(ac.username, n); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,167 @@
+package connpool
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/shell909090/goproxy/store"
+)
+
+func TestAccounting(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	quotas := map[string]Quota{"user": {Daily: 100}}
+
+	acct, err := NewAccounting(quotas, file, nil)
+	if err != nil {
+		t.Fatalf("NewAccounting failed: %s", err)
+	}
+
+	if err = acct.Add("user", 60); err != nil {
+		t.Fatalf("quota exceeded too early: %s", err)
+	}
+	if err = acct.Add("user", 60); err != ErrQuotaExceeded {
+		t.Fatalf("quota not exceeded: %v", err)
+	}
+	if err = acct.Check("user"); err != ErrQuotaExceeded {
+		t.Fatalf("check passed after exceeded: %v", err)
+	}
+	if err = acct.Add("other", 1000); err != nil {
+		t.Fatalf("user without quota limited: %s", err)
+	}
+
+	if err = acct.Save(); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	acct, err = NewAccounting(quotas, file, nil)
+	if err != nil {
+		t.Fatalf("NewAccounting failed: %s", err)
+	}
+	usages := acct.GetUsages()
+	if len(usages) != 2 || usages[1].Username != "user" || usages[1].Total != 120 {
+		t.Fatalf("usage not persisted: %+v", usages)
+	}
+
+	if err = acct.Reset("user"); err != nil {
+		t.Fatalf("Reset failed: %s", err)
+	}
+	if err = acct.Check("user"); err != nil {
+		t.Fatalf("check failed after reset: %s", err)
+	}
+}
+
+func TestSharedAccounting(t *testing.T) {
+	st := store.NewMemStore()
+	quotas := map[string]Quota{"user": {Monthly: 100}}
+
+	acct1, _ := NewAccounting(quotas, "", st)
+	acct2, _ := NewAccounting(quotas, "", st)
+
+	acct1.Add("user", 60)
+	acct2.Add("user", 60)
+	if err := acct1.Sync(); err != nil {
+		t.Fatalf("Sync failed: %s", err)
+	}
+	if err := acct2.Sync(); err != nil {
+		t.Fatalf("Sync failed: %s", err)
+	}
+
+	if err := acct1.Check("user"); err != ErrQuotaExceeded {
+		t.Fatalf("quota on other server not counted: %v", err)
+	}
+}
+
+// failStore fails the failAt-th IncrBy.
+type failStore struct {
+	*store.MemStore
+	calls  int
+	failAt int
+}
+
+func (fs *failStore) IncrBy(key string, n int64) (total int64, err error) {
+	fs.calls++
+	if fs.calls == fs.failAt {
+		return 0, errors.New("store down.")
+	}
+	return fs.MemStore.IncrBy(key, n)
+}
+
+func TestSyncFailed(t *testing.T) {
+	st := &failStore{MemStore: store.NewMemStore()}
+	acct, _ := NewAccounting(nil, "", st)
+	users := []string{"user1", "user2", "user3"}
+	for _, user := range users {
+		acct.Add(user, 10)
+	}
+
+	// fails after all keys of the first user pushed.
+	st.failAt = 4
+	if err := acct.Sync(); err == nil {
+		t.Fatal("Sync not failed.")
+	}
+	if err := acct.Sync(); err != nil {
+		t.Fatalf("Sync failed: %s", err)
+	}
+
+	for _, user := range users {
+		value, _, _ := st.Get(fmt.Sprintf("goproxy:usage:%s:total", user))
+		if value != "10" {
+			t.Fatalf("total of %s in store: %q", user, value)
+		}
+	}
+	for _, u := range acct.GetUsages() {
+		if u.Total != 10 {
+			t.Fatalf("total of %s: %d", u.Username, u.Total)
+		}
+	}
+}
+
+func TestSyncPartlyFailed(t *testing.T) {
+	st := &failStore{MemStore: store.NewMemStore()}
+	acct, _ := NewAccounting(nil, "", st)
+	acct.Add("user", 10)
+
+	// daily pushed, monthly failed.
+	st.failAt = 2
+	if err := acct.Sync(); err == nil {
+		t.Fatal("Sync not failed.")
+	}
+	if err := acct.Sync(); err != nil {
+		t.Fatalf("Sync failed: %s", err)
+	}
+
+	u := acct.GetUsages()[0]
+	for _, key := range []string{"day:" + u.Day, "month:" + u.Month, "total"} {
+		value, _, _ := st.Get("goproxy:usage:user:" + key)
+		if value != "10" {
+			t.Fatalf("%s in store: %q", key, value)
+		}
+	}
+	if u.Daily != 10 || u.Monthly != 10 || u.Total != 10 {
+		t.Fatalf("wrong usage: %v", u)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	st := store.NewMemStore()
+	acct, _ := NewAccounting(nil, file, st)
+	acct.Add("user", 10)
+
+	if err := acct.Flush(); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+	value, _, _ := st.Get("goproxy:usage:user:total")
+	if value != "10" {
+		t.Fatalf("total in store: %q", value)
+	}
+	acct, err := NewAccounting(nil, file, nil)
+	if err != nil {
+		t.Fatalf("NewAccounting failed: %s", err)
+	}
+	usages := acct.GetUsages()
+	if len(usages) != 1 || usages[0].Total != 10 {
+		t.Fatalf("usage not saved: %+v", usages)
+	}
+}
@@ -1,15 +1,45 @@
 package connpool
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/shell909090/goproxy/cryptconn"
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/store"
 	"github.com/shell909090/goproxy/tunnel"
 )
 
+// AUTH_PREFIX is prefix of key for user password in store.
+const AUTH_PREFIX = "goproxy:auth:"
+
+var ErrNoClientCert = errors.New("no verified client certificate.")
+
 type Server struct {
 	*Pool
 	tunnel.Server
 	auth *map[string]string
+	// Accounting counts bytes per user if not nil.
+	Accounting *Accounting
+	// Store keeps passwords shared with other servers if not nil.
+	Store store.Store
+	// Users keeps hashed passwords if not nil.
+	Users *UserDB
+	// Banner counts failed auth if not nil.
+	Banner *netutil.Banner
+	// CertAuth takes common name of verified client certificate as
+	// username, and no password needed.
+	CertAuth bool
+
+	flock    sync.Mutex
+	failures map[string]int64
 }
 
 func NewServer(auth *map[string]string) (server *Server) {
@@ -17,39 +47,271 @@ func NewServer(auth *map[string]string) (server *Server) {
 		auth = nil
 	}
 	server = &Server{
-		Pool: NewPool(),
-		auth: auth,
+		Pool:     NewPool(),
+		auth:     auth,
+		failures: make(map[string]int64, 0),
 	}
 	server.Server.Handler = server
+	server.AddMetrics(server.WriteMetrics)
+	return
+}
+
+func (server *Server) lookupPassword(username string) (password string, ok bool) {
+	if server.auth != nil {
+		password, ok = (*server.auth)[username]
+		if ok {
+			return
+		}
+	}
+	if server.Store == nil {
+		return
+	}
+
+	password, ok, err := server.Store.Get(AUTH_PREFIX + username)
+	if err != nil {
+		logger.Error(err.Error())
+		return "", false
+	}
 	return
 }
 
 func (server *Server) AuthPass(username, password string) bool {
-	if server.auth == nil {
+	if server.auth == nil && server.Store == nil && server.Users == nil {
 		return true
 	}
-	password1, ok := (*server.auth)[username]
+	if server.Users != nil && server.Users.Has(username) {
+		if !server.Users.Verify(username, password) {
+			return false
+		}
+		return server.checkUser(username)
+	}
+	password1, ok := server.lookupPassword(username)
 	if !ok {
 		return false
 	}
 	if password1 != password {
 		return false
 	}
+	return server.checkUser(username)
+}
+
+// checkUser tells if user authed can create session now.
+func (server *Server) checkUser(username string) bool {
+	if server.Accounting != nil {
+		err := server.Accounting.Check(username)
+		if err != nil {
+			logger.Errorf("user %s rejected: %s", username, err.Error())
+			return false
+		}
+	}
 	return true
 }
 
+func (server *Server) AuthOtp(username, code string) bool {
+	if server.Users == nil {
+		return true
+	}
+	if !server.Users.UseOtp(username, code) {
+		logger.Errorf("user %s otp wrong or used.", username)
+		return false
+	}
+	return true
+}
+
+// CertAuthenticator passes the user named in client certificate. No
+// password needed, but user in Users still can be disabled, and must
+// send code if it has totp secret.
+type CertAuthenticator struct {
+	server   *Server
+	username string
+}
+
+func (ca *CertAuthenticator) AuthPass(username, password string) bool {
+	if username != "" && username != ca.username {
+		logger.Errorf("user %s not match certificate %s.", username, ca.username)
+		return false
+	}
+	if ca.server.Users != nil && ca.server.Users.Disabled(ca.username) {
+		logger.Errorf("user %s disabled.", ca.username)
+		return false
+	}
+	return ca.server.checkUser(ca.username)
+}
+
+func (ca *CertAuthenticator) AuthOtp(username, code string) bool {
+	return ca.server.AuthOtp(ca.username, code)
+}
+
+func certUser(conn net.Conn) (username string, err error) {
+	tlsconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", ErrNoClientCert
+	}
+	err = tlsconn.Handshake()
+	if err != nil {
+		return
+	}
+	chains := tlsconn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", ErrNoClientCert
+	}
+	return chains[0][0].Subject.CommonName, nil
+}
+
+// failReason classifies error of handshake for metrics.
+func failReason(err error) string {
+	switch {
+	case errors.Is(err, tunnel.ErrAuthFailed):
+		return "auth"
+	case errors.Is(err, ErrNoClientCert):
+		return "cert"
+	case errors.Is(err, tunnel.ErrUnexpectedPkg):
+		return "protocol"
+	case errors.Is(err, cryptconn.ErrReplay):
+		return "replay"
+	}
+	return "io"
+}
+
+func (server *Server) authFailed(conn net.Conn, username string, err error) {
+	logger.Error(err.Error())
+	server.flock.Lock()
+	server.failures[failReason(err)]++
+	server.flock.Unlock()
+	if server.Banner != nil {
+		server.Banner.Fail(conn.RemoteAddr())
+	}
+	netutil.Audit(&netutil.AuditEvent{
+		Event:    netutil.AUDIT_AUTH_FAIL,
+		Remote:   conn.RemoteAddr().String(),
+		Username: username,
+		KeyId:    keyIdOf(conn),
+		Reason:   err.Error(),
+	})
+}
+
+func keyIdOf(conn net.Conn) string {
+	if kc, ok := conn.(*cryptconn.AeadConn); ok {
+		return kc.KeyId
+	}
+	return ""
+}
+
 func (server *Server) Handle(conn net.Conn) (err error) {
-	err = tunnel.AuthConn(server, conn)
+	var author tunnel.PasswordAuthenticator = server
+	certname := ""
+	if server.CertAuth {
+		certname, err = certUser(conn)
+		if err != nil {
+			server.authFailed(conn, "", err)
+			return
+		}
+		author = &CertAuthenticator{server: server, username: certname}
+	}
+
+	username, err := tunnel.AuthConn(author, conn)
 	if err != nil {
-		logger.Error(err.Error())
+		server.authFailed(conn, username, err)
 		return
 	}
+	if sc, ok := conn.(*cryptconn.CryptConn); ok {
+		err = sc.Confirm()
+		if err != nil {
+			server.authFailed(conn, username, err)
+			return
+		}
+	}
+	if server.Banner != nil {
+		server.Banner.Success(conn.RemoteAddr())
+	}
+	if certname != "" {
+		username = certname
+	}
+
+	start := time.Now()
+	ev := &netutil.AuditEvent{
+		Event:    netutil.AUDIT_AUTH_OK,
+		Remote:   conn.RemoteAddr().String(),
+		Username: username,
+		KeyId:    keyIdOf(conn),
+	}
+	netutil.Audit(ev)
+
+	if server.Accounting != nil {
+		conn = NewAcctConn(conn, server.Accounting, username)
+	}
 
 	tun := tunnel.NewTunnelServer(conn)
+	tun.Username = username
 	server.Pool.Add(tun)
 	defer server.Pool.Remove(tun)
 	tun.Loop()
 	logger.Noticef("server session %s quit: %s => %s.",
 		tun.String(), conn.RemoteAddr(), conn.LocalAddr())
+
+	ev.Time = time.Time{}
+	ev.Event = netutil.AUDIT_SESSION_END
+	ev.Duration = time.Since(start).Seconds()
+	netutil.Audit(ev)
 	return
 }
+
+// Drain closes sessions once their streams are done, so clients move to
+// other server. Sessions left after grace are closed with their streams,
+// zero grace means never. It returns when all sessions closed.
+func (server *Server) Drain(grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for {
+		tuns := server.Pool.GetTunnels()
+		if len(tuns) == 0 {
+			return
+		}
+		timeout := grace != 0 && time.Now().After(deadline)
+		for _, tun := range tuns {
+			if timeout || tun.GetSize() == 0 {
+				tun.Close()
+			}
+		}
+		time.Sleep(DRAIN_CHECK)
+	}
+}
+
+// Close flushes usages, call it after sessions closed.
+func (server *Server) Close() (err error) {
+	if server.Accounting == nil {
+		return
+	}
+	return server.Accounting.Flush()
+}
+
+func (server *Server) Register(mux *http.ServeMux) {
+	server.Pool.Register(mux)
+	if server.Accounting != nil {
+		mux.HandleFunc("/usage", server.Accounting.HandlerUsage)
+		mux.HandleFunc("/usage/reset", server.Accounting.HandlerReset)
+	}
+	if server.Banner != nil {
+		mux.HandleFunc("/api/banned", server.HandlerBanned)
+	}
+	if server.Users != nil {
+		mux.HandleFunc("/api/users", server.HandlerUsers)
+		mux.HandleFunc("/api/users/", server.HandlerUserModify)
+	}
+}
+
+// WriteMetrics writes handshakes failed by reason.
+func (server *Server) WriteMetrics(w io.Writer) {
+	server.flock.Lock()
+	defer server.flock.Unlock()
+	var reasons []string
+	for reason := range server.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(w, "# HELP goproxy_handshake_failures_total Handshakes of clients failed by reason.")
+	fmt.Fprintln(w, "# TYPE goproxy_handshake_failures_total counter")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "goproxy_handshake_failures_total{reason=%q} %d\n",
+			reason, server.failures[reason])
+	}
+}
@@ -0,0 +1,134 @@
+package connpool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+const testTotp = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// newCert makes certificate of cn, signed by parent if not nil.
+func newCert(t *testing.T, cn string, parent *tls.Certificate) (cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signkey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signkey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Certificate = [][]byte{der}
+	cert.PrivateKey = key
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+type tlsDialer struct {
+	config *tls.Config
+}
+
+func (td *tlsDialer) Dial(network, address string) (net.Conn, error) {
+	return tls.Dial(network, address, td.config)
+}
+
+// runCertServer runs server with certauth, and returns address and
+// config of client with certificate of cn, no certificate if cn empty.
+func runCertServer(t *testing.T, server *Server, cn string) (addr string, config *tls.Config) {
+	ca := newCert(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server.CertAuth = true
+	go server.Serve(tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{newCert(t, "server", &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}))
+
+	config = &tls.Config{RootCAs: pool}
+	if cn != "" {
+		config.Certificates = []tls.Certificate{newCert(t, cn, &ca)}
+	}
+	return listener.Addr().String(), config
+}
+
+func TestCertAuth(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users")
+	err := ioutil.WriteFile(file, []byte(`alice:!$2a$04$ia1V25SB2Xlku7XxUXcQMeyR5KUNvBIaDuHJQJTJ9.qWSU9uJrwAu
+carol:$2a$04$ia1V25SB2Xlku7XxUXcQMeyR5KUNvBIaDuHJQJTJ9.qWSU9uJrwAu:`+testTotp+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewUserDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := tunnel.DecodeTotpSecret(testTotp)
+
+	for _, c := range []struct {
+		name     string
+		cn       string
+		username string
+		totp     []byte
+		ok       bool
+	}{
+		{"cert only", "bob", "", nil, true},
+		{"username of cert", "bob", "bob", nil, true},
+		{"username not match", "bob", "carol", nil, false},
+		{"no cert", "", "bob", nil, false},
+		{"disabled", "alice", "", nil, false},
+		{"totp", "carol", "", secret, true},
+		{"no totp", "carol", "", nil, false},
+		{"wrong totp", "carol", "", []byte("wrong secret"), false},
+	} {
+		server := NewServer(nil)
+		server.Users = users
+		addr, config := runCertServer(t, server, c.cn)
+		dc := tunnel.NewDialerCreator(&tlsDialer{config}, "tcp", addr, c.username, "")
+		dc.TotpSecret = c.totp
+		client, err := dc.Create()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: login %v, want %v", c.name, err == nil, c.ok)
+		}
+		if client != nil {
+			client.Close()
+		}
+	}
+}
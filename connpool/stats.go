@@ -0,0 +1,92 @@
+package connpool
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolStats counts how a pool works, so limits can be tuned from data.
+type PoolStats struct {
+	name      string
+	hits      int64
+	misses    int64
+	checkouts int64
+	failures  int64
+	latency   int64 // nanoseconds of all checkouts
+	lock      sync.Mutex
+	discards  map[string]int64
+}
+
+func NewPoolStats(name string) (ps *PoolStats) {
+	return &PoolStats{
+		name:     name,
+		discards: make(map[string]int64, 0),
+	}
+}
+
+// Hit counts a checkout served by pooled connection, Miss by a new one.
+func (ps *PoolStats) Hit()  { atomic.AddInt64(&ps.hits, 1) }
+func (ps *PoolStats) Miss() { atomic.AddInt64(&ps.misses, 1) }
+
+// Fail counts a connection failed to create, such as handshake with
+// server failed.
+func (ps *PoolStats) Fail() { atomic.AddInt64(&ps.failures, 1) }
+
+func (ps *PoolStats) Checkout(d time.Duration) {
+	atomic.AddInt64(&ps.checkouts, 1)
+	atomic.AddInt64(&ps.latency, int64(d))
+}
+
+func (ps *PoolStats) Discard(reason string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.discards[reason]++
+}
+
+// WriteMetrics writes counters in prometheus text format, with size and
+// idle given by pool.
+func (ps *PoolStats) WriteMetrics(w io.Writer, size, idle int) {
+	fmt.Fprintln(w, "# HELP goproxy_pool_size Connections in pool.")
+	fmt.Fprintln(w, "# TYPE goproxy_pool_size gauge")
+	fmt.Fprintf(w, "goproxy_pool_size{pool=%q} %d\n", ps.name, size)
+	fmt.Fprintln(w, "# HELP goproxy_pool_idle Connections in pool not used.")
+	fmt.Fprintln(w, "# TYPE goproxy_pool_idle gauge")
+	fmt.Fprintf(w, "goproxy_pool_idle{pool=%q} %d\n", ps.name, idle)
+
+	fmt.Fprintln(w, "# HELP goproxy_pool_checkouts_total Checkouts by pooled (hit) or new (miss) connection.")
+	fmt.Fprintln(w, "# TYPE goproxy_pool_checkouts_total counter")
+	fmt.Fprintf(w, "goproxy_pool_checkouts_total{pool=%q,result=\"hit\"} %d\n",
+		ps.name, atomic.LoadInt64(&ps.hits))
+	fmt.Fprintf(w, "goproxy_pool_checkouts_total{pool=%q,result=\"miss\"} %d\n",
+		ps.name, atomic.LoadInt64(&ps.misses))
+
+	fmt.Fprintln(w, "# HELP goproxy_pool_checkout_seconds Time to get a connection from pool.")
+	fmt.Fprintln(w, "# TYPE goproxy_pool_checkout_seconds summary")
+	fmt.Fprintf(w, "goproxy_pool_checkout_seconds_sum{pool=%q} %f\n",
+		ps.name, time.Duration(atomic.LoadInt64(&ps.latency)).Seconds())
+	fmt.Fprintf(w, "goproxy_pool_checkout_seconds_count{pool=%q} %d\n",
+		ps.name, atomic.LoadInt64(&ps.checkouts))
+
+	fmt.Fprintln(w, "# HELP goproxy_pool_create_failures_total Connections failed to create.")
+	fmt.Fprintln(w, "# TYPE goproxy_pool_create_failures_total counter")
+	fmt.Fprintf(w, "goproxy_pool_create_failures_total{pool=%q} %d\n",
+		ps.name, atomic.LoadInt64(&ps.failures))
+
+	ps.lock.Lock()
+	var reasons []string
+	for reason := range ps.discards {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(w, "# HELP goproxy_pool_discards_total Connections thrown away by reason.")
+	fmt.Fprintln(w, "# TYPE goproxy_pool_discards_total counter")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "goproxy_pool_discards_total{pool=%q,reason=%q} %d\n",
+			ps.name, reason, ps.discards[reason])
+	}
+	ps.lock.Unlock()
+}
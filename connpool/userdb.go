@@ -0,0 +1,412 @@
+package connpool
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/cryptconn"
+	"github.com/shell909090/goproxy/tunnel"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RELOAD_INTERVAL = 10
+)
+
+var (
+	ErrUserLine     = errors.New("user line format error.")
+	ErrHashFormat   = errors.New("unknown password hash.")
+	ErrUserNotFound = errors.New("user not found.")
+)
+
+// UserDB keeps users and hashes of their passwords in a file like
+// htpasswd, one "username:hash[:totp secret]" a line. Hash can be bcrypt
+// ($2a$, $2b$, $2y$) or argon2id in PHC format, a "!" before hash disables
+// the user. User with totp secret in base32 must send code of it. File is
+// reloaded once modified.
+type UserDB struct {
+	lock    sync.RWMutex
+	file    string
+	modtime time.Time
+	users   map[string]*userEntry
+	// used is last totp step accepted by UseOtp of each user, kept in
+	// reload.
+	ulock sync.Mutex
+	used  map[string]uint64
+	done  chan struct{}
+}
+
+// userEntry is never modified once put in users, but replaced, so it
+// can be read without lock.
+type userEntry struct {
+	hash     string
+	disabled bool
+	totpText string
+	totp     []byte
+}
+
+type UserInfo struct {
+	Username string
+	Disabled bool
+	Totp     bool
+}
+
+type UserSlice []UserInfo
+
+func (us UserSlice) Len() int           { return len(us) }
+func (us UserSlice) Swap(i, j int)      { us[i], us[j] = us[j], us[i] }
+func (us UserSlice) Less(i, j int) bool { return us[i].Username < us[j].Username }
+
+func NewUserDB(file string) (db *UserDB, err error) {
+	db = &UserDB{
+		file:  file,
+		users: make(map[string]*userEntry, 0),
+		used:  make(map[string]uint64, 0),
+		done:  make(chan struct{}),
+	}
+	err = db.Load()
+	if err != nil {
+		return
+	}
+	go db.loop()
+	return
+}
+
+func parseUserLine(line string) (username string, ue *userEntry, err error) {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return "", nil, ErrUserLine
+	}
+	username, ue = line[:i], &userEntry{hash: line[i+1:]}
+	if j := strings.Index(ue.hash, ":"); j >= 0 {
+		ue.totpText = ue.hash[j+1:]
+		ue.totp, err = tunnel.DecodeTotpSecret(ue.totpText)
+		if err != nil {
+			return
+		}
+		ue.hash = ue.hash[:j]
+	}
+	if strings.HasPrefix(ue.hash, "!") {
+		ue.disabled = true
+		ue.hash = ue.hash[1:]
+	}
+	return
+}
+
+func (ue *userEntry) String() (s string) {
+	s = ue.hash
+	if ue.disabled {
+		s = "!" + s
+	}
+	if ue.totpText != "" {
+		s += ":" + ue.totpText
+	}
+	return
+}
+
+func (db *UserDB) Load() (err error) {
+	fi, err := os.Stat(db.file)
+	if err != nil {
+		return
+	}
+
+	file, err := os.Open(db.file)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	users := make(map[string]*userEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, ue, err := parseUserLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", db.file, lineno, err)
+		}
+		users[username] = ue
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+
+	db.lock.Lock()
+	db.users = users
+	db.modtime = fi.ModTime()
+	db.lock.Unlock()
+	logger.Infof("%d user(s) loaded from %s.", len(users), db.file)
+	return
+}
+
+// save writes users back to file. lock must be held.
+func (db *UserDB) save() (err error) {
+	var names []string
+	for username := range db.users {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, username := range names {
+		fmt.Fprintf(&buf, "%s:%s\n", username, db.users[username].String())
+	}
+
+	// write to temp file and rename, never leave a broken file.
+	tmpfile := db.file + ".tmp"
+	err = ioutil.WriteFile(tmpfile, buf.Bytes(), 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpfile, db.file)
+	if err != nil {
+		return
+	}
+
+	// don't reload what we just wrote.
+	fi, err := os.Stat(db.file)
+	if err != nil {
+		return
+	}
+	db.modtime = fi.ModTime()
+	return
+}
+
+func (db *UserDB) loop() {
+	ticker := time.NewTicker(RELOAD_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.done:
+			return
+		}
+		fi, err := os.Stat(db.file)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		db.lock.RLock()
+		modified := !fi.ModTime().Equal(db.modtime)
+		db.lock.RUnlock()
+		if !modified {
+			continue
+		}
+		// keep old users if new file broken.
+		err = db.Load()
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// Close stops reloading file, users loaded are kept.
+func (db *UserDB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	select {
+	case <-db.done:
+	default:
+		close(db.done)
+	}
+	return nil
+}
+
+// Has tells if user is in db.
+func (db *UserDB) Has(username string) (ok bool) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	_, ok = db.users[username]
+	return
+}
+
+// Disabled tells if user is in db and disabled.
+func (db *UserDB) Disabled(username string) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	ue, ok := db.users[username]
+	return ok && ue.disabled
+}
+
+func (db *UserDB) Verify(username, password string) bool {
+	db.lock.RLock()
+	ue, ok := db.users[username]
+	db.lock.RUnlock()
+	if !ok || ue.disabled {
+		return false
+	}
+
+	ok, err := VerifyHash(ue.hash, password)
+	if err != nil {
+		logger.Errorf("hash of user %s: %s", username, err.Error())
+		return false
+	}
+	return ok
+}
+
+// VerifyOtp checks code if user has totp secret.
+func (db *UserDB) VerifyOtp(username, code string) bool {
+	db.lock.RLock()
+	ue, ok := db.users[username]
+	db.lock.RUnlock()
+	if !ok || ue.totp == nil {
+		return true
+	}
+	return tunnel.TotpVerify(ue.totp, code, time.Now())
+}
+
+// UseOtp is VerifyOtp, but code can be used only once, and no code
+// before it can be used after. Http proxy sends the same code in each
+// request, so it can't use this.
+func (db *UserDB) UseOtp(username, code string) bool {
+	db.lock.RLock()
+	ue, ok := db.users[username]
+	db.lock.RUnlock()
+	if !ok || ue.totp == nil {
+		return true
+	}
+	step, ok := tunnel.TotpStep(ue.totp, code, time.Now())
+	if !ok {
+		return false
+	}
+	db.ulock.Lock()
+	defer db.ulock.Unlock()
+	if last, ok := db.used[username]; ok && step <= last {
+		return false
+	}
+	db.used[username] = step
+	return true
+}
+
+func (db *UserDB) List() (users UserSlice) {
+	db.lock.RLock()
+	for username, ue := range db.users {
+		users = append(users, UserInfo{
+			Username: username,
+			Disabled: ue.disabled,
+			Totp:     ue.totp != nil,
+		})
+	}
+	db.lock.RUnlock()
+	sort.Sort(users)
+	return
+}
+
+// Set creates user, or changes password and totp secret of user.
+func (db *UserDB) Set(username, password, totp string) (err error) {
+	if username == "" || strings.ContainsAny(username, ":\n") {
+		return ErrUserLine
+	}
+	ue := &userEntry{totpText: totp}
+	if totp != "" {
+		ue.totp, err = tunnel.DecodeTotpSecret(totp)
+		if err != nil {
+			return
+		}
+	}
+	ue.hash, err = HashPassword(password)
+	if err != nil {
+		return
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.users[username] = ue
+	return db.save()
+}
+
+func (db *UserDB) SetDisabled(username string, disabled bool) (err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	ue, ok := db.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	changed := *ue
+	changed.disabled = disabled
+	db.users[username] = &changed
+	return db.save()
+}
+
+func (db *UserDB) Delete(username string) (err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.users[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(db.users, username)
+	return db.save()
+}
+
+// HashPassword makes argon2id hash in PHC format.
+func HashPassword(password string) (hash string, err error) {
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+	key := argon2.IDKey([]byte(password), salt, cryptconn.ARGON2_TIME,
+		cryptconn.ARGON2_MEMORY, cryptconn.ARGON2_THREADS, 32)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
+		cryptconn.ARGON2_MEMORY, cryptconn.ARGON2_TIME, cryptconn.ARGON2_THREADS,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyHash checks password with bcrypt or argon2id hash.
+func VerifyHash(hash, password string) (ok bool, err error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	}
+	return false, ErrHashFormat
+}
+
+// verifyArgon2id takes hash like
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>, salt and key in base64
+// without padding.
+func verifyArgon2id(hash, password string) (ok bool, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return false, ErrHashFormat
+	}
+
+	var memory, times uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &times, &threads)
+	if err != nil {
+		return false, ErrHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrHashFormat
+	}
+
+	key1 := argon2.IDKey([]byte(password), salt, times, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, key1) == 1, nil
+}
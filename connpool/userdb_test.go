@@ -0,0 +1,137 @@
+package connpool
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+const testUsers = `# test users
+bob:$2a$04$ia1V25SB2Xlku7XxUXcQMeyR5KUNvBIaDuHJQJTJ9.qWSU9uJrwAu
+alice:$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$GMv1V/a9uBNqF+93SqBH3JLZiqfe1V1xP9SfOSAqqRE
+`
+
+func TestUserDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users")
+	err := ioutil.WriteFile(file, []byte(testUsers), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewUserDB(file)
+	if err != nil {
+		t.Fatalf("NewUserDB failed: %s", err)
+	}
+	for _, username := range []string{"bob", "alice"} {
+		if !db.Verify(username, "secret") {
+			t.Fatalf("user %s refused.", username)
+		}
+		if db.Verify(username, "wrong") {
+			t.Fatalf("user %s passed with wrong password.", username)
+		}
+	}
+	if db.Verify("nobody", "secret") {
+		t.Fatal("unknown user passed.")
+	}
+}
+
+func TestUserDBModify(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users")
+	err := ioutil.WriteFile(file, []byte(testUsers), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewUserDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set("carol", "pass", ""); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err = db.SetDisabled("bob", true); err != nil {
+		t.Fatalf("SetDisabled failed: %s", err)
+	}
+	if err = db.Delete("alice"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+
+	// changes must be in file.
+	if err = db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Verify("carol", "pass") {
+		t.Fatal("new user refused.")
+	}
+	if db.Verify("bob", "secret") {
+		t.Fatal("disabled user passed.")
+	}
+	if db.Has("alice") {
+		t.Fatal("deleted user still exists.")
+	}
+}
+
+// TestUserDBConcurrent is for go test -race.
+func TestUserDBConcurrent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users")
+	err := ioutil.WriteFile(file, []byte(testUsers), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewUserDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			db.SetDisabled("bob", i%2 == 0)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		db.Verify("bob", "secret")
+		db.VerifyOtp("bob", "")
+	}
+	wg.Wait()
+	if !db.Verify("bob", "secret") {
+		t.Fatal("bob disabled at last.")
+	}
+}
+
+func TestUseOtp(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users")
+	err := ioutil.WriteFile(file, []byte(
+		"carol:$2a$04$ia1V25SB2Xlku7XxUXcQMeyR5KUNvBIaDuHJQJTJ9.qWSU9uJrwAu:"+testTotp+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewUserDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := tunnel.DecodeTotpSecret(testTotp)
+	now := time.Now()
+	code := tunnel.TotpCode(secret, now)
+	last := tunnel.TotpCode(secret, now.Add(-tunnel.TOTP_STEP*time.Second))
+
+	if !db.UseOtp("carol", code) {
+		t.Fatal("otp refused.")
+	}
+	if db.UseOtp("carol", code) {
+		t.Fatal("otp used twice.")
+	}
+	if db.UseOtp("carol", last) {
+		t.Fatal("otp before the used one passed.")
+	}
+	// http proxy verifies the same code in each request.
+	if !db.VerifyOtp("carol", code) {
+		t.Fatal("otp used refused in verify.")
+	}
+}
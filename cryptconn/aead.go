@@ -0,0 +1,378 @@
+package cryptconn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	SALTSIZE    = 32
+	KEYIDSIZE   = 4
+	MACSIZE     = 16
+	HELLOSIZE   = SALTSIZE + 8 + KEYIDSIZE + MACSIZE
+	MAX_PAYLOAD = 0x3FFF
+	REKEY_FLAG  = 0x8000
+
+	REKEY_BYTES    = 1 << 30
+	REKEY_INTERVAL = time.Hour
+)
+
+var (
+	ErrPayloadSize = errors.New("aead payload size error.")
+	ErrUnknownKey  = errors.New("handshake key id unknown.")
+	ErrKeyIdDup    = errors.New("key id duplicated.")
+)
+
+type newAeadFunc func(key []byte) (cipher.AEAD, error)
+
+func newGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// AeadMethod seals data in records, each record carries an authentication
+// tag, so any modification is detected.
+//
+// Server can hold more than one key. Client sends id of its key in hello,
+// so keys can be added and removed one by one.
+type AeadMethod struct {
+	name    string
+	key     []byte
+	keys    map[uint32][]byte
+	keysize int
+	newAead newAeadFunc
+	filter  *ReplayFilter
+}
+
+// NewAeadMethod takes keys, the first one used by client. Name of method
+// is in mac of hello, so server knows which method client chose.
+func NewAeadMethod(name string, keys [][]byte, keysize int, f newAeadFunc) (m *AeadMethod, err error) {
+	m = &AeadMethod{
+		name:    name,
+		key:     keys[0],
+		keys:    make(map[uint32][]byte, len(keys)),
+		keysize: keysize,
+		newAead: f,
+		filter:  NewReplayFilter(),
+	}
+	for _, key := range keys {
+		// try the key before any connection.
+		_, err = f(deriveKey(key, make([]byte, SALTSIZE), "test", keysize))
+		if err != nil {
+			return nil, err
+		}
+		id := KeyId(key)
+		if _, ok := m.keys[id]; ok {
+			return nil, ErrKeyIdDup
+		}
+		m.keys[id] = key
+	}
+	return
+}
+
+// KeyId is the first 4 bytes of sha256 of key.
+func KeyId(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(sum[:KEYIDSIZE])
+}
+
+// keyIdMask hides key id in hello, so it's not the same bytes in each
+// handshake. It's not a secret, anyone can remove it.
+func keyIdMask(salt []byte) uint32 {
+	sum := sha256.Sum256(salt)
+	return binary.BigEndian.Uint32(sum[:KEYIDSIZE])
+}
+
+// deriveKey makes a key for one direction of one session.
+// Each direction has its own key, so nonces never collide.
+func deriveKey(key, salt []byte, label string, size int) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)[:size]
+}
+
+func helloMAC(key []byte, name string, salt, ts []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("hello"))
+	mac.Write([]byte(name))
+	mac.Write(salt)
+	mac.Write(ts)
+	return mac.Sum(nil)[:MACSIZE]
+}
+
+func (m *AeadMethod) newConn(conn net.Conn, key, salt []byte, inLabel, outLabel string) (ac *AeadConn, err error) {
+	return NewAeadConn(conn, m.newAead,
+		deriveKey(key, salt, inLabel, m.keysize),
+		deriveKey(key, salt, outLabel, m.keysize))
+}
+
+// Client sends hello: salt, timestamp, masked key id and mac of them,
+// then receives salt of server. Session salt is the two joined.
+func (m *AeadMethod) Client(conn net.Conn) (net.Conn, error) {
+	hello := make([]byte, SALTSIZE+8+KEYIDSIZE, HELLOSIZE)
+	_, err := rand.Read(hello[:SALTSIZE])
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(hello[SALTSIZE:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint32(hello[SALTSIZE+8:],
+		KeyId(m.key)^keyIdMask(hello[:SALTSIZE]))
+	hello = append(hello, helloMAC(m.key, m.name, hello[:SALTSIZE], hello[SALTSIZE:])...)
+
+	_, err = conn.Write(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	salts, err := RecvIV(conn, SALTSIZE)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte(nil), hello[:SALTSIZE]...), salts...)
+	return m.newConn(conn, m.key, salt, "server", "client")
+}
+
+// Server checks hello from client before anything sent. Hello with unknown
+// key, wrong mac, old timestamp or seen salt is rejected, so a recorded
+// handshake can't be replayed.
+func (m *AeadMethod) Server(conn net.Conn) (net.Conn, error) {
+	hello, err := RecvIV(conn, HELLOSIZE)
+	if err != nil {
+		return nil, err
+	}
+	key, id, err := m.checkMAC(hello)
+	if err != nil {
+		return nil, err
+	}
+	return m.accept(conn, hello, key, id)
+}
+
+// checkMAC finds key of hello, and checks mac with it.
+func (m *AeadMethod) checkMAC(hello []byte) (key []byte, id uint32, err error) {
+	saltc := hello[:SALTSIZE]
+	id = binary.BigEndian.Uint32(hello[SALTSIZE+8:]) ^ keyIdMask(saltc)
+	key, ok := m.keys[id]
+	if !ok {
+		return nil, id, ErrUnknownKey
+	}
+	if !hmac.Equal(hello[SALTSIZE+8+KEYIDSIZE:],
+		helloMAC(key, m.name, saltc, hello[SALTSIZE:SALTSIZE+8+KEYIDSIZE])) {
+		return nil, id, ErrHelloMAC
+	}
+	return
+}
+
+func (m *AeadMethod) accept(conn net.Conn, hello, key []byte, id uint32) (net.Conn, error) {
+	saltc := hello[:SALTSIZE]
+	ts := hello[SALTSIZE : SALTSIZE+8]
+	skew := time.Since(time.Unix(int64(binary.BigEndian.Uint64(ts)), 0))
+	if skew > REPLAY_WINDOW || skew < -REPLAY_WINDOW {
+		return nil, ErrTimestamp
+	}
+	if !m.filter.Check(saltc) {
+		return nil, ErrReplay
+	}
+
+	salts, err := SentIV(conn, SALTSIZE)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte(nil), saltc...), salts...)
+	logger.Debugf("client %s use key %08x.", conn.RemoteAddr(), id)
+	ac, err := m.newConn(conn, key, salt, "client", "server")
+	if err != nil {
+		return nil, err
+	}
+	ac.KeyId = fmt.Sprintf("%08x", id)
+	return ac, nil
+}
+
+// AeadConn sends data in records:
+// sealed payload length (2 bytes + tag), sealed payload (n bytes + tag).
+// Nonce is a counter for each direction, increased after each seal.
+//
+// Each direction change its key after REKEY_BYTES or REKEY_INTERVAL.
+// Writer sets REKEY_FLAG in length of an empty record, then both sides
+// take next key as HMAC(key, "rekey") and drop the old one. So a leaked key
+// can't decrypt traffic before it.
+type AeadConn struct {
+	net.Conn
+	// KeyId is id of key client used, on server side.
+	KeyId   string
+	newAead newAeadFunc
+	in      cipher.AEAD
+	out     cipher.AEAD
+	inKey   []byte
+	outKey  []byte
+	rnonce  []byte
+	wnonce  []byte
+	rbuf    []byte
+	r_rest  []byte
+	wbuf    []byte
+	wbytes  int64
+	wtime   time.Time
+}
+
+func NewAeadConn(conn net.Conn, f newAeadFunc, inKey, outKey []byte) (ac *AeadConn, err error) {
+	ac = &AeadConn{
+		Conn:    conn,
+		newAead: f,
+		inKey:   inKey,
+		outKey:  outKey,
+		wtime:   time.Now(),
+	}
+	ac.in, err = f(inKey)
+	if err != nil {
+		return
+	}
+	ac.out, err = f(outKey)
+	if err != nil {
+		return
+	}
+	ac.rnonce = make([]byte, ac.in.NonceSize())
+	ac.wnonce = make([]byte, ac.out.NonceSize())
+	ac.rbuf = make([]byte, 2+MAX_PAYLOAD+2*ac.in.Overhead())
+	ac.wbuf = make([]byte, 2+MAX_PAYLOAD+2*ac.out.Overhead())
+	return
+}
+
+func increase(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func nextKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("rekey"))
+	return mac.Sum(nil)[:len(key)]
+}
+
+func (ac *AeadConn) writeRecord(b []byte, flag uint16) (err error) {
+	buf := ac.wbuf[:2]
+	binary.BigEndian.PutUint16(buf, uint16(len(b))|flag)
+	buf = ac.out.Seal(buf[:0], ac.wnonce, buf, nil)
+	increase(ac.wnonce)
+	buf = ac.out.Seal(buf, ac.wnonce, b, nil)
+	increase(ac.wnonce)
+
+	_, err = ac.Conn.Write(buf)
+	return
+}
+
+func (ac *AeadConn) rekeyOut() (err error) {
+	err = ac.writeRecord(nil, REKEY_FLAG)
+	if err != nil {
+		return
+	}
+	ac.outKey = nextKey(ac.outKey)
+	ac.out, err = ac.newAead(ac.outKey)
+	if err != nil {
+		return
+	}
+	ac.wnonce = make([]byte, ac.out.NonceSize())
+	ac.wbytes = 0
+	ac.wtime = time.Now()
+	logger.Debugf("rekey for %s.", ac.Conn.RemoteAddr())
+	return
+}
+
+func (ac *AeadConn) rekeyIn() (err error) {
+	ac.inKey = nextKey(ac.inKey)
+	ac.in, err = ac.newAead(ac.inKey)
+	if err != nil {
+		return
+	}
+	ac.rnonce = make([]byte, ac.in.NonceSize())
+	return
+}
+
+func (ac *AeadConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if ac.wbytes >= REKEY_BYTES || time.Since(ac.wtime) >= REKEY_INTERVAL {
+			err = ac.rekeyOut()
+			if err != nil {
+				return
+			}
+		}
+
+		size := len(b)
+		if size > MAX_PAYLOAD {
+			size = MAX_PAYLOAD
+		}
+
+		err = ac.writeRecord(b[:size], 0)
+		if err != nil {
+			return
+		}
+		b = b[size:]
+		n += size
+		ac.wbytes += int64(size)
+	}
+	return
+}
+
+func (ac *AeadConn) readRecord() (err error) {
+	lsize := 2 + ac.in.Overhead()
+	buf := ac.rbuf[:lsize]
+	_, err = io.ReadFull(ac.Conn, buf)
+	if err != nil {
+		return
+	}
+	_, err = ac.in.Open(buf[:0], ac.rnonce, buf, nil)
+	if err != nil {
+		return
+	}
+	increase(ac.rnonce)
+
+	size := int(binary.BigEndian.Uint16(buf))
+	flag := uint16(size) & REKEY_FLAG
+	size &= MAX_PAYLOAD
+	if flag != 0 && size != 0 {
+		return ErrPayloadSize
+	}
+
+	buf = ac.rbuf[:size+ac.in.Overhead()]
+	_, err = io.ReadFull(ac.Conn, buf)
+	if err != nil {
+		return
+	}
+	ac.r_rest, err = ac.in.Open(buf[:0], ac.rnonce, buf, nil)
+	if err != nil {
+		return
+	}
+	increase(ac.rnonce)
+
+	if flag != 0 {
+		err = ac.rekeyIn()
+	}
+	return
+}
+
+func (ac *AeadConn) Read(b []byte) (n int, err error) {
+	for len(ac.r_rest) == 0 {
+		err = ac.readRecord()
+		if err != nil {
+			return
+		}
+	}
+	n = copy(b, ac.r_rest)
+	ac.r_rest = ac.r_rest[n:]
+	return
+}
@@ -0,0 +1,138 @@
+package cryptconn
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+const BENCH_TIME = 50 * time.Millisecond
+
+// CipherChoice tells which aead cipher auto method chose, and why.
+type CipherChoice struct {
+	Cipher      string
+	AesHardware bool
+	AesGcmMBps  float64 `json:",omitempty"`
+	ChachaMBps  float64 `json:",omitempty"`
+}
+
+var (
+	choiceLock sync.Mutex
+	choice     CipherChoice
+)
+
+// HasAesHardware tells if cpu can do aes-gcm in hardware.
+func HasAesHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	}
+	return false
+}
+
+// benchAead returns MB per second of f sealing full records.
+func benchAead(f newAeadFunc, keysize int) float64 {
+	aead, err := f(make([]byte, keysize))
+	if err != nil {
+		return 0
+	}
+	buf := make([]byte, MAX_PAYLOAD, MAX_PAYLOAD+aead.Overhead())
+	nonce := make([]byte, aead.NonceSize())
+
+	var n int
+	start := time.Now()
+	for time.Since(start) < BENCH_TIME {
+		aead.Seal(buf[:0], nonce, buf, nil)
+		increase(nonce)
+		n += len(buf)
+	}
+	return float64(n) / time.Since(start).Seconds() / 1e6
+}
+
+// ChooseCipher picks chacha20-poly1305 if cpu has no aes hardware,
+// otherwise the faster one in a short benchmark. Only done once.
+func ChooseCipher() CipherChoice {
+	choiceLock.Lock()
+	defer choiceLock.Unlock()
+	if choice.Cipher == "" {
+		choice.AesHardware = HasAesHardware()
+		if !choice.AesHardware {
+			choice.Cipher = "chacha20-poly1305"
+		} else {
+			choice.AesGcmMBps = benchAead(newGCM, 32)
+			choice.ChachaMBps = benchAead(chacha20poly1305.New, chacha20poly1305.KeySize)
+			choice.Cipher = "aes-gcm"
+			if choice.ChachaMBps > choice.AesGcmMBps {
+				choice.Cipher = "chacha20-poly1305"
+			}
+		}
+		logger.Noticef("cipher auto selected: %s, aes hardware: %t, aes-gcm %.0f MB/s, chacha20-poly1305 %.0f MB/s.",
+			choice.Cipher, choice.AesHardware, choice.AesGcmMBps, choice.ChachaMBps)
+	}
+	return choice
+}
+
+// GetCipherChoice returns choice made, or nil if auto never used.
+func GetCipherChoice() *CipherChoice {
+	choiceLock.Lock()
+	defer choiceLock.Unlock()
+	if choice.Cipher == "" {
+		return nil
+	}
+	c := choice
+	return &c
+}
+
+// AutoMethod uses cipher chosen by ChooseCipher as client. As server, it
+// accepts both aes-gcm and chacha20-poly1305, and follows the one client
+// used, found by mac of hello.
+type AutoMethod struct {
+	client  *AeadMethod
+	methods []*AeadMethod
+}
+
+func NewAutoMethod(keys [][]byte) (m *AutoMethod, err error) {
+	gcm, err := newAesGcmMethod(keys)
+	if err != nil {
+		return
+	}
+	chacha, err := newChachaMethod(keys)
+	if err != nil {
+		return
+	}
+	m = &AutoMethod{
+		client:  gcm,
+		methods: []*AeadMethod{gcm, chacha},
+	}
+	if ChooseCipher().Cipher != "aes-gcm" {
+		m.client = chacha
+	}
+	return
+}
+
+func (m *AutoMethod) Client(conn net.Conn) (net.Conn, error) {
+	return m.client.Client(conn)
+}
+
+func (m *AutoMethod) Server(conn net.Conn) (net.Conn, error) {
+	hello, err := RecvIV(conn, HELLOSIZE)
+	if err != nil {
+		return nil, err
+	}
+	for _, am := range m.methods {
+		key, id, err1 := am.checkMAC(hello)
+		if err1 == nil {
+			return am.accept(conn, hello, key, id)
+		}
+		err = err1
+	}
+	return nil, err
+}
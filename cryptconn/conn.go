@@ -44,9 +44,20 @@ func NewBlock(method string, key string) (c cipher.Block, err error) {
 
 type CryptConn struct {
 	net.Conn
-	block cipher.Block
-	in    cipher.Stream
-	out   cipher.Stream
+	block  cipher.Block
+	in     cipher.Stream
+	out    cipher.Stream
+	filter *ReplayFilter
+	ivr    []byte // iv of client, recorded in filter by Confirm.
+}
+
+// Confirm records iv of client once it passed auth, returns ErrReplay
+// if the same iv confirmed by another conn meanwhile.
+func (sc *CryptConn) Confirm() error {
+	if sc.filter == nil || sc.filter.Check(sc.ivr) {
+		return nil
+	}
+	return ErrReplay
 }
 
 func SentIV(conn net.Conn, n int) (iv []byte, err error) {
@@ -132,14 +143,17 @@ func NewServer(conn net.Conn, block cipher.Block) (sc *CryptConn, err error) {
 	if err != nil {
 		return
 	}
+	sc = newCryptConn(conn, block, iv)
+	return
+}
 
-	sc = &CryptConn{
+func newCryptConn(conn net.Conn, block cipher.Block, iv []byte) (sc *CryptConn) {
+	return &CryptConn{
 		Conn:  conn,
 		block: block,
 		in:    cipher.NewCFBDecrypter(block, iv),
 		out:   cipher.NewCFBEncrypter(block, iv),
 	}
-	return
 }
 
 func (sc CryptConn) Read(b []byte) (n int, err error) {
@@ -1,37 +1,65 @@
 package cryptconn
 
 import (
-	"crypto/cipher"
+	"context"
 	"net"
+	"time"
 
 	"github.com/shell909090/goproxy/netutil"
 )
 
 type Dialer struct {
 	netutil.Dialer
-	block cipher.Block
+	method Method
+	// Obfs wraps raw connection under crypt if not nil.
+	Obfs Obfs
 }
 
-func NewDialer(dialer netutil.Dialer, method string, key string) (d *Dialer, err error) {
+func NewDialer(dialer netutil.Dialer, method string, keys ...string) (d *Dialer, err error) {
 	logger.Infof("Crypt Dialer with %s preparing.", method)
-	c, err := NewBlock(method, key)
+	m, err := NewMethod(method, keys...)
 	if err != nil {
 		return
 	}
 
 	d = &Dialer{
 		Dialer: dialer,
-		block:  c,
+		method: m,
 	}
 	return
 }
 
 func (d *Dialer) Dial(network, addr string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext gives up when ctx done, handshake of obfs and crypt
+// included.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
 	logger.Infof("Ctypt Dailer connect %s", addr)
-	conn, err = d.Dialer.Dial(network, addr)
+	conn, err = netutil.DialContext(ctx, d.Dialer, network, addr)
 	if err != nil {
 		return
 	}
 
-	return NewClient(conn, d.block)
+	raw := conn
+	stop := context.AfterFunc(ctx, func() {
+		raw.SetDeadline(time.Now())
+	})
+	defer func() {
+		// handshake broken by deadline set when ctx done.
+		if !stop() && err == nil {
+			conn.Close()
+			conn, err = nil, ctx.Err()
+		}
+	}()
+
+	if d.Obfs != nil {
+		conn, err = d.Obfs.Client(conn)
+		if err != nil {
+			raw.Close()
+			return
+		}
+	}
+	return d.method.Client(conn)
 }
@@ -0,0 +1,40 @@
+package cryptconn
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FipsMode allows only approved ciphers and key sizes. It's set by config,
+// or always on in binary built with tag fips.
+var FipsMode bool
+
+var ErrNotApproved = errors.New("not approved in fips mode")
+
+// APPROVED_CIPHERS maps ciphers allowed in fips mode to key sizes allowed.
+var APPROVED_CIPHERS = map[string][]int{
+	"aes-gcm": {16, 24, 32},
+}
+
+// CheckApproved returns error if method or any key is not approved.
+func CheckApproved(method string, keys [][]byte) (err error) {
+	sizes, ok := APPROVED_CIPHERS[method]
+	if !ok {
+		return fmt.Errorf("cipher %s %s", method, ErrNotApproved)
+	}
+	for _, key := range keys {
+		if !containSize(sizes, len(key)) {
+			return fmt.Errorf("key size %d of %s %s", len(key), method, ErrNotApproved)
+		}
+	}
+	return
+}
+
+func containSize(sizes []int, n int) bool {
+	for _, size := range sizes {
+		if size == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,7 @@
+//go:build fips
+
+package cryptconn
+
+func init() {
+	FipsMode = true
+}
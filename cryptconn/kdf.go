@@ -0,0 +1,63 @@
+package cryptconn
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ARGON2_TIME    = 1
+	ARGON2_MEMORY  = 64 * 1024
+	ARGON2_THREADS = 4
+	SCRYPT_N       = 32768
+	SCRYPT_R       = 8
+	SCRYPT_P       = 1
+)
+
+var (
+	ErrNoSalt     = errors.New("salt needed to derive key from passphrase.")
+	ErrUnknownKdf = errors.New("unknown kdf.")
+)
+
+// KeySize returns bytes of key needed by method.
+func KeySize(method string) int {
+	ce, ok := getCipher(method)
+	if !ok {
+		ce, _ = getCipher(DEFAULT_CIPHER)
+	}
+	return ce.keysize
+}
+
+// DeriveKey makes a key for method from passphrase, in base64 as key
+// in config. Salt should be unique for each deployment, and all sides
+// must use the same kdf, salt and passphrase.
+func DeriveKey(kdf, method, passphrase, salt string) (key string, err error) {
+	if FipsMode {
+		return "", fmt.Errorf("kdf %s %s", kdf, ErrNotApproved)
+	}
+	if salt == "" {
+		return "", ErrNoSalt
+	}
+	size := KeySize(method)
+
+	var byteKey []byte
+	switch strings.ToLower(kdf) {
+	case "", "argon2id":
+		byteKey = argon2.IDKey([]byte(passphrase), []byte(salt),
+			ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, uint32(size))
+	case "scrypt":
+		byteKey, err = scrypt.Key([]byte(passphrase), []byte(salt),
+			SCRYPT_N, SCRYPT_R, SCRYPT_P, size)
+		if err != nil {
+			return
+		}
+	default:
+		return "", ErrUnknownKdf
+	}
+	return base64.StdEncoding.EncodeToString(byteKey), nil
+}
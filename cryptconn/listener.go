@@ -1,41 +1,161 @@
 package cryptconn
 
 import (
-	"crypto/cipher"
+	"errors"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	DIAL_TIMEOUT = 10 * time.Second
+	// ACCEPT_TIMEOUT is default time for whole handshake in server.
+	ACCEPT_TIMEOUT = 5 * time.Second
+	// MAX_HANDSHAKES limits handshakes in progress, accepting waits
+	// when reached.
+	MAX_HANDSHAKES = 1024
 )
 
 type Listener struct {
 	net.Listener
-	block cipher.Block
+	method Method
+	// Obfs wraps raw connection under crypt if not nil.
+	Obfs Obfs
+	// Timeout limits whole handshake.
+	Timeout time.Duration
+	// Policy for connections failed in handshake: close, stall
+	// or fallback to Fallback address.
+	Policy   string
+	Fallback string
+	// Banner counts failed handshakes if not nil.
+	Banner *netutil.Banner
+
+	once  sync.Once
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	err   error
 }
 
-func NewListener(listener net.Listener, method string, key string) (l *Listener, err error) {
-	logger.Infof("Crypt Listener with %s preparing.", method)
-	c, err := NewBlock(method, key)
+// NewListener accepts clients with any of keys.
+func NewListener(listener net.Listener, method string, keys ...string) (l *Listener, err error) {
+	logger.Infof("Crypt Listener with %s and %d key(s) preparing.", method, len(keys))
+	m, err := NewMethod(method, keys...)
 	if err != nil {
 		return
 	}
 
 	l = &Listener{
 		Listener: listener,
-		block:    c,
+		method:   m,
+		Timeout:  ACCEPT_TIMEOUT,
+		Policy:   POLICY_CLOSE,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
 	}
 	return
 }
 
-func (l *Listener) Accept() (conn net.Conn, err error) {
-	for {
-		conn, err = l.Listener.Accept()
+func (l *Listener) handshake(raw net.Conn) (conn net.Conn, err error) {
+	conn = raw
+	if l.Obfs != nil {
+		conn, err = l.Obfs.Server(conn)
 		if err != nil {
 			return
 		}
+	}
+	return l.method.Server(conn)
+}
+
+// Accept returns connections finished handshake. Handshakes run in
+// their own goroutines, so a silent client holds up nobody else.
+func (l *Listener) Accept() (conn net.Conn, err error) {
+	l.once.Do(func() {
+		go l.loop()
+	})
+	select {
+	case conn = <-l.conns:
+		return
+	case err = <-l.errs:
+		return
+	case <-l.done:
+		return nil, l.err
+	}
+}
 
-		conn, err = NewServer(conn, l.block)
-		if err == nil {
+func (l *Listener) loop() {
+	sem := make(chan struct{}, MAX_HANDSHAKES)
+	for {
+		raw, err := l.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			l.err = err
+			close(l.done)
 			return
 		}
-		logger.Error(err.Error())
+		if err != nil {
+			l.errs <- err
+			continue
+		}
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			conn, err := l.serve(raw)
+			if err != nil {
+				return
+			}
+			select {
+			case l.conns <- conn:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// serve handshakes with raw, deals it by Policy if failed.
+func (l *Listener) serve(raw net.Conn) (conn net.Conn, err error) {
+	pc := newProbeConn(raw, l.Timeout)
+	conn, err = l.handshake(pc)
+	if err == nil {
+		pc.finish()
+		return
 	}
+	logger.Errorf("handshake with %s failed: %s", raw.RemoteAddr(), err.Error())
+	netutil.Audit(&netutil.AuditEvent{
+		Event:  netutil.AUDIT_HANDSHAKE_FAIL,
+		Remote: raw.RemoteAddr().String(),
+		Reason: err.Error(),
+	})
+	if l.Banner != nil {
+		l.Banner.Fail(raw.RemoteAddr())
+	}
+	go l.onProbe(pc)
 	return
 }
+
+// authFailed records client failed in handshake of shadowsocks or
+// trojan, as Listener does.
+func authFailed(banner *netutil.Banner, conn net.Conn, proto string, err error) {
+	logger.Errorf("%s: handshake with %s failed: %s", proto, conn.RemoteAddr(), err.Error())
+	netutil.Audit(&netutil.AuditEvent{
+		Event:  netutil.AUDIT_AUTH_FAIL,
+		Remote: conn.RemoteAddr().String(),
+		Reason: err.Error(),
+	})
+	if banner != nil {
+		banner.Fail(conn.RemoteAddr())
+	}
+}
+
+func authPassed(banner *netutil.Banner, conn net.Conn) {
+	netutil.Audit(&netutil.AuditEvent{
+		Event:  netutil.AUDIT_AUTH_OK,
+		Remote: conn.RemoteAddr().String(),
+	})
+	if banner != nil {
+		banner.Success(conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,105 @@
+package cryptconn
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	ErrNoKey    = errors.New("no key.")
+	ErrMultiKey = errors.New("multiple keys need aead method.")
+)
+
+// Method wraps connections with one cipher and key.
+type Method interface {
+	Client(conn net.Conn) (net.Conn, error)
+	Server(conn net.Conn) (net.Conn, error)
+}
+
+// NewMethod creates method with keys in base64, by cipher registered.
+// Client uses the first key, server accepts any of them. Only aead
+// methods take more than one. For noise, first key is private key of
+// self, and the rest are public keys of peers. Unknown cipher falls back
+// to aes.
+func NewMethod(method string, keys ...string) (m Method, err error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKey
+	}
+
+	ce, ok := getCipher(method)
+	if !ok {
+		logger.Warningf("unknown cipher %s, use %s.", method, DEFAULT_CIPHER)
+		ce, _ = getCipher(DEFAULT_CIPHER)
+	}
+
+	byteKeys, err := decodeKeys(keys)
+	if err != nil {
+		return
+	}
+	if FipsMode {
+		err = CheckApproved(method, byteKeys)
+		if err != nil {
+			return
+		}
+	}
+	return ce.factory(byteKeys)
+}
+
+func decodeKeys(keys []string) (byteKeys [][]byte, err error) {
+	byteKeys = make([][]byte, len(keys))
+	for i, key := range keys {
+		byteKeys[i], err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func newAesGcmMethod(keys [][]byte) (*AeadMethod, error) {
+	return NewAeadMethod("aes-gcm", keys, len(keys[0]), newGCM)
+}
+
+func newChachaMethod(keys [][]byte) (*AeadMethod, error) {
+	return NewAeadMethod("chacha20-poly1305",
+		keys, chacha20poly1305.KeySize, chacha20poly1305.New)
+}
+
+// StreamMethod uses block cipher in CFB mode. Data is not authenticated.
+type StreamMethod struct {
+	block  cipher.Block
+	filter *ReplayFilter
+}
+
+func (m *StreamMethod) Client(conn net.Conn) (net.Conn, error) {
+	sc, err := NewClient(conn, m.block)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Server refuses iv of client seen recently. Protocol has no timestamp,
+// so replay older than the filter can't be found here. Stream has no
+// auth of its own, iv is recorded by Confirm after client authenticated.
+func (m *StreamMethod) Server(conn net.Conn) (net.Conn, error) {
+	n := m.block.BlockSize()
+	ivs, err := SentIV(conn, n)
+	if err != nil {
+		return nil, err
+	}
+	ivr, err := RecvIV(conn, n)
+	if err != nil {
+		return nil, err
+	}
+	if m.filter.Seen(ivr) {
+		return nil, ErrReplay
+	}
+	sc := newCryptConn(conn, m.block, XOR(n, ivs, ivr))
+	sc.filter, sc.ivr = m.filter, ivr
+	return sc, nil
+}
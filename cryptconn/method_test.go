@@ -0,0 +1,383 @@
+package cryptconn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const testKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+
+func testMethod(t *testing.T, method string) {
+	testMethodWith(t, method, nil, false)
+}
+
+func testMethodWith(t *testing.T, method string, obfs Obfs, rekey bool) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	listener, err := NewListener(raw, method, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Obfs = obfs
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	dialer, err := NewDialer(&net.Dialer{}, method, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer.Obfs = obfs
+	conn, err := dialer.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if rekey {
+		err = conn.(*AeadConn).rekeyOut()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// larger than one record.
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	go conn.Write(append([]byte(nil), data...))
+
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatalf("%s: %s", method, err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("%s: data not match", method)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	for _, method := range []string{"aes", "aes-gcm", "chacha20-poly1305", "auto"} {
+		testMethod(t, method)
+	}
+}
+
+func TestRegisterCipher(t *testing.T) {
+	err := RegisterCipher("custom-aes", KEYSIZE, BlockFactory(aes.NewCipher))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RegisterCipher("aes", KEYSIZE, nil); err != ErrCipherExist {
+		t.Fatalf("cipher registered twice: %v", err)
+	}
+	testMethod(t, "custom-aes")
+}
+
+func TestRekey(t *testing.T) {
+	testMethodWith(t, "aes-gcm", nil, true)
+}
+
+func TestObfs(t *testing.T) {
+	for _, name := range []string{"http", "padding"} {
+		obfs, err := NewObfs(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testMethodWith(t, "aes", obfs, false)
+		testMethodWith(t, "chacha20-poly1305", obfs, false)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	rf := NewReplayFilter()
+	if !rf.Check([]byte("nonce1")) {
+		t.Fatal("new nonce rejected")
+	}
+	if rf.Check([]byte("nonce1")) {
+		t.Fatal("replayed nonce accepted")
+	}
+	if !rf.Check([]byte("nonce2")) {
+		t.Fatal("new nonce rejected")
+	}
+}
+
+func TestReplayFilterSize(t *testing.T) {
+	rf := NewReplayFilter()
+	for i := 0; i <= REPLAY_SIZE; i++ {
+		rf.Check([]byte(fmt.Sprintf("nonce%d", i)))
+	}
+	if len(rf.seen) > REPLAY_SIZE {
+		t.Fatalf("%d nonces kept", len(rf.seen))
+	}
+	if rf.Check([]byte(fmt.Sprintf("nonce%d", REPLAY_SIZE))) {
+		t.Fatal("replayed nonce accepted")
+	}
+	// the oldest is forgotten.
+	if !rf.Check([]byte("nonce0")) {
+		t.Fatal("oldest nonce kept")
+	}
+}
+
+// streamServer runs handshake of m with a client sending iv.
+func streamServer(m Method, iv []byte) (net.Conn, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		io.ReadFull(c, make([]byte, len(iv)))
+		c.Write(iv)
+	}()
+	return m.Server(s)
+}
+
+func TestStreamReplay(t *testing.T) {
+	m, err := NewMethod("aes", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := bytes.Repeat([]byte{1}, aes.BlockSize)
+
+	// junk never authenticated is not recorded.
+	conn, err := streamServer(m, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = streamServer(m, iv)
+	if err != nil {
+		t.Fatalf("unconfirmed iv refused: %s", err)
+	}
+	if err = conn.(*CryptConn).Confirm(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = streamServer(m, iv)
+	if err != ErrReplay {
+		t.Fatalf("replayed iv accepted: %v", err)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	for _, kdf := range []string{"argon2id", "scrypt"} {
+		key1, err := DeriveKey(kdf, "chacha20-poly1305", "passphrase", "salt")
+		if err != nil {
+			t.Fatalf("DeriveKey %s failed: %s", kdf, err)
+		}
+		key2, _ := DeriveKey(kdf, "chacha20-poly1305", "passphrase", "salt")
+		if key1 != key2 {
+			t.Fatalf("%s not stable", kdf)
+		}
+		if _, err = NewMethod("chacha20-poly1305", key1); err != nil {
+			t.Fatalf("key from %s not usable: %s", kdf, err)
+		}
+	}
+	if _, err := DeriveKey("", "aes", "passphrase", ""); err != ErrNoSalt {
+		t.Fatalf("empty salt accepted: %v", err)
+	}
+}
+
+func TestMultiKey(t *testing.T) {
+	const oldKey = "ZmVkY2JhOTg3NjU0MzIxMA=="
+	server, err := NewMethod("aes-gcm", testKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{testKey, oldKey, "MDAwMDAwMDAwMDAwMDAwMA=="} {
+		client, err := NewMethod("aes-gcm", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c1, c2 := net.Pipe()
+		go func() {
+			conn, err := client.Client(c1)
+			if err == nil {
+				conn.Write([]byte("hello"))
+			}
+		}()
+		conn, err := server.Server(c2)
+		if key == testKey || key == oldKey {
+			if err != nil {
+				t.Fatalf("key %s refused: %s", key, err)
+			}
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(conn, buf); err != nil {
+				t.Fatalf("key %s: %s", key, err)
+			}
+		} else if err != ErrUnknownKey {
+			t.Fatalf("unknown key accepted: %v", err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+
+	if _, err = NewMethod("aes", testKey, oldKey); err != ErrMultiKey {
+		t.Fatalf("stream method took multiple keys: %v", err)
+	}
+}
+
+func TestProbeFallback(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	listener, err := NewListener(raw, "aes-gcm", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Obfs = &HttpObfs{}
+	listener.Policy = POLICY_FALLBACK
+	listener.Fallback = echo.Addr().String()
+	go listener.Accept()
+
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// not a websocket upgrade, so it goes to fallback with bytes read.
+	probe := []byte("HEAD / HTTP/1.1\r\n\r\n")
+	conn.Write(probe)
+	buf := make([]byte, len(probe))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, probe) {
+		t.Fatalf("fallback got %q", buf)
+	}
+}
+
+func TestNoise(t *testing.T) {
+	skey, _ := newKeypair(nil)
+	ckey, _ := newKeypair(nil)
+	other, _ := newKeypair(nil)
+
+	server, err := NewNoiseMethod(skey.private, [][]byte{ckey.public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kp := range []*keypair{ckey, other} {
+		client, err := NewNoiseMethod(kp.private, [][]byte{skey.public})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c1, c2 := net.Pipe()
+		go func() {
+			conn, err := client.Client(c1)
+			if err == nil {
+				conn.Write([]byte("hello"))
+			}
+		}()
+		conn, err := server.Server(c2)
+		if kp == ckey {
+			if err != nil {
+				t.Fatalf("client refused: %s", err)
+			}
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("data wrong: %q %v", buf, err)
+			}
+		} else if err != ErrNoisePeer {
+			t.Fatalf("unknown client accepted: %v", err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestFips(t *testing.T) {
+	FipsMode = true
+	defer func() { FipsMode = false }()
+
+	if _, err := NewMethod("chacha20-poly1305", testKey); err == nil {
+		t.Fatal("chacha20-poly1305 accepted in fips mode")
+	}
+	if _, err := NewMethod("aes-gcm", "MDEyMzQ1Njc="); err == nil {
+		t.Fatal("short key accepted in fips mode")
+	}
+	if _, err := NewMethod("aes-gcm", testKey); err != nil {
+		t.Fatalf("aes-gcm rejected in fips mode: %s", err)
+	}
+	if _, err := DeriveKey("", "aes-gcm", "passphrase", "salt"); err == nil {
+		t.Fatal("kdf accepted in fips mode")
+	}
+}
+
+func TestSilentClient(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(raw, "aes-gcm", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Timeout = 10 * time.Second
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	timeout := time.After(2 * time.Second)
+	// silent client holds its handshake till timeout.
+	silent, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	dialer, err := NewDialer(&net.Dialer{}, "aes-gcm", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err = <-accepted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-timeout:
+		t.Fatal("client blocked by silent one.")
+	}
+
+	listener.Close()
+	if _, err = listener.Accept(); err == nil {
+		t.Fatal("accepted after close.")
+	}
+}
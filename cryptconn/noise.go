@@ -0,0 +1,307 @@
+package cryptconn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	NOISE_PROTOCOL = "Noise_IK_25519_ChaChaPoly_SHA256"
+	NOISE_PROLOGUE = "goproxy"
+	DHLEN          = 32
+	TAGLEN         = 16
+	// e, encrypted s, encrypted timestamp
+	NOISE_MSG1 = DHLEN + DHLEN + TAGLEN + 8 + TAGLEN
+	// e, encrypted empty payload
+	NOISE_MSG2 = DHLEN + TAGLEN
+)
+
+var (
+	ErrNoiseKey     = errors.New("noise key should be 32 bytes.")
+	ErrNoisePeer    = errors.New("noise peer not allowed.")
+	ErrNoiseNoPeers = errors.New("noise needs public key of peer.")
+)
+
+// symmetricState is the SymmetricState and CipherState of noise spec.
+type symmetricState struct {
+	ck []byte
+	h  []byte
+	k  []byte
+	n  uint64
+}
+
+func newSymmetricState() (ss *symmetricState) {
+	// protocol name is exactly 32 bytes, used as h directly.
+	ss = &symmetricState{h: []byte(NOISE_PROTOCOL)}
+	ss.ck = ss.h
+	ss.mixHash([]byte(NOISE_PROLOGUE))
+	return
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(ss.h)
+	sum.Write(data)
+	ss.h = sum.Sum(nil)
+}
+
+func hmacSum(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func noiseHKDF(ck, ikm []byte) (out1, out2 []byte) {
+	temp := hmacSum(ck, ikm)
+	out1 = hmacSum(temp, []byte{1})
+	out2 = hmacSum(temp, out1, []byte{2})
+	return
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	ss.ck, ss.k = noiseHKDF(ss.ck, ikm)
+	ss.n = 0
+}
+
+func (ss *symmetricState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], ss.n)
+	ss.n++
+	return nonce
+}
+
+// k is always set before first encryption in IK.
+func (ss *symmetricState) encryptAndHash(out, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(ss.k)
+	c := aead.Seal(out, ss.nonce(), plaintext, ss.h)
+	ss.mixHash(c[len(out):])
+	return c
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+	aead, _ := chacha20poly1305.New(ss.k)
+	plaintext, err = aead.Open(nil, ss.nonce(), ciphertext, ss.h)
+	if err != nil {
+		return
+	}
+	ss.mixHash(ciphertext)
+	return
+}
+
+// split returns keys for initiator to responder, and the other way.
+func (ss *symmetricState) split() (k1, k2 []byte) {
+	return noiseHKDF(ss.ck, nil)
+}
+
+func dh(private, public []byte) (shared []byte, err error) {
+	return curve25519.X25519(private, public)
+}
+
+type keypair struct {
+	private []byte
+	public  []byte
+}
+
+func newKeypair(private []byte) (kp *keypair, err error) {
+	if private == nil {
+		private = make([]byte, DHLEN)
+		_, err = rand.Read(private)
+		if err != nil {
+			return
+		}
+	}
+	if len(private) != DHLEN {
+		return nil, ErrNoiseKey
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	return &keypair{private: private, public: public}, nil
+}
+
+// NoisePublicKey returns public key of private key, both in base64.
+func NoisePublicKey(private string) (public string, err error) {
+	key, err := base64.StdEncoding.DecodeString(private)
+	if err != nil {
+		return
+	}
+	kp, err := newKeypair(key)
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(kp.public), nil
+}
+
+// NoiseMethod does Noise_IK handshake. Client knows static key of server
+// before, and sends its own static key encrypted in first message. Both
+// sides are authenticated by static keys, and session keys come from
+// ephemeral keys, so a leaked static key can't decrypt sessions recorded.
+//
+// Client holds public key of server in peers. Server holds public keys of
+// clients allowed.
+type NoiseMethod struct {
+	static *keypair
+	peers  map[string]bool
+	server []byte
+	filter *ReplayFilter
+}
+
+func NewNoiseMethod(private []byte, peers [][]byte) (m *NoiseMethod, err error) {
+	if len(peers) == 0 {
+		return nil, ErrNoiseNoPeers
+	}
+	static, err := newKeypair(private)
+	if err != nil {
+		return
+	}
+	m = &NoiseMethod{
+		static: static,
+		peers:  make(map[string]bool, len(peers)),
+		server: peers[0],
+		filter: NewReplayFilter(),
+	}
+	for _, peer := range peers {
+		if len(peer) != DHLEN {
+			return nil, ErrNoiseKey
+		}
+		m.peers[string(peer)] = true
+	}
+	return
+}
+
+// Client writes e, es, s, ss with timestamp as payload, then reads e, ee, se.
+func (m *NoiseMethod) Client(conn net.Conn) (net.Conn, error) {
+	ss := newSymmetricState()
+	ss.mixHash(m.server)
+
+	e, err := newKeypair(nil)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 0, NOISE_MSG1)
+	msg = append(msg, e.public...)
+	ss.mixHash(e.public)
+	shared, err := dh(e.private, m.server)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(shared)
+	msg = ss.encryptAndHash(msg, m.static.public)
+	shared, err = dh(m.static.private, m.server)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(shared)
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+	msg = ss.encryptAndHash(msg, ts)
+
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = RecvIV(conn, NOISE_MSG2)
+	if err != nil {
+		return nil, err
+	}
+	re := msg[:DHLEN]
+	ss.mixHash(re)
+	for _, priv := range [][]byte{e.private, m.static.private} {
+		shared, err = dh(priv, re)
+		if err != nil {
+			return nil, err
+		}
+		ss.mixKey(shared)
+	}
+	_, err = ss.decryptAndHash(msg[DHLEN:])
+	if err != nil {
+		return nil, err
+	}
+
+	out, in := ss.split()
+	return NewAeadConn(conn, chacha20poly1305.New, in, out)
+}
+
+// Server reads first message, and rejects clients not in peers, with old
+// timestamp, or replayed ephemeral key, before anything sent.
+func (m *NoiseMethod) Server(conn net.Conn) (net.Conn, error) {
+	ss := newSymmetricState()
+	ss.mixHash(m.static.public)
+
+	msg, err := RecvIV(conn, NOISE_MSG1)
+	if err != nil {
+		return nil, err
+	}
+	re := msg[:DHLEN]
+	ss.mixHash(re)
+	shared, err := dh(m.static.private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(shared)
+	rs, err := ss.decryptAndHash(msg[DHLEN : 2*DHLEN+TAGLEN])
+	if err != nil {
+		return nil, err
+	}
+	if !m.peers[string(rs)] {
+		return nil, ErrNoisePeer
+	}
+	shared, err = dh(m.static.private, rs)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(shared)
+	ts, err := ss.decryptAndHash(msg[2*DHLEN+TAGLEN:])
+	if err != nil {
+		return nil, err
+	}
+	skew := time.Since(time.Unix(int64(binary.BigEndian.Uint64(ts)), 0))
+	if skew > REPLAY_WINDOW || skew < -REPLAY_WINDOW {
+		return nil, ErrTimestamp
+	}
+	if !m.filter.Check(re) {
+		return nil, ErrReplay
+	}
+
+	e, err := newKeypair(nil)
+	if err != nil {
+		return nil, err
+	}
+	msg = make([]byte, 0, NOISE_MSG2)
+	msg = append(msg, e.public...)
+	ss.mixHash(e.public)
+	for _, pub := range [][]byte{re, rs} {
+		shared, err = dh(e.private, pub)
+		if err != nil {
+			return nil, err
+		}
+		ss.mixKey(shared)
+	}
+	msg = ss.encryptAndHash(msg, nil)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	in, out := ss.split()
+	ac, err := NewAeadConn(conn, chacha20poly1305.New, in, out)
+	if err != nil {
+		return nil, err
+	}
+	ac.KeyId = fmt.Sprintf("%08x", KeyId(rs))
+	return ac, nil
+}
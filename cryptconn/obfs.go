@@ -0,0 +1,200 @@
+package cryptconn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	MAX_HEADER  = 4096
+	MAX_PADDING = 255
+)
+
+var (
+	ErrUnknownObfs = errors.New("unknown obfs.")
+	ErrObfsHeader  = errors.New("obfs header invalid.")
+)
+
+// Obfs hides bytes of handshake on wire from DPI. It runs under crypt
+// method, and gives no security itself.
+type Obfs interface {
+	Client(conn net.Conn) (net.Conn, error)
+	Server(conn net.Conn) (net.Conn, error)
+}
+
+// lazyConn runs recv before the first read. So client can send handshake
+// without waiting preamble of server, no more round trip needed.
+type lazyConn struct {
+	net.Conn
+	recv func(net.Conn) error
+	err  error
+}
+
+func (lc *lazyConn) Read(b []byte) (n int, err error) {
+	if lc.recv != nil {
+		lc.err = lc.recv(lc.Conn)
+		lc.recv = nil
+	}
+	if lc.err != nil {
+		return 0, lc.err
+	}
+	return lc.Conn.Read(b)
+}
+
+// NewObfs creates obfs by name, empty name means none. host is used by
+// http obfs in Host header.
+func NewObfs(name, host string) (o Obfs, err error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "http":
+		if host == "" {
+			host = "www.bing.com"
+		}
+		return &HttpObfs{Host: host}, nil
+	case "padding":
+		return &PaddingObfs{}, nil
+	}
+	return nil, ErrUnknownObfs
+}
+
+// HttpObfs looks like a websocket upgrade. Client sends request and goes
+// on without waiting, server replies 101 after request read.
+type HttpObfs struct {
+	Host string
+}
+
+func randomToken(n int) (s string, err error) {
+	b := make([]byte, n)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (o *HttpObfs) Client(conn net.Conn) (net.Conn, error) {
+	path, err := randomToken(9)
+	if err != nil {
+		return nil, err
+	}
+	key, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	req := fmt.Sprintf("GET /%s HTTP/1.1\r\nHost: %s\r\n"+
+		"User-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64)\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		path, o.Host, key)
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		return nil, err
+	}
+
+	return &lazyConn{Conn: conn, recv: func(c net.Conn) error {
+		return readHeader(c, "HTTP/1.1 101 ")
+	}}, nil
+}
+
+func (o *HttpObfs) Server(conn net.Conn) (net.Conn, error) {
+	err := readHeader(conn, "GET /")
+	if err != nil {
+		return nil, err
+	}
+	accept, err := randomToken(20)
+	if err != nil {
+		return nil, err
+	}
+	resp := fmt.Sprintf("HTTP/1.1 101 Switching Protocols\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", accept)
+	_, err = conn.Write([]byte(resp))
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readHeader reads byte by byte till end of header, never reads data
+// after it.
+func readHeader(conn net.Conn, prefix string) (err error) {
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= MAX_HEADER {
+			return ErrObfsHeader
+		}
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			return
+		}
+		header = append(header, b[0])
+		if len(header) == len(prefix) && string(header) != prefix {
+			return ErrObfsHeader
+		}
+	}
+	return
+}
+
+// PaddingObfs sends random bytes of random length before handshake,
+// so first packet has no fixed size.
+type PaddingObfs struct{}
+
+func sendPadding(conn net.Conn) (err error) {
+	var n [1]byte
+	_, err = rand.Read(n[:])
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 1+int(n[0]))
+	_, err = rand.Read(buf[1:])
+	if err != nil {
+		return
+	}
+	buf[0] = n[0]
+	_, err = conn.Write(buf)
+	return
+}
+
+func recvPadding(conn net.Conn) (err error) {
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1+MAX_PADDING)
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return
+	}
+	_, err = io.ReadFull(conn, buf[1:1+int(buf[0])])
+	return
+}
+
+func (o *PaddingObfs) Client(conn net.Conn) (net.Conn, error) {
+	err := sendPadding(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &lazyConn{Conn: conn, recv: recvPadding}, nil
+}
+
+func (o *PaddingObfs) Server(conn net.Conn) (net.Conn, error) {
+	err := recvPadding(conn)
+	if err != nil {
+		return nil, err
+	}
+	err = sendPadding(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,116 @@
+package cryptconn
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	POLICY_CLOSE    = "close"
+	POLICY_STALL    = "stall"
+	POLICY_FALLBACK = "fallback"
+
+	STALL_TIMEOUT = 5 * time.Minute
+	MAX_RECORD    = 16 * 1024
+)
+
+// probeConn records bytes read in handshake, for fallback to replay, and
+// keeps all reads in handshake before one deadline, whatever deadline
+// set by layers above.
+type probeConn struct {
+	net.Conn
+	lock     sync.Mutex
+	deadline time.Time
+	done     bool
+	record   []byte
+}
+
+func newProbeConn(conn net.Conn, timeout time.Duration) (pc *probeConn) {
+	pc = &probeConn{
+		Conn:     conn,
+		deadline: time.Now().Add(timeout),
+	}
+	conn.SetDeadline(pc.deadline)
+	return
+}
+
+func (pc *probeConn) Read(b []byte) (n int, err error) {
+	n, err = pc.Conn.Read(b)
+	pc.lock.Lock()
+	if !pc.done && len(pc.record) < MAX_RECORD {
+		pc.record = append(pc.record, b[:n]...)
+	}
+	pc.lock.Unlock()
+	return
+}
+
+func (pc *probeConn) limit(t time.Time) time.Time {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if pc.done || (!t.IsZero() && t.Before(pc.deadline)) {
+		return t
+	}
+	return pc.deadline
+}
+
+func (pc *probeConn) SetDeadline(t time.Time) error {
+	return pc.Conn.SetDeadline(pc.limit(t))
+}
+
+func (pc *probeConn) SetReadDeadline(t time.Time) error {
+	return pc.Conn.SetReadDeadline(pc.limit(t))
+}
+
+func (pc *probeConn) SetWriteDeadline(t time.Time) error {
+	return pc.Conn.SetWriteDeadline(pc.limit(t))
+}
+
+// finish stops recording and leaves deadlines to layers above.
+func (pc *probeConn) finish() {
+	pc.lock.Lock()
+	pc.done = true
+	pc.record = nil
+	pc.lock.Unlock()
+	pc.Conn.SetDeadline(time.Time{})
+}
+
+// onProbe deals with a connection failed in handshake. Closing it at once
+// tells a prober what we are, so it can stall, or be passed to another
+// service as if it's the one listening here.
+func (l *Listener) onProbe(pc *probeConn) {
+	switch l.Policy {
+	case POLICY_STALL:
+		pc.Conn.SetDeadline(time.Now().Add(STALL_TIMEOUT))
+		io.Copy(ioutil.Discard, pc.Conn)
+	case POLICY_FALLBACK:
+		pc.fallback(l.Fallback)
+	}
+	pc.Conn.Close()
+}
+
+// fallback replays bytes read to address, and relays the rest.
+func (pc *probeConn) fallback(address string) {
+	pc.lock.Lock()
+	record := pc.record
+	pc.record = nil
+	pc.done = true
+	pc.lock.Unlock()
+	pc.Conn.SetDeadline(time.Time{})
+
+	conn, err := net.DialTimeout("tcp", address, DIAL_TIMEOUT)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	_, err = conn.Write(record)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	netutil.Relay(pc.Conn, conn)
+}
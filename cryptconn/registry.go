@@ -0,0 +1,101 @@
+package cryptconn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const DEFAULT_CIPHER = "aes"
+
+var ErrCipherExist = errors.New("cipher already registered.")
+
+// MethodFactory creates method from keys decoded. Stream ciphers take
+// just one key.
+type MethodFactory func(keys [][]byte) (Method, error)
+
+type cipherEntry struct {
+	keysize int
+	factory MethodFactory
+}
+
+var (
+	cipherLock sync.RWMutex
+	ciphers    = make(map[string]*cipherEntry)
+)
+
+// RegisterCipher adds a cipher by name. keysize is bytes of key generated
+// by DeriveKey for it. Call it in init of package which brings the cipher.
+func RegisterCipher(name string, keysize int, factory MethodFactory) (err error) {
+	cipherLock.Lock()
+	defer cipherLock.Unlock()
+	if _, ok := ciphers[name]; ok {
+		return ErrCipherExist
+	}
+	ciphers[name] = &cipherEntry{keysize: keysize, factory: factory}
+	return
+}
+
+func getCipher(name string) (ce *cipherEntry, ok bool) {
+	cipherLock.RLock()
+	defer cipherLock.RUnlock()
+	ce, ok = ciphers[name]
+	return
+}
+
+// ListCiphers returns names of all ciphers registered.
+func ListCiphers() (names []string) {
+	cipherLock.RLock()
+	for name := range ciphers {
+		names = append(names, name)
+	}
+	cipherLock.RUnlock()
+	sort.Strings(names)
+	return
+}
+
+// BlockFactory makes block cipher in CFB mode into a method.
+func BlockFactory(newBlock func(key []byte) (cipher.Block, error)) MethodFactory {
+	return func(keys [][]byte) (m Method, err error) {
+		if len(keys) > 1 {
+			return nil, ErrMultiKey
+		}
+		block, err := newBlock(keys[0])
+		if err != nil {
+			return
+		}
+		return &StreamMethod{block: block, filter: NewReplayFilter()}, nil
+	}
+}
+
+// AeadFactory makes aead cipher into a method. With keysize 0, length of
+// first key is used.
+func AeadFactory(name string, keysize int, f func(key []byte) (cipher.AEAD, error)) MethodFactory {
+	return func(keys [][]byte) (Method, error) {
+		size := keysize
+		if size == 0 {
+			size = len(keys[0])
+		}
+		return NewAeadMethod(name, keys, size, f)
+	}
+}
+
+func init() {
+	RegisterCipher("aes", KEYSIZE, BlockFactory(aes.NewCipher))
+	RegisterCipher("des", 8, BlockFactory(des.NewCipher))
+	RegisterCipher("tripledes", 24, BlockFactory(des.NewTripleDESCipher))
+	RegisterCipher("aes-gcm", 32, AeadFactory("aes-gcm", 0, newGCM))
+	RegisterCipher("chacha20-poly1305", chacha20poly1305.KeySize,
+		AeadFactory("chacha20-poly1305", chacha20poly1305.KeySize, chacha20poly1305.New))
+	RegisterCipher("auto", 32, func(keys [][]byte) (Method, error) {
+		return NewAutoMethod(keys)
+	})
+	RegisterCipher("noise", DHLEN, func(keys [][]byte) (Method, error) {
+		return NewNoiseMethod(keys[0], keys[1:])
+	})
+}
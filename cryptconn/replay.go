@@ -0,0 +1,82 @@
+package cryptconn
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	REPLAY_WINDOW = 300 * time.Second
+	// REPLAY_SIZE is max nonces kept, stream method records iv only
+	// after client authenticated, so who has no key can't fill it.
+	REPLAY_SIZE = 1 << 16
+)
+
+var (
+	ErrReplay    = errors.New("handshake replayed.")
+	ErrTimestamp = errors.New("handshake timestamp out of window.")
+	ErrHelloMAC  = errors.New("handshake mac not match.")
+)
+
+// ReplayFilter remembers nonces seen in last 2 * REPLAY_WINDOW.
+// Handshakes older than REPLAY_WINDOW should be rejected by timestamp,
+// so anything older can be forgotten. No more than REPLAY_SIZE nonces
+// are kept, the oldest is forgotten for a new one.
+type ReplayFilter struct {
+	lock      sync.Mutex
+	seen      map[string]time.Time
+	ring      []string // nonces in order seen, oldest in next if full.
+	next      int
+	lastPrune time.Time
+}
+
+func NewReplayFilter() (rf *ReplayFilter) {
+	return &ReplayFilter{
+		seen:      make(map[string]time.Time, 0),
+		lastPrune: time.Now(),
+	}
+}
+
+// Check returns false if nonce has been seen, and remember it if not.
+func (rf *ReplayFilter) Check(nonce []byte) bool {
+	now := time.Now()
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if now.Sub(rf.lastPrune) > REPLAY_WINDOW {
+		rf.prune(now)
+	}
+
+	key := string(nonce)
+	if _, ok := rf.seen[key]; ok {
+		return false
+	}
+	rf.seen[key] = now
+	if len(rf.ring) < REPLAY_SIZE {
+		rf.ring = append(rf.ring, key)
+		return true
+	}
+	delete(rf.seen, rf.ring[rf.next])
+	rf.ring[rf.next] = key
+	rf.next = (rf.next + 1) % REPLAY_SIZE
+	return true
+}
+
+// Seen returns true if nonce has been seen, without remembering it.
+func (rf *ReplayFilter) Seen(nonce []byte) bool {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	_, ok := rf.seen[string(nonce)]
+	return ok
+}
+
+// lock must be held.
+func (rf *ReplayFilter) prune(now time.Time) {
+	for key, t := range rf.seen {
+		if now.Sub(t) > 2*REPLAY_WINDOW {
+			delete(rf.seen, key)
+		}
+	}
+	rf.lastPrune = now
+}
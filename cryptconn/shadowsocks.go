@@ -0,0 +1,239 @@
+package cryptconn
+
+import (
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// SS_MAX_PAYLOAD is the largest record, upper 2 bits of length
+	// must be zero.
+	SS_MAX_PAYLOAD = 0x3FFF
+	SS_TAG_SIZE    = 16
+	SS_SUBKEY_INFO = "ss-subkey"
+)
+
+var (
+	ErrSsMethod = errors.New("shadowsocks: method not supported.")
+	ErrSsPacket = errors.New("shadowsocks: packet too short.")
+)
+
+type ssCipherEntry struct {
+	keysize int
+	newAead newAeadFunc
+}
+
+var ssCiphers = map[string]ssCipherEntry{
+	"aes-128-gcm":            {16, newGCM},
+	"aes-192-gcm":            {24, newGCM},
+	"aes-256-gcm":            {32, newGCM},
+	"chacha20-ietf-poly1305": {chacha20poly1305.KeySize, chacha20poly1305.New},
+}
+
+// SsCipher is an aead cipher of shadowsocks, with key derived from
+// password as EVP_BytesToKey of openssl. Salt is as long as key.
+type SsCipher struct {
+	key     []byte
+	newAead newAeadFunc
+}
+
+// NewSsCipher takes method like aes-256-gcm or chacha20-ietf-poly1305.
+// Stream ciphers of shadowsocks are not supported.
+func NewSsCipher(method, password string) (c *SsCipher, err error) {
+	if FipsMode {
+		return nil, fmt.Errorf("shadowsocks %s", ErrNotApproved)
+	}
+	ce, ok := ssCiphers[strings.ToLower(method)]
+	if !ok {
+		return nil, ErrSsMethod
+	}
+	return &SsCipher{key: evpBytesToKey(password, ce.keysize), newAead: ce.newAead}, nil
+}
+
+func evpBytesToKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:size]
+}
+
+// aead makes cipher of a salt, by subkey in hkdf-sha1.
+func (c *SsCipher) aead(salt []byte) (aead cipher.AEAD, err error) {
+	subkey := make([]byte, len(c.key))
+	_, err = io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte(SS_SUBKEY_INFO)), subkey)
+	if err != nil {
+		return
+	}
+	return c.newAead(subkey)
+}
+
+// SealPacket appends udp packet to dst: salt, then sealed payload with
+// zero nonce.
+func (c *SsCipher) SealPacket(dst, payload []byte) (pkt []byte, err error) {
+	n := len(dst)
+	pkt = append(dst, make([]byte, len(c.key))...)
+	_, err = rand.Read(pkt[n:])
+	if err != nil {
+		return
+	}
+	aead, err := c.aead(pkt[n:])
+	if err != nil {
+		return
+	}
+	return aead.Seal(pkt, make([]byte, aead.NonceSize()), payload, nil), nil
+}
+
+// OpenPacket appends payload in udp packet to dst.
+func (c *SsCipher) OpenPacket(dst, pkt []byte) (payload []byte, err error) {
+	if len(pkt) < len(c.key) {
+		return nil, ErrSsPacket
+	}
+	aead, err := c.aead(pkt[:len(c.key)])
+	if err != nil {
+		return
+	}
+	return aead.Open(dst, make([]byte, aead.NonceSize()), pkt[len(c.key):], nil)
+}
+
+// SsConn is a stream of shadowsocks aead. Each direction starts with
+// salt, then records as AeadConn: sealed length (2 bytes + tag), sealed
+// payload (n bytes + tag), with little endian nonce increased after each
+// seal. Salt of writer is sent with first record.
+type SsConn struct {
+	net.Conn
+	cipher *SsCipher
+	in     cipher.AEAD
+	out    cipher.AEAD
+	rnonce []byte
+	wnonce []byte
+	rbuf   []byte
+	r_rest []byte
+	wbuf   []byte
+}
+
+func NewSsConn(conn net.Conn, c *SsCipher) *SsConn {
+	return &SsConn{Conn: conn, cipher: c}
+}
+
+// salt appends salt of writer to buf, and starts cipher out.
+func (sc *SsConn) salt(buf []byte) (out []byte, err error) {
+	n := len(buf)
+	out = append(buf, make([]byte, len(sc.cipher.key))...)
+	_, err = rand.Read(out[n:])
+	if err != nil {
+		return
+	}
+	sc.out, err = sc.cipher.aead(out[n:])
+	if err != nil {
+		return
+	}
+	sc.wnonce = make([]byte, sc.out.NonceSize())
+	return
+}
+
+func (sc *SsConn) Write(b []byte) (n int, err error) {
+	if sc.wbuf == nil {
+		sc.wbuf = make([]byte, 0, len(sc.cipher.key)+2+SS_MAX_PAYLOAD+2*SS_TAG_SIZE)
+	}
+	for len(b) > 0 {
+		buf := sc.wbuf[:0]
+		if sc.out == nil {
+			buf, err = sc.salt(buf)
+			if err != nil {
+				return
+			}
+		}
+
+		size := len(b)
+		if size > SS_MAX_PAYLOAD {
+			size = SS_MAX_PAYLOAD
+		}
+		l := len(buf)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(size))
+		buf = sc.out.Seal(buf[:l], sc.wnonce, buf[l:], nil)
+		increase(sc.wnonce)
+		l = len(buf)
+		buf = append(buf, b[:size]...)
+		buf = sc.out.Seal(buf[:l], sc.wnonce, buf[l:], nil)
+		increase(sc.wnonce)
+
+		_, err = sc.Conn.Write(buf)
+		if err != nil {
+			return
+		}
+		b = b[size:]
+		n += size
+	}
+	return
+}
+
+func (sc *SsConn) readRecord() (err error) {
+	if sc.in == nil {
+		salt := make([]byte, len(sc.cipher.key))
+		_, err = io.ReadFull(sc.Conn, salt)
+		if err != nil {
+			return
+		}
+		sc.in, err = sc.cipher.aead(salt)
+		if err != nil {
+			return
+		}
+		sc.rnonce = make([]byte, sc.in.NonceSize())
+		sc.rbuf = make([]byte, 2+SS_MAX_PAYLOAD+2*sc.in.Overhead())
+	}
+
+	buf := sc.rbuf[:2+sc.in.Overhead()]
+	_, err = io.ReadFull(sc.Conn, buf)
+	if err != nil {
+		return
+	}
+	_, err = sc.in.Open(buf[:0], sc.rnonce, buf, nil)
+	if err != nil {
+		return
+	}
+	increase(sc.rnonce)
+
+	size := int(binary.BigEndian.Uint16(buf))
+	if size > SS_MAX_PAYLOAD {
+		return ErrPayloadSize
+	}
+	buf = sc.rbuf[:size+sc.in.Overhead()]
+	_, err = io.ReadFull(sc.Conn, buf)
+	if err != nil {
+		return
+	}
+	sc.r_rest, err = sc.in.Open(buf[:0], sc.rnonce, buf, nil)
+	if err != nil {
+		return
+	}
+	increase(sc.rnonce)
+	return
+}
+
+func (sc *SsConn) Read(b []byte) (n int, err error) {
+	for len(sc.r_rest) == 0 {
+		err = sc.readRecord()
+		if err != nil {
+			return
+		}
+	}
+	n = copy(b, sc.r_rest)
+	sc.r_rest = sc.r_rest[n:]
+	return
+}
@@ -0,0 +1,119 @@
+package cryptconn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestEvpBytesToKey(t *testing.T) {
+	key := hex.EncodeToString(evpBytesToKey("password", 32))
+	if key != "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08" {
+		t.Fatalf("wrong key: %s", key)
+	}
+}
+
+func ssServer(t *testing.T, method, password string) (addr string, closer func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pconn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSsServer(&net.Dialer{}, method, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	go s.ServePacket(pconn)
+	return listener.Addr().String(), func() {
+		listener.Close()
+		pconn.Close()
+	}
+}
+
+func TestShadowsocks(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		addr, closer := ssServer(t, method, "pass")
+		dialer, err := NewSsDialer(&net.Dialer{}, addr, method, "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("0123456789"), 4000)
+		go conn.Write(data)
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("%s not relayed: %v", method, err)
+		}
+		conn.Close()
+		closer()
+	}
+
+	// wrong password is cut off by server.
+	addr, closer := ssServer(t, "aes-256-gcm", "pass")
+	defer closer()
+	dialer, _ := NewSsDialer(&net.Dialer{}, addr, "aes-256-gcm", "wrong")
+	conn, err := dialer.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 5)); err == nil {
+		t.Fatal("relayed with wrong password")
+	}
+}
+
+func TestShadowsocksUdp(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	addr, closer := ssServer(t, "aes-256-gcm", "pass")
+	defer closer()
+	// SIP002 form, base64 of method:password.
+	dialer, err := netutil.NewUpstreamDialer(&net.Dialer{}, "ss://YWVzLTI1Ni1nY206cGFzcw==@"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("not relayed: %q %v", buf[:n], err)
+	}
+}
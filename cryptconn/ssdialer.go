@@ -0,0 +1,122 @@
+package cryptconn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// SsDialer connects through shadowsocks server, tcp in stream and udp in
+// packets.
+type SsDialer struct {
+	netutil.Dialer
+	Server string
+	cipher *SsCipher
+}
+
+func NewSsDialer(dialer netutil.Dialer, server, method, password string) (d *SsDialer, err error) {
+	c, err := NewSsCipher(method, password)
+	if err != nil {
+		return
+	}
+	return &SsDialer{Dialer: dialer, Server: server, cipher: c}, nil
+}
+
+// Dial sends address to server in first record, and doesn't wait for
+// any reply.
+func (d *SsDialer) Dial(network, address string) (conn net.Conn, err error) {
+	header, err := netutil.AppendSocks5Address(nil, address)
+	if err != nil {
+		return
+	}
+	if strings.HasPrefix(network, "udp") {
+		conn, err = d.Dialer.Dial("udp", d.Server)
+		if err != nil {
+			return
+		}
+		return &ssPacketConn{Conn: conn, cipher: d.cipher, header: header}, nil
+	}
+
+	conn, err = d.Dialer.Dial("tcp", d.Server)
+	if err != nil {
+		return
+	}
+	sc := NewSsConn(conn, d.cipher)
+	_, err = sc.Write(header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// ssPacketConn sends packets to a target by server, each packet starts
+// with address of target.
+type ssPacketConn struct {
+	net.Conn
+	cipher *SsCipher
+	header []byte
+	rbuf   []byte
+}
+
+func (c *ssPacketConn) Write(b []byte) (n int, err error) {
+	pkt, err := c.cipher.SealPacket(nil, append(c.header[:len(c.header):len(c.header)], b...))
+	if err != nil {
+		return
+	}
+	_, err = c.Conn.Write(pkt)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *ssPacketConn) Read(b []byte) (n int, err error) {
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, netutil.MAX_PACKET)
+	}
+	for {
+		n, err = c.Conn.Read(c.rbuf)
+		if err != nil {
+			return
+		}
+		var payload []byte
+		payload, err = c.cipher.OpenPacket(c.rbuf[n:n], c.rbuf[:n])
+		if err != nil {
+			logger.Debugf("shadowsocks: packet from %s dropped: %s", c.Conn.RemoteAddr(), err.Error())
+			continue
+		}
+		r := bytes.NewReader(payload)
+		_, err = netutil.ReadSocks5Address(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, payload[len(payload)-r.Len():]), nil
+	}
+}
+
+// newSsUpstream takes ss://method:password@host:port, or
+// ss://base64(method:password)@host:port of SIP002.
+func newSsUpstream(dialer netutil.Dialer, u *url.URL) (netutil.Dialer, error) {
+	method := u.User.Username()
+	password, ok := u.User.Password()
+	if !ok {
+		userinfo, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(method, "="))
+		if err != nil {
+			userinfo, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(method, "="))
+			if err != nil {
+				return nil, err
+			}
+		}
+		method, password, _ = strings.Cut(string(userinfo), ":")
+	}
+	return NewSsDialer(dialer, u.Host, method, password)
+}
+
+func init() {
+	netutil.RegisterUpstream("ss", newSsUpstream)
+}
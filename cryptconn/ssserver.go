@@ -0,0 +1,133 @@
+package cryptconn
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// SS_UDP_TIMEOUT closes udp flow idle that long.
+const SS_UDP_TIMEOUT = 2 * time.Minute
+
+// SsServer serves shadowsocks clients, and connects targets by dialer.
+type SsServer struct {
+	netutil.Dialer
+	// Banner counts clients failed in handshake, nil if not banning.
+	Banner *netutil.Banner
+	cipher *SsCipher
+}
+
+func NewSsServer(dialer netutil.Dialer, method, password string) (s *SsServer, err error) {
+	c, err := NewSsCipher(method, password)
+	if err != nil {
+		return
+	}
+	return &SsServer{Dialer: dialer, cipher: c}, nil
+}
+
+// Serve relays tcp clients in listener.
+func (s *SsServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SsServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	sc := NewSsConn(conn, s.cipher)
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	address, err := netutil.ReadSocks5Address(sc)
+	if err != nil {
+		authFailed(s.Banner, conn, "shadowsocks", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	authPassed(s.Banner, conn)
+
+	dstconn, err := s.Dialer.Dial("tcp", address)
+	if err != nil {
+		logger.Errorf("shadowsocks: dial %s: %s", address, err.Error())
+		return
+	}
+	logger.Infof("shadowsocks: %s connected to %s.", conn.RemoteAddr(), address)
+	netutil.Relay(sc, dstconn)
+}
+
+// ServePacket relays udp of clients in conn, a flow for each client and
+// target, closed after SS_UDP_TIMEOUT idle.
+func (s *SsServer) ServePacket(conn net.PacketConn) error {
+	var lock sync.Mutex
+	flows := make(map[string]net.Conn)
+	buf := make([]byte, netutil.MAX_PACKET)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		payload, err := s.cipher.OpenPacket(nil, buf[:n])
+		if err != nil {
+			logger.Debugf("shadowsocks: packet from %s dropped: %s", addr, err.Error())
+			continue
+		}
+		r := bytes.NewReader(payload)
+		address, err := netutil.ReadSocks5Address(r)
+		if err != nil {
+			continue
+		}
+		header := payload[:len(payload)-r.Len()]
+
+		key := addr.String() + " " + address
+		lock.Lock()
+		dconn, ok := flows[key]
+		lock.Unlock()
+		if !ok {
+			dconn, err = s.Dialer.Dial("udp", address)
+			if err != nil {
+				logger.Errorf("shadowsocks: udp %s: %s", address, err.Error())
+				continue
+			}
+			lock.Lock()
+			flows[key] = dconn
+			lock.Unlock()
+			go func() {
+				s.recvPacket(conn, addr, dconn, header)
+				lock.Lock()
+				delete(flows, key)
+				lock.Unlock()
+				dconn.Close()
+			}()
+		}
+		dconn.SetReadDeadline(time.Now().Add(SS_UDP_TIMEOUT))
+		_, err = dconn.Write(payload[len(header):])
+		if err != nil {
+			logger.Debugf("shadowsocks: udp %s: %s", address, err.Error())
+		}
+	}
+}
+
+// recvPacket sends replies of target back to client, until idle.
+func (s *SsServer) recvPacket(conn net.PacketConn, addr net.Addr, dconn net.Conn, header []byte) {
+	buf := make([]byte, netutil.MAX_PACKET)
+	for {
+		n, err := dconn.Read(buf)
+		if err != nil {
+			return
+		}
+		dconn.SetReadDeadline(time.Now().Add(SS_UDP_TIMEOUT))
+		pkt, err := s.cipher.SealPacket(nil, append(header[:len(header):len(header)], buf[:n]...))
+		if err != nil {
+			return
+		}
+		_, err = conn.WriteTo(pkt, addr)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package cryptconn
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	TROJAN_CONNECT = 0x01
+	TROJAN_UDP     = 0x03
+	// TROJAN_HASH_SIZE is length of hex of sha224 of password.
+	TROJAN_HASH_SIZE = 56
+)
+
+var (
+	ErrTrojanPassword = errors.New("trojan: password not matched.")
+	ErrTrojanNoPass   = errors.New("trojan: no password.")
+	ErrTrojanCommand  = errors.New("trojan: command not supported.")
+	ErrTrojanCRLF     = errors.New("trojan: crlf expected.")
+)
+
+// TrojanHash is hex of sha224 of password, sent by client first.
+func TrojanHash(password string) string {
+	sum := sha256.Sum224([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func readCRLF(r io.Reader) (err error) {
+	var buf [2]byte
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return
+	}
+	if buf[0] != '\r' || buf[1] != '\n' {
+		return ErrTrojanCRLF
+	}
+	return
+}
+
+// trojanRequest is hash, crlf, command, address in socks5, crlf.
+func trojanRequest(hash string, cmd byte, address string) (b []byte, err error) {
+	b = append([]byte(hash), '\r', '\n', cmd)
+	b, err = netutil.AppendSocks5Address(b, address)
+	if err != nil {
+		return
+	}
+	return append(b, '\r', '\n'), nil
+}
+
+// appendTrojanPacket appends udp packet in stream: address, length,
+// crlf, payload.
+func appendTrojanPacket(b []byte, address string, payload []byte) (pkt []byte, err error) {
+	pkt, err = netutil.AppendSocks5Address(b, address)
+	if err != nil {
+		return
+	}
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(payload)))
+	pkt = append(pkt, '\r', '\n')
+	return append(pkt, payload...), nil
+}
+
+func readTrojanPacket(r io.Reader, buf []byte) (address string, payload []byte, err error) {
+	address, err = netutil.ReadSocks5Address(r)
+	if err != nil {
+		return
+	}
+	var size [2]byte
+	_, err = io.ReadFull(r, size[:])
+	if err != nil {
+		return
+	}
+	err = readCRLF(r)
+	if err != nil {
+		return
+	}
+	payload = buf[:binary.BigEndian.Uint16(size[:])]
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+// TrojanServer serves trojan clients in tls connections, and connects
+// targets by dialer. Clients without password matched are passed to
+// Fallback, like a website, as if it's listening here. They are closed
+// if Fallback is empty.
+type TrojanServer struct {
+	netutil.Dialer
+	Fallback string
+	// Banner counts clients failed in auth, nil if not banning.
+	Banner *netutil.Banner
+	hashes map[string]bool
+}
+
+func NewTrojanServer(dialer netutil.Dialer, passwords []string, fallback string) (s *TrojanServer, err error) {
+	if len(passwords) == 0 {
+		return nil, ErrTrojanNoPass
+	}
+	s = &TrojanServer{
+		Dialer:   dialer,
+		Fallback: fallback,
+		hashes:   make(map[string]bool, len(passwords)),
+	}
+	for _, password := range passwords {
+		s.hashes[TrojanHash(password)] = true
+	}
+	return
+}
+
+// Serve relays clients in listener, which should be tls.
+func (s *TrojanServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// auth reads hash of password and crlf.
+func (s *TrojanServer) auth(r io.Reader) (err error) {
+	var hash [TROJAN_HASH_SIZE]byte
+	_, err = io.ReadFull(r, hash[:])
+	if err != nil {
+		return
+	}
+	if !s.hashes[string(hash[:])] {
+		return ErrTrojanPassword
+	}
+	return readCRLF(r)
+}
+
+func (s *TrojanServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+		err := tc.Handshake()
+		if err != nil {
+			logger.Errorf("trojan: tls with %s failed: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+
+	pc := newProbeConn(conn, HANDSHAKE_TIMEOUT)
+	err := s.auth(pc)
+	if err != nil {
+		authFailed(s.Banner, conn, "trojan", err)
+		if s.Fallback != "" {
+			pc.fallback(s.Fallback)
+		}
+		return
+	}
+	pc.finish()
+	authPassed(s.Banner, conn)
+
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	var cmd [1]byte
+	_, err = io.ReadFull(conn, cmd[:])
+	if err != nil {
+		return
+	}
+	address, err := netutil.ReadSocks5Address(conn)
+	if err != nil {
+		return
+	}
+	err = readCRLF(conn)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch cmd[0] {
+	case TROJAN_CONNECT:
+		var dstconn net.Conn
+		dstconn, err = s.Dialer.Dial("tcp", address)
+		if err != nil {
+			logger.Errorf("trojan: dial %s: %s", address, err.Error())
+			return
+		}
+		logger.Infof("trojan: %s connected to %s.", conn.RemoteAddr(), address)
+		netutil.Relay(conn, dstconn)
+	case TROJAN_UDP:
+		s.associate(conn)
+	default:
+		logger.Errorf("trojan: %s from %s", ErrTrojanCommand.Error(), conn.RemoteAddr())
+	}
+}
+
+// associate relays udp packets in stream, a flow for each target, until
+// stream closed.
+func (s *TrojanServer) associate(conn net.Conn) {
+	var wlock sync.Mutex
+	flows := make(map[string]net.Conn)
+	defer func() {
+		for _, dconn := range flows {
+			dconn.Close()
+		}
+	}()
+
+	buf := make([]byte, netutil.MAX_PACKET)
+	for {
+		address, payload, err := readTrojanPacket(conn, buf)
+		if err != nil {
+			return
+		}
+		dconn, ok := flows[address]
+		if !ok {
+			dconn, err = s.Dialer.Dial("udp", address)
+			if err != nil {
+				logger.Errorf("trojan: udp %s: %s", address, err.Error())
+				continue
+			}
+			flows[address] = dconn
+			go func(address string, dconn net.Conn) {
+				buf := make([]byte, netutil.MAX_PACKET)
+				for {
+					n, err := dconn.Read(buf)
+					if err != nil {
+						return
+					}
+					pkt, err := appendTrojanPacket(nil, address, buf[:n])
+					if err != nil {
+						return
+					}
+					wlock.Lock()
+					_, err = conn.Write(pkt)
+					wlock.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}(address, dconn)
+		}
+		_, err = dconn.Write(payload)
+		if err != nil {
+			logger.Debugf("trojan: udp %s: %s", address, err.Error())
+		}
+	}
+}
+
+// TrojanDialer connects through trojan server in tls, tcp in stream and
+// udp in packets over stream.
+type TrojanDialer struct {
+	netutil.Dialer
+	Server string
+	config *tls.Config
+	hash   string
+}
+
+// NewTrojanDialer verifies server by config, ServerName is host of
+// server if empty.
+func NewTrojanDialer(dialer netutil.Dialer, server, password string, config *tls.Config) (d *TrojanDialer, err error) {
+	if config.ServerName == "" {
+		var host string
+		host, _, err = net.SplitHostPort(server)
+		if err != nil {
+			return
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	return &TrojanDialer{Dialer: dialer, Server: server, config: config, hash: TrojanHash(password)}, nil
+}
+
+// Dial sends request with tls handshake, and doesn't wait for any reply.
+func (d *TrojanDialer) Dial(network, address string) (conn net.Conn, err error) {
+	cmd := byte(TROJAN_CONNECT)
+	udp := strings.HasPrefix(network, "udp")
+	if udp {
+		cmd = TROJAN_UDP
+	}
+	req, err := trojanRequest(d.hash, cmd, address)
+	if err != nil {
+		return
+	}
+	raw, err := d.Dialer.Dial("tcp", d.Server)
+	if err != nil {
+		return
+	}
+	raw.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	tc := tls.Client(raw, d.config)
+	_, err = tc.Write(req)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	if udp {
+		return &trojanPacketConn{Conn: tc, address: address}, nil
+	}
+	return tc, nil
+}
+
+// trojanPacketConn sends packets to a target in stream.
+type trojanPacketConn struct {
+	net.Conn
+	address string
+	rbuf    []byte
+}
+
+func (c *trojanPacketConn) Write(b []byte) (n int, err error) {
+	pkt, err := appendTrojanPacket(nil, c.address, b)
+	if err != nil {
+		return
+	}
+	_, err = c.Conn.Write(pkt)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *trojanPacketConn) Read(b []byte) (n int, err error) {
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, netutil.MAX_PACKET)
+	}
+	_, payload, err := readTrojanPacket(c.Conn, c.rbuf)
+	if err != nil {
+		return
+	}
+	return copy(b, payload), nil
+}
+
+// newTrojanUpstream takes trojan://password@host:port, with sni in
+// query for name of server, allowInsecure=1 for not verifying it.
+func newTrojanUpstream(dialer netutil.Dialer, u *url.URL) (netutil.Dialer, error) {
+	q := u.Query()
+	config := &tls.Config{
+		ServerName: q.Get("sni"),
+		MinVersion: tls.VersionTLS12,
+	}
+	switch q.Get("allowInsecure") {
+	case "1", "true":
+		config.InsecureSkipVerify = true
+	}
+	return NewTrojanDialer(dialer, u.Host, u.User.Username(), config)
+}
+
+func init() {
+	netutil.RegisterUpstream("trojan", newTrojanUpstream)
+}
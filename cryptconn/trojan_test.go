@@ -0,0 +1,183 @@
+package cryptconn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func tcpEcho(t *testing.T) net.Listener {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return echo
+}
+
+func TestTrojan(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	// decoy echoes, so request of prober comes back.
+	decoy := tcpEcho(t)
+	defer decoy.Close()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tls.NewListener(raw, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	defer listener.Close()
+	s, err := NewTrojanServer(&net.Dialer{}, []string{"pass"}, decoy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+
+	_, port, _ := net.SplitHostPort(raw.Addr().String())
+	dialer, err := netutil.NewUpstreamDialer(&net.Dialer{}, "trojan://pass@localhost:"+port+"?allowInsecure=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("not relayed: %q %v", buf, err)
+	}
+	conn.Close()
+
+	conn, err = tls.Dial("tcp", raw.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := "GET / HTTP/1.1\r\nHost: localhost\r\nUser-Agent: " + strings.Repeat("x", 64) + "\r\n\r\n"
+	conn.Write([]byte(req))
+	buf = make([]byte, len(req))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != req {
+		t.Fatalf("not fallback: %q %v", buf, err)
+	}
+}
+
+func TestTrojanUdp(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tls.NewListener(raw, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	defer listener.Close()
+	s, _ := NewTrojanServer(&net.Dialer{}, []string{"pass"}, "")
+	go s.Serve(listener)
+
+	dialer, _ := NewTrojanDialer(&net.Dialer{}, raw.Addr().String(), "pass",
+		&tls.Config{InsecureSkipVerify: true})
+	conn, err := dialer.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("not relayed: %q %v", buf[:n], err)
+	}
+}
+
+func TestTrojanAuthFailed(t *testing.T) {
+	var buf bytes.Buffer
+	netutil.DefaultAuditLogger = netutil.NewAuditLogger(&buf)
+	defer func() { netutil.DefaultAuditLogger = nil }()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tls.NewListener(raw, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	defer listener.Close()
+	s, err := NewTrojanServer(&net.Dialer{}, []string{"pass"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Banner = netutil.NewBanner(1, time.Minute)
+	go s.Serve(listener)
+
+	conn, err := tls.Dial("tcp", raw.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(TrojanHash("wrong") + "\r\n"))
+	// server closes it after auth failed.
+	io.Copy(io.Discard, conn)
+
+	if !s.Banner.Banned(conn.LocalAddr()) {
+		t.Fatal("client not banned.")
+	}
+	if !strings.Contains(buf.String(), `"Event":"auth_fail"`) {
+		t.Fatalf("auth failure not audited: %s", buf.String())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shell909090/goproxy/connpool"
+	"github.com/shell909090/goproxy/ipfilter"
+)
+
+var ErrAdminNoAuth = errors.New("admin: adminuser needed if adminiface is not loopback or unix socket.")
+
+var started = time.Now()
+
+// AdminStatus is what /api/status replies. Dialers are named pools of
+// client, Filters are ipfilter lists loaded.
+type AdminStatus struct {
+	Mode     string
+	Started  time.Time
+	Uptime   string
+	Sessions int
+	Streams  int
+	Dialers  map[string]connpool.PoolStatus `json:",omitempty"`
+	Filters  []ipfilter.FilterStatus        `json:",omitempty"`
+	Portmaps int
+}
+
+func newAdminStatus(mode string, pool *connpool.Pool) (status *AdminStatus) {
+	ps := pool.Status()
+	status = &AdminStatus{
+		Mode:     mode,
+		Started:  started,
+		Uptime:   time.Since(started).Round(time.Second).String(),
+		Sessions: ps.Sessions,
+		Streams:  ps.Streams,
+	}
+	return
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// handlerStatus replies status collected each time it's requested.
+func handlerStatus(collect func() *AdminStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeJson(w, collect())
+	}
+}
+
+// localAddrs tells if all addresses are loopback or unix socket.
+func localAddrs(addrs string) bool {
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if strings.HasPrefix(addr, "unix://") {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		if host == "localhost" {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// adminHandler requires basic auth of AdminUser and AdminPassword before
+// handler. AdminUser can be empty only if AdminIface is local.
+func (cfg *Config) adminHandler(handler http.Handler) (http.Handler, error) {
+	if cfg.AdminUser == "" {
+		if !localAddrs(cfg.AdminIface) {
+			return nil, ErrAdminNoAuth
+		}
+		return handler, nil
+	}
+	user, password := []byte(cfg.AdminUser), []byte(cfg.AdminPassword)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		// evaluate both, not to tell which one is wrong by time.
+		userOk := subtle.ConstantTimeCompare([]byte(u), user)
+		passOk := subtle.ConstantTimeCompare([]byte(p), password)
+		if !ok || userOk&passOk != 1 {
+			logger.Warningf("admin auth failed from %s.", req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="goproxy admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}), nil
+}
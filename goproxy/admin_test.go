@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	for iface, ok := range map[string]bool{
+		"127.0.0.1:5234":                true,
+		"[::1]:5234":                    true,
+		"localhost:5234":                true,
+		"unix:///run/goproxy.sock":      true,
+		"127.0.0.1:5234,unix:///a.sock": true,
+		":5234":                         false,
+		"0.0.0.0:5234":                  false,
+		"192.168.1.1:5234":              false,
+		"127.0.0.1:5234,:5235":          false,
+	} {
+		cfg := &Config{AdminIface: iface}
+		_, err := cfg.adminHandler(http.NewServeMux())
+		if (err == nil) != ok {
+			t.Fatalf("%s without auth: %v", iface, err)
+		}
+	}
+
+	cfg := &Config{AdminIface: ":5234", AdminUser: "admin", AdminPassword: "secret"}
+	handler, err := cfg.adminHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for password, code := range map[string]int{"secret": 200, "wrong": 401} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("admin", password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Fatalf("password %s: %d", password, w.Code)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// RECENT_SIZE is requests kept for routing decisions in dashboard.
+const RECENT_SIZE = 100
+
+// str_dashboard polls apis of admin interface, those not found in this
+// mode are left empty. Rates of hosts are computed from bytes between
+// two polls.
+const str_dashboard = `<!DOCTYPE html>
+<html>
+  <head>
+    <title>goproxy dashboard</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <style>
+      body { font-family: sans-serif; font-size: 13px; margin: 1em; }
+      h2 { font-size: 15px; margin: 1.2em 0 0.4em; }
+      table { border-collapse: collapse; width: 100%; }
+      th, td { text-align: left; padding: 2px 8px; border-bottom: 1px solid #ddd; }
+      td.n { text-align: right; }
+      pre { background: #f4f4f4; padding: 0.5em; max-height: 30em; overflow: auto; }
+    </style>
+  </head>
+  <body>
+    <div id="status"></div>
+    <h2>Sessions</h2>
+    <table id="sessions"></table>
+    <h2>Hosts</h2>
+    <table id="hosts"></table>
+    <h2>Recent requests</h2>
+    <table id="recent"></table>
+    <h2>Log</h2>
+    <pre id="logs"></pre>
+    <script>
+var INTERVAL = 2000;
+var last = {}, lastTime = 0;
+
+function size(n) {
+  var units = ["B", "KB", "MB", "GB", "TB"], i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i ? 1 : 0) + units[i];
+}
+
+function fill(id, head, rows) {
+  var table = document.getElementById(id);
+  table.textContent = "";
+  var tr = table.insertRow();
+  head.forEach(function(h) {
+    var th = document.createElement("th");
+    th.textContent = h;
+    tr.appendChild(th);
+  });
+  rows.forEach(function(row) {
+    var tr = table.insertRow();
+    row.forEach(function(v) {
+      var td = tr.insertCell();
+      td.textContent = v;
+      if (typeof v === "number") td.className = "n";
+    });
+  });
+}
+
+function get(path, f) {
+  fetch(path, {credentials: "same-origin"}).then(function(resp) {
+    if (resp.ok) return resp.json().then(f);
+  }).catch(function() {});
+}
+
+function poll() {
+  get("api/status", function(st) {
+    document.getElementById("status").textContent =
+      st.Mode + ", up " + st.Uptime + ", " + st.Sessions + " sessions, " +
+      st.Streams + " streams";
+  });
+  get("api/sessions", function(sessions) {
+    fill("sessions", ["Name", "Uptime", "Streams", "Sent", "Recv"],
+      (sessions || []).map(function(s) {
+        return [s.Name, Math.round(s.Uptime) + "s", (s.Streams || []).length,
+          size(s.Sent), size(s.Recv)];
+      }));
+  });
+  get("api/hosts?top=20", function(hosts) {
+    var now = Date.now(), secs = (now - lastTime) / 1000, cur = {};
+    fill("hosts", ["Host", "Requests", "Errors", "Sent", "Recv", "Rate"],
+      (hosts || []).map(function(h) {
+        var total = h.Sent + h.Recv, prev = last[h.Host];
+        cur[h.Host] = total;
+        var rate = prev === undefined ? "" : size((total - prev) / secs) + "/s";
+        return [h.Host, h.Requests, h.Errors, size(h.Sent), size(h.Recv), rate];
+      }));
+    last = cur;
+    lastTime = now;
+  });
+  get("api/recent", function(records) {
+    fill("recent", ["Time", "Client", "Method", "URL", "Status", "Dialer", "Bytes", "Seconds"],
+      (records || []).slice(0, 50).map(function(r) {
+        return [new Date(r.Time).toLocaleTimeString(), r.Client, r.Method, r.URL,
+          r.Status, r.Dialer || "", size(r.Bytes), r.Duration.toFixed(3)];
+      }));
+  });
+  get("api/logs?n=50", function(lines) {
+    document.getElementById("logs").textContent = (lines || []).map(function(l) {
+      return new Date(l.Time).toLocaleTimeString() + " " + l.Level + ": " + l.Message;
+    }).join("\n");
+  });
+}
+
+poll();
+setInterval(poll, INTERVAL);
+    </script>
+  </body>
+</html>`
+
+func HandlerDashboard(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, str_dashboard)
+}
+
+// registerDashboard adds dashboard and logs it reads, to mux of admin
+// interface.
+func registerDashboard(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard", HandlerDashboard)
+	mux.HandleFunc("/api/logs", logTail.HandlerLogs)
+}
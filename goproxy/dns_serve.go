@@ -1,14 +1,32 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"net"
+
 	"github.com/miekg/dns"
 	mydns "github.com/shell909090/goproxy/dns"
 )
 
+var (
+	ErrNotExchanger = errors.New("dns: DefaultResolver not Exchanger.")
+	ErrNoResponse   = errors.New("dns: no response.")
+)
+
 type DnsServer struct {
 	mydns.Exchanger
 }
 
+// NewDnsServer answers queries by DefaultResolver, in mode of dnsnet.
+func NewDnsServer() (dnssrv *DnsServer, err error) {
+	exhg, ok := mydns.DefaultResolver.(mydns.Exchanger)
+	if !ok {
+		return nil, ErrNotExchanger
+	}
+	return &DnsServer{Exchanger: exhg}, nil
+}
+
 func (dnssrv *DnsServer) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
 	logger.Debugf("dns server query: %s", quiz.Question[0].Name)
 	resp, err := dnssrv.Exchanger.Exchange(quiz)
@@ -25,20 +43,77 @@ func (dnssrv *DnsServer) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
 	return
 }
 
-func RunDnsServer(addr string) {
-	handler := new(DnsServer)
-	exhg, ok := mydns.DefaultResolver.(mydns.Exchanger)
-	handler.Exchanger = exhg
-	if !ok {
-		panic("DefaultResolver not Exchanger?")
+// Answer answers a query in udp packet.
+func (dnssrv *DnsServer) Answer(query []byte) (resp []byte, err error) {
+	quiz := new(dns.Msg)
+	err = quiz.Unpack(query)
+	if err != nil {
+		return
 	}
+	if len(quiz.Question) > 0 {
+		logger.Debugf("dns hijacked query: %s", quiz.Question[0].Name)
+	}
+	msg, err := dnssrv.Exchanger.Exchange(quiz)
+	if err != nil {
+		return
+	}
+	if msg == nil {
+		return nil, ErrNoResponse
+	}
+	msg.Id = quiz.Id
+	return msg.Pack()
+}
 
-	server := &dns.Server{
-		Addr:    addr,
-		Net:     "udp",
-		Handler: handler,
+// ServeConn answers queries in tcp connection, until it's closed.
+func (dnssrv *DnsServer) ServeConn(conn net.Conn) {
+	dconn := &dns.Conn{Conn: conn}
+	for {
+		quiz, err := dconn.ReadMsg()
+		if err != nil {
+			if err != io.EOF {
+				logger.Error(err.Error())
+			}
+			return
+		}
+		if len(quiz.Question) > 0 {
+			logger.Debugf("dns hijacked query: %s", quiz.Question[0].Name)
+		}
+		resp, err := dnssrv.Exchanger.Exchange(quiz)
+		if err == nil && resp == nil {
+			err = ErrNoResponse
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		resp.Id = quiz.Id
+		err = dconn.WriteMsg(resp)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
+
+// RunDnsServer serves dns in udp and tcp of addr.
+func RunDnsServer(addr string) {
+	handler, err := NewDnsServer()
+	if err != nil {
+		panic(err.Error())
 	}
 
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: handler,
+		}
+		go func() {
+			err := server.ListenAndServe()
+			if err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
 	logger.Infof("dns server start.")
-	go server.ListenAndServe()
 }
@@ -1,37 +1,80 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	stdlog "log"
+	"net"
 	"os"
+	"time"
 
 	logging "github.com/op/go-logging"
+	"github.com/shell909090/goproxy/cryptconn"
 	"github.com/shell909090/goproxy/dns"
+	"github.com/shell909090/goproxy/netutil"
 )
 
 var logger = logging.MustGetLogger("")
 
 var (
 	ConfigFile string
+	NoiseKey   bool
 )
 
 type Config struct {
 	Mode   string
 	Listen string
+	// Acceptors is listeners in Listen sharing ports by SO_REUSEPORT,
+	// each has its own accept loop.
+	Acceptors int
 
 	Logfile    string
 	Loglevel   string
 	AdminIface string
+	// AdminUser and AdminPassword are basic auth of admin interface.
+	AdminUser     string
+	AdminPassword string
 
 	DnsAddrs []string
 	DnsNet   string
+
+	Fips bool
+
+	// BindInterface and BindAddr make direct connections from this
+	// interface or source address.
+	BindInterface string
+	BindAddr      string
+	// FwMark is set as SO_MARK of direct connections.
+	FwMark int
+	// DialRetry is times to retry direct dialing failed for transient
+	// errors.
+	DialRetry int
+	// MaxDials limits direct dials in flight, others wait up to
+	// DialWait seconds.
+	MaxDials int
+	DialWait int
+	// BufferSize is size of buffers in copy and tunnel frames.
+	BufferSize int
+}
+
+// serveAll runs serve in each listener, and returns when any of them
+// returned.
+func serveAll(listeners []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- serve(listener)
+		}(listener)
+	}
+	return <-errs
 }
 
 func init() {
 	flag.StringVar(&ConfigFile, "config", "/etc/goproxy/config.json", "config file")
-	flag.Parse()
+	flag.BoolVar(&NoiseKey, "noisekey", false, "generate a key pair for noise and quit")
 }
 
 func LoadJson(configfile string, cfg interface{}) (err error) {
@@ -52,9 +95,39 @@ func LoadConfig() (cfg *Config, err error) {
 	if err != nil {
 		return
 	}
+	err = resolveSecrets(&cfg.AdminPassword)
 	return
 }
 
+// KeyConfig holds the psk, or passphrase to derive it from.
+type KeyConfig struct {
+	Key        string
+	Passphrase string
+	Salt       string
+	Kdf        string
+}
+
+// GetKey returns key in config, or derives one from passphrase.
+func (kc *KeyConfig) GetKey(cipher string) (key string, err error) {
+	if kc.Key != "" || kc.Passphrase == "" {
+		return kc.Key, nil
+	}
+	return cryptconn.DeriveKey(kc.Kdf, cipher, kc.Passphrase, kc.Salt)
+}
+
+// setDialRetry limits direct dials in flight, and makes them retry
+// transient errors. It should be called after DefaultTcpDialer set.
+func (cfg *Config) setDialRetry() {
+	if cfg.MaxDials > 0 {
+		netutil.DefaultTcpDialer = netutil.NewLimitDialer(netutil.DefaultTcpDialer,
+			cfg.MaxDials, time.Duration(cfg.DialWait)*time.Second)
+	}
+	if cfg.DialRetry > 0 {
+		netutil.DefaultTcpDialer = netutil.NewRetryDialer(
+			netutil.DefaultTcpDialer, cfg.DialRetry)
+	}
+}
+
 func SetLogging(cfg *Config) (err error) {
 	var file *os.File
 	file = os.Stdout
@@ -67,7 +140,8 @@ func SetLogging(cfg *Config) (err error) {
 	}
 	logBackend := logging.NewLogBackend(file, "",
 		stdlog.LstdFlags|stdlog.Lmicroseconds|stdlog.Lshortfile)
-	logging.SetBackend(logBackend)
+	// logTail is leveled as logBackend, for dashboard.
+	logging.SetBackend(logBackend, logTail)
 
 	logging.SetFormatter(logging.MustStringFormatter("%{level}: %{message}"))
 
@@ -80,7 +154,29 @@ func SetLogging(cfg *Config) (err error) {
 	return
 }
 
+func genNoiseKey() {
+	private := make([]byte, cryptconn.DHLEN)
+	_, err := rand.Read(private)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(private)
+	public, err := cryptconn.NoisePublicKey(key)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Printf("private: %s\npublic: %s\n", key, public)
+}
+
 func main() {
+	flag.Parse()
+	if NoiseKey {
+		genNoiseKey()
+		return
+	}
+
 	basecfg, err := LoadConfig()
 	if err != nil {
 		fmt.Println(err.Error())
@@ -92,6 +188,32 @@ func main() {
 		return
 	}
 
+	if basecfg.Fips {
+		cryptconn.FipsMode = true
+	}
+	if cryptconn.FipsMode {
+		logger.Notice("fips mode on.")
+	}
+
+	if basecfg.BufferSize != 0 {
+		err = netutil.SetBufferSize(basecfg.BufferSize)
+		if err != nil {
+			logger.Error("%s", err)
+			return
+		}
+	}
+
+	if basecfg.BindInterface != "" || basecfg.BindAddr != "" || basecfg.FwMark != 0 {
+		var bd *netutil.BindDialer
+		bd, err = netutil.NewBindDialer(basecfg.BindInterface, basecfg.BindAddr)
+		if err != nil {
+			logger.Error("%s", err)
+			return
+		}
+		bd.Mark = basecfg.FwMark
+		netutil.DefaultTcpDialer = netutil.NewEyeballsDialer(bd)
+	}
+
 	switch basecfg.DnsNet {
 	case "https":
 		dns.DefaultResolver, err = dns.NewHttpsDns(nil)
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
@@ -120,3 +121,43 @@ func testURL(myClient *http.Client, url string) (err error) {
 	// logger.Debug(string(b))
 	return
 }
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("GOPROXY_TEST_SECRET", "fromenv")
+	file := filepath.Join(t.TempDir(), "secret")
+	ioutil.WriteFile(file, []byte("fromfile\n"), 0600)
+
+	for value, expected := range map[string]string{
+		"plain":                     "plain",
+		"env://GOPROXY_TEST_SECRET": "fromenv",
+		"file://" + file:            "fromfile",
+		"cmd://echo fromcmd":        "fromcmd",
+	} {
+		secret, err := ResolveSecret(value)
+		if err != nil {
+			t.Fatalf("%s: %s", value, err)
+		}
+		if secret != expected {
+			t.Fatalf("%s resolved to %s", value, secret)
+		}
+	}
+
+	os.Chmod(file, 0644)
+	if _, err := ResolveSecret("file://" + file); err == nil {
+		t.Fatal("secret file readable by others accepted.")
+	}
+}
+
+func TestCheckTotpSecret(t *testing.T) {
+	for value, ok := range map[string]bool{
+		"":                   true,
+		"file:///etc/totp":   true,
+		"cmd://pass totp":    true,
+		"GEZDGNBVGY3TQOJQ":   false,
+		"env://GOPROXY_TOTP": false,
+	} {
+		if (checkTotpSecret(value) == nil) != ok {
+			t.Fatalf("%s: accepted %v", value, !ok)
+		}
+	}
+}
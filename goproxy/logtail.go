@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+// LOG_TAIL is lines of log kept in memory for dashboard.
+const LOG_TAIL = 200
+
+type LogLine struct {
+	Time    time.Time
+	Level   string
+	Module  string
+	Message string
+}
+
+// LogTail is a backend of logging keeping the last lines.
+type LogTail struct {
+	lock  sync.Mutex
+	lines []LogLine
+	next  int
+	full  bool
+}
+
+var logTail = NewLogTail(LOG_TAIL)
+
+func NewLogTail(size int) (lt *LogTail) {
+	return &LogTail{lines: make([]LogLine, size)}
+}
+
+func (lt *LogTail) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	line := LogLine{
+		Time:    rec.Time,
+		Level:   level.String(),
+		Module:  rec.Module,
+		Message: rec.Message(),
+	}
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.lines[lt.next] = line
+	lt.next++
+	if lt.next == len(lt.lines) {
+		lt.next = 0
+		lt.full = true
+	}
+	return nil
+}
+
+// Tail returns the last n lines, the oldest first. All kept if n is 0.
+func (lt *LogTail) Tail(n int) (lines []LogLine) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	size := lt.next
+	if lt.full {
+		size = len(lt.lines)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+	lines = make([]LogLine, 0, n)
+	for i := n; i > 0; i-- {
+		lines = append(lines, lt.lines[(lt.next-i+len(lt.lines))%len(lt.lines)])
+	}
+	return
+}
+
+// HandlerLogs lists lines of log in json, parameter n limits lines.
+func (lt *LogTail) HandlerLogs(w http.ResponseWriter, req *http.Request) {
+	n, _ := strconv.Atoi(req.URL.Query().Get("n"))
+	writeJson(w, lt.Tail(n))
+}
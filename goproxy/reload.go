@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	logging "github.com/op/go-logging"
+	"github.com/shell909090/goproxy/connpool"
+	"github.com/shell909090/goproxy/ipfilter"
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/portmapper"
+	"github.com/shell909090/goproxy/proxy"
+)
+
+var (
+	ErrReloadMode = errors.New("reload: mode changed, restart needed.")
+	ErrListenLost = errors.New("reload: listener lost in restarting.")
+)
+
+var (
+	// clientRestartKeys are those of client config can't be applied
+	// without restarting.
+	clientRestartKeys = []string{
+		"Logfile", "AdminIface", "AdminUser", "AdminPassword",
+		"DnsAddrs", "DnsNet", "Fips", "BindInterface", "BindAddr",
+		"FwMark", "DialRetry", "MaxDials", "DialWait", "BufferSize",
+		"MinSess", "MaxConn", "MaxIdle", "MaxAge", "ValidateIdle",
+		"MaxWait", "Order", "FlushWindow", "DrainGrace", "Warmup",
+		"CacheMemory", "CacheDir", "CacheDisk", "CacheObject",
+		"TunName", "TunAddr", "DnsHijack", "DnsServer",
+		"VirtualHosts", "ReverseListen", "ReverseTlsListen",
+		"PortmapFile",
+	}
+	// listener keys restart listeners of them when changed. Limits of
+	// http are applied to server, not requests.
+	mainKeys = []string{
+		"Listen", "Acceptors", "Http2",
+		"HttpMaxHeader", "HttpHeaderTimeout", "HttpIdleTimeout",
+	}
+	httpsKeys = []string{
+		"HttpsListen", "HttpsCert", "HttpsKey", "Acceptors",
+		"HttpMaxHeader", "HttpHeaderTimeout", "HttpIdleTimeout",
+	}
+	socksKeys       = []string{"SocksListen", "Acceptors"}
+	transparentKeys = []string{"TransparentListen", "TransparentMode"}
+	accessKeys      = []string{"AccessLog", "AccessFormat", "AccessLogSize"}
+	mitmKeys        = []string{"MitmCert", "MitmKey", "MitmBypass"}
+	icapKeys        = []string{"IcapReqMod", "IcapRespMod", "IcapBypass", "IcapMaxBody"}
+	throttleKeys    = []string{"ClientUpRate", "ClientDownRate", "ClientBurst", "ThrottleBy"}
+	// user file is reloaded by UserDB itself once modified.
+	userKeys = []string{"HttpUserFile"}
+)
+
+// changed returns names of fields differ in struct a and b, which are
+// pointers of the same type.
+func changed(a, b interface{}, names ...string) (diff []string) {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for _, name := range names {
+		if !reflect.DeepEqual(va.FieldByName(name).Interface(),
+			vb.FieldByName(name).Interface()) {
+			diff = append(diff, name)
+		}
+	}
+	return
+}
+
+// setFields copies fields of names from src to dst, which are pointers
+// of the same type.
+func setFields(dst, src interface{}, names ...string) {
+	vd, vs := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for _, name := range names {
+		vd.FieldByName(name).Set(vs.FieldByName(name))
+	}
+}
+
+// service serves listeners in background, till any of them failed or
+// they are closed.
+type service struct {
+	listeners []net.Listener
+	done      chan struct{}
+	err       error
+	closed    int32
+}
+
+func newService(listeners []net.Listener, serve func(net.Listener) error) (svc *service) {
+	svc = &service{listeners: listeners, done: make(chan struct{})}
+	go func() {
+		err := serveAll(listeners, serve)
+		if atomic.LoadInt32(&svc.closed) == 0 {
+			svc.err = err
+		}
+		close(svc.done)
+	}()
+	return
+}
+
+// Wait returns error of listeners, nil if closed by Close.
+func (svc *service) Wait() error {
+	<-svc.done
+	return svc.err
+}
+
+// Close stops accepting, connections accepted are not affected. It's
+// fine to close nil service.
+func (svc *service) Close() {
+	if svc == nil {
+		return
+	}
+	atomic.StoreInt32(&svc.closed, 1)
+	for _, listener := range svc.listeners {
+		listener.Close()
+	}
+	<-svc.done
+}
+
+// ReloadResult tells parts of config applied, and keys changed but
+// need restart.
+type ReloadResult struct {
+	Applied []string
+	Restart []string
+}
+
+// client keeps what RunHttproxy built, for config reloaded to apply
+// changes only.
+type client struct {
+	lock    sync.Mutex
+	cfg     *ClientConfig
+	pool    *connpool.Dialer
+	named   map[string]*connpool.Dialer
+	dialer  netutil.Dialer
+	fdialer *ipfilter.FilteredDialer
+	mapper  *portmapper.Manager
+	stats   *proxy.HostStats
+	recent  *proxy.RecentLog
+	swap    *proxy.Swap
+	// listened is config each listener restarted in by reload.
+	listened map[string]*ClientConfig
+
+	main        *service
+	https       *service
+	socks       *service
+	transparent *service
+}
+
+// wait returns when main listeners stopped, but not by restarting.
+func (c *client) wait() (err error) {
+	for {
+		c.lock.Lock()
+		svc := c.main
+		c.lock.Unlock()
+		if svc == nil {
+			return ErrListenLost
+		}
+		err = svc.Wait()
+		c.lock.Lock()
+		restarted := c.main != svc
+		c.lock.Unlock()
+		if !restarted {
+			return
+		}
+	}
+}
+
+// restart closes service in svc, and starts it by start in config. If
+// failed, it's started in old config again.
+func (c *client) restart(svc **service, old, cfg *ClientConfig, start func(*ClientConfig) (*service, error)) (err error) {
+	(*svc).Close()
+	*svc, err = start(cfg)
+	if err == nil {
+		return
+	}
+	var e error
+	*svc, e = start(old)
+	if e != nil {
+		logger.Errorf("restore listener: %s", e.Error())
+	}
+	return
+}
+
+func (c *client) startMain(cfg *ClientConfig) (svc *service, err error) {
+	listeners, err := netutil.ListenN(cfg.Listen, cfg.Acceptors)
+	if err != nil {
+		return
+	}
+	return newService(listeners, c.swap.NewServer(cfg.Http2).Serve), nil
+}
+
+func (c *client) startHttps(cfg *ClientConfig) (svc *service, err error) {
+	if cfg.HttpsListen == "" {
+		return
+	}
+	return cfg.runHttps(c.swap)
+}
+
+func (c *client) startSocks(cfg *ClientConfig) (svc *service, err error) {
+	if cfg.SocksListen == "" {
+		return
+	}
+	return cfg.serveBackground(cfg.SocksListen, c.swap.ServeSocks5)
+}
+
+func (c *client) startTransparent(cfg *ClientConfig) (svc *service, err error) {
+	if cfg.TransparentListen == "" {
+		return
+	}
+	return cfg.runTransparent(c.swap)
+}
+
+// Reload applies changes of config. Servers changed get new sessions,
+// the old ones are closed once their streams done. Filters are read
+// again and swapped, proxy rebuilt for new requests, and listeners
+// changed restarted. Others are kept with their connections.
+// If any part failed, those applied before it are kept in config of
+// client and result, and the rest are left as they were.
+func (c *client) Reload(cfg *ClientConfig) (result *ReloadResult, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.cfg
+	if cfg.Mode != old.Mode {
+		return nil, ErrReloadMode
+	}
+	result = &ReloadResult{
+		Restart: changed(old, cfg, clientRestartKeys...),
+	}
+
+	// parts can't be undone are checked before any applied.
+	var lv logging.Level
+	if cfg.Loglevel != old.Loglevel {
+		lv, err = logging.LogLevel(cfg.Loglevel)
+		if err != nil {
+			return
+		}
+	}
+	serversChanged := len(changed(old, cfg, "Servers")) > 0
+	if serversChanged {
+		err = cfg.checkServers(c.named)
+		if err != nil {
+			return
+		}
+	}
+
+	applied := *old
+	defer func() {
+		if err != nil {
+			c.cfg = &applied
+		}
+	}()
+
+	if cfg.Loglevel != old.Loglevel {
+		logging.SetLevel(lv, "")
+		setFields(&applied, cfg, "Loglevel")
+		result.Applied = append(result.Applied, "Loglevel")
+	}
+
+	if serversChanged {
+		var named []string
+		named, err = cfg.setCreators(c.pool, c.named, old)
+		if err != nil {
+			return
+		}
+		for _, name := range named {
+			c.mapper.SetDialer(name, c.named[name])
+		}
+		setFields(&applied, cfg, "Servers")
+		result.Applied = append(result.Applied, "Servers")
+	}
+
+	// applied whatever changed or not, files of them are read again.
+	c.mapper.Sync(cfg.Portmaps)
+	setFields(&applied, cfg, "Portmaps")
+	result.Applied = append(result.Applied, "Portmaps")
+
+	switch {
+	case (old.Blackfile == "") != (cfg.Blackfile == ""):
+		result.Restart = append(result.Restart, "Blackfile")
+	case cfg.Blackfile == "":
+	case cfg.Blackfile == old.Blackfile:
+		err = c.fdialer.Reload()
+	default:
+		err = c.fdialer.SetFilter(netutil.NewNamedDialer(
+			portmapper.DIALER_DIRECT, netutil.DefaultTcpDialer), cfg.Blackfile)
+	}
+	if err != nil {
+		return
+	}
+	if cfg.Blackfile != "" && old.Blackfile != "" {
+		setFields(&applied, cfg, "Blackfile")
+		result.Applied = append(result.Applied, "Blackfile")
+	}
+
+	oldp := c.swap.Get()
+	p, _, err := c.newProxy(cfg, oldp)
+	if err != nil {
+		if p != nil && p.AccessLog != oldp.AccessLog && p.AccessLog != nil {
+			p.AccessLog.Close()
+		}
+		if p != nil && p.Users != oldp.Users {
+			closeUsers(p.Users)
+		}
+		return
+	}
+	c.swap.Set(p)
+	if p.AccessLog != oldp.AccessLog && oldp.AccessLog != nil {
+		oldp.AccessLog.Close()
+	}
+	if p.Users != oldp.Users {
+		closeUsers(oldp.Users)
+	}
+	setFields(&applied, cfg, accessKeys...)
+	setFields(&applied, cfg, mitmKeys...)
+	setFields(&applied, cfg, icapKeys...)
+	setFields(&applied, cfg, throttleKeys...)
+	setFields(&applied, cfg, userKeys...)
+	setFields(&applied, cfg, "ErrorPages")
+	result.Applied = append(result.Applied, "Proxy")
+
+	for _, s := range []struct {
+		name  string
+		svc   **service
+		keys  []string
+		start func(*ClientConfig) (*service, error)
+	}{
+		{"Listen", &c.main, mainKeys, c.startMain},
+		{"HttpsListen", &c.https, httpsKeys, c.startHttps},
+		{"SocksListen", &c.socks, socksKeys, c.startSocks},
+		{"TransparentListen", &c.transparent, transparentKeys, c.startTransparent},
+	} {
+		// listeners share keys, so config each started in is kept
+		// apart.
+		from, ok := c.listened[s.name]
+		if !ok {
+			from = old
+		}
+		if len(changed(from, cfg, s.keys...)) == 0 {
+			continue
+		}
+		err = c.restart(s.svc, from, cfg, s.start)
+		if err != nil {
+			return
+		}
+		if c.listened == nil {
+			c.listened = make(map[string]*ClientConfig, 0)
+		}
+		c.listened[s.name] = cfg
+		result.Applied = append(result.Applied, s.name)
+	}
+
+	c.cfg = cfg
+	return
+}
+
+// closeUsers stops reloading of user file, if users are read from it.
+func closeUsers(v proxy.Verifier) {
+	if cl, ok := v.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// reload reads config file again and applies it.
+func (c *client) reload() (result *ReloadResult, err error) {
+	basecfg, err := LoadConfig()
+	if err != nil {
+		return
+	}
+	cfg, err := LoadClientConfig(basecfg)
+	if err != nil {
+		return
+	}
+	result, err = c.Reload(cfg)
+	if err != nil {
+		if result != nil && len(result.Applied) > 0 {
+			logger.Warningf("config partly reloaded, applied: %s.", strings.Join(result.Applied, ", "))
+		}
+		return
+	}
+	logger.Noticef("config reloaded, applied: %s.", strings.Join(result.Applied, ", "))
+	if len(result.Restart) > 0 {
+		logger.Warningf("restart to apply: %s.", strings.Join(result.Restart, ", "))
+	}
+	return
+}
+
+// HandlerReload reloads config file, and replies result.
+func (c *client) HandlerReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	logger.Notice("config reload by admin.")
+	result, err := c.reload()
+	if err != nil {
+		logger.Errorf("reload config: %s", err.Error())
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJson(w, result)
+}
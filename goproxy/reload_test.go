@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	logging "github.com/op/go-logging"
+	"github.com/shell909090/goproxy/connpool"
+	"github.com/shell909090/goproxy/portmapper"
+	"github.com/shell909090/goproxy/proxy"
+)
+
+const testKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+
+// newTestClient makes client of cfg as RunHttproxy, with main listener
+// only.
+func newTestClient(t *testing.T, cfg *ClientConfig) (c *client) {
+	pool := cfg.newPool(0)
+	c = &client{
+		cfg:    cfg,
+		pool:   pool,
+		named:  make(map[string]*connpool.Dialer, 0),
+		dialer: pool,
+	}
+	_, err := cfg.setCreators(pool, c.named, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mapper = portmapper.NewManager(pool)
+	p, _, err := c.newProxy(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.swap = proxy.NewSwap(p)
+	c.main, err = c.startMain(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.main.Close()
+		c.socks.Close()
+	})
+	return
+}
+
+func testClientConfig() (cfg *ClientConfig) {
+	cfg = &ClientConfig{}
+	cfg.Mode = "http"
+	cfg.Loglevel = "WARNING"
+	cfg.Listen = "127.0.0.1:0"
+	return
+}
+
+func testServer(name string) (srv *ServerDefine) {
+	srv = &ServerDefine{Name: name, Server: "127.0.0.1:1"}
+	srv.Key = testKey
+	return
+}
+
+func TestReloadCheckFailed(t *testing.T) {
+	c := newTestClient(t, testClientConfig())
+	old := c.cfg
+	lv := logging.GetLevel("")
+
+	cfg := testClientConfig()
+	cfg.Loglevel = "INFO"
+	srv := testServer("a")
+	srv.Via = "nosuch"
+	cfg.Servers = []*ServerDefine{srv}
+	_, err := c.Reload(cfg)
+	if err != ErrViaNotFound {
+		t.Fatalf("reload with via not found: %v", err)
+	}
+	if c.cfg != old || logging.GetLevel("") != lv {
+		t.Fatal("config changed")
+	}
+	if len(c.named) != 0 {
+		t.Fatal("pool added")
+	}
+}
+
+func TestReloadListenFailed(t *testing.T) {
+	c := newTestClient(t, testClientConfig())
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	cfg := testClientConfig()
+	cfg.Loglevel = "INFO"
+	cfg.Servers = []*ServerDefine{testServer("a")}
+	cfg.SocksListen = busy.Addr().String()
+	result, err := c.Reload(cfg)
+	if err == nil {
+		t.Fatal("reload with listen in use")
+	}
+	if c.cfg == cfg {
+		t.Fatal("config failed taken")
+	}
+	if c.cfg.Loglevel != "INFO" || len(c.cfg.Servers) != 1 {
+		t.Fatal("parts applied not in config")
+	}
+	if c.cfg.SocksListen != "" || c.socks != nil {
+		t.Fatal("socks started")
+	}
+	if len(result.Applied) == 0 || c.named["a"] == nil {
+		t.Fatal("servers not applied")
+	}
+
+	// only the part failed is tried again.
+	busy.Close()
+	result, err = c.Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cfg != cfg {
+		t.Fatal("config not taken")
+	}
+	for _, name := range result.Applied {
+		if name == "Servers" || name == "Loglevel" {
+			t.Fatalf("%s applied again", name)
+		}
+	}
+	if c.socks == nil {
+		t.Fatal("socks not started")
+	}
+}
+
+func TestReloadKeepProxy(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users")
+	ioutil.WriteFile(users, []byte("user:hash\n"), 0600)
+	newcfg := func() (cfg *ClientConfig) {
+		cfg = testClientConfig()
+		cfg.HttpUserFile = users
+		cfg.ClientUpRate = 1000
+		cfg.ErrorPages = dir
+		cfg.IcapReqMod = "icap://127.0.0.1/reqmod"
+		return
+	}
+	c := newTestClient(t, newcfg())
+	old := c.swap.Get()
+
+	_, err := c.Reload(newcfg())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.swap.Get()
+	if p == old {
+		t.Fatal("proxy not rebuilt")
+	}
+	if p.Users != old.Users || p.Throttle != old.Throttle ||
+		p.ErrorPages != old.ErrorPages || p.Icap != old.Icap {
+		t.Fatal("parts not changed rebuilt")
+	}
+
+	cfg := newcfg()
+	cfg.ClientUpRate = 2000
+	_, err = c.Reload(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = c.swap.Get()
+	if p.Throttle == old.Throttle || p.Throttle.UpRate != 2000 {
+		t.Fatal("throttle changed not rebuilt")
+	}
+	if p.Users != old.Users {
+		t.Fatal("users rebuilt")
+	}
+}
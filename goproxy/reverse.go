@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/proxy"
+)
+
+var ErrNoReverseCert = errors.New("reverse: tls listen but no virtual host has certificate.")
+
+// serveReverse serves listener in background, logs when it quits.
+func serveReverse(srv *http.Server, listener net.Listener, tls bool) {
+	var err error
+	if tls {
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != nil {
+		logger.Error("%s", err.Error())
+	}
+}
+
+// runReverse serves VirtualHosts in ReverseListen, and in
+// ReverseTlsListen with certificates of them.
+func (cfg *ClientConfig) runReverse(dialer netutil.Dialer, dialers map[string]netutil.Dialer) (err error) {
+	r := proxy.NewReverse(dialer)
+	for name, d := range dialers {
+		r.SetDialer(name, d)
+	}
+	for _, vh := range cfg.VirtualHosts {
+		err = r.AddHost(vh)
+		if err != nil {
+			return
+		}
+	}
+
+	if cfg.ReverseListen != "" {
+		var listener net.Listener
+		listener, err = netutil.Listen(cfg.ReverseListen)
+		if err != nil {
+			return
+		}
+		srv := &http.Server{Handler: r}
+		proxy.DefaultLimits.Apply(srv)
+		go serveReverse(srv, listener, false)
+	}
+	if cfg.ReverseTlsListen != "" {
+		config := r.TlsConfig()
+		if config == nil {
+			return ErrNoReverseCert
+		}
+		var listener net.Listener
+		listener, err = netutil.Listen(cfg.ReverseTlsListen)
+		if err != nil {
+			return
+		}
+		srv := &http.Server{Handler: r, TLSConfig: config}
+		proxy.DefaultLimits.Apply(srv)
+		go serveReverse(srv, listener, true)
+	}
+	return
+}
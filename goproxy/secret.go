@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	ErrSecretEnv  = errors.New("secret: environment variable not set")
+	ErrSecretMode = errors.New("secret: file readable by group or others")
+	ErrTotpSecret = errors.New("secret: totpsecret should be given by file:// or cmd://")
+)
+
+// ResolveSecret takes secret from where value refers:
+// env://NAME from environment, file:///path from a file which only
+// owner can read, cmd://command from output of a shell command.
+// Anything else is the secret itself. Trailing newline is removed.
+func ResolveSecret(value string) (secret string, err error) {
+	switch {
+	case strings.HasPrefix(value, "env://"):
+		name := strings.TrimPrefix(value, "env://")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s: %s", ErrSecretEnv, name)
+		}
+		return secret, nil
+
+	case strings.HasPrefix(value, "file://"):
+		path := strings.TrimPrefix(value, "file://")
+		var fi os.FileInfo
+		fi, err = os.Stat(path)
+		if err != nil {
+			return
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			return "", fmt.Errorf("%s: %s", ErrSecretMode, path)
+		}
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+
+	case strings.HasPrefix(value, "cmd://"):
+		cmd := exec.Command("/bin/sh", "-c", strings.TrimPrefix(value, "cmd://"))
+		cmd.Stderr = os.Stderr
+		var data []byte
+		data, err = cmd.Output()
+		if err != nil {
+			return
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// checkTotpSecret refuses totp secret in config itself. It's no second
+// factor if kept in the same file with password.
+func checkTotpSecret(value string) error {
+	if value == "" || strings.HasPrefix(value, "file://") || strings.HasPrefix(value, "cmd://") {
+		return nil
+	}
+	return ErrTotpSecret
+}
+
+// resolveSecrets replaces each value pointed in place.
+func resolveSecrets(values ...*string) (err error) {
+	for _, v := range values {
+		*v, err = ResolveSecret(*v)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (kc *KeyConfig) resolveSecrets() (err error) {
+	return resolveSecrets(&kc.Key, &kc.Passphrase)
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/shell909090/goproxy/connpool"
 	"github.com/shell909090/goproxy/cryptconn"
 	"github.com/shell909090/goproxy/dns"
+	"github.com/shell909090/goproxy/ipfilter"
+	"github.com/shell909090/goproxy/nat"
 	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/store"
+	"github.com/shell909090/goproxy/tunnel"
 )
 
 type ServerConfig struct {
@@ -17,12 +27,60 @@ type ServerConfig struct {
 	RootCAs     string
 	CertFile    string
 	CertKeyFile string
+	CertAuth    bool
 	ForceIPv4   bool
 	Cipher      string
-	Key         string
+	Obfs        string
+	ObfsHost    string
+	Handshake   int
+	ProbePolicy string
+	Fallback    string
+	Keys        []string
 	Auth        map[string]string
+	UserFile    string
+	AllowFile   string
+	BanFails    int
+	BanTime     int
+	Quotas      map[string]connpool.Quota
+	QuotaFile   string
+	StreamLog   string
+	AuditLog    string
+	DrainGrace  int
+	// SsListen serves shadowsocks clients in tcp and udp, by SsMethod
+	// like aes-256-gcm and SsPassword.
+	SsListen   string
+	SsMethod   string
+	SsPassword string
+	// TrojanListen serves trojan clients in tls with CertFile and
+	// CertKeyFile. Clients without any of TrojanPasswords are passed
+	// to TrojanFallback, like a website.
+	TrojanListen    string
+	TrojanPasswords []string
+	TrojanFallback  string
+	// PortMap maps ports of Listen in gateway, by upnp, natpmp or auto.
+	PortMap string
+	// Rendezvous registers server as RendezvousName in it, clients
+	// behind another nat are punched in by name.
+	Rendezvous     string
+	RendezvousName string
+	// RendezvousListen serves rendezvous for other servers and clients.
+	RendezvousListen string
+
+	Redis         string
+	RedisPassword string
+	RedisDB       int
+
+	KeyConfig
+	netutil.SockOpts
 }
 
+var (
+	ErrCertAuthNoCA     = errors.New("certauth needs tls mode with rootcas.")
+	ErrProbePolicy      = errors.New("unknown probe policy.")
+	ErrNoFallback       = errors.New("fallback policy needs fallback address.")
+	ErrNoRendezvousName = errors.New("rendezvous needs name to register.")
+)
+
 func LoadServerConfig(basecfg *Config) (cfg *ServerConfig, err error) {
 	err = LoadJson(ConfigFile, &cfg)
 	if err != nil {
@@ -32,39 +90,442 @@ func LoadServerConfig(basecfg *Config) (cfg *ServerConfig, err error) {
 	if cfg.Cipher == "" {
 		cfg.Cipher = "aes"
 	}
+	if cfg.DrainGrace == 0 {
+		cfg.DrainGrace = 10
+	}
+
+	err = cfg.KeyConfig.resolveSecrets()
+	if err != nil {
+		return
+	}
+	err = resolveSecrets(&cfg.RedisPassword)
+	if err != nil {
+		return
+	}
+	err = resolveSecrets(&cfg.SsPassword)
+	if err != nil {
+		return
+	}
+	for i := range cfg.TrojanPasswords {
+		err = resolveSecrets(&cfg.TrojanPasswords[i])
+		if err != nil {
+			return
+		}
+	}
+	if cfg.SsMethod == "" {
+		cfg.SsMethod = "aes-256-gcm"
+	}
+	for i := range cfg.Keys {
+		err = resolveSecrets(&cfg.Keys[i])
+		if err != nil {
+			return
+		}
+	}
+	for username, password := range cfg.Auth {
+		err = resolveSecrets(&password)
+		if err != nil {
+			return
+		}
+		cfg.Auth[username] = password
+	}
 	return
 }
 
-func RunServer(cfg *ServerConfig) (err error) {
-	dns.RegisterService()
+// filterListener makes listener tuned, and refuses clients not allowed
+// or banned.
+func (cfg *ServerConfig) filterListener(listener net.Listener, filter *ipfilter.IPFilter, banner *netutil.Banner) net.Listener {
+	listener = netutil.NewTunedListener(listener, &cfg.SockOpts)
+	if filter != nil {
+		listener = ipfilter.NewAllowListener(listener, filter)
+	}
+	if banner != nil {
+		listener = netutil.NewBanListener(listener, banner)
+	}
+	return listener
+}
 
-	listener, err := net.Listen("tcp4", cfg.Listen)
+// wrapListener makes listener of an acceptor, tuned, filtered and
+// encrypted as configured.
+func (cfg *ServerConfig) wrapListener(listener net.Listener, filter *ipfilter.IPFilter, banner *netutil.Banner, keys []string) (wrapped net.Listener, err error) {
+	listener = cfg.filterListener(listener, filter, banner)
+
+	if strings.ToLower(cfg.CryptMode) == "tls" {
+		return TlsListener(
+			listener, cfg.CertFile, cfg.CertKeyFile, cfg.RootCAs)
+	}
+
+	clistener, err := cryptconn.NewListener(listener, cfg.Cipher, keys...)
+	if err != nil {
+		return
+	}
+	clistener.Obfs, err = cryptconn.NewObfs(cfg.Obfs, cfg.ObfsHost)
 	if err != nil {
 		return
 	}
+	clistener.Banner = banner
+	if cfg.Handshake != 0 {
+		clistener.Timeout = time.Duration(cfg.Handshake) * time.Second
+	}
+	switch cfg.ProbePolicy {
+	case "":
+	case cryptconn.POLICY_CLOSE, cryptconn.POLICY_STALL:
+		clistener.Policy = cfg.ProbePolicy
+	case cryptconn.POLICY_FALLBACK:
+		if cfg.Fallback == "" {
+			return nil, ErrNoFallback
+		}
+		clistener.Policy = cfg.ProbePolicy
+		clistener.Fallback = cfg.Fallback
+	default:
+		return nil, ErrProbePolicy
+	}
+	return clistener, nil
+}
 
-	if strings.ToLower(cfg.CryptMode) == "tls" {
-		listener, err = TlsListener(
-			listener, cfg.CertFile, cfg.CertKeyFile, cfg.RootCAs)
-	} else {
-		listener, err = cryptconn.NewListener(listener, cfg.Cipher, cfg.Key)
+// runShadowsocks serves shadowsocks in tcp and udp of SsListen, in
+// background. Tcp clients are filtered and banned as those of Listen.
+func (cfg *ServerConfig) runShadowsocks(filter *ipfilter.IPFilter, banner *netutil.Banner) (err error) {
+	ss, err := cryptconn.NewSsServer(netutil.DefaultTcpDialer, cfg.SsMethod, cfg.SsPassword)
+	if err != nil {
+		return
+	}
+	ss.Banner = banner
+	raw, err := net.Listen("tcp", cfg.SsListen)
+	if err != nil {
+		return
 	}
+	listener := cfg.filterListener(raw, filter, banner)
+	pconn, err := net.ListenPacket("udp", cfg.SsListen)
 	if err != nil {
+		listener.Close()
 		return
 	}
+	if filter != nil {
+		pconn = ipfilter.NewAllowPacketConn(pconn, filter)
+	}
+	logger.Noticef("shadowsocks in %s with %s.", cfg.SsListen, cfg.SsMethod)
+	go func() {
+		err := ss.Serve(listener)
+		if err != nil {
+			logger.Error("%s", err.Error())
+		}
+	}()
+	go func() {
+		err := ss.ServePacket(pconn)
+		if err != nil {
+			logger.Error("%s", err.Error())
+		}
+	}()
+	return
+}
+
+// runTrojan serves trojan in TrojanListen, in background. Clients are
+// filtered and banned as those of Listen.
+func (cfg *ServerConfig) runTrojan(filter *ipfilter.IPFilter, banner *netutil.Banner) (err error) {
+	trojan, err := cryptconn.NewTrojanServer(netutil.DefaultTcpDialer, cfg.TrojanPasswords, cfg.TrojanFallback)
+	if err != nil {
+		return
+	}
+	trojan.Banner = banner
+	raw, err := net.Listen("tcp", cfg.TrojanListen)
+	if err != nil {
+		return
+	}
+	listener, err := TlsListener(cfg.filterListener(raw, filter, banner),
+		cfg.CertFile, cfg.CertKeyFile, "")
+	if err != nil {
+		raw.Close()
+		return
+	}
+	logger.Noticef("trojan in %s.", cfg.TrojanListen)
+	go func() {
+		err := trojan.Serve(listener)
+		if err != nil {
+			logger.Error("%s", err.Error())
+		}
+	}()
+	return
+}
+
+// mapPort maps port of address in gateway.
+func mapPort(mapper nat.Mapper, address string) (pm *nat.PortMapping, err error) {
+	_, p, err := net.SplitHostPort(strings.TrimSpace(address))
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return
+	}
+	pm, err = nat.MapPort(mapper, "tcp", port)
+	if err != nil {
+		return
+	}
+	external, _ := pm.Address()
+	logger.Noticef("port %d mapped to %s by %s.", port, external, mapper)
+	return
+}
+
+// mapPorts maps each port of Listen in gateway, for clients out of nat.
+func (cfg *ServerConfig) mapPorts() (mappings []*nat.PortMapping, err error) {
+	mapper, err := nat.Discover(cfg.PortMap)
+	if err != nil {
+		return
+	}
+	for _, address := range strings.Split(cfg.Listen, ",") {
+		var pm *nat.PortMapping
+		pm, err = mapPort(mapper, address)
+		if err != nil {
+			for _, pm := range mappings {
+				pm.Close()
+			}
+			return nil, err
+		}
+		mappings = append(mappings, pm)
+	}
+	return
+}
+
+// runRendezvous serves rendezvous in RendezvousListen, in background.
+func (cfg *ServerConfig) runRendezvous() (err error) {
+	listener, err := net.Listen("tcp", cfg.RendezvousListen)
+	if err != nil {
+		return
+	}
+	logger.Noticef("rendezvous in %s.", cfg.RendezvousListen)
+	go func() {
+		err := nat.NewRendezvous().Serve(listener)
+		if err != nil {
+			logger.Error("%s", err.Error())
+		}
+	}()
+	return
+}
+
+func RunServer(cfg *ServerConfig) (err error) {
+	dns.RegisterService()
+
+	var filter *ipfilter.IPFilter
+	if cfg.AllowFile != "" {
+		filter, err = ipfilter.ReadIPListFile(cfg.AllowFile)
+		if err != nil {
+			return
+		}
+	}
+
+	var banner *netutil.Banner
+	if cfg.BanFails > 0 {
+		if cfg.BanTime == 0 {
+			cfg.BanTime = 60
+		}
+		banner = netutil.NewBanner(
+			cfg.BanFails, time.Duration(cfg.BanTime)*time.Second)
+	}
+
+	var keys []string
+	if strings.ToLower(cfg.CryptMode) != "tls" {
+		var key string
+		key, err = cfg.GetKey(cfg.Cipher)
+		if err != nil {
+			return
+		}
+		keys = cfg.Keys
+		if key != "" {
+			keys = append([]string{key}, keys...)
+		}
+		if cfg.Cipher == "noise" {
+			var public string
+			public, err = cryptconn.NoisePublicKey(key)
+			if err != nil {
+				return
+			}
+			logger.Noticef("noise public key: %s", public)
+		}
+	}
+
+	raws, err := cfg.SockOpts.NewListeners("tcp4", cfg.Listen, cfg.Acceptors)
+	if err != nil {
+		return
+	}
+	var listeners []net.Listener
+	for _, raw := range raws {
+		var listener net.Listener
+		listener, err = cfg.wrapListener(raw, filter, banner, keys)
+		if err != nil {
+			for _, raw := range raws {
+				raw.Close()
+			}
+			return
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if cfg.PortMap != "" {
+		var mappings []*nat.PortMapping
+		mappings, err = cfg.mapPorts()
+		if err != nil {
+			return
+		}
+		defer func() {
+			for _, pm := range mappings {
+				pm.Close()
+			}
+		}()
+	}
+
+	var punch *nat.PunchListener
+	if cfg.Rendezvous != "" {
+		if cfg.RendezvousName == "" {
+			return ErrNoRendezvousName
+		}
+		punch, err = nat.NewPunchListener(cfg.Rendezvous, cfg.RendezvousName)
+		if err != nil {
+			return
+		}
+		var listener net.Listener
+		listener, err = cfg.wrapListener(punch, filter, banner, keys)
+		if err != nil {
+			punch.Close()
+			return
+		}
+		listeners = append(listeners, listener)
+		logger.Noticef("registered %s in %s.", cfg.RendezvousName, cfg.Rendezvous)
+	}
+
+	if cfg.StreamLog != "" {
+		var file *os.File
+		file, err = os.OpenFile(cfg.StreamLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return
+		}
+		tunnel.DefaultStreamLogger = tunnel.NewJsonStreamLogger(file)
+	}
+
+	if cfg.AuditLog != "" {
+		var file *os.File
+		file, err = os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return
+		}
+		netutil.DefaultAuditLogger = netutil.NewAuditLogger(file)
+	}
 
 	if cfg.ForceIPv4 {
 		logger.Info("force ipv4 dailer.")
-		netutil.DefaultTcpDialer = netutil.DefaultTcp4Dialer
+		if ed, ok := netutil.DefaultTcpDialer.(*netutil.EyeballsDialer); ok {
+			ed.Network = "tcp4"
+		} else {
+			netutil.DefaultTcpDialer = netutil.DefaultTcp4Dialer
+		}
+	}
+	cfg.setDialRetry()
+
+	if cfg.SsListen != "" {
+		err = cfg.runShadowsocks(filter, banner)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.TrojanListen != "" {
+		err = cfg.runTrojan(filter, banner)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.RendezvousListen != "" {
+		err = cfg.runRendezvous()
+		if err != nil {
+			return
+		}
 	}
 
 	server := connpool.NewServer(&cfg.Auth)
+	server.Banner = banner
+	if cfg.CertAuth {
+		if strings.ToLower(cfg.CryptMode) != "tls" || cfg.RootCAs == "" {
+			return ErrCertAuthNoCA
+		}
+		server.CertAuth = true
+	}
+
+	if cfg.UserFile != "" {
+		server.Users, err = connpool.NewUserDB(cfg.UserFile)
+		if err != nil {
+			return
+		}
+	}
+
+	if cfg.Redis != "" {
+		server.Store = store.NewRedis(
+			cfg.Redis, cfg.RedisPassword, cfg.RedisDB)
+	}
+
+	if len(cfg.Quotas) > 0 || cfg.QuotaFile != "" || server.Store != nil {
+		server.Accounting, err = connpool.NewAccounting(
+			cfg.Quotas, cfg.QuotaFile, server.Store)
+		if err != nil {
+			return
+		}
+	}
 
 	if cfg.AdminIface != "" {
 		mux := http.NewServeMux()
 		server.Register(mux)
-		go httpserver(cfg.AdminIface, mux)
+		mux.HandleFunc("/api/status", handlerStatus(func() *AdminStatus {
+			return newAdminStatus(cfg.Mode, server.Pool)
+		}))
+		registerDashboard(mux)
+		var handler http.Handler
+		handler, err = cfg.adminHandler(mux)
+		if err != nil {
+			return
+		}
+		go httpserver(cfg.AdminIface, handler)
+	}
+
+	go handoffOnSignal()
+	go stopOnSignal()
+	go ignoreHup()
+	netutil.CloseInherited()
+	err = serveAll(listeners, server.Serve)
+	if punch != nil {
+		// new process registers the name.
+		punch.Close()
 	}
+	switch {
+	case netutil.Stopped():
+		logger.Notice("listener closed, drain sessions.")
+	case err == nil && netutil.HandedOff():
+		logger.Notice("listener handed off, drain sessions.")
+	default:
+		return
+	}
+	server.Drain(time.Duration(cfg.DrainGrace) * time.Second)
+	err = server.Close()
+	if err != nil {
+		logger.Errorf("save usage: %s", err.Error())
+	}
+	logger.Notice("sessions drained, quit.")
+	return nil
+}
+
+// stopOnSignal stops listening when asked to stop, then server drains
+// sessions and saves usages before quit. Signal again kills it.
+// ignoreHup keeps server running when SIGHUP received, reload is for
+// client only.
+func ignoreHup() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logger.Warning("SIGHUP received, server can't reload config, restart it to apply.")
+	}
+}
 
-	return server.Serve(listener)
+func stopOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	signal.Stop(ch)
+	logger.Noticef("%s received, stop listening.", sig)
+	netutil.StopListeners()
 }
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"io/ioutil"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/shell909090/goproxy/cryptconn"
 	"github.com/shell909090/goproxy/netutil"
 )
 
-var ErrLoadPEM = errors.New("certpool: append cert to pem failed")
+var (
+	ErrLoadPEM  = errors.New("certpool: append cert to pem failed")
+	ErrPinWrong = errors.New("pin: not a base64 sha256 hash")
+	ErrPinMatch = errors.New("pin: no certificate in chain matches pins")
+)
 
 var CipherSuites []uint16 = []uint16{
 	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
@@ -32,6 +41,37 @@ var CurvePreferences []tls.CurveID = []tls.CurveID{
 	tls.X25519,
 }
 
+// FipsCipherSuites and FipsCurvePreferences are used in fips mode.
+var FipsCipherSuites []uint16 = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
+
+var FipsCurvePreferences []tls.CurveID = []tls.CurveID{
+	tls.CurveP256,
+	tls.CurveP384,
+}
+
+// newTlsConfig returns config with suites and curves, restricted in
+// fips mode.
+func newTlsConfig() (config *tls.Config) {
+	if cryptconn.FipsMode {
+		return &tls.Config{
+			CipherSuites:     FipsCipherSuites,
+			MinVersion:       tls.VersionTLS12,
+			MaxVersion:       tls.VersionTLS12,
+			CurvePreferences: FipsCurvePreferences,
+		}
+	}
+	return &tls.Config{
+		CipherSuites:     CipherSuites,
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: CurvePreferences,
+	}
+}
+
 func loadCertPool(caCerts string) (caCertPool *x509.CertPool, err error) {
 	var pemCert []byte
 	caCertPool = x509.NewCertPool()
@@ -53,12 +93,8 @@ func TlsListener(raw net.Listener, CertFile, CertKeyFile, RootCAs string) (wrapp
 		return
 	}
 
-	config := &tls.Config{
-		Certificates:     []tls.Certificate{cert},
-		CipherSuites:     CipherSuites,
-		MinVersion:       tls.VersionTLS12,
-		CurvePreferences: CurvePreferences,
-	}
+	config := newTlsConfig()
+	config.Certificates = []tls.Certificate{cert}
 
 	if RootCAs != "" {
 		config.ClientCAs, err = loadCertPool(RootCAs)
@@ -72,21 +108,60 @@ func TlsListener(raw net.Listener, CertFile, CertKeyFile, RootCAs string) (wrapp
 	return
 }
 
+// parsePins reads base64 sha256 hashes of SubjectPublicKeyInfo,
+// one per line.
+func parsePins(pins string) (hashes [][]byte, err error) {
+	for _, pin := range strings.Split(pins, "\n") {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+		pin = strings.TrimPrefix(pin, "sha256/")
+		var hash []byte
+		hash, err = base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, ErrPinWrong
+		}
+		hashes = append(hashes, hash)
+	}
+	return
+}
+
+// verifyPins passes if any certificate in verified chains has a
+// public key pinned.
+func verifyPins(hashes [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, hash := range hashes {
+					if bytes.Equal(sum[:], hash) {
+						return nil
+					}
+				}
+			}
+		}
+		return ErrPinMatch
+	}
+}
+
 type TlsDialer struct {
+	dialer netutil.Dialer
 	config *tls.Config
 }
 
-func NewTlsDialer(CertFile, CertKeyFile, RootCAs string) (dialer netutil.Dialer, err error) {
-	cert, err := tls.LoadX509KeyPair(CertFile, CertKeyFile)
-	if err != nil {
-		return
-	}
+// NewTlsDialer creates a tls dialer, client certificate is optional.
+// With Pins, server must have a public key pinned in its chain.
+func NewTlsDialer(raw netutil.Dialer, CertFile, CertKeyFile, RootCAs, Pins string) (dialer netutil.Dialer, err error) {
+	config := newTlsConfig()
 
-	config := &tls.Config{
-		Certificates:     []tls.Certificate{cert},
-		CipherSuites:     CipherSuites,
-		MinVersion:       tls.VersionTLS12,
-		CurvePreferences: CurvePreferences,
+	if CertFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(CertFile, CertKeyFile)
+		if err != nil {
+			return
+		}
+		config.Certificates = []tls.Certificate{cert}
 	}
 
 	if RootCAs != "" {
@@ -96,15 +171,66 @@ func NewTlsDialer(CertFile, CertKeyFile, RootCAs string) (dialer netutil.Dialer,
 		}
 	}
 
-	dialer = &TlsDialer{config: config}
+	if Pins != "" {
+		var hashes [][]byte
+		hashes, err = parsePins(Pins)
+		if err != nil {
+			return
+		}
+		config.VerifyPeerCertificate = verifyPins(hashes)
+	}
+
+	dialer = &TlsDialer{dialer: raw, config: config}
+	return
+}
+
+func (td *TlsDialer) handshake(ctx context.Context, conn net.Conn, address string) (tlsconn *tls.Conn, err error) {
+	config := td.config
+	if config.ServerName == "" {
+		// address without port is name in rendezvous.
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsconn = tls.Client(conn, config)
+	err = tlsconn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	return
 }
 
 func (td *TlsDialer) Dial(network, address string) (net.Conn, error) {
-	return tls.Dial(network, address, td.config)
+	return td.DialContext(context.Background(), network, address)
+}
+
+func (td *TlsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := netutil.DialContext(ctx, td.dialer, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return td.handshake(ctx, conn, address)
 }
 
 func (td *TlsDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
-	d := &net.Dialer{Timeout: timeout}
-	return tls.DialWithDialer(d, network, address, td.config)
+	dialer, ok := td.dialer.(netutil.TimeoutDialer)
+	if !ok {
+		return td.Dial(network, address)
+	}
+	conn, err := dialer.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	tlsconn, err := td.handshake(context.Background(), conn, address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsconn, nil
 }
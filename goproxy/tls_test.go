@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+)
+
+func TestParsePins(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	hashes, err := parsePins("sha256/" + pin + "\n\n " + pin + " \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 2 || string(hashes[0]) != string(sum[:]) {
+		t.Fatalf("wrong hashes: %v", hashes)
+	}
+
+	short := base64.StdEncoding.EncodeToString(sum[:16])
+	for _, pins := range []string{short, "not base64!", pin + "\n" + short} {
+		_, err = parsePins(pins)
+		if err != ErrPinWrong {
+			t.Errorf("%q: %v", pins, err)
+		}
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	leaf := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("leaf")}
+	ca := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("ca")}
+	chains := [][]*x509.Certificate{{leaf, ca}}
+	sum := sha256.Sum256([]byte("ca"))
+	other := sha256.Sum256([]byte("other"))
+
+	if err := verifyPins([][]byte{other[:], sum[:]})(nil, chains); err != nil {
+		t.Fatalf("pinned ca not matched: %v", err)
+	}
+	if err := verifyPins([][]byte{other[:]})(nil, chains); err != ErrPinMatch {
+		t.Fatalf("chain not pinned: %v", err)
+	}
+	if err := verifyPins([][]byte{sum[:]})(nil, nil); err != ErrPinMatch {
+		t.Fatalf("no chain: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (fd *FilteredDialer) HandlerFilters(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, fd.Status())
+	return
+}
+
+// HandlerReload reads files of filters again, old ones are kept if any
+// failed.
+func (fd *FilteredDialer) HandlerReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	err := fd.Reload()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logger.Notice("filters reloaded by admin.")
+	return
+}
+
+// HandlerFlush drops hostnames cached for matching filters.
+func (fd *FilteredDialer) HandlerFlush(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	if dc, ok := fd.Resolver.(*DNSCache); ok {
+		dc.Flush()
+	}
+	logger.Notice("dns cache flushed by admin.")
+	return
+}
+
+// WriteMetrics writes dials by filter matched, and dns cache if used.
+func (fd *FilteredDialer) WriteMetrics(w io.Writer) {
+	fd.mlock.Lock()
+	var names []string
+	for name := range fd.matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP goproxy_filter_matches_total Dials by file of filter matched.")
+	fmt.Fprintln(w, "# TYPE goproxy_filter_matches_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "goproxy_filter_matches_total{filter=%q} %d\n",
+			name, fd.matches[name])
+	}
+	fd.mlock.Unlock()
+
+	if dc, ok := fd.Resolver.(*DNSCache); ok {
+		dc.WriteMetrics(w)
+	}
+}
+
+func (fd *FilteredDialer) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/filters", fd.HandlerFilters)
+	mux.HandleFunc("/api/filters/reload", fd.HandlerReload)
+	mux.HandleFunc("/api/dns/flush", fd.HandlerFlush)
+}
@@ -2,8 +2,11 @@ package ipfilter
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/shell909090/goproxy/dns"
 )
@@ -13,8 +16,10 @@ const maxCache = 512
 var errType = errors.New("type error")
 
 type DNSCache struct {
-	lock  sync.Mutex
-	cache *Cache
+	hits   int64
+	misses int64
+	lock   sync.Mutex
+	cache  *Cache
 }
 
 func CreateDNSCache() (dc *DNSCache) {
@@ -30,6 +35,7 @@ func (dc *DNSCache) LookupIP(hostname string) (addrs []net.IP, err error) {
 	dc.lock.Unlock()
 
 	if ok {
+		atomic.AddInt64(&dc.hits, 1)
 		addrs, ok = value.([]net.IP)
 		if !ok {
 			err = errType
@@ -38,6 +44,7 @@ func (dc *DNSCache) LookupIP(hostname string) (addrs []net.IP, err error) {
 		return
 	}
 
+	atomic.AddInt64(&dc.misses, 1)
 	addrs, err = dns.DefaultResolver.LookupIP(hostname)
 	if err != nil {
 		return
@@ -51,3 +58,20 @@ func (dc *DNSCache) LookupIP(hostname string) (addrs []net.IP, err error) {
 	}
 	return
 }
+
+// Flush removes all hostnames cached.
+func (dc *DNSCache) Flush() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.cache = New(maxCache)
+}
+
+// WriteMetrics writes lookups hit or missed in cache.
+func (dc *DNSCache) WriteMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP goproxy_dns_cache_lookups_total Lookups of filter by result in cache.")
+	fmt.Fprintln(w, "# TYPE goproxy_dns_cache_lookups_total counter")
+	fmt.Fprintf(w, "goproxy_dns_cache_lookups_total{result=\"hit\"} %d\n",
+		atomic.LoadInt64(&dc.hits))
+	fmt.Fprintf(w, "goproxy_dns_cache_lookups_total{result=\"miss\"} %d\n",
+		atomic.LoadInt64(&dc.misses))
+}
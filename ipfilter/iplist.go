@@ -3,12 +3,14 @@ package ipfilter
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
 	"net"
 	"os"
 	"strings"
+	"sync"
 
 	logging "github.com/op/go-logging"
 	"github.com/shell909090/goproxy/dns"
@@ -17,7 +19,10 @@ import (
 
 var logger = logging.MustGetLogger("ipfilter")
 
-var ErrDNSNotFound = errors.New("dns not found")
+var (
+	ErrDNSNotFound = errors.New("dns not found")
+	ErrLineFormat  = errors.New("iplist line format error")
+)
 
 type IPFilter struct {
 	rest []*net.IPNet
@@ -62,6 +67,26 @@ func (f IPFilter) Contain(ip net.IP) bool {
 	return false
 }
 
+// Nets returns all networks in filter.
+func (f IPFilter) Nets() (nets []*net.IPNet) {
+	nets = append(nets, f.rest...)
+	for _, iplist := range f.idx1 {
+		nets = append(nets, iplist...)
+	}
+	for _, iplist := range f.idx2 {
+		nets = append(nets, iplist...)
+	}
+	return
+}
+
+// Filters returns filters loaded, in order of matching.
+func (fd *FilteredDialer) Filters() (filters []*IPFilter) {
+	for _, fp := range fd.pairs() {
+		filters = append(filters, fp.filter)
+	}
+	return
+}
+
 func ParseLine(line string) (ipnet *net.IPNet, err error) {
 	_, ipnet, err = net.ParseCIDR(line)
 	if err == nil {
@@ -70,6 +95,9 @@ func ParseLine(line string) (ipnet *net.IPNet, err error) {
 	err = nil
 
 	addrs := strings.Split(line, " ")
+	if len(addrs) < 2 {
+		return nil, ErrLineFormat
+	}
 
 	ip := net.ParseIP(addrs[0])
 	if x := ip.To4(); x != nil {
@@ -108,6 +136,9 @@ QUIT:
 			return nil, err
 		}
 		line = strings.Trim(line, "\r\n ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 
 		ipnet, err = ParseLine(line)
 		if err != nil {
@@ -158,31 +189,114 @@ func ReadIPListFile(filename string) (filter *IPFilter, err error) {
 }
 
 type FilterPair struct {
-	dialer netutil.Dialer
-	filter *IPFilter
+	dialer   netutil.Dialer
+	filter   *IPFilter
+	filename string
 }
 
 type FilteredDialer struct {
 	dialer netutil.Dialer
 	dns.Resolver
-	fps []*FilterPair
+	lock sync.RWMutex
+	fps  []*FilterPair
+	// matches counts dials by file of filter matched, kept in reload.
+	mlock   sync.Mutex
+	matches map[string]int64
 }
 
 func NewFilteredDialer(dialer netutil.Dialer) (fd *FilteredDialer) {
 	fd = &FilteredDialer{
 		dialer:   dialer,
 		Resolver: CreateDNSCache(),
+		matches:  make(map[string]int64, 0),
 	}
 	return
 }
 
+// MATCH_DEFAULT and MATCH_UNRESOLVED count dials not matched by any
+// filter, and those failed in dns.
+const (
+	MATCH_DEFAULT    = "default"
+	MATCH_UNRESOLVED = "unresolved"
+)
+
+func (fd *FilteredDialer) match(name string) {
+	fd.mlock.Lock()
+	defer fd.mlock.Unlock()
+	fd.matches[name]++
+}
+
+func (fd *FilteredDialer) getMatches(name string) int64 {
+	fd.mlock.Lock()
+	defer fd.mlock.Unlock()
+	return fd.matches[name]
+}
+
 func (fd *FilteredDialer) LoadFilter(dialer netutil.Dialer, filename string) (err error) {
-	fp := &FilterPair{dialer: dialer}
+	fp := &FilterPair{dialer: dialer, filename: filename}
 	fp.filter, err = ReadIPListFile(filename)
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
 	fd.fps = append(fd.fps, fp)
 	return
 }
 
+func (fd *FilteredDialer) pairs() []*FilterPair {
+	fd.lock.RLock()
+	defer fd.lock.RUnlock()
+	return fd.fps
+}
+
+// Reload reads files of filters again. Filters are all replaced if
+// files are all read, or none of them.
+func (fd *FilteredDialer) Reload() (err error) {
+	old := fd.pairs()
+	fps := make([]*FilterPair, len(old))
+	for i, fp := range old {
+		fps[i] = &FilterPair{dialer: fp.dialer, filename: fp.filename}
+		fps[i].filter, err = ReadIPListFile(fp.filename)
+		if err != nil {
+			return
+		}
+	}
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	fd.fps = fps
+	return
+}
+
+// SetFilter replaces all filters by the one in filename, filters are
+// kept if file can't be read.
+func (fd *FilteredDialer) SetFilter(dialer netutil.Dialer, filename string) (err error) {
+	fp := &FilterPair{dialer: dialer, filename: filename}
+	fp.filter, err = ReadIPListFile(filename)
+	if err != nil {
+		return
+	}
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	fd.fps = []*FilterPair{fp}
+	return
+}
+
+// FilterStatus is file of filter and count of networks in it.
+type FilterStatus struct {
+	File    string
+	Nets    int
+	Matches int64
+}
+
+func (fd *FilteredDialer) Status() (status []FilterStatus) {
+	for _, fp := range fd.pairs() {
+		status = append(status, FilterStatus{
+			File:    fp.filename,
+			Nets:    len(fp.filter.Nets()),
+			Matches: fd.getMatches(fp.filename),
+		})
+	}
+	return
+}
+
 func Getaddrs(resolver dns.Resolver, hostname string) (ips []net.IP) {
 	ip := net.ParseIP(hostname)
 	if ip != nil {
@@ -197,9 +311,14 @@ func Getaddrs(resolver dns.Resolver, hostname string) (ips []net.IP) {
 }
 
 func (fd *FilteredDialer) Dial(network, address string) (conn net.Conn, err error) {
+	return fd.DialContext(context.Background(), network, address)
+}
+
+func (fd *FilteredDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
 	logger.Infof("filter dial: %s", address)
-	if len(fd.fps) == 0 {
-		return fd.dialer.Dial(network, address)
+	fps := fd.pairs()
+	if len(fps) == 0 {
+		return netutil.DialContext(ctx, fd.dialer, network, address)
 	}
 
 	hostname, _, err := net.SplitHostPort(address)
@@ -210,16 +329,19 @@ func (fd *FilteredDialer) Dial(network, address string) (conn net.Conn, err erro
 
 	addrs := Getaddrs(fd.Resolver, hostname)
 	if addrs == nil {
+		fd.match(MATCH_UNRESOLVED)
 		return nil, ErrDNSNotFound
 	}
 
-	for _, fp := range fd.fps {
+	for _, fp := range fps {
 		for _, addr := range addrs {
 			if fp.filter.Contain(addr) {
-				return fp.dialer.Dial(network, address)
+				fd.match(fp.filename)
+				return netutil.DialContext(ctx, fp.dialer, network, address)
 			}
 		}
 	}
 
-	return fd.dialer.Dial(network, address)
+	fd.match(MATCH_DEFAULT)
+	return netutil.DialContext(ctx, fd.dialer, network, address)
 }
@@ -2,8 +2,16 @@ package ipfilter
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/shell909090/goproxy/tunnel"
 )
@@ -31,3 +39,147 @@ func TestIPList(t *testing.T) {
 		t.Fatalf("Contain wrong3.")
 	}
 }
+
+func TestAllowListener(t *testing.T) {
+	filter, err := ReadIPList(bytes.NewBufferString("# local only\n127.0.0.0/8\n"))
+	if err != nil {
+		t.Fatalf("ReadIPList failed: %s", err)
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewAllowListener(raw, filter)
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", raw.Addr().String())
+		if err == nil {
+			defer conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("local connection refused: %s", err)
+	}
+	conn.Close()
+}
+
+func TestAllowPacketConn(t *testing.T) {
+	for list, allowed := range map[string]bool{
+		"127.0.0.0/8\n": true,
+		"10.0.0.0/8\n":  false,
+	} {
+		filter, err := ReadIPList(bytes.NewBufferString(list))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := NewAllowPacketConn(raw, filter)
+		defer conn.Close()
+
+		client, err := net.Dial("udp", raw.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write([]byte("foo"))
+
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 16)
+		_, _, err = conn.ReadFrom(buf)
+		if (err == nil) != allowed {
+			t.Fatalf("%s: packet read %v, want %v", list, err == nil, allowed)
+		}
+	}
+}
+
+func TestFilterReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.list")
+	os.WriteFile(file, []byte("10.0.0.0/8\n"), 0644)
+	fd := NewFilteredDialer(nil)
+	err := fd.LoadFilter(nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(file, []byte("10.0.0.0/8\n192.168.0.0/16\n"), 0644)
+	mux := http.NewServeMux()
+	fd.Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/filters/reload", nil))
+	if w.Code != 200 || !fd.Filters()[0].Contain(net.ParseIP("192.168.1.1")) {
+		t.Fatalf("not reloaded: %d %s", w.Code, w.Body.String())
+	}
+
+	// filters are kept if file is broken.
+	os.WriteFile(file, []byte("garbage\n"), 0644)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/filters/reload", nil))
+	if w.Code != 500 {
+		t.Fatalf("broken file reloaded: %d", w.Code)
+	}
+	status := fd.Status()
+	if len(status) != 1 || status[0].File != file || status[0].Nets != 2 {
+		t.Fatalf("wrong status: %v", status)
+	}
+
+	other := filepath.Join(t.TempDir(), "other.list")
+	if fd.SetFilter(nil, other) == nil {
+		t.Fatal("filter set by file not exist")
+	}
+	os.WriteFile(other, []byte("172.16.0.0/12\n"), 0644)
+	err = fd.SetFilter(nil, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = fd.Status()
+	if len(status) != 1 || status[0].File != other || status[0].Nets != 1 {
+		t.Fatalf("wrong status: %v", status)
+	}
+}
+
+type nameDialer string
+
+func (nd nameDialer) Dial(network, address string) (net.Conn, error) {
+	return nil, errors.New(string(nd))
+}
+
+func TestFilterMatches(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.list")
+	os.WriteFile(file, []byte("10.0.0.0/8\n"), 0644)
+	fd := NewFilteredDialer(nameDialer("tunnel"))
+	err := fd.LoadFilter(nameDialer("direct"), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ address, dialer string }{
+		{"10.1.1.1:80", "direct"},
+		{"10.2.2.2:80", "direct"},
+		{"8.8.8.8:53", "tunnel"},
+	} {
+		_, err = fd.Dial("tcp", c.address)
+		if err == nil || err.Error() != c.dialer {
+			t.Fatalf("%s dialed by %v", c.address, err)
+		}
+	}
+
+	var b bytes.Buffer
+	fd.WriteMetrics(&b)
+	for _, line := range []string{
+		fmt.Sprintf("goproxy_filter_matches_total{filter=%q} 2", file),
+		`goproxy_filter_matches_total{filter="default"} 1`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("%s not in metrics:\n%s", line, b.String())
+		}
+	}
+	if fd.Status()[0].Matches != 2 {
+		t.Fatalf("wrong status: %v", fd.Status())
+	}
+}
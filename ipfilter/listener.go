@@ -0,0 +1,54 @@
+package ipfilter
+
+import (
+	"net"
+)
+
+// AllowListener accepts connections only from networks in filter,
+// others are closed before anything read.
+type AllowListener struct {
+	net.Listener
+	filter *IPFilter
+}
+
+func NewAllowListener(listener net.Listener, filter *IPFilter) (al *AllowListener) {
+	return &AllowListener{Listener: listener, filter: filter}
+}
+
+func (al *AllowListener) Accept() (conn net.Conn, err error) {
+	for {
+		conn, err = al.Listener.Accept()
+		if err != nil {
+			return
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && al.filter.Contain(addr.IP) {
+			return
+		}
+		logger.Debugf("%s not allowed.", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// AllowPacketConn reads packets only from networks in filter, others
+// are dropped.
+type AllowPacketConn struct {
+	net.PacketConn
+	filter *IPFilter
+}
+
+func NewAllowPacketConn(conn net.PacketConn, filter *IPFilter) (ac *AllowPacketConn) {
+	return &AllowPacketConn{PacketConn: conn, filter: filter}
+}
+
+func (ac *AllowPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = ac.PacketConn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if ua, ok := addr.(*net.UDPAddr); ok && ac.filter.Contain(ua.IP) {
+			return
+		}
+		logger.Debugf("%s not allowed.", addr)
+	}
+}
@@ -0,0 +1,39 @@
+package nat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultGateway reads gateway of default route in /proc/net/route.
+func DefaultGateway() (ip net.IP, err error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		// addresses are hex of u32 in host order, little endian.
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		ip = make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+		return ip, nil
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	return nil, ErrNoGateway
+}
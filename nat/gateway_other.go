@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package nat
+
+import "net"
+
+func DefaultGateway() (ip net.IP, err error) {
+	return nil, ErrNotSupported
+}
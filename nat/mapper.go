@@ -0,0 +1,139 @@
+package nat
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("nat")
+
+const (
+	METHOD_AUTO   = "auto"
+	METHOD_UPNP   = "upnp"
+	METHOD_NATPMP = "natpmp"
+	// MAP_LIFETIME is lease of mapping asked, renewed in half of it.
+	MAP_LIFETIME = time.Hour
+	// MAP_RETRY is wait after renewing failed.
+	MAP_RETRY = time.Minute
+)
+
+var (
+	ErrNotSupported = errors.New("nat: not supported in this platform.")
+	ErrNoGateway    = errors.New("nat: no default gateway.")
+	ErrMethod       = errors.New("nat: unknown port mapping method.")
+	ErrNoMapper     = errors.New("nat: no gateway can map ports.")
+)
+
+// Mapper maps ports in gateway, like Upnp and NatPmp.
+type Mapper interface {
+	ExternalAddress() (net.IP, error)
+	AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (int, error)
+	DeletePortMapping(protocol string, internal, external int) error
+}
+
+// Discover finds gateway by method, auto tries upnp and then natpmp.
+func Discover(method string) (mapper Mapper, err error) {
+	switch method {
+	case METHOD_UPNP:
+		return DiscoverUpnp()
+	case METHOD_NATPMP:
+		var gw net.IP
+		gw, err = DefaultGateway()
+		if err != nil {
+			return
+		}
+		np := NewNatPmp(gw.String())
+		// probe if gateway speaks natpmp.
+		_, err = np.ExternalAddress()
+		if err != nil {
+			return
+		}
+		return np, nil
+	case METHOD_AUTO, "":
+		for _, m := range []string{METHOD_UPNP, METHOD_NATPMP} {
+			mapper, err = Discover(m)
+			if err == nil {
+				return
+			}
+			logger.Infof("%s: %s", m, err.Error())
+		}
+		return nil, ErrNoMapper
+	}
+	return nil, ErrMethod
+}
+
+// PortMapping keeps a port mapped in gateway, till closed.
+type PortMapping struct {
+	mapper   Mapper
+	Protocol string
+	Internal int
+	External int
+	Lifetime time.Duration
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// MapPort maps internal port of protocol to the same external port if
+// gateway agrees, and renews it in background.
+func MapPort(mapper Mapper, protocol string, internal int) (pm *PortMapping, err error) {
+	pm = &PortMapping{
+		mapper:   mapper,
+		Protocol: protocol,
+		Internal: internal,
+		Lifetime: MAP_LIFETIME,
+		quit:     make(chan struct{}),
+	}
+	pm.External, err = mapper.AddPortMapping(protocol, internal, internal, pm.Lifetime)
+	if err != nil {
+		return nil, err
+	}
+	pm.wg.Add(1)
+	go pm.renew()
+	return
+}
+
+func (pm *PortMapping) renew() {
+	defer pm.wg.Done()
+	wait := pm.Lifetime / 2
+	for {
+		select {
+		case <-pm.quit:
+			return
+		case <-time.After(wait):
+		}
+		external, err := pm.mapper.AddPortMapping(
+			pm.Protocol, pm.Internal, pm.External, pm.Lifetime)
+		if err != nil {
+			logger.Errorf("renew mapping of %d: %s", pm.Internal, err.Error())
+			wait = MAP_RETRY
+			continue
+		}
+		if external != pm.External {
+			logger.Warningf("port %d mapped to %d instead of %d.",
+				pm.Internal, external, pm.External)
+			pm.External = external
+		}
+		wait = pm.Lifetime / 2
+	}
+}
+
+// Address is external address of gateway and mapped port.
+func (pm *PortMapping) Address() (addr string, err error) {
+	ip, err := pm.mapper.ExternalAddress()
+	if err != nil {
+		return
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(pm.External)), nil
+}
+
+// Close stops renewing and removes mapping from gateway.
+func (pm *PortMapping) Close() (err error) {
+	close(pm.quit)
+	pm.wg.Wait()
+	return pm.mapper.DeletePortMapping(pm.Protocol, pm.Internal, pm.External)
+}
@@ -0,0 +1,227 @@
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeGateway struct {
+	lock   sync.Mutex
+	mapped map[int]int
+}
+
+func (gw *fakeGateway) get(internal int) (external int, ok bool) {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	external, ok = gw.mapped[internal]
+	return
+}
+
+// fakeNatPmp replies mappings and address as a gateway, external port
+// is internal plus 1000.
+func fakeNatPmp(t *testing.T, gw *fakeGateway) (addr string, closer func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, remote, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 2 {
+				continue
+			}
+			resp := make([]byte, 16)
+			resp[1] = buf[1] + 128
+			switch buf[1] {
+			case NATPMP_ADDRESS:
+				copy(resp[8:12], []byte{203, 0, 113, 1})
+				resp = resp[:12]
+			case NATPMP_TCP, NATPMP_UDP:
+				internal := binary.BigEndian.Uint16(buf[4:6])
+				lifetime := binary.BigEndian.Uint32(buf[8:12])
+				external := internal + 1000
+				gw.lock.Lock()
+				if lifetime == 0 {
+					delete(gw.mapped, int(internal))
+					external = 0
+				} else {
+					gw.mapped[int(internal)] = int(external)
+				}
+				gw.lock.Unlock()
+				copy(resp[8:10], buf[4:6])
+				binary.BigEndian.PutUint16(resp[10:12], external)
+				copy(resp[12:16], buf[8:12])
+			}
+			conn.WriteTo(resp, remote)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestNatPmp(t *testing.T) {
+	gw := &fakeGateway{mapped: make(map[int]int)}
+	addr, closer := fakeNatPmp(t, gw)
+	defer closer()
+	np := NewNatPmp(addr)
+
+	pm, err := MapPort(np, "tcp", 8899)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if external, _ := gw.get(8899); pm.External != 9899 || external != 9899 {
+		t.Fatalf("wrong mapping: %d %d", pm.External, external)
+	}
+	external, err := pm.Address()
+	if err != nil || external != "203.0.113.1:9899" {
+		t.Fatalf("wrong address: %s %v", external, err)
+	}
+	err = pm.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gw.get(8899); ok {
+		t.Fatal("mapping not deleted")
+	}
+
+	_, err = np.AddPortMapping("sctp", 1, 1, time.Hour)
+	if err != ErrNatPmpProtocol {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
+
+const testDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+func TestUpnp(t *testing.T) {
+	var lock sync.Mutex
+	var actions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rootDesc.xml" {
+			io.WriteString(w, testDescription)
+			return
+		}
+		if r.URL.Path != "/ctl/IPConn" {
+			http.NotFound(w, r)
+			return
+		}
+		action := r.Header.Get("SOAPAction")
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		actions = append(actions, action)
+		lock.Unlock()
+		switch {
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>203.0.113.2</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		case strings.HasSuffix(action, `#AddPortMapping"`):
+			if !strings.Contains(string(body), "<NewInternalPort>8899</NewInternalPort>") {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, `<s:Envelope><s:Body><s:Fault><detail><UPnPError><errorCode>402</errorCode><errorDescription>Invalid Args</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	u, err := NewUpnp(srv.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ControlURL != srv.URL+"/ctl/IPConn" || u.Client != "127.0.0.1" {
+		t.Fatalf("wrong device: %v", u)
+	}
+
+	pm, err := MapPort(u, "tcp", 8899)
+	if err != nil {
+		t.Fatal(err)
+	}
+	external, err := pm.Address()
+	if err != nil || external != "203.0.113.2:8899" {
+		t.Fatalf("wrong address: %s %v", external, err)
+	}
+	pm.Close()
+	lock.Lock()
+	done := actions
+	lock.Unlock()
+	if len(done) != 3 || !strings.HasSuffix(done[2], `#DeletePortMapping"`) {
+		t.Fatalf("wrong actions: %v", done)
+	}
+
+	_, err = u.AddPortMapping("tcp", 1, 1, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "Invalid Args") {
+		t.Fatalf("fault not returned: %v", err)
+	}
+}
+
+func TestPunch(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go NewRendezvous().Serve(listener)
+	rendezvous := listener.Addr().String()
+
+	_, err = NewPunchDialer(rendezvous).Dial("tcp", "home")
+	if err == nil || !strings.Contains(err.Error(), ErrNoServer.Error()) {
+		t.Fatalf("connected server not registered: %v", err)
+	}
+
+	pl, err := NewPunchListener(rendezvous, "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go func() {
+		for {
+			conn, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := NewPunchDialer(rendezvous).Dial("tcp", "home")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := fmt.Sprintf("hello %d", i)
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf) != msg {
+			t.Fatalf("not relayed: %q %v", buf, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	NATPMP_PORT    = 5351
+	NATPMP_VERSION = 0
+	NATPMP_ADDRESS = 0
+	NATPMP_UDP     = 1
+	NATPMP_TCP     = 2
+	// NATPMP_TIMEOUT is the first wait of reply, doubled in each retry.
+	NATPMP_TIMEOUT = 250 * time.Millisecond
+	NATPMP_RETRIES = 4
+)
+
+var (
+	ErrNatPmpReply    = errors.New("natpmp: wrong reply.")
+	ErrNatPmpProtocol = errors.New("natpmp: protocol should be tcp or udp.")
+)
+
+// NatPmp maps ports in gateway by NAT-PMP, RFC 6886.
+type NatPmp struct {
+	Gateway string
+	Timeout time.Duration
+}
+
+// NewNatPmp talks to gateway in ip, with port 5351 if not set.
+func NewNatPmp(gateway string) *NatPmp {
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, strconv.Itoa(NATPMP_PORT))
+	}
+	return &NatPmp{Gateway: gateway, Timeout: NATPMP_TIMEOUT}
+}
+
+// call sends request and waits reply of op, resends if no reply.
+func (np *NatPmp) call(req []byte, size int) (resp []byte, err error) {
+	conn, err := net.Dial("udp", np.Gateway)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	timeout := np.Timeout
+	for i := 0; i < NATPMP_RETRIES; i++ {
+		_, err = conn.Write(req)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		var n int
+		n, err = conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			timeout *= 2
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if n < size || buf[0] != NATPMP_VERSION || buf[1] != req[1]+128 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+			return nil, fmt.Errorf("natpmp: result code %d.", code)
+		}
+		return buf[:n], nil
+	}
+	return
+}
+
+// ExternalAddress asks public address of gateway.
+func (np *NatPmp) ExternalAddress() (ip net.IP, err error) {
+	resp, err := np.call([]byte{NATPMP_VERSION, NATPMP_ADDRESS}, 12)
+	if err != nil {
+		return
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// AddPortMapping maps external port in gateway to internal port of
+// this host, gateway may choose another external port.
+func (np *NatPmp) AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (mapped int, err error) {
+	var op byte
+	switch protocol {
+	case "tcp":
+		op = NATPMP_TCP
+	case "udp":
+		op = NATPMP_UDP
+	default:
+		return 0, ErrNatPmpProtocol
+	}
+	req := make([]byte, 12)
+	req[0] = NATPMP_VERSION
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:8], uint16(external))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	resp, err := np.call(req, 16)
+	if err != nil {
+		return
+	}
+	if int(binary.BigEndian.Uint16(resp[8:10])) != internal {
+		return 0, ErrNatPmpReply
+	}
+	return int(binary.BigEndian.Uint16(resp[10:12])), nil
+}
+
+// DeletePortMapping removes mapping of internal port, by zero lifetime.
+func (np *NatPmp) DeletePortMapping(protocol string, internal, external int) (err error) {
+	_, err = np.AddPortMapping(protocol, internal, 0, 0)
+	return
+}
+
+func (np *NatPmp) String() string {
+	return "natpmp " + np.Gateway
+}
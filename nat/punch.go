@@ -0,0 +1,312 @@
+package nat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	// PUNCH_TIMEOUT limits dialing peer till connected.
+	PUNCH_TIMEOUT  = 10 * time.Second
+	PUNCH_INTERVAL = 200 * time.Millisecond
+	// REGISTER_RETRY is wait before registering again when control
+	// connection is lost.
+	REGISTER_RETRY = 5 * time.Second
+)
+
+var (
+	ErrPunchTimeout = errors.New("punch: peer not connected in time.")
+	ErrListenClosed = errors.New("punch: listener closed.")
+)
+
+// dialReuse connects address from a port can be shared later.
+func dialReuse(network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: RENDEZVOUS_TIMEOUT, Control: netutil.ReuseControl}
+	return dialer.Dial(network, address)
+}
+
+// ask sends command to rendezvous in a new connection, and reads PEER
+// replied. Connection is kept open, for port of it is still in use.
+func ask(network, rendezvous, cmd, arg string) (conn net.Conn, peer string, err error) {
+	conn, err = dialReuse(network, rendezvous)
+	if err != nil {
+		return
+	}
+	err = writeLine(conn, cmd, arg)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(RENDEZVOUS_TIMEOUT))
+	reply, peer, err := readLine(bufio.NewReaderSize(conn, MAX_LINE))
+	if err == nil && reply != CMD_PEER {
+		err = fmt.Errorf("rendezvous: %s %s", reply, peer)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return
+}
+
+// punch connects peer from local port, both sides dial each other at
+// the same time, so mappings in nat of both are opened. If listen, peer
+// can also connect into local port, as it's mapped in gateway or not
+// behind nat at all.
+func punch(local net.Addr, peer string, listen bool) (conn net.Conn, err error) {
+	peerAddr, err := net.ResolveTCPAddr("tcp", peer)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PUNCH_TIMEOUT)
+	defer cancel()
+
+	var once sync.Once
+	ch := make(chan net.Conn, 1)
+	win := func(c net.Conn) {
+		won := false
+		once.Do(func() {
+			ch <- c
+			won = true
+		})
+		if !won {
+			c.Close()
+		}
+	}
+
+	if listen {
+		lc := net.ListenConfig{Control: netutil.ReuseControl}
+		var listener net.Listener
+		listener, err = lc.Listen(ctx, "tcp", local.String())
+		if err != nil {
+			return
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				remote, ok := c.RemoteAddr().(*net.TCPAddr)
+				if !ok || !remote.IP.Equal(peerAddr.IP) {
+					c.Close()
+					continue
+				}
+				win(c)
+			}
+		}()
+	}
+
+	go func() {
+		dialer := net.Dialer{LocalAddr: local, Control: netutil.ReuseControl}
+		for {
+			c, err := dialer.DialContext(ctx, "tcp", peer)
+			if err == nil {
+				win(c)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(PUNCH_INTERVAL):
+			}
+		}
+	}()
+
+	select {
+	case conn = <-ch:
+	case <-ctx.Done():
+		// no one wins after this.
+		once.Do(func() {})
+		select {
+		case conn = <-ch:
+		default:
+			return nil, ErrPunchTimeout
+		}
+	}
+	return conn, nil
+}
+
+// PunchDialer connects servers registered in rendezvous by name, which
+// are behind nat.
+type PunchDialer struct {
+	Rendezvous string
+}
+
+func NewPunchDialer(rendezvous string) *PunchDialer {
+	return &PunchDialer{Rendezvous: rendezvous}
+}
+
+// Dial connects server registered as name, network is used to reach
+// rendezvous.
+func (pd *PunchDialer) Dial(network, name string) (conn net.Conn, err error) {
+	ctrl, peer, err := ask(network, pd.Rendezvous, CMD_CONNECT, name)
+	if err != nil {
+		return
+	}
+	defer ctrl.Close()
+	return punch(ctrl.LocalAddr(), peer, false)
+}
+
+type punchAddr string
+
+func (pa punchAddr) Network() string { return "punch" }
+
+func (pa punchAddr) String() string { return string(pa) }
+
+// PunchListener registers name in rendezvous, and accepts connections
+// of clients punched in.
+type PunchListener struct {
+	Rendezvous string
+	Name       string
+	conns      chan net.Conn
+	lock       sync.Mutex
+	ctrl       net.Conn
+	closed     chan struct{}
+}
+
+// NewPunchListener registers name in rendezvous, errors if it can't be
+// done in the first time. Registration is retried in background if
+// lost after that.
+func NewPunchListener(rendezvous, name string) (pl *PunchListener, err error) {
+	pl = &PunchListener{
+		Rendezvous: rendezvous,
+		Name:       name,
+		conns:      make(chan net.Conn),
+		closed:     make(chan struct{}),
+	}
+	reader, err := pl.register()
+	if err != nil {
+		return nil, err
+	}
+	go pl.loop(reader)
+	return
+}
+
+// register connects rendezvous as control connection, and waits OK.
+func (pl *PunchListener) register() (reader *bufio.Reader, err error) {
+	conn, err := net.DialTimeout("tcp", pl.Rendezvous, RENDEZVOUS_TIMEOUT)
+	if err != nil {
+		return
+	}
+	err = writeLine(conn, CMD_REGISTER, pl.Name)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	reader = bufio.NewReaderSize(conn, MAX_LINE)
+	conn.SetReadDeadline(time.Now().Add(RENDEZVOUS_TIMEOUT))
+	cmd, arg, err := readLine(reader)
+	if err == nil && cmd != CMD_OK {
+		err = fmt.Errorf("rendezvous: %s %s", cmd, arg)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	select {
+	case <-pl.closed:
+		conn.Close()
+		return nil, ErrListenClosed
+	default:
+	}
+	pl.ctrl = conn
+	return
+}
+
+// loop reads PUNCH from rendezvous, registers again if lost.
+func (pl *PunchListener) loop(reader *bufio.Reader) {
+	for {
+		cmd, arg, err := readLine(reader)
+		switch {
+		case err == nil && cmd == CMD_PUNCH:
+			go pl.accept(arg)
+			continue
+		case err == nil && cmd == CMD_ERR:
+			// not to take name back from the newer one.
+			logger.Errorf("rendezvous %s: %s, stop registering.", pl.Rendezvous, arg)
+			pl.ctrl.Close()
+			return
+		case err == nil:
+			continue
+		}
+
+		select {
+		case <-pl.closed:
+			return
+		default:
+		}
+		logger.Errorf("rendezvous %s: %s", pl.Rendezvous, err.Error())
+		pl.ctrl.Close()
+		for {
+			select {
+			case <-pl.closed:
+				return
+			case <-time.After(REGISTER_RETRY):
+			}
+			reader, err = pl.register()
+			if err == nil {
+				break
+			}
+			logger.Errorf("register in %s: %s", pl.Rendezvous, err.Error())
+		}
+		logger.Noticef("registered %s in %s again.", pl.Name, pl.Rendezvous)
+	}
+}
+
+// accept punches client introduced by token.
+func (pl *PunchListener) accept(token string) {
+	ctrl, peer, err := ask("tcp", pl.Rendezvous, CMD_ACCEPT, token)
+	if err != nil {
+		logger.Errorf("accept %s: %s", token, err.Error())
+		return
+	}
+	defer ctrl.Close()
+	conn, err := punch(ctrl.LocalAddr(), peer, true)
+	if err != nil {
+		logger.Errorf("punch %s: %s", peer, err.Error())
+		return
+	}
+	select {
+	case pl.conns <- conn:
+	case <-pl.closed:
+		conn.Close()
+	}
+}
+
+func (pl *PunchListener) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-pl.conns:
+		return
+	case <-pl.closed:
+		return nil, ErrListenClosed
+	}
+}
+
+func (pl *PunchListener) Close() (err error) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	select {
+	case <-pl.closed:
+		return
+	default:
+	}
+	close(pl.closed)
+	return pl.ctrl.Close()
+}
+
+func (pl *PunchListener) Addr() net.Addr {
+	return punchAddr(pl.Name + "@" + pl.Rendezvous)
+}
@@ -0,0 +1,219 @@
+package nat
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rendezvous introduces clients to servers behind nat. Lines of a
+// connection to rendezvous are:
+//
+//	server: REGISTER name, replied by OK, then PUNCH token for each client,
+//	or ERR if another server registered the same name.
+//	client: CONNECT name, replied by PEER address of server.
+//	server: ACCEPT token in a new connection, replied by PEER address of
+//	client.
+//
+// Addresses are those rendezvous saw, both sides dial each other from
+// the same ports they reached rendezvous.
+const (
+	CMD_REGISTER = "REGISTER"
+	CMD_CONNECT  = "CONNECT"
+	CMD_ACCEPT   = "ACCEPT"
+	CMD_PUNCH    = "PUNCH"
+	CMD_PEER     = "PEER"
+	CMD_OK       = "OK"
+	CMD_ERR      = "ERR"
+	// RENDEZVOUS_TIMEOUT limits reading command and waiting server to
+	// accept.
+	RENDEZVOUS_TIMEOUT = 10 * time.Second
+	// MAX_LINE limits line of command.
+	MAX_LINE = 256
+)
+
+var (
+	ErrLineTooLong = errors.New("rendezvous: line too long.")
+	ErrNoServer    = errors.New("rendezvous: server not registered.")
+	ErrReplaced    = errors.New("rendezvous: registered by another server.")
+)
+
+// readLine reads a line ended by \n, returns command and argument.
+func readLine(r *bufio.Reader) (cmd, arg string, err error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", "", ErrLineTooLong
+	}
+	if err != nil {
+		return
+	}
+	cmd, arg, _ = strings.Cut(strings.TrimSpace(string(line)), " ")
+	return
+}
+
+func writeLine(conn net.Conn, cmd, arg string) (err error) {
+	conn.SetWriteDeadline(time.Now().Add(RENDEZVOUS_TIMEOUT))
+	_, err = fmt.Fprintf(conn, "%s %s\n", cmd, arg)
+	conn.SetWriteDeadline(time.Time{})
+	return
+}
+
+// replyError writes error as ERR line, for peer knows why it's closed.
+func replyError(conn net.Conn, err error) error {
+	writeLine(conn, CMD_ERR, err.Error())
+	return err
+}
+
+type Rendezvous struct {
+	lock    sync.Mutex
+	servers map[string]net.Conn
+	pending map[string]chan net.Conn
+}
+
+func NewRendezvous() *Rendezvous {
+	return &Rendezvous{
+		servers: make(map[string]net.Conn),
+		pending: make(map[string]chan net.Conn),
+	}
+}
+
+func (r *Rendezvous) Serve(listener net.Listener) (err error) {
+	var conn net.Conn
+	for {
+		conn, err = listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			err := r.serveConn(conn)
+			if err != nil {
+				logger.Infof("rendezvous %s: %s", conn.RemoteAddr(), err.Error())
+			}
+		}(conn)
+	}
+}
+
+func (r *Rendezvous) serveConn(conn net.Conn) (err error) {
+	reader := bufio.NewReaderSize(conn, MAX_LINE)
+	conn.SetReadDeadline(time.Now().Add(RENDEZVOUS_TIMEOUT))
+	cmd, arg, err := readLine(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch cmd {
+	case CMD_REGISTER:
+		return r.register(conn, reader, arg)
+	case CMD_CONNECT:
+		defer conn.Close()
+		return r.connect(conn, arg)
+	case CMD_ACCEPT:
+		return r.accept(conn, arg)
+	}
+	conn.Close()
+	return fmt.Errorf("rendezvous: unknown command %q.", cmd)
+}
+
+// register keeps control connection of server till it's closed. The
+// newer one replaces older in same name.
+func (r *Rendezvous) register(conn net.Conn, reader *bufio.Reader, name string) (err error) {
+	defer conn.Close()
+	r.lock.Lock()
+	if old, ok := r.servers[name]; ok {
+		replyError(old, ErrReplaced)
+		old.Close()
+	}
+	r.servers[name] = conn
+	r.lock.Unlock()
+	logger.Noticef("server %s registered from %s.", name, conn.RemoteAddr())
+
+	err = writeLine(conn, CMD_OK, name)
+	if err == nil {
+		// nothing expected from server, wait till it's gone.
+		_, err = reader.ReadByte()
+	}
+
+	r.lock.Lock()
+	if r.servers[name] == conn {
+		delete(r.servers, name)
+	}
+	r.lock.Unlock()
+	logger.Noticef("server %s unregistered.", name)
+	return
+}
+
+// connect asks server in name to punch, and tells both sides address of
+// each other.
+func (r *Rendezvous) connect(conn net.Conn, name string) (err error) {
+	var b [16]byte
+	_, err = rand.Read(b[:])
+	if err != nil {
+		return
+	}
+	token := hex.EncodeToString(b[:])
+	ch := make(chan net.Conn, 1)
+
+	r.lock.Lock()
+	server, ok := r.servers[name]
+	if ok {
+		r.pending[token] = ch
+		err = writeLine(server, CMD_PUNCH, token)
+	}
+	r.lock.Unlock()
+	if !ok {
+		return replyError(conn, ErrNoServer)
+	}
+	defer func() {
+		r.lock.Lock()
+		delete(r.pending, token)
+		r.lock.Unlock()
+		// server accepted after timeout.
+		select {
+		case late := <-ch:
+			late.Close()
+		default:
+		}
+	}()
+	if err != nil {
+		return replyError(conn, err)
+	}
+
+	var accepted net.Conn
+	select {
+	case accepted = <-ch:
+	case <-time.After(RENDEZVOUS_TIMEOUT):
+		return replyError(conn, ErrNoServer)
+	}
+	defer accepted.Close()
+	err = writeLine(accepted, CMD_PEER, conn.RemoteAddr().String())
+	if err != nil {
+		return replyError(conn, err)
+	}
+	logger.Infof("%s punching %s in %s.", conn.RemoteAddr(), name, accepted.RemoteAddr())
+	return writeLine(conn, CMD_PEER, accepted.RemoteAddr().String())
+}
+
+// accept hands connection of server to client waiting for token.
+func (r *Rendezvous) accept(conn net.Conn, token string) (err error) {
+	r.lock.Lock()
+	ch, ok := r.pending[token]
+	r.lock.Unlock()
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("rendezvous: unknown token %q.", token)
+	}
+	select {
+	case ch <- conn:
+	default:
+		conn.Close()
+	}
+	return
+}
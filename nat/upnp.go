@@ -0,0 +1,262 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SSDP_ADDR   = "239.255.255.250:1900"
+	UPNP_DEVICE = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	// UPNP_TIMEOUT limits discovery and each of soap calls.
+	UPNP_TIMEOUT = 3 * time.Second
+	// UPNP_MAX_BODY limits description and soap replies read.
+	UPNP_MAX_BODY = 1 << 20
+)
+
+// UPNP_SERVICES are services which map ports, in preference order.
+var UPNP_SERVICES = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+var (
+	ErrNoUpnpDevice  = errors.New("upnp: no gateway device found.")
+	ErrNoUpnpService = errors.New("upnp: no port mapping service in device.")
+)
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// find looks for service of type in device and its embedded devices.
+func (d *upnpDevice) find(typ string) *upnpService {
+	for i := range d.Services {
+		if d.Services[i].ServiceType == typ {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].find(typ); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// Upnp maps ports in gateway by soap calls of UPnP IGD.
+type Upnp struct {
+	ControlURL string
+	Service    string
+	// Client is address of this host in lan, where ports are mapped to.
+	Client string
+	client *http.Client
+}
+
+// DiscoverUpnp searches gateway in lan by SSDP, takes the first device
+// replied.
+func DiscoverUpnp() (u *Upnp, err error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	addr, err := net.ResolveUDPAddr("udp4", SSDP_ADDR)
+	if err != nil {
+		return
+	}
+	search := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n", SSDP_ADDR, UPNP_DEVICE)
+	_, err = conn.WriteTo([]byte(search), addr)
+	if err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(UPNP_TIMEOUT))
+	buf := make([]byte, 2048)
+	for {
+		var n int
+		n, _, err = conn.ReadFrom(buf)
+		if err != nil {
+			return nil, ErrNoUpnpDevice
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		u, err = NewUpnp(location)
+		if err != nil {
+			logger.Infof("upnp device %s: %s", location, err.Error())
+			continue
+		}
+		return u, nil
+	}
+}
+
+// NewUpnp reads description of gateway in location for control url of
+// port mapping service.
+func NewUpnp(location string) (u *Upnp, err error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: UPNP_TIMEOUT}
+	resp, err := client.Get(location)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: description %s.", resp.Status)
+	}
+	var root struct {
+		Device upnpDevice `xml:"device"`
+	}
+	err = xml.NewDecoder(io.LimitReader(resp.Body, UPNP_MAX_BODY)).Decode(&root)
+	if err != nil {
+		return
+	}
+
+	for _, typ := range UPNP_SERVICES {
+		s := root.Device.find(typ)
+		if s == nil {
+			continue
+		}
+		control, err := base.Parse(strings.TrimSpace(s.ControlURL))
+		if err != nil {
+			return nil, err
+		}
+		u = &Upnp{ControlURL: control.String(), Service: typ, client: client}
+		// ports are mapped to address which reached gateway.
+		conn, err := net.DialTimeout("tcp", control.Host, UPNP_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		u.Client, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+		conn.Close()
+		return u, nil
+	}
+	return nil, ErrNoUpnpService
+}
+
+// soap calls action with args in pairs of name and value, returns text
+// of element named result in reply, if any.
+func (u *Upnp) soap(action string, result string, args ...string) (value string, err error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.Service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", u.ControlURL, &body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.Service, action))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, UPNP_MAX_BODY))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		desc, _ := findElement(reply, "errorDescription")
+		return "", fmt.Errorf("upnp: %s %s %s.", action, resp.Status, desc)
+	}
+	if result == "" {
+		return
+	}
+	return findElement(reply, result)
+}
+
+// findElement gets text of first element in local name.
+func findElement(doc []byte, name string) (value string, err error) {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		var token xml.Token
+		token, err = decoder.Token()
+		if err != nil {
+			return
+		}
+		if se, ok := token.(xml.StartElement); ok && se.Name.Local == name {
+			var text string
+			err = decoder.DecodeElement(&text, &se)
+			return strings.TrimSpace(text), err
+		}
+	}
+}
+
+// ExternalAddress asks public address of gateway.
+func (u *Upnp) ExternalAddress() (ip net.IP, err error) {
+	value, err := u.soap("GetExternalIPAddress", "NewExternalIPAddress")
+	if err != nil {
+		return
+	}
+	ip = net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("upnp: wrong external address %q.", value)
+	}
+	return
+}
+
+// AddPortMapping maps external port in gateway to internal port of
+// Client, same port is used if external is zero.
+func (u *Upnp) AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (mapped int, err error) {
+	if external == 0 {
+		external = internal
+	}
+	_, err = u.soap("AddPortMapping", "",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(external),
+		"NewProtocol", strings.ToUpper(protocol),
+		"NewInternalPort", strconv.Itoa(internal),
+		"NewInternalClient", u.Client,
+		"NewEnabled", "1",
+		"NewPortMappingDescription", "goproxy",
+		"NewLeaseDuration", strconv.Itoa(int(lifetime/time.Second)))
+	if err != nil {
+		return
+	}
+	return external, nil
+}
+
+// DeletePortMapping removes mapping of external port.
+func (u *Upnp) DeletePortMapping(protocol string, internal, external int) (err error) {
+	_, err = u.soap("DeletePortMapping", "",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(external),
+		"NewProtocol", strings.ToUpper(protocol))
+	return
+}
+
+func (u *Upnp) String() string {
+	return "upnp " + u.ControlURL
+}
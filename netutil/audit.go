@@ -0,0 +1,60 @@
+package netutil
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_HANDSHAKE_FAIL = "handshake_fail"
+	AUDIT_AUTH_FAIL      = "auth_fail"
+	AUDIT_AUTH_OK        = "auth_ok"
+	AUDIT_SESSION_END    = "session_end"
+	AUDIT_BANNED         = "banned"
+)
+
+// AuditEvent is one security related event on server.
+type AuditEvent struct {
+	Time     time.Time
+	Event    string
+	Remote   string
+	Username string  `json:",omitempty"`
+	KeyId    string  `json:",omitempty"`
+	Reason   string  `json:",omitempty"`
+	Duration float64 `json:",omitempty"` // seconds of session, or ban
+}
+
+// AuditLogger writes one json object per line, apart from debug logs.
+type AuditLogger struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func NewAuditLogger(w io.Writer) (al *AuditLogger) {
+	return &AuditLogger{enc: json.NewEncoder(w)}
+}
+
+// DefaultAuditLogger receives events from Audit, nothing logged if nil.
+var DefaultAuditLogger *AuditLogger
+
+func (al *AuditLogger) Log(ev *AuditEvent) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	err := al.enc.Encode(ev)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// Audit sends event to DefaultAuditLogger, with time filled.
+func Audit(ev *AuditEvent) {
+	if DefaultAuditLogger == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	DefaultAuditLogger.Log(ev)
+}
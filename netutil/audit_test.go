@@ -0,0 +1,52 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	var buf bytes.Buffer
+	DefaultAuditLogger = NewAuditLogger(&buf)
+	defer func() { DefaultAuditLogger = nil }()
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	Audit(&AuditEvent{Event: AUDIT_AUTH_FAIL, Remote: "1.2.3.4:5", Reason: "wrong password"})
+	Audit(&AuditEvent{Event: AUDIT_AUTH_OK, Remote: "1.2.3.4:6", Username: "user"})
+	Audit(&AuditEvent{Time: start, Event: AUDIT_SESSION_END, Remote: "1.2.3.4:6",
+		Username: "user", Duration: 1.5})
+
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var ev map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &ev)
+		if err != nil {
+			t.Fatalf("not json line %q: %s", scanner.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 3 {
+		t.Fatalf("%d events", len(events))
+	}
+
+	if events[0]["Event"] != "auth_fail" || events[0]["Reason"] != "wrong password" {
+		t.Fatalf("wrong auth_fail: %v", events[0])
+	}
+	if _, ok := events[0]["Username"]; ok {
+		t.Fatalf("empty field written: %v", events[0])
+	}
+	if events[0]["Time"] == "0001-01-01T00:00:00Z" {
+		t.Fatal("time not filled")
+	}
+	if events[1]["Event"] != "auth_ok" || events[1]["Username"] != "user" {
+		t.Fatalf("wrong auth_ok: %v", events[1])
+	}
+	if events[2]["Event"] != "session_end" || events[2]["Duration"] != 1.5 ||
+		events[2]["Time"] != "2020-01-02T03:04:05Z" {
+		t.Fatalf("wrong session_end: %v", events[2])
+	}
+}
@@ -0,0 +1,177 @@
+package netutil
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	FAIL_WINDOW = 10 * time.Minute
+	MAX_BAN     = 24 * time.Hour
+)
+
+type banEntry struct {
+	fails int
+	bans  uint
+	last  time.Time
+	until time.Time
+}
+
+type BanInfo struct {
+	Host  string
+	Fails int
+	Bans  uint
+	Until time.Time
+}
+
+type BanSlice []BanInfo
+
+func (bs BanSlice) Len() int           { return len(bs) }
+func (bs BanSlice) Swap(i, j int)      { bs[i], bs[j] = bs[j], bs[i] }
+func (bs BanSlice) Less(i, j int) bool { return bs[i].Host < bs[j].Host }
+
+// Banner counts failed handshakes by source ip. After Threshold failures
+// in FAIL_WINDOW, the ip is banned for BanTime, and the time doubles for
+// each ban after that, up to MAX_BAN.
+type Banner struct {
+	lock      sync.Mutex
+	Threshold int
+	BanTime   time.Duration
+	hosts     map[string]*banEntry
+	lastPrune time.Time
+}
+
+func NewBanner(threshold int, bantime time.Duration) (b *Banner) {
+	return &Banner{
+		Threshold: threshold,
+		BanTime:   bantime,
+		hosts:     make(map[string]*banEntry, 0),
+		lastPrune: time.Now(),
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// lock must be held.
+func (b *Banner) prune(now time.Time) {
+	if now.Sub(b.lastPrune) < FAIL_WINDOW {
+		return
+	}
+	for host, be := range b.hosts {
+		if now.Sub(be.last) > FAIL_WINDOW && now.After(be.until) &&
+			now.Sub(be.until) > b.BanTime<<be.bans {
+			delete(b.hosts, host)
+		}
+	}
+	b.lastPrune = now
+}
+
+func (b *Banner) Fail(addr net.Addr) {
+	host := hostOf(addr)
+	now := time.Now()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.prune(now)
+
+	be, ok := b.hosts[host]
+	if !ok {
+		be = &banEntry{}
+		b.hosts[host] = be
+	}
+	if now.Sub(be.last) > FAIL_WINDOW {
+		be.fails = 0
+	}
+	be.fails++
+	be.last = now
+	if be.fails < b.Threshold {
+		return
+	}
+
+	bantime := b.BanTime << be.bans
+	if bantime > MAX_BAN || bantime <= 0 {
+		bantime = MAX_BAN
+	}
+	be.until = now.Add(bantime)
+	be.fails = 0
+	be.bans++
+	logger.Noticef("%s banned for %s.", host, bantime)
+	Audit(&AuditEvent{
+		Event:    AUDIT_BANNED,
+		Remote:   host,
+		Duration: bantime.Seconds(),
+	})
+}
+
+// Success clears failures, but bans before are still counted.
+func (b *Banner) Success(addr net.Addr) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if be, ok := b.hosts[hostOf(addr)]; ok {
+		be.fails = 0
+	}
+}
+
+func (b *Banner) Banned(addr net.Addr) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	be, ok := b.hosts[hostOf(addr)]
+	return ok && time.Now().Before(be.until)
+}
+
+// Unban removes host from banner.
+func (b *Banner) Unban(host string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.hosts, host)
+}
+
+// GetBanned returns hosts banned now.
+func (b *Banner) GetBanned() (bans BanSlice) {
+	now := time.Now()
+	b.lock.Lock()
+	for host, be := range b.hosts {
+		if now.Before(be.until) {
+			bans = append(bans, BanInfo{
+				Host:  host,
+				Fails: be.fails,
+				Bans:  be.bans,
+				Until: be.until,
+			})
+		}
+	}
+	b.lock.Unlock()
+	sort.Sort(bans)
+	return
+}
+
+// BanListener closes connections from banned hosts at once.
+type BanListener struct {
+	net.Listener
+	banner *Banner
+}
+
+func NewBanListener(listener net.Listener, banner *Banner) (bl *BanListener) {
+	return &BanListener{Listener: listener, banner: banner}
+}
+
+func (bl *BanListener) Accept() (conn net.Conn, err error) {
+	for {
+		conn, err = bl.Listener.Accept()
+		if err != nil {
+			return
+		}
+		if !bl.banner.Banned(conn.RemoteAddr()) {
+			return
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,37 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	b := NewBanner(3, time.Minute)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	b.Fail(addr)
+	b.Fail(addr)
+	if b.Banned(addr) {
+		t.Fatal("banned before threshold.")
+	}
+	b.Fail(addr)
+	if !b.Banned(addr) {
+		t.Fatal("not banned after threshold.")
+	}
+
+	// other port of the same host is banned too.
+	addr2 := &net.TCPAddr{IP: addr.IP, Port: 4321}
+	if !b.Banned(addr2) {
+		t.Fatal("ban not by host.")
+	}
+	bans := b.GetBanned()
+	if len(bans) != 1 || bans[0].Host != "192.0.2.1" {
+		t.Fatalf("banned list wrong: %+v", bans)
+	}
+
+	b.Unban("192.0.2.1")
+	if b.Banned(addr) {
+		t.Fatal("still banned after unban.")
+	}
+}
@@ -0,0 +1,123 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBindAddr  = errors.New("bind: source address not an ip.")
+	ErrBindIface = errors.New("bind: interface has no address.")
+)
+
+// BindDialer makes direct connections from an interface or a source
+// address, so hosts with more than one uplink can choose one of them.
+// It also sets other options needed before connect.
+type BindDialer struct {
+	// Interface is bound by SO_BINDTODEVICE in linux. In other
+	// platforms, Source is taken from its addresses.
+	Interface string
+	Source    net.IP
+	// Multipath uses multipath tcp if kernel supports.
+	Multipath bool
+	// Mark is set as SO_MARK of sockets if not zero, so policy routing
+	// can tell them by fwmark. linux only.
+	Mark int
+}
+
+func NewBindDialer(iface, source string) (bd *BindDialer, err error) {
+	bd = &BindDialer{Interface: iface}
+	if source != "" {
+		bd.Source = net.ParseIP(source)
+		if bd.Source == nil {
+			return nil, ErrBindAddr
+		}
+	}
+	if iface != "" && !BIND_DEVICE && bd.Source == nil {
+		bd.Source, err = interfaceAddr(iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// interfaceAddr returns first ipv4 address of interface, or first ipv6
+// if none.
+func interfaceAddr(name string) (ip net.IP, err error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+		if ip == nil {
+			ip = ipnet.IP
+		}
+	}
+	if ip == nil {
+		err = ErrBindIface
+	}
+	return
+}
+
+func (bd *BindDialer) Dial(network, address string) (net.Conn, error) {
+	return bd.DialContext(context.Background(), network, address)
+}
+
+func (bd *BindDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	if bd.Multipath {
+		d.SetMultipathTCP(true)
+	}
+	if bd.Source != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: bd.Source}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: bd.Source}
+		}
+	}
+	if (bd.Interface != "" && BIND_DEVICE) || bd.Mark != 0 {
+		d.Control = bd.control
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// control sets options of socket before connect.
+func (bd *BindDialer) control(network, address string, c syscall.RawConn) (err error) {
+	e := c.Control(func(fd uintptr) {
+		if bd.Interface != "" && BIND_DEVICE {
+			err = bindDevice(fd, bd.Interface)
+			if err != nil {
+				return
+			}
+		}
+		if bd.Mark != 0 {
+			err = setMark(fd, bd.Mark)
+		}
+	})
+	if e != nil {
+		return e
+	}
+	return
+}
+
+func (bd *BindDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return bd.DialContext(ctx, network, address)
+}
@@ -0,0 +1,81 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBindDialer(t *testing.T) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	go func() {
+		conn, err := lsock.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	bd, err := NewBindDialer("", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := bd.Dial("tcp", lsock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(bd.Source) {
+		t.Fatalf("source address wrong: %s", ip)
+	}
+
+	if _, err = NewBindDialer("", "localhost"); err != ErrBindAddr {
+		t.Fatalf("wrong address accepted: %v", err)
+	}
+}
+
+func TestMultipath(t *testing.T) {
+	so := &SockOpts{Multipath: true}
+	lsock, err := so.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	go func() {
+		conn, err := lsock.Accept()
+		if err == nil {
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+
+	// falls back to tcp if multipath not supported.
+	bd := &BindDialer{Multipath: true}
+	conn, err := bd.Dial("tcp", lsock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf [1]byte
+	if _, err = conn.Read(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMark(t *testing.T) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+
+	bd := &BindDialer{Mark: 0x66}
+	conn, err := bd.Dial("tcp", lsock.Addr().String())
+	if err != nil {
+		// needs CAP_NET_ADMIN, and linux.
+		t.Skip(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,64 @@
+package netutil
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	MIN_BUFFERSIZE = 1024
+	MAX_BUFFERSIZE = 65535 // max data in one tunnel frame.
+)
+
+var ErrBufferSize = errors.New("buffer size out of range.")
+
+var (
+	BUFFERSIZE = 8 * 1024
+	// BufferPool keeps buffers for copy loops and tunnel frames.
+	BufferPool = NewBytePool(BUFFERSIZE)
+)
+
+// SetBufferSize changes size of buffers in BufferPool. Larger buffers
+// cost less syscalls, smaller ones less memory with many connections.
+// It should be called before any connection made.
+func SetBufferSize(size int) (err error) {
+	if size < MIN_BUFFERSIZE || size > MAX_BUFFERSIZE {
+		return ErrBufferSize
+	}
+	BUFFERSIZE = size
+	BufferPool = NewBytePool(size)
+	return
+}
+
+// BytePool keeps buffers of one size for reuse, so busy connections
+// don't allocate one for each read.
+type BytePool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewBytePool(size int) (bp *BytePool) {
+	bp = &BytePool{size: size}
+	bp.pool.New = func() interface{} {
+		return make([]byte, size)
+	}
+	return
+}
+
+func (bp *BytePool) Size() int {
+	return bp.size
+}
+
+// Get returns a buffer of Size bytes.
+func (bp *BytePool) Get() []byte {
+	return bp.pool.Get().([]byte)
+}
+
+// Put gives back a buffer, which may be resliced. Buffers not from this
+// pool are dropped.
+func (bp *BytePool) Put(b []byte) {
+	if cap(b) != bp.size {
+		return
+	}
+	bp.pool.Put(b[:bp.size])
+}
@@ -0,0 +1,26 @@
+package netutil
+
+import "testing"
+
+func TestBytePool(t *testing.T) {
+	bp := NewBytePool(2048)
+	b := bp.Get()
+	if len(b) != 2048 {
+		t.Fatalf("buffer size wrong: %d", len(b))
+	}
+	bp.Put(b[:10])
+	if b = bp.Get(); len(b) != 2048 {
+		t.Fatalf("resliced buffer not restored: %d", len(b))
+	}
+	bp.Put(make([]byte, 100))
+	if b = bp.Get(); len(b) != 2048 {
+		t.Fatalf("foreign buffer taken: %d", len(b))
+	}
+
+	if err := SetBufferSize(100); err != ErrBufferSize {
+		t.Fatalf("small size accepted: %v", err)
+	}
+	if err := SetBufferSize(70000); err != ErrBufferSize {
+		t.Fatalf("large size accepted: %v", err)
+	}
+}
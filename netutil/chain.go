@@ -0,0 +1,15 @@
+package netutil
+
+// NewChainDialer creates dialer going through proxies in rawurls one by
+// one, the first one is reached by dialer, and each of the others by the
+// one before it. Connections are made by the last proxy.
+func NewChainDialer(dialer Dialer, rawurls ...string) (chain Dialer, err error) {
+	chain = dialer
+	for _, rawurl := range rawurls {
+		chain, err = NewUpstreamDialer(chain, rawurl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
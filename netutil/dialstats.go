@@ -0,0 +1,107 @@
+package netutil
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DIAL_BUCKETS are upper bounds in seconds of dial latency histogram.
+var DIAL_BUCKETS = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets, as prometheus does.
+type Histogram struct {
+	Buckets []float64
+	Counts  []int64 // not cumulative, the last one is +Inf.
+	Sum     float64
+	Count   int64
+}
+
+func NewHistogram(buckets []float64) (h *Histogram) {
+	return &Histogram{
+		Buckets: buckets,
+		Counts:  make([]int64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.Buckets, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+// WriteMetrics writes buckets of name with labels, which is like
+// `dialer="direct"`.
+func (h *Histogram) WriteMetrics(w io.Writer, name, labels string) {
+	var acc int64
+	for i, le := range h.Buckets {
+		acc += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, acc)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %f\n", name, labels, h.Sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.Count)
+}
+
+type dialCounter struct {
+	latency  *Histogram
+	failures int64
+}
+
+// DialStats counts dials and their latency by name of dialer.
+type DialStats struct {
+	lock    sync.Mutex
+	dialers map[string]*dialCounter
+}
+
+var DefaultDialStats = NewDialStats()
+
+func NewDialStats() (ds *DialStats) {
+	return &DialStats{
+		dialers: make(map[string]*dialCounter, 0),
+	}
+}
+
+// Dialed records a dial of name took d, failed dials are counted but not
+// in latency.
+func (ds *DialStats) Dialed(name string, d time.Duration, err error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	dc, ok := ds.dialers[name]
+	if !ok {
+		dc = &dialCounter{latency: NewHistogram(DIAL_BUCKETS)}
+		ds.dialers[name] = dc
+	}
+	if err != nil {
+		dc.failures++
+		return
+	}
+	dc.latency.Observe(d.Seconds())
+}
+
+// WriteMetrics writes counters in prometheus text format.
+func (ds *DialStats) WriteMetrics(w io.Writer) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	var names []string
+	for name := range ds.dialers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP goproxy_dial_seconds Time to connect by dialer.")
+	fmt.Fprintln(w, "# TYPE goproxy_dial_seconds histogram")
+	for _, name := range names {
+		ds.dialers[name].latency.WriteMetrics(w, "goproxy_dial_seconds",
+			fmt.Sprintf("dialer=%q", name))
+	}
+	fmt.Fprintln(w, "# HELP goproxy_dial_failures_total Dials failed by dialer.")
+	fmt.Fprintln(w, "# TYPE goproxy_dial_failures_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "goproxy_dial_failures_total{dialer=%q} %d\n",
+			name, ds.dialers[name].failures)
+	}
+}
@@ -0,0 +1,47 @@
+package netutil
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type errDialer struct{}
+
+func (ed errDialer) Dial(network, address string) (net.Conn, error) {
+	return nil, errors.New("refused")
+}
+
+func TestDialStats(t *testing.T) {
+	ds := NewDialStats()
+	ds.Dialed("direct", 20*time.Millisecond, nil)
+	ds.Dialed("direct", 3*time.Second, nil)
+	ds.Dialed("direct", time.Minute, nil)
+	ds.Dialed("tunnel", time.Second, errors.New("refused"))
+
+	var b bytes.Buffer
+	ds.WriteMetrics(&b)
+	for _, line := range []string{
+		`goproxy_dial_seconds_bucket{dialer="direct",le="0.01"} 0`,
+		`goproxy_dial_seconds_bucket{dialer="direct",le="0.05"} 1`,
+		`goproxy_dial_seconds_bucket{dialer="direct",le="5"} 2`,
+		`goproxy_dial_seconds_bucket{dialer="direct",le="+Inf"} 3`,
+		`goproxy_dial_seconds_count{dialer="direct"} 3`,
+		`goproxy_dial_seconds_count{dialer="tunnel"} 0`,
+		`goproxy_dial_failures_total{dialer="tunnel"} 1`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("%s not in metrics:\n%s", line, b.String())
+		}
+	}
+
+	NewNamedDialer("test-errdialer", errDialer{}).Dial("tcp", "127.0.0.1:1")
+	b.Reset()
+	DefaultDialStats.WriteMetrics(&b)
+	if !strings.Contains(b.String(), `goproxy_dial_failures_total{dialer="test-errdialer"} 1`) {
+		t.Fatalf("named dialer not counted:\n%s", b.String())
+	}
+}
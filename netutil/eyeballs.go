@@ -0,0 +1,144 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// EYEBALLS_DELAY is time to wait before trying next address, as the
+// connection attempt delay recommended in RFC 8305.
+const EYEBALLS_DELAY = 250 * time.Millisecond
+
+type IPResolver interface {
+	LookupIP(host string) (addrs []net.IP, err error)
+}
+
+// EyeballsDialer races addresses of host in tcp dialing (RFC 8305). ipv6
+// and ipv4 addresses are tried in turn, each one Delay after the one
+// before or right after it failed, and the first connected wins. So a
+// broken ipv6 network costs only a short delay.
+type EyeballsDialer struct {
+	Dialer
+	// Resolver looks up addresses of host, system resolver if nil.
+	Resolver IPResolver
+	Delay    time.Duration
+	// Network replaces network of dial if not empty, eg. tcp4.
+	Network string
+}
+
+func NewEyeballsDialer(dialer Dialer) (ed *EyeballsDialer) {
+	return &EyeballsDialer{Dialer: dialer, Delay: EYEBALLS_DELAY}
+}
+
+func (ed *EyeballsDialer) lookup(ctx context.Context, host string) (ips []net.IP, err error) {
+	if ed.Resolver != nil {
+		return ed.Resolver.LookupIP(host)
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// interleave sorts addresses as ipv6, ipv4, ipv6, ...
+func interleave(ips []net.IP) (sorted []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			sorted, v6 = append(sorted, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			sorted, v4 = append(sorted, v4[0]), v4[1:]
+		}
+	}
+	return
+}
+
+func (ed *EyeballsDialer) Dial(network, address string) (net.Conn, error) {
+	return ed.DialContext(context.Background(), network, address)
+}
+
+func (ed *EyeballsDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if ed.Network != "" {
+		network = ed.Network
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	if network != "tcp" || net.ParseIP(host) != nil {
+		return DialContext(ctx, ed.Dialer, network, address)
+	}
+
+	ips, err := ed.lookup(ctx, host)
+	if err != nil {
+		return
+	}
+	addrs := interleave(ips)
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := DialContext(ctx, ed.Dialer, network, addr)
+			ch <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(ed.Delay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case r := <-ch:
+			pending--
+			if r.err == nil {
+				// the others are canceled, close those connected anyway.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-ch; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if err == nil {
+				err = r.err
+			}
+			if next < len(addrs) {
+				start()
+				timer.Reset(ed.Delay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(ed.Delay)
+			}
+		}
+	}
+	return nil, err
+}
+
+func (ed *EyeballsDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ed.DialContext(ctx, network, address)
+}
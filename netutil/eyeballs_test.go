@@ -0,0 +1,72 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type staticResolver []net.IP
+
+func (sr staticResolver) LookupIP(host string) ([]net.IP, error) {
+	return sr, nil
+}
+
+// blackholeDialer never connects to ipv6, like a broken ipv6 network.
+type blackholeDialer struct {
+	TcpDialer
+}
+
+func (bd *blackholeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	if net.ParseIP(host).To4() == nil {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return bd.TcpDialer.DialContext(ctx, network, address)
+}
+
+func TestInterleave(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"),
+		net.ParseIP("::1"), net.ParseIP("::2"), net.ParseIP("::3"),
+	}
+	want := []string{"::1", "10.0.0.1", "::2", "10.0.0.2", "::3"}
+	sorted := interleave(ips)
+	for i, ip := range sorted {
+		if ip.String() != want[i] {
+			t.Fatalf("wrong order: %v", sorted)
+		}
+	}
+}
+
+func TestEyeballsDialer(t *testing.T) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	_, port, _ := net.SplitHostPort(lsock.Addr().String())
+
+	ed := NewEyeballsDialer(&blackholeDialer{})
+	ed.Resolver = staticResolver{net.ParseIP("2001:db8::1"), net.ParseIP("127.0.0.1")}
+	ed.Delay = 50 * time.Millisecond
+
+	start := time.Now()
+	conn, err := ed.DialTimeout("tcp", "example.com:"+port, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("ipv4 tried too late: %s", d)
+	}
+
+	ed.Resolver = staticResolver{net.ParseIP("2001:db8::1")}
+	_, err = ed.DialTimeout("tcp", "example.com:"+port, 100*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("blackhole not timeout: %v", err)
+	}
+}
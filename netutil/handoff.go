@@ -0,0 +1,219 @@
+package netutil
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// HANDOFF_ENV passes keys of listeners to new process, their fds start
+// from 3 in the same order.
+const (
+	HANDOFF_ENV  = "GOPROXY_LISTENERS"
+	HANDOFF_WAIT = 3 * time.Second
+)
+
+var ErrHandoffExit = errors.New("handoff: new process exited.")
+
+var (
+	handoffLock sync.Mutex
+	inherited   = loadInherited()
+	listeners   = make(map[*handoffListener]struct{}, 0)
+	handedOff   bool
+	stopped     bool
+)
+
+func loadInherited() (files map[string]*os.File) {
+	files = make(map[string]*os.File, 0)
+	env := os.Getenv(HANDOFF_ENV)
+	if env == "" {
+		return
+	}
+	os.Unsetenv(HANDOFF_ENV)
+	var keys []string
+	err := json.Unmarshal([]byte(env), &keys)
+	if err != nil {
+		logger.Errorf("handoff: %s", err.Error())
+		return
+	}
+	for i, key := range keys {
+		files[key] = os.NewFile(uintptr(3+i), key)
+	}
+	return
+}
+
+// handoffListener can be passed to new process.
+type handoffListener struct {
+	net.Listener
+	key string
+}
+
+func (hl *handoffListener) Close() error {
+	handoffLock.Lock()
+	delete(listeners, hl)
+	handoffLock.Unlock()
+	return hl.Listener.Close()
+}
+
+// listenInherit takes listener of network and address from parent
+// process, or creates one by listen if none. Listener returned can be
+// handed off.
+func listenInherit(network, address string, listen func() (net.Listener, error)) (l net.Listener, err error) {
+	key := network + "/" + address
+	handoffLock.Lock()
+	f, ok := inherited[key]
+	delete(inherited, key)
+	handoffLock.Unlock()
+
+	if ok {
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			logger.Errorf("inherit %s: %s", key, err.Error())
+		} else {
+			logger.Infof("listener %s inherited.", key)
+		}
+	}
+	if l == nil {
+		l, err = listen()
+		if err != nil {
+			return
+		}
+	}
+
+	hl := &handoffListener{Listener: l, key: key}
+	handoffLock.Lock()
+	listeners[hl] = struct{}{}
+	handoffLock.Unlock()
+	return hl, nil
+}
+
+// CloseInherited closes listeners from parent process not taken, they
+// are not in config any more.
+func CloseInherited() {
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+	for key, f := range inherited {
+		logger.Infof("listener %s not used, close it.", key)
+		f.Close()
+	}
+	inherited = make(map[string]*os.File, 0)
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Handoff starts a new process of the same binary and arguments, which
+// takes over all listeners, for upgrading without losing connections.
+// It fails if new process exited in HANDOFF_WAIT. Listeners should be
+// closed by CloseListeners after that.
+func Handoff() (p *os.Process, err error) {
+	handoffLock.Lock()
+	var keys []string
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for hl := range listeners {
+		fl, ok := hl.Listener.(filer)
+		if !ok {
+			continue
+		}
+		var f *os.File
+		f, err = fl.File()
+		if err != nil {
+			break
+		}
+		keys = append(keys, hl.key)
+		files = append(files, f)
+	}
+	handoffLock.Unlock()
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	p, err = os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   append(os.Environ(), HANDOFF_ENV+"="+string(data)),
+		Files: files,
+	})
+	if err != nil {
+		return
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return nil, ErrHandoffExit
+	case <-time.After(HANDOFF_WAIT):
+	}
+	return
+}
+
+// CloseListeners stops accepting in all listeners, sockets stay open in
+// new process. Unix socket files are kept.
+func CloseListeners() {
+	handoffLock.Lock()
+	handedOff = true
+	hls := getListeners()
+	handoffLock.Unlock()
+
+	for _, hl := range hls {
+		if ul, ok := hl.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		hl.Close()
+	}
+}
+
+// StopListeners closes all listeners to quit, no new process takes
+// them.
+func StopListeners() {
+	handoffLock.Lock()
+	stopped = true
+	hls := getListeners()
+	handoffLock.Unlock()
+
+	for _, hl := range hls {
+		hl.Close()
+	}
+}
+
+// getListeners returns listeners, call it with handoffLock held.
+func getListeners() (hls []*handoffListener) {
+	for hl := range listeners {
+		hls = append(hls, hl)
+	}
+	return
+}
+
+// Stopped tells if listeners closed by StopListeners.
+func Stopped() bool {
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+	return stopped
+}
+
+// HandedOff tells if listeners handed off to new process.
+func HandedOff() bool {
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+	return handedOff
+}
@@ -0,0 +1,93 @@
+package netutil
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenInherit(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := raw.Addr().String()
+	f, err := raw.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	handoffLock.Lock()
+	inherited["tcp/"+address] = f
+	handoffLock.Unlock()
+
+	// port is still listened by inherited fd.
+	lsocks, err := ListenPort("tcp", address, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsock := lsocks[0]
+	go func() {
+		conn, err := lsock.Accept()
+		if err == nil {
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [1]byte
+	if _, err = conn.Read(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	CloseListeners()
+	defer func() {
+		handoffLock.Lock()
+		handedOff = false
+		handoffLock.Unlock()
+	}()
+	if !HandedOff() {
+		t.Fatal("not handed off")
+	}
+	if _, err = lsock.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("listener not closed: %v", err)
+	}
+	handoffLock.Lock()
+	_, ok := listeners[lsock.(*handoffListener)]
+	handoffLock.Unlock()
+	if ok {
+		t.Fatal("listener left in handoff")
+	}
+}
+
+func TestStopListeners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock")
+	lsock, err := Listen("127.0.0.1:0,unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	StopListeners()
+	defer func() {
+		handoffLock.Lock()
+		stopped = false
+		handoffLock.Unlock()
+	}()
+	if !Stopped() || HandedOff() {
+		t.Fatal("not stopped")
+	}
+	if _, err = lsock.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("listener not closed: %v", err)
+	}
+	// nothing takes unix socket, file removed.
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package netutil
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrProxyAuth = errors.New("http proxy auth failed.")
+
+// HttpConnectDialer connects destination through a http proxy by CONNECT.
+// With username, it answers Basic, NTLM or Negotiate (NTLM inside only,
+// no kerberos) auth asked by proxy. Username can be DOMAIN\user for NTLM.
+type HttpConnectDialer struct {
+	dialer   Dialer
+	server   string
+	username string
+	password string
+}
+
+func NewHttpConnectDialer(dialer Dialer, server, username, password string) (hd *HttpConnectDialer) {
+	return &HttpConnectDialer{
+		dialer:   dialer,
+		server:   server,
+		username: username,
+		password: password,
+	}
+}
+
+// bufConn reads data proxy sent after response from buffer first.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+func (hd *HttpConnectDialer) Dial(network, address string) (net.Conn, error) {
+	return hd.DialContext(context.Background(), network, address)
+}
+
+func (hd *HttpConnectDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, ErrSocksNetwork
+	}
+
+	var br *bufio.Reader
+	var resp *http.Response
+	conn, br, resp, err = hd.connect(ctx, nil, nil, address, "")
+	if err == nil && resp.StatusCode == http.StatusProxyAuthRequired && hd.username != "" {
+		conn, br, resp, err = hd.auth(ctx, conn, br, resp, address)
+	}
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		if conn != nil {
+			conn.Close()
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, ErrProxyAuth
+		}
+		return nil, fmt.Errorf("http proxy connect %s: %s.", address, resp.Status)
+	}
+	return &bufConn{Conn: conn, r: br}, nil
+}
+
+// auth answers 407 by scheme proxy offered, NTLM first.
+func (hd *HttpConnectDialer) auth(ctx context.Context, conn net.Conn, br *bufio.Reader, resp *http.Response, address string) (net.Conn, *bufio.Reader, *http.Response, error) {
+	schemes := make(map[string]string, 0)
+	for _, value := range resp.Header.Values("Proxy-Authenticate") {
+		fields := strings.SplitN(value, " ", 2)
+		schemes[strings.ToLower(fields[0])] = fields[0]
+	}
+
+	scheme, ok := schemes["ntlm"]
+	if !ok {
+		scheme, ok = schemes["negotiate"]
+	}
+	if ok {
+		return hd.authNtlm(ctx, conn, br, resp, address, scheme)
+	}
+
+	if _, ok = schemes["basic"]; ok {
+		token := base64.StdEncoding.EncodeToString(
+			[]byte(hd.username + ":" + hd.password))
+		return hd.connect(ctx, conn, br, address, "Basic "+token)
+	}
+	conn.Close()
+	return nil, nil, nil, ErrProxyAuth
+}
+
+// authNtlm runs negotiate and authenticate on the same connection.
+func (hd *HttpConnectDialer) authNtlm(ctx context.Context, conn net.Conn, br *bufio.Reader, resp *http.Response, address, scheme string) (net.Conn, *bufio.Reader, *http.Response, error) {
+	conn, br, resp, err := hd.connect(ctx, conn, br, address,
+		scheme+" "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return conn, br, resp, err
+	}
+
+	var challenge []byte
+	for _, value := range resp.Header.Values("Proxy-Authenticate") {
+		fields := strings.SplitN(value, " ", 2)
+		if len(fields) == 2 && strings.EqualFold(fields[0], scheme) {
+			challenge, err = base64.StdEncoding.DecodeString(strings.TrimSpace(fields[1]))
+			break
+		}
+	}
+	if challenge == nil || err != nil {
+		conn.Close()
+		return nil, nil, nil, ErrNtlmChallenge
+	}
+
+	msg, err := ntlmAuthenticate(challenge, hd.username, hd.password)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return hd.connect(ctx, conn, br, address,
+		scheme+" "+base64.StdEncoding.EncodeToString(msg))
+}
+
+// connect sends CONNECT with auth if not empty. Connection to proxy is
+// reused if possible, or a new one is made.
+func (hd *HttpConnectDialer) connect(ctx context.Context, conn net.Conn, br *bufio.Reader, address, auth string) (net.Conn, *bufio.Reader, *http.Response, error) {
+	var err error
+	if conn == nil {
+		conn, err = DialContext(ctx, hd.dialer, "tcp", hd.server)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		br = bufio.NewReader(conn)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	err = req.Write(conn)
+	if err == nil {
+		var resp *http.Response
+		resp, err = http.ReadResponse(br, req)
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			if resp.StatusCode == http.StatusOK {
+				return conn, br, resp, nil
+			}
+			// drain body, so next request can go in this connection.
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.Close {
+				conn.Close()
+				if resp.StatusCode != http.StatusProxyAuthRequired {
+					return nil, nil, resp, nil
+				}
+				// proxy wants auth in a new connection.
+				conn, err = DialContext(ctx, hd.dialer, "tcp", hd.server)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				br = bufio.NewReader(conn)
+			}
+			return conn, br, resp, nil
+		}
+	}
+	conn.Close()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return nil, nil, nil, err
+}
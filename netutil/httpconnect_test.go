@@ -0,0 +1,96 @@
+package netutil
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakeHttpProxy asks NTLM auth on one connection, then relays to target.
+func fakeHttpProxy(t *testing.T, lsock net.Listener, target string) {
+	conn, err := lsock.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != "CONNECT" {
+		t.Errorf("not connect: %v", err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 407 Auth Required\r\nProxy-Authenticate: NTLM\r\nProxy-Authenticate: Basic realm=\"x\"\r\nContent-Length: 0\r\n\r\n")
+
+	req, err = http.ReadRequest(br)
+	if err != nil || !strings.HasPrefix(req.Header.Get("Proxy-Authorization"), "NTLM ") {
+		t.Errorf("ntlm negotiate not sent: %v", err)
+		return
+	}
+	challenge := make([]byte, 48)
+	copy(challenge, NTLM_SIGNATURE)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	io.WriteString(conn, "HTTP/1.1 407 Auth Required\r\nProxy-Authenticate: NTLM "+
+		base64.StdEncoding.EncodeToString(challenge)+"\r\nContent-Length: 0\r\n\r\n")
+
+	req, err = http.ReadRequest(br)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	msg, _ := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "NTLM "))
+	if len(msg) < 64 || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Errorf("ntlm authenticate wrong: %x", msg)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	dconn, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	Relay(&bufConn{Conn: conn, r: br}, dconn)
+}
+
+func TestHttpConnectDialer(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	go fakeHttpProxy(t, lsock, echo.Addr().String())
+
+	hd := NewHttpConnectDialer(DefaultTcpDialer, lsock.Addr().String(), "DOMAIN\\user", "pass")
+	conn, err := hd.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	var buf [4]byte
+	io.ReadFull(conn, buf[:])
+	if string(buf[:]) != "ping" {
+		t.Fatalf("wrong reply: %q", buf)
+	}
+}
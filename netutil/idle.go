@@ -0,0 +1,70 @@
+package netutil
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIdleTimeout = errors.New("relay idle timeout.")
+
+// activeRWC records time of last read or write in active.
+type activeRWC struct {
+	io.ReadWriteCloser
+	active *int64
+}
+
+func (a *activeRWC) Read(b []byte) (n int, err error) {
+	n, err = a.ReadWriteCloser.Read(b)
+	atomic.StoreInt64(a.active, time.Now().UnixNano())
+	return
+}
+
+func (a *activeRWC) Write(b []byte) (n int, err error) {
+	n, err = a.ReadWriteCloser.Write(b)
+	atomic.StoreInt64(a.active, time.Now().UnixNano())
+	return
+}
+
+// RelayIdle is Relay, but closes both sides when no data goes in either
+// direction for timeout, and err is ErrIdleTimeout then. It works with
+// streams not supporting deadline. Zero timeout means never.
+func RelayIdle(a, b io.ReadWriteCloser, timeout time.Duration) (sent, recv int64, err error) {
+	if timeout == 0 {
+		return Relay(a, b)
+	}
+
+	active := time.Now().UnixNano()
+	var idled int32
+	done := make(chan struct{})
+	go func() {
+		interval := timeout / 4
+		if interval < time.Second {
+			interval = time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				last := time.Unix(0, atomic.LoadInt64(&active))
+				if time.Since(last) > timeout {
+					atomic.StoreInt32(&idled, 1)
+					a.Close()
+					b.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sent, recv, err = Relay(&activeRWC{a, &active}, &activeRWC{b, &active})
+	close(done)
+	if atomic.LoadInt32(&idled) == 1 {
+		err = ErrIdleTimeout
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayIdle(t *testing.T) {
+	a, a1 := net.Pipe()
+	b, b1 := net.Pipe()
+	defer a1.Close()
+	defer b1.Close()
+
+	ch := make(chan error, 1)
+	go func() {
+		_, _, err := RelayIdle(a, b, 500*time.Millisecond)
+		ch <- err
+	}()
+
+	go func() {
+		var buf [10]byte
+		for {
+			if _, err := b1.Read(buf[:]); err != nil {
+				return
+			}
+		}
+	}()
+	// keep relay busy in one direction, it shouldn't time out.
+	for i := 0; i < 6; i++ {
+		a1.Write([]byte("ping"))
+		time.Sleep(200 * time.Millisecond)
+	}
+	select {
+	case err := <-ch:
+		t.Fatalf("relay closed while active: %v", err)
+	default:
+	}
+
+	select {
+	case err := <-ch:
+		if err != ErrIdleTimeout {
+			t.Fatalf("wrong error: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("relay idle not closed.")
+	}
+}
@@ -0,0 +1,74 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrDialBusy = errors.New("too many dials in flight, wait timeout.")
+
+// LimitDialer allows at most max dials in flight, others wait in queue
+// up to Wait (zero means until ctx done), and fail with ErrDialBusy
+// after that. It keeps a recovering upstream from flooded by dials.
+type LimitDialer struct {
+	Dialer
+	sem  chan struct{}
+	Wait time.Duration
+}
+
+func NewLimitDialer(dialer Dialer, max int, wait time.Duration) (ld *LimitDialer) {
+	return &LimitDialer{
+		Dialer: dialer,
+		sem:    make(chan struct{}, max),
+		Wait:   wait,
+	}
+}
+
+// InFlight returns dials running now.
+func (ld *LimitDialer) InFlight() int {
+	return len(ld.sem)
+}
+
+func (ld *LimitDialer) acquire(ctx context.Context) (err error) {
+	select {
+	case ld.sem <- struct{}{}:
+		return
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if ld.Wait != 0 {
+		timer := time.NewTimer(ld.Wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case ld.sem <- struct{}{}:
+		return
+	case <-timeout:
+		return ErrDialBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ld *LimitDialer) Dial(network, address string) (net.Conn, error) {
+	return ld.DialContext(context.Background(), network, address)
+}
+
+func (ld *LimitDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	err := ld.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { <-ld.sem }()
+	return DialContext(ctx, ld.Dialer, network, address)
+}
+
+func (ld *LimitDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ld.DialContext(ctx, network, address)
+}
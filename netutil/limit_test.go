@@ -0,0 +1,57 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockDialer blocks dials until release closed.
+type blockDialer struct {
+	release chan struct{}
+}
+
+func (bd *blockDialer) Dial(network, address string) (net.Conn, error) {
+	<-bd.release
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestLimitDialer(t *testing.T) {
+	bd := &blockDialer{release: make(chan struct{})}
+	ld := NewLimitDialer(bd, 2, 50*time.Millisecond)
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := ld.Dial("tcp", "127.0.0.1:1")
+			if err == nil {
+				conn.Close()
+			}
+			done <- err
+		}()
+	}
+	for ld.InFlight() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := ld.Dial("tcp", "127.0.0.1:1"); err != ErrDialBusy {
+		t.Fatalf("dial not limited: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ld.DialContext(ctx, "tcp", "127.0.0.1:1"); err != context.Canceled {
+		t.Fatalf("canceled dial waited: %v", err)
+	}
+
+	close(bd.release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ld.InFlight() != 0 {
+		t.Fatalf("slots not released: %d", ld.InFlight())
+	}
+}
@@ -0,0 +1,123 @@
+package netutil
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// SplitAddrs splits comma separated addresses, blanks are ignored.
+func SplitAddrs(addresses string) (addrs []string) {
+	for _, addr := range strings.Split(addresses, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return
+}
+
+// ListenAll listens in each of comma separated addresses by listen, and
+// returns a listener accepting from all of them. If any address failed,
+// error tells every failed one, and no one is listened.
+func ListenAll(addresses string, listen func(string) (net.Listener, error)) (net.Listener, error) {
+	addrs := SplitAddrs(addresses)
+	if len(addrs) <= 1 {
+		return listen(strings.TrimSpace(addresses))
+	}
+
+	var listeners []net.Listener
+	var errs []error
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(errs) != 0 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, errors.Join(errs...)
+	}
+	return NewMultiListener(listeners...), nil
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// MultiListener accepts connections from all its listeners. Addr is of
+// the first one.
+type MultiListener struct {
+	listeners []net.Listener
+	ch        chan acceptResult
+	done      chan struct{}
+	once      sync.Once
+}
+
+func NewMultiListener(listeners ...net.Listener) (ml *MultiListener) {
+	ml = &MultiListener{
+		listeners: listeners,
+		ch:        make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.loop(l)
+	}
+	return
+}
+
+func (ml *MultiListener) loop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case ml.ch <- acceptResult{conn, err}:
+		case <-ml.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (ml *MultiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.ch:
+		return r.conn, r.err
+	case <-ml.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *MultiListener) Close() (err error) {
+	ml.once.Do(func() {
+		close(ml.done)
+		for _, l := range ml.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return
+}
+
+func (ml *MultiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
+// Addrs returns addresses of all listeners.
+func (ml *MultiListener) Addrs() (addrs []net.Addr) {
+	for _, l := range ml.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenAll(t *testing.T) {
+	l, err := Listen("127.0.0.1:0, 127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ml := l.(*MultiListener)
+	addrs := ml.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("listened in %v", addrs)
+	}
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sconn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sconn.LocalAddr().String() != addr.String() {
+			t.Fatalf("accepted from %s, want %s", sconn.LocalAddr(), addr)
+		}
+		sconn.Close()
+		conn.Close()
+	}
+
+	// one address failed, no one listened.
+	_, err = Listen(addrs[0].String() + ",127.0.0.1:0")
+	if err == nil {
+		t.Fatal("address in use listened.")
+	}
+
+	l.Close()
+	if _, err = l.Accept(); err != net.ErrClosed {
+		t.Fatalf("accept after close: %v", err)
+	}
+}
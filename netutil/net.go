@@ -1,9 +1,10 @@
 package netutil
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
-	"sync"
 	"time"
 
 	logging "github.com/op/go-logging"
@@ -13,26 +14,109 @@ var (
 	logger = logging.MustGetLogger("sutils")
 )
 
-var (
-	BUFFERSIZE = 8 * 1024
-	BufferPool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, BUFFERSIZE)
-		},
+var ErrNoCloseWrite = errors.New("connection can't close writing.")
+
+// Drainer is implemented by readers which keep received data in buffers
+// of their own, such as tunnel streams. Copy lets them write the data out
+// directly instead of reading it into a pooled buffer first.
+type Drainer interface {
+	DrainTo(io.Writer) (int64, error)
+}
+
+// Copy copies from src to dst until EOF or error. A buffer is borrowed from
+// BufferPool only while the copy is running. Between tcp sockets, data is
+// spliced in kernel if supported.
+func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
+	if d, ok := src.(Drainer); ok {
+		return d.DrainTo(dst)
 	}
-)
+	if written, err, ok := spliceCopy(dst, src); ok {
+		return written, err
+	}
+
+	pool := BufferPool
+	buf := pool.Get()
+	defer pool.Put(buf)
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+			if ew != nil {
+				err = ew
+				return
+			}
+			if nr != nw {
+				err = io.ErrShortWrite
+				return
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			return
+		}
+	}
+}
 
 func CopyLink(dst, src io.ReadWriteCloser) {
+	Relay(dst, src)
+}
+
+// Relay copies data between a and b in both directions, and returns after
+// both are closed. sent is the bytes from a to b, recv from b to a. err is
+// the error of the direction ended first, nil if it ended with EOF.
+func Relay(a, b io.ReadWriteCloser) (sent, recv int64, err error) {
+	ch := make(chan error, 2)
 	go func() {
-		defer src.Close()
-		buf := BufferPool.Get().([]byte)
-		defer BufferPool.Put(buf)
-		io.CopyBuffer(src, dst, buf)
+		defer a.Close()
+		var e error
+		recv, e = Copy(a, b)
+		ch <- e
 	}()
-	defer dst.Close()
-	buf := BufferPool.Get().([]byte)
-	defer BufferPool.Put(buf)
-	io.CopyBuffer(dst, src, nil)
+	go func() {
+		defer b.Close()
+		var e error
+		sent, e = Copy(b, a)
+		ch <- e
+	}()
+	// the other side fails because we closed it, ignore that.
+	err = <-ch
+	<-ch
+	return
+}
+
+// CloseWriter shuts down writing side of connection, like TCPConn.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// RelayHalf is Relay, but a direction ended with EOF only closes writing
+// of its destination if it can, data in the other direction keeps going
+// until it ends too. Both are closed when returned.
+func RelayHalf(a, b io.ReadWriteCloser) (sent, recv int64, err error) {
+	ch := make(chan error, 2)
+	half := func(dst, src io.ReadWriteCloser, n *int64) {
+		var e error
+		*n, e = Copy(dst, src)
+		cw, ok := dst.(CloseWriter)
+		if e != nil || !ok || cw.CloseWrite() != nil {
+			// can't keep the other direction.
+			a.Close()
+			b.Close()
+		}
+		ch <- e
+	}
+	go half(a, b, &recv)
+	go half(b, a, &sent)
+	err = <-ch
+	if e := <-ch; err == nil {
+		err = e
+	}
+	a.Close()
+	b.Close()
+	return
 }
 
 type Dialer interface {
@@ -44,6 +128,46 @@ type TimeoutDialer interface {
 	DialTimeout(string, string, time.Duration) (net.Conn, error)
 }
 
+// ContextDialer gives up dialing when ctx is done. Dial of it should be
+// DialContext with background context.
+type ContextDialer interface {
+	Dialer
+	DialContext(context.Context, string, string) (net.Conn, error)
+}
+
+// DialContext dials by dialer with ctx. Dialer not a ContextDialer runs
+// in background, and connection it made after ctx done is closed.
+func DialContext(ctx context.Context, dialer Dialer, network, address string) (net.Conn, error) {
+	if cd, ok := dialer.(ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+	if ctx.Done() == nil {
+		return dialer.Dial(network, address)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial(network, address)
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
 type TcpDialer struct {
 }
 
@@ -51,11 +175,17 @@ func (td *TcpDialer) Dial(network, address string) (net.Conn, error) {
 	return net.Dial(network, address)
 }
 
+func (td *TcpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
 func (td *TcpDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
 	return net.DialTimeout(network, address, timeout)
 }
 
-var DefaultTcpDialer TimeoutDialer = &TcpDialer{}
+// DefaultTcpDialer makes direct connections, racing ipv6 and ipv4.
+var DefaultTcpDialer TimeoutDialer = NewEyeballsDialer(&TcpDialer{})
 
 type Tcp4Dialer struct {
 }
@@ -64,6 +194,11 @@ func (td *Tcp4Dialer) Dial(network, address string) (net.Conn, error) {
 	return net.Dial("tcp4", address)
 }
 
+func (td *Tcp4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp4", address)
+}
+
 func (td *Tcp4Dialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
 	return net.DialTimeout("tcp4", address, timeout)
 }
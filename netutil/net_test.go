@@ -0,0 +1,55 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+type slowDialer struct {
+	delay time.Duration
+	conns chan net.Conn
+}
+
+func (sd *slowDialer) Dial(network, address string) (net.Conn, error) {
+	time.Sleep(sd.delay)
+	a, b := net.Pipe()
+	sd.conns <- b
+	return a, nil
+}
+
+func TestDialContext(t *testing.T) {
+	sd := &slowDialer{delay: 200 * time.Millisecond, conns: make(chan net.Conn, 1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := DialContext(ctx, sd, "tcp", "example.com:80")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("dial not canceled: %v", err)
+	}
+
+	// connection made too late should be closed.
+	peer := <-sd.conns
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err = peer.Read(buf[:]); err == nil || isTimeout(err) {
+		t.Fatalf("late connection not closed: %v", err)
+	}
+
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	conn, err := DialContext(context.Background(), DefaultTcpDialer, "tcp", lsock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,121 @@
+package netutil
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM_FLAGS: unicode, oem, request target, ntlm, always sign, extended
+// session security, target info, 128 and 56 bits.
+const NTLM_FLAGS = 0xa0888207
+
+var NTLM_SIGNATURE = []byte("NTLMSSP\x00")
+
+var ErrNtlmChallenge = errors.New("ntlm challenge invalid.")
+
+func utf16le(s string) []byte {
+	var buf bytes.Buffer
+	for _, c := range utf16.Encode([]rune(s)) {
+		binary.Write(&buf, binary.LittleEndian, c)
+	}
+	return buf.Bytes()
+}
+
+// ntlmNegotiate is the first message, type 1.
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, NTLM_SIGNATURE)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], NTLM_FLAGS)
+	return msg
+}
+
+// ntowfv2 is key of NTLMv2 from password, user and domain.
+func ntowfv2(user, password, domain string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	mac := hmac.New(md5.New, h.Sum(nil))
+	mac.Write(utf16le(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmV2Response returns NT and LM responses to server challenge.
+func ntlmV2Response(key, schal, cchal []byte, timestamp uint64, targetInfo []byte) (nt, lm []byte) {
+	var blob bytes.Buffer
+	blob.Write([]byte{0x01, 0x01, 0, 0, 0, 0, 0, 0})
+	binary.Write(&blob, binary.LittleEndian, timestamp)
+	blob.Write(cchal)
+	blob.Write([]byte{0, 0, 0, 0})
+	blob.Write(targetInfo)
+	blob.Write([]byte{0, 0, 0, 0})
+
+	mac := hmac.New(md5.New, key)
+	mac.Write(schal)
+	mac.Write(blob.Bytes())
+	nt = append(mac.Sum(nil), blob.Bytes()...)
+
+	mac = hmac.New(md5.New, key)
+	mac.Write(schal)
+	mac.Write(cchal)
+	lm = append(mac.Sum(nil), cchal...)
+	return
+}
+
+// filetime is 100ns since 1601-01-01.
+func filetime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+// ntlmAuthenticate answers challenge (type 2) with type 3 message.
+// username can be DOMAIN\user.
+func ntlmAuthenticate(challenge []byte, username, password string) (msg []byte, err error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], NTLM_SIGNATURE) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, ErrNtlmChallenge
+	}
+	schal := challenge[24:32]
+	tlen := int(binary.LittleEndian.Uint16(challenge[40:]))
+	toff := int(binary.LittleEndian.Uint32(challenge[44:]))
+	if toff+tlen > len(challenge) {
+		return nil, ErrNtlmChallenge
+	}
+	targetInfo := challenge[toff : toff+tlen]
+
+	domain := ""
+	if idx := strings.Index(username, "\\"); idx != -1 {
+		domain, username = username[:idx], username[idx+1:]
+	}
+
+	cchal := make([]byte, 8)
+	_, err = rand.Read(cchal)
+	if err != nil {
+		return
+	}
+	nt, lm := ntlmV2Response(ntowfv2(username, password, domain),
+		schal, cchal, filetime(time.Now()), targetInfo)
+
+	// domain, user, workstation, lm, nt, session key in order.
+	fields := [][]byte{utf16le(domain), utf16le(username), nil, lm, nt, nil}
+	slots := []int{28, 36, 44, 12, 20, 52}
+	msg = make([]byte, 64)
+	copy(msg, NTLM_SIGNATURE)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	binary.LittleEndian.PutUint32(msg[60:], NTLM_FLAGS)
+	for i, field := range fields {
+		pos := slots[i]
+		binary.LittleEndian.PutUint16(msg[pos:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[pos+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[pos+4:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	return
+}
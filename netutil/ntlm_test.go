@@ -0,0 +1,32 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// vectors from MS-NLMP 4.2.4.
+func TestNtlmV2(t *testing.T) {
+	key := ntowfv2("User", "Password", "Domain")
+	if hex.EncodeToString(key) != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Fatalf("ntowfv2 wrong: %x", key)
+	}
+
+	var info bytes.Buffer
+	info.Write([]byte{0x02, 0x00, 0x0c, 0x00})
+	info.Write(utf16le("Domain"))
+	info.Write([]byte{0x01, 0x00, 0x0c, 0x00})
+	info.Write(utf16le("Server"))
+	info.Write([]byte{0x00, 0x00, 0x00, 0x00})
+
+	schal, _ := hex.DecodeString("0123456789abcdef")
+	cchal, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	nt, lm := ntlmV2Response(key, schal, cchal, 0, info.Bytes())
+	if hex.EncodeToString(nt[:16]) != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Fatalf("nt proof wrong: %x", nt[:16])
+	}
+	if hex.EncodeToString(lm[:16]) != "86c35097ac9cec102554764a57cccc19" {
+		t.Fatalf("lmv2 wrong: %x", lm[:16])
+	}
+}
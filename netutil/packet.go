@@ -0,0 +1,70 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const MAX_PACKET = 65535
+
+var ErrPacketTooLarge = errors.New("packet too large.")
+
+// PacketConn keeps boundaries of packets over a stream connection, such
+// as udp carried by a tunnel stream. Each packet is prefixed by its
+// length in 2 bytes, big endian. One Read returns one packet, and the
+// part not fit in buffer is dropped, like udp does.
+type PacketConn struct {
+	net.Conn
+	rlock sync.Mutex
+	wlock sync.Mutex
+	rbuf  []byte
+}
+
+func NewPacketConn(conn net.Conn) (pc *PacketConn) {
+	return &PacketConn{Conn: conn}
+}
+
+func (pc *PacketConn) Read(b []byte) (n int, err error) {
+	pc.rlock.Lock()
+	defer pc.rlock.Unlock()
+
+	var header [2]byte
+	_, err = io.ReadFull(pc.Conn, header[:])
+	if err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size <= len(b) {
+		return io.ReadFull(pc.Conn, b[:size])
+	}
+
+	if pc.rbuf == nil {
+		pc.rbuf = make([]byte, MAX_PACKET)
+	}
+	_, err = io.ReadFull(pc.Conn, pc.rbuf[:size])
+	if err != nil {
+		return
+	}
+	n = copy(b, pc.rbuf[:size])
+	return
+}
+
+func (pc *PacketConn) Write(b []byte) (n int, err error) {
+	if len(b) > MAX_PACKET {
+		return 0, ErrPacketTooLarge
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	pc.wlock.Lock()
+	defer pc.wlock.Unlock()
+	_, err = pc.Conn.Write(buf)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
@@ -0,0 +1,241 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol from haproxy, passing address of client through proxies.
+const (
+	PROXY_V1 = "v1"
+	PROXY_V2 = "v2"
+	// PROXY_TIMEOUT in seconds to read header.
+	PROXY_TIMEOUT = 10
+	// max length of v1 line, including CRLF.
+	PROXY_V1_MAX = 107
+)
+
+var PROXY_V2_SIG = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	ErrProxyHeader  = errors.New("proxy protocol header invalid.")
+	ErrProxyVersion = errors.New("proxy protocol version should be v1 or v2.")
+)
+
+func CheckProxyVersion(version string) (err error) {
+	switch version {
+	case "", PROXY_V1, PROXY_V2:
+		return nil
+	}
+	return ErrProxyVersion
+}
+
+// ProxyConn is connection with a PROXY header read, addresses in header
+// are returned as RemoteAddr and LocalAddr.
+type ProxyConn struct {
+	net.Conn
+	r   *bufio.Reader
+	src net.Addr
+	dst net.Addr
+}
+
+// AcceptProxy reads PROXY header, v1 or v2, from conn. Header is required.
+// Addresses of conn are kept if header says unknown or local.
+func AcceptProxy(conn net.Conn) (pc *ProxyConn, err error) {
+	pc = &ProxyConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+		src:  conn.RemoteAddr(),
+		dst:  conn.LocalAddr(),
+	}
+	conn.SetReadDeadline(time.Now().Add(PROXY_TIMEOUT * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	sig, err := pc.r.Peek(len(PROXY_V2_SIG))
+	if err != nil {
+		return
+	}
+	switch {
+	case bytes.Equal(sig, PROXY_V2_SIG):
+		err = pc.readV2()
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		err = pc.readV1()
+	default:
+		err = ErrProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (pc *ProxyConn) readV1() (err error) {
+	var line []byte
+	for len(line) < PROXY_V1_MAX {
+		var c byte
+		c, err = pc.r.ReadByte()
+		if err != nil {
+			return
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrProxyHeader
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return
+	}
+	pc.src, pc.dst = src, dst
+	return
+}
+
+func parseProxyAddr(host, port string) (addr *net.TCPAddr, err error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func (pc *ProxyConn) readV2() (err error) {
+	var hdr [16]byte
+	_, err = io.ReadFull(pc.r, hdr[:])
+	if err != nil {
+		return
+	}
+	if hdr[12]>>4 != 2 {
+		return ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	_, err = io.ReadFull(pc.r, body)
+	if err != nil {
+		return
+	}
+	// LOCAL command, connection made by proxy itself.
+	if hdr[12]&0xf == 0 {
+		return
+	}
+
+	switch hdr[13] {
+	case 0x11: // tcp over ipv4
+		if len(body) < 12 {
+			return ErrProxyHeader
+		}
+		pc.src = &net.TCPAddr{IP: net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:]))}
+		pc.dst = &net.TCPAddr{IP: net.IP(body[4:8]),
+			Port: int(binary.BigEndian.Uint16(body[10:]))}
+	case 0x21: // tcp over ipv6
+		if len(body) < 36 {
+			return ErrProxyHeader
+		}
+		pc.src = &net.TCPAddr{IP: net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:]))}
+		pc.dst = &net.TCPAddr{IP: net.IP(body[16:32]),
+			Port: int(binary.BigEndian.Uint16(body[34:]))}
+	}
+	// other families are kept as unknown.
+	return
+}
+
+func (pc *ProxyConn) Read(b []byte) (n int, err error) {
+	return pc.r.Read(b)
+}
+
+func (pc *ProxyConn) RemoteAddr() net.Addr {
+	return pc.src
+}
+
+func (pc *ProxyConn) LocalAddr() net.Addr {
+	return pc.dst
+}
+
+// WriteProxy writes PROXY header of version for connection from src to
+// dst. Addresses not tcp are sent as unknown.
+func WriteProxy(w io.Writer, version string, src, dst net.Addr) (err error) {
+	var header []byte
+	switch version {
+	case PROXY_V1:
+		header = proxyV1(src, dst)
+	case PROXY_V2:
+		header = proxyV2(src, dst)
+	default:
+		return ErrProxyVersion
+	}
+	_, err = w.Write(header)
+	return
+}
+
+func tcpAddrs(src, dst net.Addr) (s, d *net.TCPAddr, ok bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	return s, d, ok1 && ok2
+}
+
+func proxyV1(src, dst net.Addr) []byte {
+	s, d, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	sip, dip := s.IP.To16(), d.IP.To16()
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		family = "TCP4"
+		sip, dip = s.IP.To4(), d.IP.To4()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, sip, dip, s.Port, d.Port))
+}
+
+func proxyV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(PROXY_V2_SIG)
+	s, d, ok := tcpAddrs(src, dst)
+	if !ok {
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	var body []byte
+	family := byte(0x21)
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		family = 0x11
+		body = append(body, s.IP.To4()...)
+		body = append(body, d.IP.To4()...)
+	} else {
+		body = append(body, s.IP.To16()...)
+		body = append(body, d.IP.To16()...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(s.Port))
+	body = binary.BigEndian.AppendUint16(body, uint16(d.Port))
+
+	buf.Write([]byte{0x21, family})
+	binary.Write(&buf, binary.BigEndian, uint16(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
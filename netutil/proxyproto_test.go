@@ -0,0 +1,54 @@
+package netutil
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	for _, c := range []struct {
+		src, dst string
+	}{
+		{"1.2.3.4:1111", "5.6.7.8:2222"},
+		{"[2001:db8::1]:1111", "[2001:db8::2]:2222"},
+	} {
+		src, _ := net.ResolveTCPAddr("tcp", c.src)
+		dst, _ := net.ResolveTCPAddr("tcp", c.dst)
+		for _, version := range []string{PROXY_V1, PROXY_V2} {
+			a, b := net.Pipe()
+			go func() {
+				var buf bytes.Buffer
+				WriteProxy(&buf, version, src, dst)
+				buf.WriteString("data")
+				a.Write(buf.Bytes())
+				a.Close()
+			}()
+
+			pc, err := AcceptProxy(b)
+			if err != nil {
+				t.Fatalf("%s: %s", version, err)
+			}
+			if pc.RemoteAddr().String() != c.src || pc.LocalAddr().String() != c.dst {
+				t.Fatalf("%s: wrong addresses %s => %s.",
+					version, pc.RemoteAddr(), pc.LocalAddr())
+			}
+			var buf [10]byte
+			n, _ := pc.Read(buf[:])
+			if string(buf[:n]) != "data" {
+				t.Fatalf("%s: data after header lost: %q.", version, buf[:n])
+			}
+			b.Close()
+		}
+	}
+
+	a, b := net.Pipe()
+	go func() {
+		a.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		a.Close()
+	}()
+	_, err := AcceptProxy(b)
+	if err != ErrProxyHeader {
+		t.Fatalf("header not proxy accepted: %v", err)
+	}
+}
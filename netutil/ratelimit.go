@@ -0,0 +1,105 @@
+package netutil
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows rate events per second on average, and up to burst
+// at once.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a bucket full of tokens. burst less than 1 is
+// taken as 1.
+func NewTokenBucket(rate, burst float64) (tb *TokenBucket) {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// fill adds tokens since last time, lock held.
+func (tb *TokenBucket) fill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// Allow takes a token if there is one.
+func (tb *TokenBucket) Allow() bool {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	tb.fill(time.Now())
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// Wait takes n tokens, and sleeps until they are filled if not enough.
+// Tokens go below zero, so n larger than burst works.
+func (tb *TokenBucket) Wait(n int) {
+	tb.lock.Lock()
+	tb.fill(time.Now())
+	tb.tokens -= float64(n)
+	var d time.Duration
+	if tb.tokens < 0 {
+		d = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.lock.Unlock()
+	time.Sleep(d)
+}
+
+// ShapedConn limits bytes read by rbucket and written by wbucket, nil
+// means no limit. Buckets can be shared by connections.
+type ShapedConn struct {
+	net.Conn
+	rbucket *TokenBucket
+	wbucket *TokenBucket
+}
+
+func NewShapedConn(conn net.Conn, rbucket, wbucket *TokenBucket) (sc *ShapedConn) {
+	return &ShapedConn{
+		Conn:    conn,
+		rbucket: rbucket,
+		wbucket: wbucket,
+	}
+}
+
+func (sc *ShapedConn) Read(b []byte) (n int, err error) {
+	n, err = sc.Conn.Read(b)
+	if sc.rbucket != nil && n > 0 {
+		sc.rbucket.Wait(n)
+	}
+	return
+}
+
+func (sc *ShapedConn) Write(b []byte) (n int, err error) {
+	if sc.wbucket != nil {
+		sc.wbucket.Wait(len(b))
+	}
+	return sc.Conn.Write(b)
+}
+
+// CloseWrite closes writing of the connection under, if it can.
+func (sc *ShapedConn) CloseWrite() error {
+	if cw, ok := sc.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return ErrNoCloseWrite
+}
@@ -0,0 +1,19 @@
+package netutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(10000, 1000)
+	start := time.Now()
+	tb.Wait(1000)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("burst not allowed.")
+	}
+	tb.Wait(3000)
+	if d := time.Since(start); d < 250*time.Millisecond || d > time.Second {
+		t.Fatalf("wait wrong time: %s.", d)
+	}
+}
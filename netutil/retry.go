@@ -0,0 +1,92 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	RETRY_BASE = 200 * time.Millisecond
+	RETRY_MAX  = 5 * time.Second
+)
+
+// IsTransient tells if dial failed for reason may go away soon, such as
+// refused or timeout. Errors by canceled context are not.
+func IsTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// RetryDialer dials again when failed by transient error, up to Retries
+// times. Wait before retry doubles from Base up to Max, with half of it
+// random, so clients won't retry at the same time.
+type RetryDialer struct {
+	Dialer
+	Retries int
+	Base    time.Duration
+	Max     time.Duration
+}
+
+func NewRetryDialer(dialer Dialer, retries int) (rd *RetryDialer) {
+	return &RetryDialer{
+		Dialer:  dialer,
+		Retries: retries,
+		Base:    RETRY_BASE,
+		Max:     RETRY_MAX,
+	}
+}
+
+// Backoff returns time to wait before nth retry, from 0.
+func (rd *RetryDialer) Backoff(n int) time.Duration {
+	d := rd.Max
+	if n < 30 && rd.Base<<uint(n) < rd.Max {
+		d = rd.Base << uint(n)
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func (rd *RetryDialer) Dial(network, address string) (net.Conn, error) {
+	return rd.DialContext(context.Background(), network, address)
+}
+
+func (rd *RetryDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	for i := 0; ; i++ {
+		conn, err = DialContext(ctx, rd.Dialer, network, address)
+		if err == nil || i >= rd.Retries || !IsTransient(err) {
+			return
+		}
+		d := rd.Backoff(i)
+		logger.Debugf("dial %s failed: %s, retry in %s.", address, err.Error(), d)
+
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// DialTimeout limits time of all tries in timeout.
+func (rd *RetryDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return rd.DialContext(ctx, network, address)
+}
@@ -0,0 +1,74 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyDialer fails with err for fails times.
+type flakyDialer struct {
+	fails int
+	err   error
+	tries int
+}
+
+func (fd *flakyDialer) Dial(network, address string) (net.Conn, error) {
+	fd.tries++
+	if fd.tries <= fd.fails {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fd.err}
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestRetryDialer(t *testing.T) {
+	fd := &flakyDialer{fails: 2, err: syscall.ECONNREFUSED}
+	rd := NewRetryDialer(fd, 3)
+	rd.Base = time.Millisecond
+	conn, err := rd.Dial("tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if fd.tries != 3 {
+		t.Fatalf("tried %d times", fd.tries)
+	}
+
+	fd = &flakyDialer{fails: 5, err: syscall.ECONNREFUSED}
+	rd.Dialer = fd
+	if _, err = rd.Dial("tcp", "127.0.0.1:1"); !errors.Is(err, syscall.ECONNREFUSED) || fd.tries != 4 {
+		t.Fatalf("retries not limited: %v, %d", err, fd.tries)
+	}
+
+	fd = &flakyDialer{fails: 5, err: syscall.EACCES}
+	rd.Dialer = fd
+	if _, err = rd.Dial("tcp", "127.0.0.1:1"); fd.tries != 1 {
+		t.Fatalf("retried permanent error: %v, %d", err, fd.tries)
+	}
+
+	fd = &flakyDialer{fails: 5, err: syscall.ECONNREFUSED}
+	rd.Dialer = fd
+	rd.Base = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = rd.DialContext(ctx, "tcp", "127.0.0.1:1"); fd.tries != 1 {
+		t.Fatalf("retried after context done: %v, %d", err, fd.tries)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	rd := NewRetryDialer(nil, 10)
+	for n := 0; n < 40; n++ {
+		d := rd.Backoff(n)
+		if d < 0 || d > rd.Max {
+			t.Fatalf("backoff %d out of range: %s", n, d)
+		}
+	}
+	if d := rd.Backoff(0); d < RETRY_BASE/2 || d > RETRY_BASE {
+		t.Fatalf("first backoff wrong: %s", d)
+	}
+}
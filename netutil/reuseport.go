@@ -0,0 +1,96 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var ErrReuseUnix = errors.New("reuseport: not for unix socket.")
+
+// ListenReuse calls listen for each of n acceptors, all listeners are
+// closed if any failed. Less than one acceptor means one.
+func ListenReuse(n int, listen func(i int) (net.Listener, error)) (listeners []net.Listener, err error) {
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		var l net.Listener
+		l, err = listen(i)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return
+}
+
+// listenPort listens in address as acceptor i of n, with SO_REUSEPORT
+// if more than one, so they share the port and kernel spreads
+// connections among them. The first acceptor is handed off as if there
+// is no others.
+func listenPort(lc net.ListenConfig, network, address string, i, n int) (net.Listener, error) {
+	if n > 1 {
+		control := lc.Control
+		lc.Control = func(network, address string, c syscall.RawConn) (err error) {
+			if control != nil {
+				err = control(network, address, c)
+				if err != nil {
+					return
+				}
+			}
+			return ReuseControl(network, address, c)
+		}
+	}
+	key := address
+	if i > 0 {
+		key = fmt.Sprintf("%s#%d", address, i)
+	}
+	return listenInherit(network, key, func() (net.Listener, error) {
+		return lc.Listen(context.Background(), network, address)
+	})
+}
+
+// ListenPort opens n listeners in address of network, each for its own
+// accept loop. They can be handed off.
+func ListenPort(network, address string, n int) ([]net.Listener, error) {
+	return ListenReuse(n, func(i int) (net.Listener, error) {
+		return listenPort(net.ListenConfig{}, network, address, i, n)
+	})
+}
+
+// ListenN is Listen for n acceptors, unix socket only for one.
+func ListenN(addresses string, n int) ([]net.Listener, error) {
+	if n <= 1 {
+		l, err := Listen(addresses)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	return ListenReuse(n, func(i int) (net.Listener, error) {
+		return ListenAll(addresses, func(address string) (net.Listener, error) {
+			if _, ok := ParseUnix(address); ok {
+				return nil, ErrReuseUnix
+			}
+			return listenPort(net.ListenConfig{}, "tcp", address, i, n)
+		})
+	})
+}
+
+// ReuseControl sets SO_REUSEPORT as Control of net.Dialer or
+// net.ListenConfig, so sockets can share a local port.
+func ReuseControl(network, address string, c syscall.RawConn) (err error) {
+	e := c.Control(func(fd uintptr) {
+		err = setReusePort(fd)
+	})
+	if e != nil {
+		return e
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenPort(t *testing.T) {
+	if SPLICE == false {
+		t.Skip("reuseport only in linux")
+	}
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := lsock.Addr().String()
+	lsock.Close()
+
+	lsocks, err := ListenPort("tcp", address, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range lsocks {
+			l.Close()
+		}
+	}()
+	if len(lsocks) != 4 {
+		t.Fatalf("%d listeners", len(lsocks))
+	}
+
+	ml := NewMultiListener(lsocks...)
+	go func() {
+		for {
+			conn, err := ml.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 16; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf [1]byte
+		if _, err = conn.Read(buf[:]); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func TestListenReuseFailed(t *testing.T) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+
+	handoffLock.Lock()
+	n := len(listeners)
+	handoffLock.Unlock()
+
+	// port taken without SO_REUSEPORT.
+	_, err = ListenPort("tcp", lsock.Addr().String(), 2)
+	if err == nil {
+		t.Fatal("listened in port taken")
+	}
+	handoffLock.Lock()
+	left := len(listeners) - n
+	handoffLock.Unlock()
+	if left != 0 {
+		t.Fatalf("%d listeners left", left)
+	}
+}
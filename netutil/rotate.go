@@ -0,0 +1,74 @@
+package netutil
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const ROTATE_KEEP = 7
+
+// RotateFile appends to file in path, which is moved to path.1 when it
+// grows over MaxSize, and path.1 to path.2, keeps Keep of them.
+// Zero MaxSize means never rotate.
+type RotateFile struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	MaxSize int64
+	Keep    int
+}
+
+func NewRotateFile(path string, maxsize int64) (rf *RotateFile, err error) {
+	rf = &RotateFile{path: path, MaxSize: maxsize, Keep: ROTATE_KEEP}
+	err = rf.open()
+	return
+}
+
+func (rf *RotateFile) open() (err error) {
+	rf.file, err = os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	fi, err := rf.file.Stat()
+	if err != nil {
+		rf.file.Close()
+		return
+	}
+	rf.size = fi.Size()
+	return
+}
+
+func (rf *RotateFile) rotate() (err error) {
+	rf.file.Close()
+	for i := rf.Keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if rf.Keep > 0 {
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+	return rf.open()
+}
+
+func (rf *RotateFile) Write(b []byte) (n int, err error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.MaxSize != 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.MaxSize {
+		err = rf.rotate()
+		if err != nil {
+			return
+		}
+	}
+	n, err = rf.file.Write(b)
+	rf.size += int64(n)
+	return
+}
+
+func (rf *RotateFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.file.Close()
+}
@@ -0,0 +1,39 @@
+package netutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := NewRotateFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Keep = 2
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err = rf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+
+	for name, content := range map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: %q", name, data)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); err == nil {
+		t.Error("more files kept")
+	}
+}
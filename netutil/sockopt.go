@@ -0,0 +1,171 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrNotSupported = errors.New("not supported in this platform.")
+
+// SockOpts tunes tcp connections between client and server.
+// Zero value leaves the system default.
+type SockOpts struct {
+	NoDelay    *bool
+	KeepAlive  int // seconds, negative to disable.
+	SendBuffer int
+	RecvBuffer int
+	Congestion string // tcp congestion control algorithm, linux only.
+	// Multipath uses multipath tcp if kernel supports, falls back to tcp
+	// if not. It is set when dialing or listening, linux only.
+	Multipath bool
+}
+
+// NewListener listens in comma separated addresses with options needed
+// before that. ipv6 address is listened in tcp6 if network is tcp4.
+func (so *SockOpts) NewListener(network, addresses string) (net.Listener, error) {
+	listeners, err := so.NewListeners(network, addresses, 1)
+	if err != nil {
+		return nil, err
+	}
+	return listeners[0], nil
+}
+
+// NewListeners is NewListener for n acceptors sharing addresses by
+// SO_REUSEPORT.
+func (so *SockOpts) NewListeners(network, addresses string, n int) ([]net.Listener, error) {
+	var lc net.ListenConfig
+	if so.Multipath {
+		lc.SetMultipathTCP(true)
+	}
+	return ListenReuse(n, func(i int) (net.Listener, error) {
+		return ListenAll(addresses, func(address string) (net.Listener, error) {
+			nw := network
+			host, _, err := net.SplitHostPort(address)
+			if err == nil && nw == "tcp4" {
+				if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+					nw = "tcp6"
+				}
+			}
+			return listenPort(lc, nw, address, i, n)
+		})
+	})
+}
+
+func (so *SockOpts) Apply(conn net.Conn) (err error) {
+	tcpconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if so.NoDelay != nil {
+		err = tcpconn.SetNoDelay(*so.NoDelay)
+		if err != nil {
+			return
+		}
+	}
+
+	switch {
+	case so.KeepAlive < 0:
+		err = tcpconn.SetKeepAlive(false)
+	case so.KeepAlive > 0:
+		err = tcpconn.SetKeepAlive(true)
+		if err != nil {
+			return
+		}
+		err = tcpconn.SetKeepAlivePeriod(
+			time.Duration(so.KeepAlive) * time.Second)
+	}
+	if err != nil {
+		return
+	}
+
+	if so.SendBuffer > 0 {
+		err = tcpconn.SetWriteBuffer(so.SendBuffer)
+		if err != nil {
+			return
+		}
+	}
+
+	if so.RecvBuffer > 0 {
+		err = tcpconn.SetReadBuffer(so.RecvBuffer)
+		if err != nil {
+			return
+		}
+	}
+
+	if so.Congestion != "" {
+		err = setCongestion(tcpconn, so.Congestion)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+type TunedDialer struct {
+	Dialer
+	opts *SockOpts
+}
+
+func NewTunedDialer(dialer Dialer, opts *SockOpts) (td *TunedDialer) {
+	return &TunedDialer{Dialer: dialer, opts: opts}
+}
+
+func (td *TunedDialer) Dial(network, address string) (conn net.Conn, err error) {
+	return td.DialContext(context.Background(), network, address)
+}
+
+func (td *TunedDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	conn, err = DialContext(ctx, td.Dialer, network, address)
+	if err != nil {
+		return
+	}
+	err = td.opts.Apply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+func (td *TunedDialer) DialTimeout(network, address string, timeout time.Duration) (conn net.Conn, err error) {
+	dialer, ok := td.Dialer.(TimeoutDialer)
+	if !ok {
+		return td.Dial(network, address)
+	}
+	conn, err = dialer.DialTimeout(network, address, timeout)
+	if err != nil {
+		return
+	}
+	err = td.opts.Apply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+type TunedListener struct {
+	net.Listener
+	opts *SockOpts
+}
+
+func NewTunedListener(listener net.Listener, opts *SockOpts) (tl *TunedListener) {
+	return &TunedListener{Listener: listener, opts: opts}
+}
+
+func (tl *TunedListener) Accept() (conn net.Conn, err error) {
+	conn, err = tl.Listener.Accept()
+	if err != nil {
+		return
+	}
+	err = tl.opts.Apply(conn)
+	if err != nil {
+		// don't break accept loop for one connection.
+		logger.Error(err.Error())
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package netutil
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setCongestion(conn *net.TCPConn, name string) (err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	e := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(
+			int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, name)
+	})
+	if e != nil {
+		return e
+	}
+	return
+}
+
+// BIND_DEVICE tells if connections can be bound to interface.
+const BIND_DEVICE = true
+
+func bindDevice(fd uintptr, iface string) error {
+	return syscall.BindToDevice(int(fd), iface)
+}
+
+// SPLICE tells if Copy moves data between sockets by splice.
+const SPLICE = true
+
+func setMark(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
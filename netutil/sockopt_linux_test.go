@@ -0,0 +1,84 @@
+package netutil
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// getsockopt reads int option of conn.
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) (value int) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e error
+	err = raw.Control(func(fd uintptr) {
+		value, e = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil || e != nil {
+		t.Fatal(err, e)
+	}
+	return
+}
+
+func TestTunedListener(t *testing.T) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodelay := false
+	opts := &SockOpts{
+		NoDelay:    &nodelay,
+		KeepAlive:  30,
+		RecvBuffer: 65536,
+		Congestion: "reno",
+	}
+	listener := NewTunedListener(lsock, opts)
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", lsock.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Fatal("nodelay not cleared")
+	}
+	if getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 1 {
+		t.Fatal("keepalive not set")
+	}
+	if idle := getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 30 {
+		t.Fatalf("keepalive idle: %d", idle)
+	}
+	// kernel doubles buffer size for bookkeeping.
+	if size := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); size < 65536 {
+		t.Fatalf("recv buffer: %d", size)
+	}
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cc string
+	var e error
+	err = raw.Control(func(fd uintptr) {
+		cc, e = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	})
+	if err != nil || e != nil {
+		t.Fatal(err, e)
+	}
+	if cc != "reno" {
+		t.Fatalf("congestion: %s", cc)
+	}
+}
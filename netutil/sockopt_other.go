@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package netutil
+
+import (
+	"net"
+)
+
+func setCongestion(conn *net.TCPConn, name string) (err error) {
+	return ErrNotSupported
+}
+
+// BIND_DEVICE tells if connections can be bound to interface.
+const BIND_DEVICE = false
+
+func bindDevice(fd uintptr, iface string) error {
+	return ErrNotSupported
+}
+
+// SPLICE tells if Copy moves data between sockets by splice.
+const SPLICE = false
+
+func setMark(fd uintptr, mark int) error {
+	return ErrNotSupported
+}
+
+func setReusePort(fd uintptr) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,264 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SOCKS5_VERSION  = 0x05
+	SOCKS5_NOAUTH   = 0x00
+	SOCKS5_USERPASS = 0x02
+	SOCKS5_NOACCEPT = 0xff
+	SOCKS5_CONNECT  = 0x01
+	SOCKS5_BIND     = 0x02
+	SOCKS5_UDP      = 0x03
+	SOCKS5_IPV4     = 0x01
+	SOCKS5_DOMAIN   = 0x03
+	SOCKS5_IPV6     = 0x04
+)
+
+var (
+	ErrSocksNetwork = errors.New("socks5 only support tcp.")
+	ErrSocksVersion = errors.New("socks5 version wrong.")
+	ErrSocksAuth    = errors.New("socks5 auth failed.")
+	ErrSocksAddress = errors.New("socks5 address invalid.")
+)
+
+// Replies of socks5 request, index of Socks5Errors.
+const (
+	SOCKS5_SUCCEEDED   = 0x00
+	SOCKS5_FAILURE     = 0x01
+	SOCKS5_FORBIDDEN   = 0x02
+	SOCKS5_UNREACHABLE = 0x04
+	SOCKS5_REFUSED     = 0x05
+	SOCKS5_NOCOMMAND   = 0x07
+	SOCKS5_NOADDRESS   = 0x08
+)
+
+var Socks5Errors = []string{
+	"",
+	"general failure",
+	"connection forbidden",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Socks5Dialer connects destination through a socks5 proxy, with
+// username and password if not empty.
+type Socks5Dialer struct {
+	dialer   Dialer
+	server   string
+	username string
+	password string
+}
+
+func NewSocks5Dialer(dialer Dialer, server, username, password string) (sd *Socks5Dialer) {
+	return &Socks5Dialer{
+		dialer:   dialer,
+		server:   server,
+		username: username,
+		password: password,
+	}
+}
+
+func (sd *Socks5Dialer) Dial(network, address string) (net.Conn, error) {
+	return sd.DialContext(context.Background(), network, address)
+}
+
+func (sd *Socks5Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, ErrSocksNetwork
+	}
+	conn, err = DialContext(ctx, sd.dialer, "tcp", sd.server)
+	if err != nil {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	err = sd.handshake(conn, address)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+func (sd *Socks5Dialer) handshake(conn net.Conn, address string) (err error) {
+	methods := []byte{SOCKS5_VERSION, 1, SOCKS5_NOAUTH}
+	if sd.username != "" {
+		methods = []byte{SOCKS5_VERSION, 2, SOCKS5_NOAUTH, SOCKS5_USERPASS}
+	}
+	_, err = conn.Write(methods)
+	if err != nil {
+		return
+	}
+
+	var buf [2]byte
+	_, err = io.ReadFull(conn, buf[:])
+	if err != nil {
+		return
+	}
+	if buf[0] != SOCKS5_VERSION {
+		return ErrSocksVersion
+	}
+	switch buf[1] {
+	case SOCKS5_NOAUTH:
+	case SOCKS5_USERPASS:
+		if sd.username == "" {
+			return ErrSocksAuth
+		}
+		err = sd.auth(conn)
+		if err != nil {
+			return
+		}
+	default:
+		return ErrSocksAuth
+	}
+
+	req, err := socks5Request(address)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(req)
+	if err != nil {
+		return
+	}
+	return readSocks5Reply(conn)
+}
+
+// auth sends username and password, RFC 1929.
+func (sd *Socks5Dialer) auth(conn net.Conn) (err error) {
+	if len(sd.username) > 255 || len(sd.password) > 255 {
+		return ErrSocksAuth
+	}
+	req := []byte{0x01, byte(len(sd.username))}
+	req = append(req, sd.username...)
+	req = append(req, byte(len(sd.password)))
+	req = append(req, sd.password...)
+	_, err = conn.Write(req)
+	if err != nil {
+		return
+	}
+
+	var buf [2]byte
+	_, err = io.ReadFull(conn, buf[:])
+	if err != nil {
+		return
+	}
+	if buf[1] != 0x00 {
+		return ErrSocksAuth
+	}
+	return
+}
+
+func socks5Request(address string) (req []byte, err error) {
+	return AppendSocks5Address([]byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0x00}, address)
+}
+
+// AppendSocks5Address appends address as type, host and port in socks5.
+func AppendSocks5Address(b []byte, address string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, ErrSocksAddress
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		b = append(b, SOCKS5_IPV4)
+		b = append(b, ip.To4()...)
+	case ip != nil:
+		b = append(b, SOCKS5_IPV6)
+		b = append(b, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return nil, ErrSocksAddress
+		}
+		b = append(b, SOCKS5_DOMAIN, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(p)), nil
+}
+
+// ReadSocks5Address reads address in socks5 as host:port.
+func ReadSocks5Address(r io.Reader) (address string, err error) {
+	var buf [1]byte
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return
+	}
+	atyp := buf[0]
+	var n int
+	switch atyp {
+	case SOCKS5_IPV4:
+		n = net.IPv4len
+	case SOCKS5_IPV6:
+		n = net.IPv6len
+	case SOCKS5_DOMAIN:
+		_, err = io.ReadFull(r, buf[:])
+		if err != nil {
+			return
+		}
+		n = int(buf[0])
+	default:
+		return "", ErrSocksAddress
+	}
+	b := make([]byte, n+2)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return
+	}
+	host := string(b[:n])
+	if atyp != SOCKS5_DOMAIN {
+		host = net.IP(b[:n]).String()
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// readSocks5Reply reads reply of request, bound address is dropped.
+func readSocks5Reply(conn net.Conn) (err error) {
+	var buf [4]byte
+	_, err = io.ReadFull(conn, buf[:])
+	if err != nil {
+		return
+	}
+	if buf[0] != SOCKS5_VERSION {
+		return ErrSocksVersion
+	}
+	if buf[1] != 0x00 {
+		if int(buf[1]) < len(Socks5Errors) {
+			return errors.New("socks5: " + Socks5Errors[buf[1]] + ".")
+		}
+		return errors.New("socks5: unknown error.")
+	}
+
+	_, err = ReadSocks5Address(io.MultiReader(bytes.NewReader(buf[3:]), conn))
+	return
+}
@@ -0,0 +1,113 @@
+package netutil
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeSocks5 serves one connection, checks auth and request, then
+// relays to target.
+func fakeSocks5(t *testing.T, lsock net.Listener, target string) {
+	conn, err := lsock.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var buf [512]byte
+	io.ReadFull(conn, buf[:2])
+	io.ReadFull(conn, buf[:buf[1]])
+	conn.Write([]byte{SOCKS5_VERSION, SOCKS5_USERPASS})
+
+	io.ReadFull(conn, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(conn, pass)
+	if string(user) != "user" || string(pass) != "pass" {
+		conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	io.ReadFull(conn, buf[:4])
+	if buf[3] != SOCKS5_DOMAIN {
+		t.Errorf("address type wrong: %d", buf[3])
+		return
+	}
+	io.ReadFull(conn, buf[:1])
+	host := make([]byte, buf[0])
+	io.ReadFull(conn, host)
+	io.ReadFull(conn, buf[:2])
+	if string(host) != "localhost" {
+		t.Errorf("host wrong: %s", host)
+		return
+	}
+	conn.Write([]byte{SOCKS5_VERSION, 0, 0, SOCKS5_IPV4, 0, 0, 0, 0, 0, 0})
+
+	dconn, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	Relay(conn, dconn)
+}
+
+func TestSocks5Dialer(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	go fakeSocks5(t, lsock, echo.Addr().String())
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	sd := NewSocks5Dialer(DefaultTcpDialer, lsock.Addr().String(), "user", "pass")
+	conn, err := sd.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	var buf [4]byte
+	io.ReadFull(conn, buf[:])
+	if !bytes.Equal(buf[:], []byte("ping")) {
+		t.Fatalf("wrong reply: %q", buf)
+	}
+
+	if _, err = sd.Dial("udp", "localhost:53"); err != ErrSocksNetwork {
+		t.Fatalf("udp not refused: %v", err)
+	}
+}
+
+func TestSocks5Address(t *testing.T) {
+	for _, address := range []string{"1.2.3.4:80", "[2001:db8::1]:443", "example.com:8080", "abcd:1"} {
+		b, err := AppendSocks5Address(nil, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadSocks5Address(bytes.NewReader(b))
+		if err != nil || got != address {
+			t.Fatalf("%s read as %s: %v", address, got, err)
+		}
+	}
+	if _, err := AppendSocks5Address(nil, "example.com:70000"); err != ErrSocksAddress {
+		t.Fatal("wrong port encoded")
+	}
+}
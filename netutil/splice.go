@@ -0,0 +1,70 @@
+package netutil
+
+import (
+	"io"
+	"net"
+)
+
+// SPLICE_CHUNK is max bytes moved in one splice, wrappers are told of
+// bytes after each.
+const SPLICE_CHUNK = 1024 * 1024
+
+// SpliceConn is implemented by conn wrappers which only watch data, such
+// as counters. Copy moves data between tcp sockets under them by
+// splice(2) in linux, without copying it into user space, and tells them
+// bytes moved by Spliced. Wrappers need to see every read or write, like
+// rate limits, should not implement it.
+type SpliceConn interface {
+	RawConn() net.Conn
+	Spliced(read, written int64)
+}
+
+// rawTcp returns tcp socket under wrappers of c, and the wrappers.
+func rawTcp(c interface{}) (tcpconn *net.TCPConn, wrappers []SpliceConn) {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn, wrappers
+		case SpliceConn:
+			wrappers = append(wrappers, conn)
+			c = conn.RawConn()
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// spliceCopy copies from src to dst by splice if both are tcp sockets,
+// ok is false if not.
+func spliceCopy(dst io.Writer, src io.Reader) (written int64, err error, ok bool) {
+	if !SPLICE {
+		return
+	}
+	dtcp, dwrappers := rawTcp(dst)
+	if dtcp == nil {
+		return
+	}
+	stcp, swrappers := rawTcp(src)
+	if stcp == nil {
+		return
+	}
+
+	ok = true
+	lr := &io.LimitedReader{R: stcp}
+	for {
+		lr.N = SPLICE_CHUNK
+		var n int64
+		n, err = dtcp.ReadFrom(lr)
+		written += n
+		for _, w := range swrappers {
+			w.Spliced(n, 0)
+		}
+		for _, w := range dwrappers {
+			w.Spliced(0, n)
+		}
+		// less than limit without error means EOF.
+		if err != nil || n < SPLICE_CHUNK {
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package netutil
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+type countingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (cc *countingConn) RawConn() net.Conn {
+	return cc.Conn
+}
+
+func (cc *countingConn) Spliced(read, written int64) {
+	cc.read += read
+	cc.written += written
+}
+
+// tcpPair returns two ends of a tcp connection.
+func tcpPair(t *testing.T) (a, b net.Conn) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	a, err = net.Dial("tcp", lsock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = lsock.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSpliceCopy(t *testing.T) {
+	in, src := tcpPair(t)
+	dst, out := tcpPair(t)
+	defer out.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), SPLICE_CHUNK/8)
+	go func() {
+		in.Write(data)
+		in.Close()
+	}()
+
+	csrc := &countingConn{Conn: src}
+	cdst := &countingConn{Conn: dst}
+	ch := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(out)
+		ch <- b
+	}()
+
+	written, err := Copy(cdst, csrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+	src.Close()
+	if !bytes.Equal(<-ch, data) || written != int64(len(data)) {
+		t.Fatalf("data wrong, %d written", written)
+	}
+	if SPLICE && (csrc.read != written || cdst.written != written) {
+		t.Fatalf("splice not counted: %d, %d", csrc.read, cdst.written)
+	}
+}
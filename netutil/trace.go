@@ -0,0 +1,78 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type traceKey struct{}
+
+// DialTrace records which dialer made connection, for logging.
+type DialTrace struct {
+	lock   sync.Mutex
+	dialer string
+}
+
+// WithDialTrace returns ctx carrying a new trace.
+func WithDialTrace(ctx context.Context) (context.Context, *DialTrace) {
+	dt := &DialTrace{}
+	return context.WithValue(ctx, traceKey{}, dt), dt
+}
+
+// Dialer returns name of the first named dialer used, empty if none.
+func (dt *DialTrace) Dialer() string {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	return dt.dialer
+}
+
+func traceDialer(ctx context.Context, name string) {
+	dt, ok := ctx.Value(traceKey{}).(*DialTrace)
+	if !ok {
+		return
+	}
+	dt.lock.Lock()
+	if dt.dialer == "" {
+		dt.dialer = name
+	}
+	dt.lock.Unlock()
+}
+
+// NamedDialer puts its name in trace of ctx when dialing, and counts
+// dials in DefaultDialStats by name.
+type NamedDialer struct {
+	Dialer
+	Name string
+}
+
+func NewNamedDialer(name string, dialer Dialer) (nd *NamedDialer) {
+	return &NamedDialer{Dialer: dialer, Name: name}
+}
+
+func (nd *NamedDialer) Dial(network, address string) (conn net.Conn, err error) {
+	start := time.Now()
+	conn, err = nd.Dialer.Dial(network, address)
+	DefaultDialStats.Dialed(nd.Name, time.Since(start), err)
+	return
+}
+
+func (nd *NamedDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	traceDialer(ctx, nd.Name)
+	start := time.Now()
+	conn, err = DialContext(ctx, nd.Dialer, network, address)
+	DefaultDialStats.Dialed(nd.Name, time.Since(start), err)
+	return
+}
+
+func (nd *NamedDialer) DialTimeout(network, address string, timeout time.Duration) (conn net.Conn, err error) {
+	td, ok := nd.Dialer.(TimeoutDialer)
+	if !ok {
+		return nd.Dial(network, address)
+	}
+	start := time.Now()
+	conn, err = td.DialTimeout(network, address, timeout)
+	DefaultDialStats.Dialed(nd.Name, time.Since(start), err)
+	return
+}
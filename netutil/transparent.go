@@ -0,0 +1,35 @@
+package netutil
+
+import (
+	"errors"
+	"net"
+)
+
+// Modes of transparent proxy, by iptables target.
+const (
+	TRANSPARENT_REDIRECT = "redirect"
+	TRANSPARENT_TPROXY   = "tproxy"
+)
+
+var ErrTransparentMode = errors.New("transparent mode should be redirect or tproxy.")
+
+// ListenTransparent listens tcp in address for connections redirected
+// by iptables REDIRECT, or TPROXY which needs IP_TRANSPARENT set, and
+// CAP_NET_ADMIN for that. linux only.
+func ListenTransparent(address, mode string) (net.Listener, error) {
+	switch mode {
+	case TRANSPARENT_REDIRECT, TRANSPARENT_TPROXY:
+	default:
+		return nil, ErrTransparentMode
+	}
+	return listenTransparent(address, mode == TRANSPARENT_TPROXY)
+}
+
+// OriginalDst returns address client connected to before redirected,
+// SO_ORIGINAL_DST in REDIRECT. In TPROXY it's local address of conn.
+func OriginalDst(conn net.Conn, mode string) (address string, err error) {
+	if mode == TRANSPARENT_TPROXY {
+		return conn.LocalAddr().String(), nil
+	}
+	return originalDst(conn)
+}
@@ -0,0 +1,82 @@
+package netutil
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST in linux/netfilter_ipv6/ip6_tables.h, not in
+// x/sys.
+const IP6T_SO_ORIGINAL_DST = 80
+
+func listenTransparent(address string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) (err error) {
+			e := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if err == nil && network == "tcp6" {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if e != nil {
+				return e
+			}
+			return
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// originalDst reads SO_ORIGINAL_DST, as sockaddr_in in ipv6_mreq, or
+// sockaddr_in6 in ip6_mtuinfo.
+func originalDst(conn net.Conn) (address string, err error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var ip net.IP
+	var port uint16
+	e := raw.Control(func(fd uintptr) {
+		if ipv6 {
+			var info *unix.IPv6MTUInfo
+			info, err = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, IP6T_SO_ORIGINAL_DST)
+			if err != nil {
+				return
+			}
+			ip = append(net.IP(nil), info.Addr.Addr[:]...)
+			// port is in network order.
+			port = binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+			return
+		}
+		var mreq *unix.IPv6Mreq
+		mreq, err = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			return
+		}
+		sa := mreq.Multiaddr
+		ip = net.IPv4(sa[4], sa[5], sa[6], sa[7])
+		port = binary.BigEndian.Uint16(sa[2:4])
+	})
+	if e != nil {
+		return "", e
+	}
+	if err != nil {
+		return
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
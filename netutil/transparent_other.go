@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package netutil
+
+import (
+	"net"
+)
+
+func listenTransparent(address string, tproxy bool) (net.Listener, error) {
+	return nil, ErrNotSupported
+}
+
+func originalDst(conn net.Conn) (address string, err error) {
+	return "", ErrNotSupported
+}
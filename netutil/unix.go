@@ -0,0 +1,74 @@
+package netutil
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// UNIX_PREFIX marks unix socket path in address, like unix:///run/a.sock.
+const UNIX_PREFIX = "unix://"
+
+var ErrSocketInUse = errors.New("unix socket in use by another process.")
+
+// ParseUnix returns path of unix socket in address, ok is false if it's
+// not a unix address.
+func ParseUnix(address string) (path string, ok bool) {
+	if !strings.HasPrefix(address, UNIX_PREFIX) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, UNIX_PREFIX), true
+}
+
+// Listen listens in comma separated addresses, each is tcp address, or
+// unix socket if it starts with unix://. Socket file left by a dead
+// process is removed first.
+func Listen(addresses string) (net.Listener, error) {
+	return ListenAll(addresses, listenAddr)
+}
+
+func listenAddr(address string) (net.Listener, error) {
+	path, ok := ParseUnix(address)
+	if !ok {
+		return listenInherit("tcp", address, func() (net.Listener, error) {
+			return net.Listen("tcp", address)
+		})
+	}
+	return listenInherit("unix", path, func() (net.Listener, error) {
+		err := removeStale(path)
+		if err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	})
+}
+
+// removeStale removes socket file at path if no one listens on it.
+func removeStale(path string) (err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil // let listen fail.
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return ErrSocketInUse
+	}
+	return os.Remove(path)
+}
+
+// DialAddr connects to unix socket in address if it starts with unix://,
+// otherwise by dialer. Unix sockets are always local.
+func DialAddr(dialer Dialer, network, address string) (net.Conn, error) {
+	if path, ok := ParseUnix(address); ok {
+		return net.Dial("unix", path)
+	}
+	return dialer.Dial(network, address)
+}
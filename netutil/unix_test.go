@@ -0,0 +1,48 @@
+package netutil
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnix(t *testing.T) {
+	address := UNIX_PREFIX + filepath.Join(t.TempDir(), "test.sock")
+	lsock, err := Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lsock.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+
+	if _, err = Listen(address); err != ErrSocketInUse {
+		t.Fatalf("socket in use taken: %v", err)
+	}
+
+	conn, err := DialAddr(DefaultTcpDialer, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [1]byte
+	if _, err = conn.Read(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// socket file left without listener is removed.
+	lsock.(*handoffListener).Listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	lsock.Close()
+	lsock, err = Listen(address)
+	if err != nil {
+		t.Fatalf("stale socket not removed: %v", err)
+	}
+	lsock.Close()
+}
@@ -0,0 +1,89 @@
+package netutil
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// CountConn adds bytes read and written to counters, nil means not
+// counted. Counters can be shared by connections. Data spliced through
+// it is counted too.
+type CountConn struct {
+	net.Conn
+	read    *int64
+	written *int64
+}
+
+func NewCountConn(conn net.Conn, read, written *int64) (cc *CountConn) {
+	return &CountConn{Conn: conn, read: read, written: written}
+}
+
+func (cc *CountConn) add(counter *int64, n int64) {
+	if counter != nil && n > 0 {
+		atomic.AddInt64(counter, n)
+	}
+}
+
+func (cc *CountConn) Read(b []byte) (n int, err error) {
+	n, err = cc.Conn.Read(b)
+	cc.add(cc.read, int64(n))
+	return
+}
+
+func (cc *CountConn) Write(b []byte) (n int, err error) {
+	n, err = cc.Conn.Write(b)
+	cc.add(cc.written, int64(n))
+	return
+}
+
+func (cc *CountConn) RawConn() net.Conn {
+	return cc.Conn
+}
+
+func (cc *CountConn) Spliced(read, written int64) {
+	cc.add(cc.read, read)
+	cc.add(cc.written, written)
+}
+
+// IdleConn fails reads and writes with timeout error, when no data goes
+// in either direction for timeout. It uses deadline of conn, which is
+// moved at most once a second.
+type IdleConn struct {
+	net.Conn
+	timeout time.Duration
+	last    int64 // unix nano of last deadline moved
+}
+
+func NewIdleConn(conn net.Conn, timeout time.Duration) (ic *IdleConn) {
+	ic = &IdleConn{Conn: conn, timeout: timeout}
+	ic.touch()
+	return
+}
+
+func (ic *IdleConn) touch() {
+	now := time.Now()
+	last := atomic.LoadInt64(&ic.last)
+	if now.UnixNano()-last < int64(time.Second) {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&ic.last, last, now.UnixNano()) {
+		ic.Conn.SetDeadline(now.Add(ic.timeout))
+	}
+}
+
+func (ic *IdleConn) Read(b []byte) (n int, err error) {
+	n, err = ic.Conn.Read(b)
+	if n > 0 {
+		ic.touch()
+	}
+	return
+}
+
+func (ic *IdleConn) Write(b []byte) (n int, err error) {
+	n, err = ic.Conn.Write(b)
+	if n > 0 {
+		ic.touch()
+	}
+	return
+}
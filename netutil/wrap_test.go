@@ -0,0 +1,56 @@
+package netutil
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCountConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	var read, written int64
+	cc := NewCountConn(a, &read, &written)
+	defer cc.Close()
+
+	go func() {
+		b.Write([]byte("hello"))
+		io.ReadFull(b, make([]byte, 3))
+	}()
+	io.ReadFull(cc, make([]byte, 5))
+	cc.Write([]byte("bye"))
+	if read != 5 || written != 3 {
+		t.Fatalf("counted wrong: %d, %d", read, written)
+	}
+}
+
+func TestIdleConn(t *testing.T) {
+	a, b := tcpPair(t)
+	defer b.Close()
+	ic := NewIdleConn(a, 1500*time.Millisecond)
+	defer ic.Close()
+
+	// keep active longer than timeout.
+	go func() {
+		for i := 0; i < 4; i++ {
+			b.Write([]byte("x"))
+			time.Sleep(500 * time.Millisecond)
+		}
+	}()
+	var buf [1]byte
+	for i := 0; i < 4; i++ {
+		if _, err := ic.Read(buf[:]); err != nil {
+			t.Fatalf("active conn failed: %v", err)
+		}
+	}
+
+	start := time.Now()
+	_, err := ic.Read(buf[:])
+	if !isTimeout(err) {
+		t.Fatalf("idle conn not timeout: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("timeout too late: %s", d)
+	}
+}
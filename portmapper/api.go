@@ -0,0 +1,149 @@
+package portmapper
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shell909090/goproxy/ipfilter"
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (mgr *Manager) HandlerPortmaps(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, mgr.Status())
+	return
+}
+
+// HandlerPortmapModify changes mappings by action in path: add, modify
+// or delete. Parameters are net (tcp by default), src, dst, timeout,
+// dialer, route (name=address, can be repeated), acceptproxy (1 to
+// enable), sendproxy, maxconns, connrate, uprate, downrate, burst and
+// allow (can be repeated).
+// Mapping is identified by net and src.
+func (mgr *Manager) HandlerPortmapModify(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	pm := PortMap{
+		Net:         req.FormValue("net"),
+		Src:         req.FormValue("src"),
+		Dst:         req.FormValue("dst"),
+		Dialer:      req.FormValue("dialer"),
+		AcceptProxy: req.FormValue("acceptproxy") == "1",
+		SendProxy:   req.FormValue("sendproxy"),
+	}
+	if pm.Net == "" {
+		pm.Net = "tcp"
+	}
+	req.ParseForm()
+	pm.Allow = req.Form["allow"]
+	for _, route := range req.Form["route"] {
+		idx := strings.Index(route, "=")
+		if idx == -1 {
+			w.WriteHeader(400)
+			w.Write([]byte("route should be name=address."))
+			return
+		}
+		if pm.Routes == nil {
+			pm.Routes = make(map[string]string, 0)
+		}
+		pm.Routes[strings.ToLower(route[:idx])] = route[idx+1:]
+	}
+	if timeout := req.FormValue("timeout"); timeout != "" {
+		var err error
+		pm.Timeout, err = strconv.Atoi(timeout)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if maxconns := req.FormValue("maxconns"); maxconns != "" {
+		var err error
+		pm.MaxConns, err = strconv.Atoi(maxconns)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	for name, v := range map[string]*int64{
+		"uprate":   &pm.UpRate,
+		"downrate": &pm.DownRate,
+		"burst":    &pm.Burst,
+	} {
+		value := req.FormValue(name)
+		if value == "" {
+			continue
+		}
+		var err error
+		*v, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if connrate := req.FormValue("connrate"); connrate != "" {
+		var err error
+		pm.ConnRate, err = strconv.ParseFloat(connrate, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	var err error
+	action := strings.TrimPrefix(req.URL.Path, "/api/portmaps/")
+	switch action {
+	case "add":
+		err = mgr.Add(pm)
+	case "modify":
+		err = mgr.Replace(pm)
+	case "delete":
+		err = mgr.Remove(pm.Key())
+	default:
+		w.WriteHeader(404)
+		return
+	}
+	switch err {
+	case nil:
+	case ErrMapNotFound:
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	case ErrMapExist, ErrMapInvalid, ErrDialerNotFound, netutil.ErrProxyVersion,
+		ipfilter.ErrLineFormat:
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	default:
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logger.Noticef("mapping %s %s by admin.", pm.Key(), action)
+
+	err = mgr.Save()
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
+func (mgr *Manager) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/portmaps", mgr.HandlerPortmaps)
+	mux.HandleFunc("/api/portmaps/", mgr.HandlerPortmapModify)
+}
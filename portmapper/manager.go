@@ -0,0 +1,274 @@
+package portmapper
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// Names of dialers registered by client.
+const (
+	DIALER_DIRECT = "direct"
+	DIALER_TUNNEL = "tunnel"
+	DIALER_FILTER = "filter"
+)
+
+var (
+	ErrDialerNotFound = errors.New("dialer of port mapping not found.")
+	ErrMapExist       = errors.New("port mapping exist.")
+	ErrMapNotFound    = errors.New("port mapping not found.")
+	ErrMapInvalid     = errors.New("port mapping needs src and dst, or routes for sni.")
+)
+
+// Manager keeps port mappings running, which can be changed at runtime.
+type Manager struct {
+	lock    sync.Mutex
+	dialer  netutil.Dialer
+	dialers map[string]netutil.Dialer
+	mappers map[string]*Mapper
+	// configured keeps keys of mappings from config, see Sync.
+	configured map[string]struct{}
+	// File keeps mappings after each change if not empty.
+	File string
+}
+
+func NewManager(dialer netutil.Dialer) (mgr *Manager) {
+	return &Manager{
+		dialer:  dialer,
+		dialers: make(map[string]netutil.Dialer, 0),
+		mappers: make(map[string]*Mapper, 0),
+	}
+}
+
+// Sync makes mappings from config the same as pms: new ones started,
+// changed ones restarted, and removed ones stopped. Others are untouched
+// and their connections kept. Mappings added by api are never removed,
+// but replaced if config has one in the same address. Returns the last
+// error, others are logged.
+func (mgr *Manager) Sync(pms []PortMap) (err error) {
+	keys := make(map[string]struct{}, 0)
+	for _, pm := range pms {
+		// invalid mapping is kept in keys, so the running one stays.
+		e := checkPortMap(&pm)
+		keys[pm.Key()] = struct{}{}
+		if e == nil {
+			e = mgr.sync(pm)
+		}
+		if e != nil {
+			logger.Errorf("mapping %s: %s", pm.Key(), e.Error())
+			err = e
+		}
+	}
+
+	mgr.lock.Lock()
+	configured := mgr.configured
+	mgr.configured = keys
+	mgr.lock.Unlock()
+	for key := range configured {
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		e := mgr.Remove(key)
+		if e != nil && e != ErrMapNotFound {
+			logger.Errorf("mapping %s: %s", key, e.Error())
+			err = e
+		}
+	}
+	return
+}
+
+func (mgr *Manager) sync(pm PortMap) (err error) {
+	mgr.lock.Lock()
+	m, ok := mgr.mappers[pm.Key()]
+	same := ok && reflect.DeepEqual(m.PortMap, pm)
+	mgr.lock.Unlock()
+	switch {
+	case same:
+		return
+	case ok:
+		logger.Noticef("mapping %s changed, restart it.", pm.Key())
+		return mgr.Replace(pm)
+	}
+	return mgr.Add(pm)
+}
+
+// SetDialer registers dialer by name, mappings can choose it in Dialer.
+func (mgr *Manager) SetDialer(name string, dialer netutil.Dialer) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	mgr.dialers[name] = dialer
+}
+
+// dialerOf returns dialer chosen by mapping, lock held.
+func (mgr *Manager) dialerOf(pm PortMap) (dialer netutil.Dialer, err error) {
+	if pm.Dialer == "" {
+		return mgr.dialer, nil
+	}
+	dialer, ok := mgr.dialers[pm.Dialer]
+	if !ok {
+		return nil, ErrDialerNotFound
+	}
+	return
+}
+
+func checkPortMap(pm *PortMap) (err error) {
+	if pm.Net == "" {
+		pm.Net = "tcp"
+	}
+	if pm.Src == "" || (pm.Dst == "" && len(pm.Routes) == 0) {
+		return ErrMapInvalid
+	}
+	if _, ok := netutil.ParseUnix(pm.Dst); ok && pm.IsUdp() {
+		return ErrMapInvalid
+	}
+	err = netutil.CheckProxyVersion(pm.SendProxy)
+	if err != nil {
+		return
+	}
+	_, err = newAllowFilter(pm.Allow)
+	return
+}
+
+// Add starts a mapping, fails if one listening in the same address.
+func (mgr *Manager) Add(pm PortMap) (err error) {
+	err = checkPortMap(&pm)
+	if err != nil {
+		return
+	}
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if _, ok := mgr.mappers[pm.Key()]; ok {
+		return ErrMapExist
+	}
+	dialer, err := mgr.dialerOf(pm)
+	if err != nil {
+		return
+	}
+	m := NewMapper(pm, dialer)
+	err = m.Start()
+	if err != nil {
+		return
+	}
+	mgr.mappers[pm.Key()] = m
+	return
+}
+
+// Replace restarts mapping listening in the same address with pm.
+// Old one is started again if pm failed.
+func (mgr *Manager) Replace(pm PortMap) (err error) {
+	err = checkPortMap(&pm)
+	if err != nil {
+		return
+	}
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	old, ok := mgr.mappers[pm.Key()]
+	if !ok {
+		return ErrMapNotFound
+	}
+	dialer, err := mgr.dialerOf(pm)
+	if err != nil {
+		return
+	}
+	old.Stop()
+	delete(mgr.mappers, pm.Key())
+
+	m := NewMapper(pm, dialer)
+	err = m.Start()
+	if err != nil {
+		old = NewMapper(old.PortMap, old.dialer)
+		if old.Start() == nil {
+			mgr.mappers[pm.Key()] = old
+		}
+		return
+	}
+	mgr.mappers[pm.Key()] = m
+	return
+}
+
+func (mgr *Manager) Remove(key string) (err error) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	m, ok := mgr.mappers[key]
+	if !ok {
+		return ErrMapNotFound
+	}
+	m.Stop()
+	delete(mgr.mappers, key)
+	return
+}
+
+func (mgr *Manager) List() (pms []PortMap) {
+	mgr.lock.Lock()
+	for _, m := range mgr.mappers {
+		pms = append(pms, m.PortMap)
+	}
+	mgr.lock.Unlock()
+	sort.Slice(pms, func(i, j int) bool {
+		return pms[i].Key() < pms[j].Key()
+	})
+	return
+}
+
+// Status returns mappings with their stats.
+func (mgr *Manager) Status() (status []MapperStatus) {
+	mgr.lock.Lock()
+	for _, m := range mgr.mappers {
+		status = append(status, m.Status())
+	}
+	mgr.lock.Unlock()
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Key() < status[j].Key()
+	})
+	return
+}
+
+// Load starts mappings in File, skipping ones already running.
+func (mgr *Manager) Load() (err error) {
+	data, err := ioutil.ReadFile(mgr.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	var pms []PortMap
+	err = json.Unmarshal(data, &pms)
+	if err != nil {
+		return
+	}
+	for _, pm := range pms {
+		err = mgr.Add(pm)
+		switch err {
+		case nil:
+		case ErrMapExist:
+			logger.Infof("mapping %s in config already.", pm.Key())
+		default:
+			logger.Errorf("mapping %s: %s", pm.Key(), err.Error())
+		}
+	}
+	return nil
+}
+
+func (mgr *Manager) Save() (err error) {
+	if mgr.File == "" {
+		return
+	}
+	data, err := json.MarshalIndent(mgr.List(), "", "\t")
+	if err != nil {
+		return
+	}
+	// write to temp file and rename, never leave a broken file.
+	tmpfile := mgr.File + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmpfile, mgr.File)
+}
@@ -0,0 +1,170 @@
+package portmapper
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/shell909090/goproxy/ipfilter"
+	"github.com/shell909090/goproxy/netutil"
+)
+
+var ErrNotAllowed = errors.New("client not allowed.")
+
+// Mapper runs a port mapping in background until stopped. Mapping of a
+// port range has a listener for each port. Connections relaying are not
+// cut by Stop, but udp flows are. Limits are shared by all ports.
+type Mapper struct {
+	active int64 // connections or udp flows, first for atomic alignment
+	PortMap
+	dialer  netutil.Dialer
+	rate    *netutil.TokenBucket
+	up      *netutil.TokenBucket
+	down    *netutil.TokenBucket
+	filter  *ipfilter.IPFilter
+	stats   *mapStats
+	closers []io.Closer
+	upms    []*UdpPortMapper
+}
+
+func NewMapper(pm PortMap, dialer netutil.Dialer) (m *Mapper) {
+	m = &Mapper{
+		PortMap: pm,
+		dialer:  dialer,
+		stats:   &mapStats{},
+	}
+	if pm.ConnRate > 0 {
+		m.rate = netutil.NewTokenBucket(pm.ConnRate, pm.ConnRate)
+	}
+	m.up = newBandwidth(pm.UpRate, pm.Burst)
+	m.down = newBandwidth(pm.DownRate, pm.Burst)
+	return
+}
+
+func newBandwidth(rate, burst int64) *netutil.TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return netutil.NewTokenBucket(float64(rate), float64(burst))
+}
+
+// admit tells if a new connection is in limits, release should be called
+// when it's done if so.
+func (m *Mapper) admit() bool {
+	if m.rate != nil && !m.rate.Allow() {
+		atomic.AddInt64(&m.stats.rejected, 1)
+		logger.Warningf("mapping %s over rate, drop connection.", m.Key())
+		return false
+	}
+	n := atomic.AddInt64(&m.active, 1)
+	if m.MaxConns > 0 && n > int64(m.MaxConns) {
+		atomic.AddInt64(&m.active, -1)
+		atomic.AddInt64(&m.stats.rejected, 1)
+		logger.Warningf("mapping %s full, drop connection.", m.Key())
+		return false
+	}
+	atomic.AddInt64(&m.stats.accepted, 1)
+	return true
+}
+
+func (m *Mapper) release() {
+	atomic.AddInt64(&m.active, -1)
+}
+
+func newAllowFilter(allow []string) (filter *ipfilter.IPFilter, err error) {
+	if len(allow) == 0 {
+		return
+	}
+	return ipfilter.ReadIPList(strings.NewReader(strings.Join(allow, "\n")))
+}
+
+// allowed tells if client in addr can use this mapping.
+func (m *Mapper) allowed(addr net.Addr) bool {
+	if m.filter == nil {
+		return true
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return m.filter.Contain(a.IP)
+	case *net.UDPAddr:
+		return m.filter.Contain(a.IP)
+	}
+	return false
+}
+
+// Start listens all ports, or none if any of them failed.
+func (m *Mapper) Start() (err error) {
+	pms, err := m.Expand()
+	if err != nil {
+		return
+	}
+	m.filter, err = newAllowFilter(m.Allow)
+	if err != nil {
+		return
+	}
+	for _, pm := range pms {
+		err = m.listen(pm)
+		if err != nil {
+			m.Stop()
+			return
+		}
+	}
+	return
+}
+
+func (m *Mapper) listen(pm PortMap) (err error) {
+	if pm.IsUdp() {
+		var sconn *net.UDPConn
+		sconn, err = ListenUdp(pm)
+		if err != nil {
+			return
+		}
+		upm := NewUdpPortMapper()
+		m.closers = append(m.closers, sconn)
+		m.upms = append(m.upms, upm)
+		go upm.Serve(pm, sconn, m)
+		return
+	}
+
+	if pm.Net == NET_SNI {
+		var lsocks []net.Listener
+		lsocks, err = netutil.ListenPort("tcp", pm.Src, pm.Acceptors)
+		if err != nil {
+			return
+		}
+		logger.Infof("sni listening in %s", pm.Src)
+		for _, lsock := range lsocks {
+			m.closers = append(m.closers, lsock)
+			go serveSni(lsock, pm, m)
+		}
+		return
+	}
+
+	lsocks, err := netutil.ListenPort(pm.Net, pm.Src, pm.Acceptors)
+	if err != nil {
+		return
+	}
+	logger.Infof("tcp listening in %s", pm.Src)
+	for _, lsock := range lsocks {
+		m.closers = append(m.closers, lsock)
+		go serveTcp(lsock, pm, m)
+	}
+	return
+}
+
+func (m *Mapper) Stop() {
+	for _, closer := range m.closers {
+		closer.Close()
+	}
+	for _, upm := range m.upms {
+		upm.CloseAll()
+	}
+	m.closers = nil
+	m.upms = nil
+	logger.Infof("stop mapping %s.", m.Key())
+}
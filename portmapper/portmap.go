@@ -1,6 +1,7 @@
 package portmapper
 
 import (
+	"errors"
 	"io"
 	"net"
 	"strings"
@@ -15,87 +16,171 @@ import (
 var logger = logging.MustGetLogger("portmap")
 
 const (
-	UDP_TICK           = 60
-	UDP_TIMEOUT        = 5
-	UDP_BLOCK_INTERVAL = 500
-	UDP_READBUFFER     = 1048576
+	UDP_TIMEOUT    = 300
+	UDP_READBUFFER = 1048576
+	UDP_QUEUE      = 16
+	UDP_BUFFERSIZE = 8192
 )
 
+// udpPool keeps buffers of udp packages, sized by udp but not
+// BUFFERSIZE, so packages won't be cut by a small BUFFERSIZE.
+var udpPool = netutil.NewBytePool(UDP_BUFFERSIZE)
+
 type PortMap struct {
 	Net string
 	Src string
 	Dst string
+	// Timeout in seconds, relay or udp flow idle that long is closed.
+	// Zero means UDP_TIMEOUT for udp, and never for tcp.
+	Timeout int
+	// Dialer names dialer registered in Manager, empty for default.
+	Dialer string `json:",omitempty"`
+	// Routes maps server name to backend, only for sni.
+	Routes map[string]string `json:",omitempty"`
+	// AcceptProxy requires PROXY header in connections accepted, and
+	// SendProxy sends one of that version (v1 or v2) to backend. Both
+	// only for tcp and sni.
+	AcceptProxy bool   `json:",omitempty"`
+	SendProxy   string `json:",omitempty"`
+	// MaxConns limits connections (or udp flows) at the same time, and
+	// ConnRate new ones per second. Zero means no limit.
+	MaxConns int     `json:",omitempty"`
+	ConnRate float64 `json:",omitempty"`
+	// UpRate limits bytes per second from clients to backend, and
+	// DownRate the other way, shared by all connections. Burst is bytes
+	// can be sent at once, one second of rate by default. Zero means no
+	// limit. Only for tcp and sni.
+	UpRate   int64 `json:",omitempty"`
+	DownRate int64 `json:",omitempty"`
+	Burst    int64 `json:",omitempty"`
+	// Allow lists networks clients can come from, in format of ipfilter.
+	// Empty means all.
+	Allow []string `json:",omitempty"`
+	// Acceptors is listeners sharing the port by SO_REUSEPORT, each has
+	// its own accept loop, linux only. Only for tcp and sni.
+	Acceptors int `json:",omitempty"`
 }
 
+// UdpPortMapper tracks flows like a NAT. Each source address has its own
+// connection to Dst, which is closed after idle for Timeout.
 type UdpPortMapper struct {
 	lock  sync.Mutex
-	ports map[net.Addr]*UdpMapperConn
+	ports map[string]*UdpMapperConn
 }
 
 func NewUdpPortMapper() (upm *UdpPortMapper) {
 	upm = &UdpPortMapper{
-		ports: make(map[net.Addr]*UdpMapperConn, 0),
+		ports: make(map[string]*UdpMapperConn, 0),
 	}
 	return
 }
 
-func (upm *UdpPortMapper) RemovePorts(addr net.Addr) {
+func (upm *UdpPortMapper) RemovePorts(umc *UdpMapperConn) {
 	upm.lock.Lock()
 	defer upm.lock.Unlock()
 
-	_, ok := upm.ports[addr]
-	if !ok {
-		logger.Error("remove a port not exits: %s.", addr.String())
+	if upm.ports[umc.key] != umc {
+		logger.Errorf("remove a port not exits: %s.", umc.key)
 		return
 	}
-	delete(upm.ports, addr)
-	logger.Debug("remove port %s.", addr.String())
+	delete(upm.ports, umc.key)
+	logger.Debugf("remove port %s.", umc.key)
 	return
 }
 
+func (upm *UdpPortMapper) getPort(key string) (umc *UdpMapperConn) {
+	upm.lock.Lock()
+	defer upm.lock.Unlock()
+	return upm.ports[key]
+}
+
 func (upm *UdpPortMapper) UdpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
+	sconn, err := ListenUdp(pm)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	return upm.Serve(pm, sconn, NewMapper(pm, dialer))
+}
+
+func ListenUdp(pm PortMap) (sconn *net.UDPConn, err error) {
 	laddr, err := net.ResolveUDPAddr(pm.Net, pm.Src)
 	if err != nil {
 		return
 	}
-	sconn, err := net.ListenUDP(pm.Net, laddr)
+	sconn, err = net.ListenUDP(pm.Net, laddr)
 	if err != nil {
 		return
 	}
-	defer sconn.Close()
 	sconn.SetReadBuffer(UDP_READBUFFER)
-	logger.Info("udp listening in %s", pm.Src)
+	logger.Infof("udp listening in %s", pm.Src)
+	return
+}
+
+// Serve forwards packages from sconn until it's closed.
+func (upm *UdpPortMapper) Serve(pm PortMap, sconn *net.UDPConn, m *Mapper) (err error) {
+	timeout := time.Duration(pm.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = UDP_TIMEOUT * time.Second
+	}
 
 	for {
 		up := NewUdpPackage()
 		nr, addr, err := sconn.ReadFrom(up.buf)
-		switch err {
-		case nil:
-		case io.EOF:
-			return nil
-		default:
-			logger.Error("%s", err.Error())
+		if err != nil {
+			up.Free()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logger.Error(err.Error())
 			continue
 		}
 		up.nr = nr
 
-		upm.lock.Lock()
-		umc, ok := upm.ports[addr]
-		if !ok {
-			logger.Info("udp forward got new addr %s.", addr)
-			dconn, err := dialer.Dial(pm.Net, pm.Dst)
+		key := addr.String()
+		umc := upm.getPort(key)
+		if umc == nil {
+			if !m.allowed(addr) {
+				logger.Debugf("%s not allowed in %s.", key, pm.Src)
+				up.Free()
+				continue
+			}
+			if !m.admit() {
+				up.Free()
+				continue
+			}
+			logger.Infof("udp forward got new addr %s.", key)
+			// only this loop adds ports, no one else will add key.
+			dconn, err := m.dialer.Dial(pm.Net, pm.Dst)
 			if err != nil {
-				upm.lock.Unlock()
-				logger.Error("%s", err.Error())
+				m.release()
+				m.stats.fail(err)
+				up.Free()
+				logger.Error(err.Error())
 				continue
 			}
 			umc = NewUdpMapperConn(upm, sconn, dconn, addr, pm.Dst)
-			upm.ports[addr] = umc
-			umc.Run()
+			umc.m = m
+			upm.lock.Lock()
+			upm.ports[key] = umc
+			upm.lock.Unlock()
+			umc.Run(timeout)
 		}
-		upm.lock.Unlock()
 
-		umc.ch <- up
+		umc.Send(up)
+	}
+}
+
+// CloseAll closes all flows.
+func (upm *UdpPortMapper) CloseAll() {
+	upm.lock.Lock()
+	var umcs []*UdpMapperConn
+	for _, umc := range upm.ports {
+		umcs = append(umcs, umc)
+	}
+	upm.lock.Unlock()
+	for _, umc := range umcs {
+		umc.Close()
 	}
 }
 
@@ -106,111 +191,152 @@ type UdpPackage struct {
 
 func NewUdpPackage() (up *UdpPackage) {
 	up = &UdpPackage{
-		buf: allocbuf(),
+		buf: udpPool.Get(),
 	}
 	return
 }
 
 func (up *UdpPackage) Free() {
-	freebuf(up.buf)
+	udpPool.Put(up.buf)
 }
 
 type UdpMapperConn struct {
-	upm   *UdpPortMapper
-	tick  <-chan time.Time
-	cnt   int32
-	sconn *net.UDPConn
-	dconn net.Conn
-	addr  net.Addr
-	dst   string
-	ch    chan *UdpPackage
+	active int64 // unix nano of last packet, first for atomic alignment
+	upm    *UdpPortMapper
+	m      *Mapper
+	sconn  *net.UDPConn
+	dconn  net.Conn
+	addr   net.Addr
+	key    string
+	dst    string
+	ch     chan *UdpPackage
+	done   chan struct{}
+	once   sync.Once
 }
 
 func NewUdpMapperConn(upm *UdpPortMapper, sconn *net.UDPConn,
 	dconn net.Conn, addr net.Addr, dst string) (umc *UdpMapperConn) {
 	umc = &UdpMapperConn{
-		upm:   upm,
-		tick:  time.Tick(UDP_TICK * time.Second),
-		sconn: sconn,
-		dconn: dconn,
-		addr:  addr,
-		dst:   dst,
-		ch:    make(chan *UdpPackage, 0),
+		active: time.Now().UnixNano(),
+		upm:    upm,
+		sconn:  sconn,
+		dconn:  dconn,
+		addr:   addr,
+		key:    addr.String(),
+		dst:    dst,
+		ch:     make(chan *UdpPackage, UDP_QUEUE),
+		done:   make(chan struct{}),
 	}
 	return
 }
 
 func (umc *UdpMapperConn) Close() {
-	logger.Notice("udp redirect %s closed.", umc.addr.String())
-	umc.dconn.Close()
-	close(umc.ch)
-	umc.upm.RemovePorts(umc.addr)
+	umc.once.Do(func() {
+		logger.Noticef("udp redirect %s closed.", umc.key)
+		close(umc.done)
+		umc.dconn.Close()
+		umc.upm.RemovePorts(umc)
+		if umc.m != nil {
+			umc.m.release()
+		}
+	})
 	return
 }
 
-func (umc *UdpMapperConn) Run() {
+// Send queues a package to dst, drops it if queue is full, like udp.
+func (umc *UdpMapperConn) Send(up *UdpPackage) {
+	select {
+	case umc.ch <- up:
+	case <-umc.done:
+		up.Free()
+	default:
+		logger.Warningf("udp queue of %s full, drop package.", umc.key)
+		up.Free()
+	}
+}
+
+func (umc *UdpMapperConn) touch() {
+	atomic.StoreInt64(&umc.active, time.Now().UnixNano())
+}
+
+func (umc *UdpMapperConn) Run(timeout time.Duration) {
 	go umc.SendHandler()
 	go umc.RecvHandler()
-	go func() {
-		for _ = range umc.tick {
-			if atomic.AddInt32(&umc.cnt, 1) >= UDP_TIMEOUT {
+	go umc.expire(timeout)
+}
+
+// expire closes flow idle for timeout.
+func (umc *UdpMapperConn) expire(timeout time.Duration) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			active := time.Unix(0, atomic.LoadInt64(&umc.active))
+			if time.Since(active) > timeout {
+				logger.Infof("udp redirect %s idle timeout.", umc.key)
 				umc.Close()
 				return
 			}
+		case <-umc.done:
+			return
 		}
-	}()
+	}
 }
 
 func (umc *UdpMapperConn) RecvHandler() {
-	var buf [8192]byte
-	defer umc.dconn.Close()
+	buf := udpPool.Get()
+	defer udpPool.Put(buf)
+	defer umc.Close()
 	for {
-		nr, err := umc.dconn.Read(buf[:])
-		switch err {
-		case nil:
-		case io.EOF:
+		nr, err := umc.dconn.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				logger.Error(err.Error())
+			}
 			return
-		default:
-			logger.Error("%s", err.Error())
-			continue
 		}
 
 		_, err = umc.sconn.WriteTo(buf[0:nr], umc.addr)
-		switch err {
-		case nil:
-		case io.EOF:
-			return
-		default:
-			logger.Error("%s", err.Error())
+		if err != nil {
+			logger.Error(err.Error())
 			continue
 		}
+		if umc.m != nil {
+			atomic.AddInt64(&umc.m.stats.down, int64(nr))
+		}
 
-		atomic.StoreInt32(&umc.cnt, 0)
-		logger.Debug("udp package recved %s <=> %s.", umc.addr.String(), umc.dst)
+		umc.touch()
+		logger.Debugf("udp package recved %s <=> %s.", umc.key, umc.dst)
 	}
 }
 
 func (umc *UdpMapperConn) SendHandler() {
-	defer umc.dconn.Close()
+	defer umc.Close()
 	for {
-		up, ok := <-umc.ch
-		if !ok {
+		var up *UdpPackage
+		select {
+		case up = <-umc.ch:
+		case <-umc.done:
 			return
 		}
 
 		_, err := umc.dconn.Write(up.buf[0:up.nr])
-		switch err {
-		case nil:
-		case io.EOF:
-			return
-		default:
-			logger.Error("%s", err.Error())
-			continue
+		if umc.m != nil && err == nil {
+			atomic.AddInt64(&umc.m.stats.up, int64(up.nr))
 		}
 		up.Free()
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
 
-		atomic.StoreInt32(&umc.cnt, 0)
-		logger.Debug("udp package sent %s <=> %s.", umc.addr.String(), umc.dst)
+		umc.touch()
+		logger.Debugf("udp package sent %s <=> %s.", umc.key, umc.dst)
 	}
 }
 
@@ -219,30 +345,113 @@ func TcpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
 	if err != nil {
 		return
 	}
-	logger.Info("tcp listening in %s", pm.Src)
+	defer lsock.Close()
+	logger.Infof("tcp listening in %s", pm.Src)
+	return serveTcp(lsock, pm, NewMapper(pm, dialer))
+}
 
+// serveTcp relays connections accepted until lsock closed. Connections
+// relaying are kept after that.
+func serveTcp(lsock net.Listener, pm PortMap, m *Mapper) (err error) {
 	for {
-		var sconn, dconn net.Conn
-
+		var sconn net.Conn
 		sconn, err = lsock.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logger.Error(err.Error())
 			continue
 		}
-		logger.Info("accept in %s:%s, try to dial %s.", pm.Net, pm.Src, pm.Dst)
-
-		dconn, err = dialer.Dial(pm.Net, pm.Dst)
-		if err != nil {
+		if !m.admit() {
 			sconn.Close()
 			continue
 		}
+		go relayTcp(sconn, pm, m)
+	}
+}
 
-		go netutil.CopyLink(dconn, sconn)
+func relayTcp(sconn net.Conn, pm PortMap, m *Mapper) {
+	defer m.release()
+	sconn, err := m.accept(sconn)
+	if err != nil {
+		logger.Errorf("accept in %s:%s: %s", pm.Net, pm.Src, err.Error())
+		m.stats.fail(err)
+		sconn.Close()
+		return
 	}
+	logger.Infof("accept %s in %s:%s, try to dial %s.",
+		sconn.RemoteAddr(), pm.Net, pm.Src, pm.Dst)
+
+	dconn, err := pm.dial(m.dialer, pm.Net, pm.Dst, sconn)
+	if err != nil {
+		logger.Error(err.Error())
+		m.stats.fail(err)
+		sconn.Close()
+		return
+	}
+	m.relay(pm, dconn, sconn)
+}
+
+// relay copies data until both closed, or idle for Timeout.
+func (m *Mapper) relay(pm PortMap, dconn, sconn net.Conn) {
+	sconn = netutil.NewCountConn(sconn, &m.stats.up, &m.stats.down)
+	if m.up != nil || m.down != nil {
+		sconn = netutil.NewShapedConn(sconn, m.up, m.down)
+	}
+	_, _, err := netutil.RelayIdle(dconn, sconn, time.Duration(pm.Timeout)*time.Second)
+	if err == netutil.ErrIdleTimeout {
+		logger.Infof("relay %s => %s idle timeout.", sconn.RemoteAddr(), pm.Src)
+	}
+}
+
+// accept reads PROXY header if required, and checks client address in
+// it (or of conn) is allowed. conn is returned as it is on error, so it
+// can be closed.
+func (m *Mapper) accept(conn net.Conn) (net.Conn, error) {
+	if m.AcceptProxy {
+		pc, err := netutil.AcceptProxy(conn)
+		if err != nil {
+			return conn, err
+		}
+		if !m.allowed(pc.RemoteAddr()) {
+			return conn, ErrNotAllowed
+		}
+		return pc, nil
+	}
+	if !m.allowed(conn.RemoteAddr()) {
+		return conn, ErrNotAllowed
+	}
+	return conn, nil
+}
+
+// dial connects backend, and sends PROXY header of sconn if required.
+// Unix socket backend is connected directly.
+func (pm PortMap) dial(dialer netutil.Dialer, network, address string, sconn net.Conn) (dconn net.Conn, err error) {
+	dconn, err = netutil.DialAddr(dialer, network, address)
+	if err != nil || pm.SendProxy == "" {
+		return
+	}
+	err = netutil.WriteProxy(dconn, pm.SendProxy, sconn.RemoteAddr(), sconn.LocalAddr())
+	if err != nil {
+		dconn.Close()
+		return nil, err
+	}
+	return
+}
+
+func (pm PortMap) IsUdp() bool {
+	return strings.HasPrefix(pm.Net, "udp")
+}
+
+// Key identifies mapping by its listening address.
+func (pm PortMap) Key() string {
+	return pm.Net + "/" + pm.Src
 }
 
 func CreatePortmap(pm PortMap, dialer netutil.Dialer) {
 	var err error
-	if strings.HasPrefix(pm.Net, "udp") {
+	if pm.IsUdp() {
 		upm := NewUdpPortMapper()
 		err = upm.UdpPortmap(pm, dialer)
 	} else {
@@ -0,0 +1,354 @@
+package portmapper
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestUdpPortmap(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		var buf [100]byte
+		for {
+			n, addr, err := echo.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// find a free port for mapper.
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := probe.LocalAddr().String()
+	probe.Close()
+
+	upm := NewUdpPortMapper()
+	pm := PortMap{Net: "udp", Src: src, Dst: echo.LocalAddr().String()}
+	go upm.UdpPortmap(pm, netutil.DefaultTcpDialer)
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 3; j++ {
+			conn.Write([]byte("ping"))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			var buf [100]byte
+			n, err := conn.Read(buf[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "ping" {
+				t.Fatalf("wrong reply: %q", buf[:n])
+			}
+		}
+		conn.Close()
+	}
+
+	upm.lock.Lock()
+	flows := len(upm.ports)
+	upm.lock.Unlock()
+	if flows != 2 {
+		t.Fatalf("flows should be tracked by source: %d", flows)
+	}
+}
+
+func TestManager(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var buf [100]byte
+				n, _ := conn.Read(buf[:])
+				conn.Write(buf[:n])
+			}()
+		}
+	}()
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := probe.Addr().String()
+	probe.Close()
+
+	mgr := NewManager(netutil.DefaultTcpDialer)
+	mgr.File = t.TempDir() + "/portmaps.json"
+	pm := PortMap{Net: "tcp", Src: src, Dst: echo.Addr().String()}
+	err = mgr.Add(pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mgr.Add(pm) != ErrMapExist {
+		t.Fatal("add mapping twice.")
+	}
+	if mgr.Add(PortMap{Src: "127.0.0.1:0", Dst: pm.Dst, Dialer: "none"}) != ErrDialerNotFound {
+		t.Fatal("mapping with unknown dialer added.")
+	}
+	err = mgr.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [100]byte
+	n, err := conn.Read(buf[:])
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("wrong reply: %q, %v", buf[:n], err)
+	}
+	conn.Close()
+
+	// relay counts after write returned, give it a moment.
+	time.Sleep(50 * time.Millisecond)
+	status := mgr.Status()
+	if len(status) != 1 || status[0].Accepted != 1 || status[0].Up != 4 || status[0].Down != 4 {
+		t.Fatalf("wrong stats: %+v", status)
+	}
+
+	err = mgr.Remove(pm.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = net.Dial("tcp", src)
+	if err == nil {
+		t.Fatal("mapping still listening after removed.")
+	}
+
+	mgr2 := NewManager(netutil.DefaultTcpDialer)
+	mgr2.File = mgr.File
+	err = mgr2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr2.Remove(pm.Key())
+	pms := mgr2.List()
+	if len(pms) != 1 || pms[0].Dst != pm.Dst {
+		t.Fatalf("wrong mappings loaded: %v", pms)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	cases := []struct {
+		src, dst string
+		first    [2]string
+		n        int
+	}{
+		{"127.0.0.1:1000", "host:2000", [2]string{"127.0.0.1:1000", "host:2000"}, 1},
+		{":1000-1010", "host:1000-1010", [2]string{":1000", "host:1000"}, 11},
+		{":1000-1010", "host:2000", [2]string{":1000", "host:2000"}, 11},
+		{":1000-1010", "host:*", [2]string{":1000", "host:1000"}, 11},
+		{":1000-1010", "unix:///run/a.sock", [2]string{":1000", "unix:///run/a.sock"}, 11},
+		{"127.0.0.1:1000, [::1]:1000-1001", "host:*", [2]string{"127.0.0.1:1000", "host:1000"}, 3},
+	}
+	for _, c := range cases {
+		pms, err := PortMap{Net: "tcp", Src: c.src, Dst: c.dst}.Expand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pms) != c.n || pms[0].Src != c.first[0] || pms[0].Dst != c.first[1] {
+			t.Fatalf("%s -> %s expanded wrong: %v", c.src, c.dst, pms)
+		}
+	}
+	if pms, _ := (PortMap{Src: ":1000-1002", Dst: "host:2000"}).Expand(); pms[2].Dst != "host:2002" {
+		t.Fatalf("offset range wrong: %v", pms)
+	}
+
+	for _, dst := range []string{"host:2000-2001", "host:65535"} {
+		_, err := PortMap{Net: "tcp", Src: ":1000-1010", Dst: dst}.Expand()
+		if err != ErrPortRange {
+			t.Fatalf("%s should be invalid: %v", dst, err)
+		}
+	}
+	_, err := PortMap{Net: "tcp", Src: ":1000-9000", Dst: "host:*"}.Expand()
+	if err != ErrPortRange {
+		t.Fatal("range too large should be invalid.")
+	}
+}
+
+func TestSni(t *testing.T) {
+	pm := PortMap{
+		Net: NET_SNI,
+		Dst: "default:443",
+		Routes: map[string]string{
+			"a.example.com":   "a:443",
+			"*.example.com":   "any:443",
+			"*.b.example.com": "b:443",
+		},
+	}
+	for name, dst := range map[string]string{
+		"a.example.com":   "a:443",
+		"c.example.com":   "any:443",
+		"c.b.example.com": "b:443",
+		"example.org":     "default:443",
+		"":                "default:443",
+	} {
+		if r := pm.route(name); r != dst {
+			t.Fatalf("%s routed to %s, not %s.", name, r, dst)
+		}
+	}
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	pm.Routes["a.example.com"] = backend.Addr().String()
+
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	go serveSni(lsock, pm, NewMapper(pm, netutil.DefaultTcpDialer))
+
+	go func() {
+		conn, err := net.Dial("tcp", lsock.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		tls.Client(conn, &tls.Config{ServerName: "a.example.com"}).Handshake()
+	}()
+
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf [1]byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(buf[:])
+	if err != nil || buf[0] != 0x16 {
+		t.Fatalf("backend didn't get client hello: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	m := NewMapper(PortMap{Net: "tcp", MaxConns: 2}, nil)
+	if !m.admit() || !m.admit() || m.admit() {
+		t.Fatal("max conns not limited.")
+	}
+	m.release()
+	if !m.admit() {
+		t.Fatal("connection released not counted.")
+	}
+
+	m = NewMapper(PortMap{Net: "tcp", ConnRate: 2}, nil)
+	if !m.admit() || !m.admit() || m.admit() {
+		t.Fatal("conn rate not limited.")
+	}
+	time.Sleep(600 * time.Millisecond)
+	if !m.admit() {
+		t.Fatal("conn rate not refilled.")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	m := NewMapper(PortMap{Net: "tcp", Allow: []string{"10.0.0.0/8", "192.168.1.0 255.255.255.0"}}, nil)
+	var err error
+	m.filter, err = newAllowFilter(m.Allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, allowed := range map[string]bool{
+		"10.1.2.3:22":    true,
+		"192.168.1.5:22": true,
+		"192.168.2.5:22": false,
+		"8.8.8.8:22":     false,
+	} {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+		if m.allowed(a) != allowed {
+			t.Fatalf("%s allowed should be %v.", addr, allowed)
+		}
+	}
+
+	if _, err = newAllowFilter([]string{"nonsense"}); err == nil {
+		t.Fatal("wrong network accepted.")
+	}
+}
+
+func TestSync(t *testing.T) {
+	var srcs []string
+	for i := 0; i < 3; i++ {
+		probe, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, probe.Addr().String())
+		probe.Close()
+	}
+
+	mgr := NewManager(netutil.DefaultTcpDialer)
+	err := mgr.Sync([]PortMap{
+		{Net: "tcp", Src: srcs[0], Dst: "127.0.0.1:1"},
+		{Net: "tcp", Src: srcs[1], Dst: "127.0.0.1:2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// added by api, not removed by sync.
+	err = mgr.Add(PortMap{Net: "tcp", Src: srcs[2], Dst: "127.0.0.1:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Remove("tcp/" + srcs[2])
+
+	mgr.lock.Lock()
+	kept := mgr.mappers["tcp/"+srcs[0]]
+	mgr.lock.Unlock()
+
+	err = mgr.Sync([]PortMap{
+		{Net: "tcp", Src: srcs[0], Dst: "127.0.0.1:1"},
+		{Net: "tcp", Src: srcs[1], Dst: "127.0.0.1:4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.lock.Lock()
+	if mgr.mappers["tcp/"+srcs[0]] != kept {
+		t.Fatal("mapping unchanged restarted.")
+	}
+	mgr.lock.Unlock()
+	pms := mgr.List()
+	if len(pms) != 3 {
+		t.Fatalf("wrong mappings: %v", pms)
+	}
+
+	err = mgr.Sync(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pms = mgr.List()
+	if len(pms) != 1 || pms[0].Src != srcs[2] {
+		t.Fatalf("wrong mappings after removed: %v", pms)
+	}
+}
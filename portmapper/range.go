@@ -0,0 +1,113 @@
+package portmapper
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// MAX_PORT_RANGE limits listeners of one mapping.
+const MAX_PORT_RANGE = 1024
+
+var ErrPortRange = errors.New("port range invalid.")
+
+// parseRange splits address like host:10000-10100 into host and ports.
+// Single port has first equal to last.
+func parseRange(addr string) (host string, first, last int, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	lo, hi := port, port
+	if idx := strings.Index(port, "-"); idx != -1 {
+		lo, hi = port[:idx], port[idx+1:]
+	}
+	first, err = strconv.Atoi(lo)
+	if err != nil {
+		return "", 0, 0, ErrPortRange
+	}
+	last, err = strconv.Atoi(hi)
+	if err != nil {
+		return "", 0, 0, ErrPortRange
+	}
+	if first <= 0 || last > 65535 || first > last {
+		return "", 0, 0, ErrPortRange
+	}
+	return
+}
+
+func isRange(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && (port == "*" || strings.Contains(port, "-"))
+}
+
+// Expand turns mapping of a port range into mappings of each port, and
+// mapping of comma separated addresses in Src into each address.
+// Dst can be a range of the same size, a single port as the start of an
+// offset range, or * to use the same port as src. Unix socket in Dst is
+// shared by all ports.
+func (pm PortMap) Expand() (pms []PortMap, err error) {
+	if srcs := netutil.SplitAddrs(pm.Src); len(srcs) > 1 {
+		for _, src := range srcs {
+			p := pm
+			p.Src = src
+			var sub []PortMap
+			sub, err = p.Expand()
+			if err != nil {
+				return nil, err
+			}
+			pms = append(pms, sub...)
+		}
+		return
+	}
+	if !isRange(pm.Src) && !isRange(pm.Dst) {
+		return []PortMap{pm}, nil
+	}
+
+	shost, sfirst, slast, err := parseRange(pm.Src)
+	if err != nil {
+		return
+	}
+	if slast-sfirst >= MAX_PORT_RANGE {
+		return nil, ErrPortRange
+	}
+
+	if _, ok := netutil.ParseUnix(pm.Dst); ok {
+		for port := sfirst; port <= slast; port++ {
+			p := pm
+			p.Src = net.JoinHostPort(shost, strconv.Itoa(port))
+			pms = append(pms, p)
+		}
+		return
+	}
+
+	dhost, dport, err := net.SplitHostPort(pm.Dst)
+	if err != nil {
+		return
+	}
+	dfirst := sfirst
+	if dport != "*" {
+		var dlast int
+		dhost, dfirst, dlast, err = parseRange(pm.Dst)
+		if err != nil {
+			return
+		}
+		if dfirst != dlast && dlast-dfirst != slast-sfirst {
+			return nil, ErrPortRange
+		}
+		if dfirst+slast-sfirst > 65535 {
+			return nil, ErrPortRange
+		}
+	}
+
+	for port := sfirst; port <= slast; port++ {
+		p := pm
+		p.Src = net.JoinHostPort(shost, strconv.Itoa(port))
+		p.Dst = net.JoinHostPort(dhost, strconv.Itoa(dfirst+port-sfirst))
+		pms = append(pms, p)
+	}
+	return
+}
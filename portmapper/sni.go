@@ -0,0 +1,132 @@
+package portmapper
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// NET_SNI listens tcp, and dispatches connections by server name in tls
+// ClientHello.
+const NET_SNI = "sni"
+
+// SNI_TIMEOUT in seconds to read ClientHello.
+const SNI_TIMEOUT = 10
+
+var (
+	ErrNoRoute = errors.New("no route for server name.")
+	errPeeked  = errors.New("client hello peeked.")
+)
+
+// readOnlyConn lets tls read ClientHello, but never writes to client.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekServerName reads ClientHello from conn, returns server name and
+// bytes read, which should be sent to backend first.
+func peekServerName(conn net.Conn) (name string, peeked []byte, err error) {
+	var buf bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(SNI_TIMEOUT * time.Second))
+	err = tls.Server(readOnlyConn{conn, io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errPeeked
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	if !errors.Is(err, errPeeked) {
+		return
+	}
+	return name, buf.Bytes(), nil
+}
+
+// route finds backend of server name in Routes. Keys like *.example.com
+// match any subdomain, and the longest one wins. Dst is the default.
+func (pm PortMap) route(name string) (dst string) {
+	name = strings.ToLower(name)
+	if dst, ok := pm.Routes[name]; ok {
+		return dst
+	}
+	for suffix := name; ; {
+		idx := strings.Index(suffix, ".")
+		if idx == -1 {
+			break
+		}
+		suffix = suffix[idx+1:]
+		if dst, ok := pm.Routes["*."+suffix]; ok {
+			return dst
+		}
+	}
+	return pm.Dst
+}
+
+func serveSni(lsock net.Listener, pm PortMap, m *Mapper) (err error) {
+	for {
+		var sconn net.Conn
+		sconn, err = lsock.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logger.Error(err.Error())
+			continue
+		}
+		if !m.admit() {
+			sconn.Close()
+			continue
+		}
+		go relaySni(sconn, pm, m)
+	}
+}
+
+func relaySni(sconn net.Conn, pm PortMap, m *Mapper) {
+	defer m.release()
+	sconn, err := m.accept(sconn)
+	if err != nil {
+		logger.Errorf("accept in %s: %s", pm.Src, err.Error())
+		m.stats.fail(err)
+		sconn.Close()
+		return
+	}
+	name, peeked, err := peekServerName(sconn)
+	if err != nil {
+		logger.Errorf("read client hello in %s: %s", pm.Src, err.Error())
+		m.stats.fail(err)
+		sconn.Close()
+		return
+	}
+	dst := pm.route(name)
+	if dst == "" {
+		logger.Errorf("no route for %q in %s.", name, pm.Src)
+		m.stats.fail(ErrNoRoute)
+		sconn.Close()
+		return
+	}
+	logger.Infof("accept %s in %s, try to dial %s.", name, pm.Src, dst)
+
+	dconn, err := pm.dial(m.dialer, "tcp", dst, sconn)
+	if err != nil {
+		logger.Error(err.Error())
+		m.stats.fail(err)
+		sconn.Close()
+		return
+	}
+	_, err = dconn.Write(peeked)
+	if err != nil {
+		logger.Error(err.Error())
+		m.stats.fail(err)
+		dconn.Close()
+		sconn.Close()
+		return
+	}
+	m.relay(pm, dconn, sconn)
+}
@@ -0,0 +1,82 @@
+package portmapper
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mapStats counts how a mapping is used, kept in Mapper.
+type mapStats struct {
+	accepted  int64
+	rejected  int64
+	up        int64 // bytes from clients to backend
+	down      int64
+	lock      sync.Mutex
+	lastErr   string
+	errorTime time.Time
+}
+
+func (ms *mapStats) fail(err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.lastErr = err.Error()
+	ms.errorTime = time.Now()
+}
+
+// MapperStatus is mapping with its stats. Connections rejected by limits
+// are not accepted. Active counts udp flows for udp.
+type MapperStatus struct {
+	PortMap
+	Accepted  int64
+	Rejected  int64
+	Active    int64
+	Up        int64
+	Down      int64
+	LastError string
+	ErrorTime time.Time
+}
+
+func (m *Mapper) Status() (ms MapperStatus) {
+	ms = MapperStatus{
+		PortMap:  m.PortMap,
+		Accepted: atomic.LoadInt64(&m.stats.accepted),
+		Rejected: atomic.LoadInt64(&m.stats.rejected),
+		Active:   atomic.LoadInt64(&m.active),
+		Up:       atomic.LoadInt64(&m.stats.up),
+		Down:     atomic.LoadInt64(&m.stats.down),
+	}
+	m.stats.lock.Lock()
+	ms.LastError = m.stats.lastErr
+	ms.ErrorTime = m.stats.errorTime
+	m.stats.lock.Unlock()
+	return
+}
+
+// WriteMetrics writes stats of all mappings in prometheus text format.
+func (mgr *Manager) WriteMetrics(w io.Writer) {
+	status := mgr.Status()
+	fmt.Fprintln(w, "# HELP goproxy_portmap_connections_total Connections or udp flows of mapping, accepted or rejected by limits.")
+	fmt.Fprintln(w, "# TYPE goproxy_portmap_connections_total counter")
+	for _, ms := range status {
+		fmt.Fprintf(w, "goproxy_portmap_connections_total{mapping=%q,result=\"accepted\"} %d\n",
+			ms.Key(), ms.Accepted)
+		fmt.Fprintf(w, "goproxy_portmap_connections_total{mapping=%q,result=\"rejected\"} %d\n",
+			ms.Key(), ms.Rejected)
+	}
+	fmt.Fprintln(w, "# HELP goproxy_portmap_active Connections or udp flows of mapping now.")
+	fmt.Fprintln(w, "# TYPE goproxy_portmap_active gauge")
+	for _, ms := range status {
+		fmt.Fprintf(w, "goproxy_portmap_active{mapping=%q} %d\n", ms.Key(), ms.Active)
+	}
+	fmt.Fprintln(w, "# HELP goproxy_portmap_bytes_total Bytes relayed by mapping.")
+	fmt.Fprintln(w, "# TYPE goproxy_portmap_bytes_total counter")
+	for _, ms := range status {
+		fmt.Fprintf(w, "goproxy_portmap_bytes_total{mapping=%q,direction=\"up\"} %d\n",
+			ms.Key(), ms.Up)
+		fmt.Fprintf(w, "goproxy_portmap_bytes_total{mapping=%q,direction=\"down\"} %d\n",
+			ms.Key(), ms.Down)
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ACCESS_COMMON   = "common"
+	ACCESS_COMBINED = "combined"
+	ACCESS_JSON     = "json"
+)
+
+var ErrAccessFormat = errors.New("access log format should be common, combined or json.")
+
+// AccessRecord is one request through proxy.
+type AccessRecord struct {
+	Time      time.Time
+	Client    string
+	Username  string `json:",omitempty"`
+	Method    string
+	Host      string
+	URL       string
+	Proto     string
+	Status    int
+	Bytes     int64   // bytes of response body, or to client in CONNECT
+	Duration  float64 // seconds
+	Dialer    string  `json:",omitempty"`
+	Referer   string  `json:",omitempty"`
+	UserAgent string  `json:",omitempty"`
+}
+
+// AccessLogger writes records in apache common or combined log format,
+// or one json object per line.
+type AccessLogger struct {
+	lock   sync.Mutex
+	w      io.Writer
+	enc    *json.Encoder
+	format string
+}
+
+func NewAccessLogger(w io.Writer, format string) (al *AccessLogger, err error) {
+	switch format {
+	case "":
+		format = ACCESS_COMBINED
+	case ACCESS_COMMON, ACCESS_COMBINED, ACCESS_JSON:
+	default:
+		return nil, ErrAccessFormat
+	}
+	return &AccessLogger{w: w, enc: json.NewEncoder(w), format: format}, nil
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (al *AccessLogger) Log(r *AccessRecord) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.format == ACCESS_JSON {
+		err := al.enc.Encode(r)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.Client)
+	if err != nil {
+		host = r.Client
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d",
+		host, dash(r.Username), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.URL, r.Proto, r.Status, r.Bytes)
+	if al.format == ACCESS_COMBINED {
+		line += fmt.Sprintf(" %q %q %.3f %s",
+			dash(r.Referer), dash(r.UserAgent), r.Duration, dash(r.Dialer))
+	}
+	_, err = fmt.Fprintln(al.w, line)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// Close closes writer of log, if it can be.
+func (al *AccessLogger) Close() (err error) {
+	if c, ok := al.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return
+}
+
+// RecentLog keeps the last records in memory, so dashboard shows where
+// requests went.
+type RecentLog struct {
+	lock    sync.Mutex
+	records []AccessRecord
+	next    int
+	full    bool
+}
+
+func NewRecentLog(size int) (rl *RecentLog) {
+	return &RecentLog{records: make([]AccessRecord, size)}
+}
+
+func (rl *RecentLog) Log(r *AccessRecord) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.records[rl.next] = *r
+	rl.next++
+	if rl.next == len(rl.records) {
+		rl.next = 0
+		rl.full = true
+	}
+}
+
+// Records returns records kept, the newest first.
+func (rl *RecentLog) Records() (records []AccessRecord) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	n := rl.next
+	if rl.full {
+		n = len(rl.records)
+	}
+	records = make([]AccessRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		records = append(records, rl.records[(rl.next-i+len(rl.records))%len(rl.records)])
+	}
+	return
+}
+
+// HandlerRecent lists records kept in json, the newest first.
+func (rl *RecentLog) HandlerRecent(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rl.Records())
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// accessWriter keeps status and bytes written to response, and bytes
+// read from request.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	sent   int64
+}
+
+// countBody counts bytes read from body of request.
+type countBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (cb *countBody) Read(b []byte) (n int, err error) {
+	n, err = cb.ReadCloser.Read(b)
+	*cb.n += int64(n)
+	return
+}
+
+func (aw *accessWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessWriter) Write(b []byte) (n int, err error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err = aw.ResponseWriter.Write(b)
+	aw.bytes += int64(n)
+	return
+}
+
+func (aw *accessWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (aw *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hij, ok := aw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hij.Hijack()
+}
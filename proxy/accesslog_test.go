@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestAccessLog(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var buf bytes.Buffer
+	p := NewProxy(netutil.NewNamedDialer("direct", netutil.DefaultTcpDialer), "", "")
+	p.AccessLog, _ = NewAccessLogger(&buf, ACCESS_JSON)
+
+	req := httptest.NewRequest("GET", origin.URL+"/x", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	var r AccessRecord
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != http.StatusTeapot || r.Bytes != 5 || r.Dialer != "direct" ||
+		r.Client != "10.0.0.1:1234" || r.URL != origin.URL+"/x" {
+		t.Fatalf("wrong record: %+v", r)
+	}
+
+	buf.Reset()
+	p.AccessLog, _ = NewAccessLogger(&buf, ACCESS_COMMON)
+	p.AccessLog.Log(&r)
+	line := buf.String()
+	if !strings.HasPrefix(line, "10.0.0.1 - - [") ||
+		!strings.HasSuffix(line, "\"GET "+origin.URL+"/x HTTP/1.1\" 418 5\n") {
+		t.Fatalf("wrong common log: %s", line)
+	}
+
+	if _, err := NewAccessLogger(&buf, "xml"); err != ErrAccessFormat {
+		t.Fatal("unknown format accepted")
+	}
+}
+
+func TestRecentLog(t *testing.T) {
+	rl := NewRecentLog(3)
+	if len(rl.Records()) != 0 {
+		t.Fatal("records in new log")
+	}
+	for _, host := range []string{"a", "b", "c", "d"} {
+		rl.Log(&AccessRecord{Host: host})
+	}
+	var hosts []string
+	for _, r := range rl.Records() {
+		hosts = append(hosts, r.Host)
+	}
+	if strings.Join(hosts, "") != "dcb" {
+		t.Fatalf("wrong records: %v", hosts)
+	}
+
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.Recent = rl
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://127.0.0.1:1/", nil))
+	if r := rl.Records()[0]; r.Host != "127.0.0.1:1" || r.Status != w.Code {
+		t.Fatalf("request not kept: %v", r)
+	}
+}
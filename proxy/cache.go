@@ -0,0 +1,575 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CACHE_MEMORY_OBJECT is the largest body kept in memory if there
+	// is a disk tier, larger ones are written to disk.
+	CACHE_MEMORY_OBJECT = 1 << 20
+	CACHE_SUFFIX        = ".cache"
+)
+
+// cacheEntry is a response stored, body in memory or in file of path.
+type cacheEntry struct {
+	key      string
+	vary     map[string]string // request headers named in Vary
+	status   int
+	header   http.Header
+	reqTime  time.Time
+	respTime time.Time
+	size     int64
+	body     []byte
+	path     string
+	elem     *list.Element
+}
+
+func varyOf(req *http.Request, header http.Header) (vary map[string]string) {
+	vary = make(map[string]string, 0)
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				vary[name] = strings.Join(req.Header.Values(name), ",")
+			}
+		}
+	}
+	return
+}
+
+func (e *cacheEntry) matchVary(vary map[string]string) bool {
+	if len(vary) != len(e.vary) {
+		return false
+	}
+	for name, value := range e.vary {
+		if v, ok := vary[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) matchReq(req *http.Request) bool {
+	for name, value := range e.vary {
+		if strings.Join(req.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Cache stores responses of GET for clients (RFC 7234, as a shared
+// cache). Bodies are kept in memory up to MaxMemory bytes, and in files
+// of dir up to MaxDisk bytes if dir is set. Entries least recently used
+// are moved from memory to disk, then dropped. Files don't survive
+// restart.
+type Cache struct {
+	MaxMemory int64
+	MaxDisk   int64
+	// MaxObject is the largest body stored, zero means limited only
+	// by size of tiers.
+	MaxObject int64
+	dir       string
+	lock      sync.Mutex
+	entries   map[string][]*cacheEntry
+	memory    *list.List
+	memSize   int64
+	disk      *list.List
+	diskSize  int64
+}
+
+func NewCache(maxMemory int64, dir string, maxDisk int64) (c *Cache, err error) {
+	c = &Cache{
+		MaxMemory: maxMemory,
+		MaxDisk:   maxDisk,
+		dir:       dir,
+		entries:   make(map[string][]*cacheEntry, 0),
+		memory:    list.New(),
+		disk:      list.New(),
+	}
+	if dir == "" {
+		return
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	// files left by last run have no index.
+	files, err := filepath.Glob(filepath.Join(dir, "*"+CACHE_SUFFIX))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+	return
+}
+
+func cacheKey(u *url.URL) string {
+	return u.String()
+}
+
+// Wrap returns transport answering from cache, and storing responses
+// of next.
+func (c *Cache) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &cacheTransport{cache: c, next: next}
+}
+
+type cacheTransport struct {
+	cache *Cache
+	next  http.RoundTripper
+}
+
+func (ct *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return ct.cache.roundTrip(req, ct.next)
+}
+
+func (c *Cache) roundTrip(req *http.Request, next http.RoundTripper) (resp *http.Response, err error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp, err = next.RoundTrip(req)
+		if err == nil && req.Method != "OPTIONS" && req.Method != "TRACE" && resp.StatusCode < 400 {
+			c.invalidate(req.URL, resp)
+		}
+		return
+	}
+	if req.Header.Get("Range") != "" {
+		return next.RoundTrip(req)
+	}
+
+	reqcc := parseCacheControl(req.Header)
+	e := c.lookup(req)
+	if e != nil && c.fresh(e, req, reqcc, time.Now()) {
+		resp, err = c.hit(req, e, time.Now())
+		if err == nil {
+			logger.Debugf("cache hit %s.", req.URL)
+			return
+		}
+		c.remove(e)
+		e = nil
+	}
+	if reqcc.has("only-if-cached") {
+		return c.response(req, http.StatusGatewayTimeout, make(http.Header), http.NoBody), nil
+	}
+	if req.Method == "HEAD" {
+		return next.RoundTrip(req)
+	}
+
+	outreq := req
+	var etag, modified string
+	if e != nil {
+		c.lock.Lock()
+		etag, modified = e.header.Get("ETag"), e.header.Get("Last-Modified")
+		c.lock.Unlock()
+	}
+	validator := etag != "" || modified != ""
+	if validator {
+		// conditions of client are answered by cache.
+		outreq = req.Clone(req.Context())
+		outreq.Header.Del("If-None-Match")
+		outreq.Header.Del("If-Modified-Since")
+		if etag != "" {
+			outreq.Header.Set("If-None-Match", etag)
+		}
+		if modified != "" {
+			outreq.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	reqTime := time.Now()
+	resp, err = next.RoundTrip(outreq)
+	if err != nil {
+		return
+	}
+	respTime := time.Now()
+	if validator && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		c.update(e, resp.Header, reqTime, respTime)
+		logger.Debugf("cache validated %s.", req.URL)
+		return c.hit(req, e, respTime)
+	}
+	if !storable(req, resp) {
+		return
+	}
+	if resp.ContentLength > 0 && c.MaxObject > 0 && resp.ContentLength > c.MaxObject {
+		return
+	}
+	resp.Body = &cacheFill{
+		ReadCloser: resp.Body,
+		cache:      c,
+		length:     resp.ContentLength,
+		entry: &cacheEntry{
+			key:      cacheKey(req.URL),
+			vary:     varyOf(req, resp.Header),
+			status:   resp.StatusCode,
+			header:   resp.Header.Clone(),
+			reqTime:  reqTime,
+			respTime: respTime,
+		},
+	}
+	return
+}
+
+// fresh tells if entry can be used without validation (RFC 7234 4.2,
+// 5.2.1).
+func (c *Cache) fresh(e *cacheEntry, req *http.Request, reqcc cacheControl, now time.Time) bool {
+	c.lock.Lock()
+	header := e.header
+	age := currentAge(header, e.reqTime, e.respTime, now)
+	life := lifetime(e.status, header, e.respTime)
+	respcc := parseCacheControl(header)
+	c.lock.Unlock()
+
+	if noCache(req, reqcc) || respcc.has("no-cache") {
+		return false
+	}
+	if d, ok := reqcc.seconds("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := reqcc.seconds("min-fresh"); ok {
+		age += d
+	}
+	if age < life {
+		return true
+	}
+	// s-maxage implies proxy-revalidate.
+	if respcc.has("must-revalidate") || respcc.has("proxy-revalidate") || respcc.has("s-maxage") {
+		return false
+	}
+	v, ok := reqcc["max-stale"]
+	if !ok {
+		return false
+	}
+	if v == "" {
+		return true
+	}
+	d, ok := reqcc.seconds("max-stale")
+	return ok && age-life <= d
+}
+
+func (c *Cache) response(req *http.Request, status int, header http.Header, body io.ReadCloser) (resp *http.Response) {
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+}
+
+// hit makes response of req from entry.
+func (c *Cache) hit(req *http.Request, e *cacheEntry, now time.Time) (resp *http.Response, err error) {
+	c.lock.Lock()
+	header := e.header.Clone()
+	age := currentAge(e.header, e.reqTime, e.respTime, now)
+	life := lifetime(e.status, e.header, e.respTime)
+	data := e.body
+	var file *os.File
+	if data == nil && req.Method == "GET" {
+		// file removed after opened is still readable.
+		file, err = os.Open(e.path)
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if age >= life {
+		header.Add("Warning", `110 - "Response is Stale"`)
+	}
+	if notModified(req, header) {
+		if file != nil {
+			file.Close()
+		}
+		header.Del("Content-Length")
+		return c.response(req, http.StatusNotModified, header, http.NoBody), nil
+	}
+	if req.Method == "HEAD" {
+		resp = c.response(req, e.status, header, http.NoBody)
+		resp.ContentLength = e.size
+		return
+	}
+
+	var body io.ReadCloser = file
+	if data != nil {
+		body = io.NopCloser(bytes.NewReader(data))
+	}
+	resp = c.response(req, e.status, header, body)
+	resp.ContentLength = e.size
+	return
+}
+
+func (c *Cache) lookup(req *http.Request) (e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e = range c.entries[cacheKey(req.URL)] {
+		if !e.matchReq(req) {
+			continue
+		}
+		if e.body != nil {
+			c.memory.MoveToFront(e.elem)
+		} else {
+			c.disk.MoveToFront(e.elem)
+		}
+		return
+	}
+	return nil
+}
+
+// update takes headers of 304 as stored response's (RFC 7234 4.3.4).
+func (c *Cache) update(e *cacheEntry, header http.Header, reqTime, respTime time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	updated := e.header.Clone()
+	for k, vv := range header {
+		if k == "Content-Length" {
+			continue
+		}
+		updated[k] = vv
+	}
+	e.header = updated
+	e.reqTime = reqTime
+	e.respTime = respTime
+}
+
+// invalidate removes responses of u, and of locations in resp on the
+// same host, after an unsafe request (RFC 7234 4.4).
+func (c *Cache) invalidate(u *url.URL, resp *http.Response) {
+	keys := []string{cacheKey(u)}
+	for _, h := range []string{"Location", "Content-Location"} {
+		v := resp.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		loc, err := u.Parse(v)
+		if err != nil || loc.Host != u.Host {
+			continue
+		}
+		keys = append(keys, cacheKey(loc))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range keys {
+		for _, e := range c.entries[key] {
+			c.drop(e)
+		}
+		delete(c.entries, key)
+	}
+}
+
+func (c *Cache) remove(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unlink(e)
+	c.drop(e)
+}
+
+// unlink removes entry from index, lock held.
+func (c *Cache) unlink(e *cacheEntry) {
+	entries := c.entries[e.key]
+	for i, e1 := range entries {
+		if e1 == e {
+			entries = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = entries
+	}
+}
+
+// drop releases storage of entry, lock held.
+func (c *Cache) drop(e *cacheEntry) {
+	if e.elem == nil {
+		return
+	}
+	if e.body != nil {
+		c.memory.Remove(e.elem)
+		c.memSize -= e.size
+		e.body = nil
+	} else {
+		c.disk.Remove(e.elem)
+		c.diskSize -= e.size
+		os.Remove(e.path)
+	}
+	e.elem = nil
+}
+
+// store puts entry filled in, replacing the one of same variant.
+func (c *Cache) store(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e1 := range c.entries[e.key] {
+		if e1.matchVary(e.vary) {
+			c.unlink(e1)
+			c.drop(e1)
+			break
+		}
+	}
+	c.entries[e.key] = append(c.entries[e.key], e)
+	if e.body != nil {
+		e.elem = c.memory.PushFront(e)
+		c.memSize += e.size
+	} else {
+		e.elem = c.disk.PushFront(e)
+		c.diskSize += e.size
+	}
+	c.evict()
+}
+
+// evict moves entries least recently used in memory to disk, and drops
+// them from disk, until both fit. Lock held.
+func (c *Cache) evict() {
+	for c.memSize > c.MaxMemory && c.memory.Len() > 0 {
+		e := c.memory.Back().Value.(*cacheEntry)
+		if c.dir == "" || !c.demote(e) {
+			c.unlink(e)
+			c.drop(e)
+		}
+	}
+	for c.diskSize > c.MaxDisk && c.disk.Len() > 0 {
+		e := c.disk.Back().Value.(*cacheEntry)
+		c.unlink(e)
+		c.drop(e)
+	}
+}
+
+// demote writes body of entry in memory to disk.
+func (c *Cache) demote(e *cacheEntry) bool {
+	file, err := os.CreateTemp(c.dir, "*"+CACHE_SUFFIX)
+	if err != nil {
+		logger.Error(err.Error())
+		return false
+	}
+	_, err = file.Write(e.body)
+	file.Close()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Remove(file.Name())
+		return false
+	}
+	c.memory.Remove(e.elem)
+	c.memSize -= e.size
+	e.body = nil
+	e.path = file.Name()
+	e.elem = c.disk.PushFront(e)
+	c.diskSize += e.size
+	return true
+}
+
+// cacheFill copies body read by client into cache, the entry is stored
+// when body read to the end.
+type cacheFill struct {
+	io.ReadCloser
+	cache  *Cache
+	entry  *cacheEntry
+	length int64
+	buf    bytes.Buffer
+	file   *os.File
+	done   bool
+}
+
+func (f *cacheFill) Read(b []byte) (n int, err error) {
+	n, err = f.ReadCloser.Read(b)
+	if n > 0 && !f.done {
+		f.write(b[:n])
+	}
+	if err == io.EOF && !f.done {
+		f.commit()
+	}
+	return
+}
+
+func (f *cacheFill) write(b []byte) {
+	c := f.cache
+	f.entry.size += int64(len(b))
+	limit := c.MaxMemory
+	if c.dir != "" {
+		limit = c.MaxDisk
+	}
+	if c.MaxObject > 0 && c.MaxObject < limit {
+		limit = c.MaxObject
+	}
+	if f.entry.size > limit {
+		f.abort()
+		return
+	}
+
+	if f.file == nil && c.dir != "" && f.entry.size > CACHE_MEMORY_OBJECT {
+		var err error
+		f.file, err = os.CreateTemp(c.dir, "*"+CACHE_SUFFIX)
+		if err != nil {
+			logger.Error(err.Error())
+			f.abort()
+			return
+		}
+		f.buf.WriteTo(f.file)
+	}
+	if f.file == nil {
+		f.buf.Write(b)
+		return
+	}
+	_, err := f.file.Write(b)
+	if err != nil {
+		logger.Error(err.Error())
+		f.abort()
+	}
+}
+
+func (f *cacheFill) commit() {
+	f.done = true
+	if f.length >= 0 && f.entry.size != f.length {
+		f.abort()
+		return
+	}
+	if f.file != nil {
+		err := f.file.Close()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Remove(f.file.Name())
+			return
+		}
+		f.entry.path = f.file.Name()
+	} else {
+		f.entry.body = f.buf.Bytes()
+		if f.entry.body == nil {
+			f.entry.body = []byte{}
+		}
+	}
+	f.cache.store(f.entry)
+}
+
+func (f *cacheFill) abort() {
+	f.done = true
+	f.buf = bytes.Buffer{}
+	if f.file != nil {
+		f.file.Close()
+		os.Remove(f.file.Name())
+		f.file = nil
+	}
+}
+
+func (f *cacheFill) Close() error {
+	if !f.done {
+		f.abort()
+	}
+	return f.ReadCloser.Close()
+}
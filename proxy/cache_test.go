@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheOrigin serves body with header set, counting full responses.
+func cacheOrigin(header http.Header, body []byte, count *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copyHeader(w.Header(), header)
+		if etag := header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt64(count, 1)
+		w.Write(body)
+	}))
+}
+
+func cacheGet(t *testing.T, rt http.RoundTripper, url string, header http.Header) (resp *http.Response, body []byte) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if header != nil {
+		req.Header = header
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestCacheFresh(t *testing.T) {
+	var count int64
+	origin := cacheOrigin(http.Header{"Cache-Control": {"max-age=60"}}, []byte("hello"), &count)
+	defer origin.Close()
+	c, _ := NewCache(1<<20, "", 0)
+	rt := c.Wrap(http.DefaultTransport)
+
+	cacheGet(t, rt, origin.URL+"/a", nil)
+	resp, body := cacheGet(t, rt, origin.URL+"/a", nil)
+	if count != 1 || string(body) != "hello" || resp.Header.Get("Age") == "" {
+		t.Fatalf("not cached: %d %q", count, body)
+	}
+
+	// client asks to validate.
+	cacheGet(t, rt, origin.URL+"/a", http.Header{"Cache-Control": {"no-cache"}})
+	if count != 2 {
+		t.Fatalf("no-cache answered by cache: %d", count)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	for _, cc := range []string{"no-store", "private, max-age=60"} {
+		var count int64
+		origin := cacheOrigin(http.Header{"Cache-Control": {cc}}, []byte("hello"), &count)
+		c, _ := NewCache(1<<20, "", 0)
+		rt := c.Wrap(http.DefaultTransport)
+		cacheGet(t, rt, origin.URL, nil)
+		cacheGet(t, rt, origin.URL, nil)
+		origin.Close()
+		if count != 2 {
+			t.Fatalf("%s stored", cc)
+		}
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	var count int64
+	origin := cacheOrigin(http.Header{
+		"Cache-Control": {"no-cache"},
+		"Etag":          {`"v1"`},
+	}, []byte("hello"), &count)
+	defer origin.Close()
+	c, _ := NewCache(1<<20, "", 0)
+	rt := c.Wrap(http.DefaultTransport)
+
+	cacheGet(t, rt, origin.URL, nil)
+	resp, body := cacheGet(t, rt, origin.URL, nil)
+	if count != 1 || resp.StatusCode != 200 || string(body) != "hello" {
+		t.Fatalf("not validated: %d %d %q", count, resp.StatusCode, body)
+	}
+
+	// condition of client is answered by cache.
+	resp, _ = cacheGet(t, rt, origin.URL, http.Header{"If-None-Match": {`"v1"`}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("wrong status: %d", resp.StatusCode)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	var count int64
+	origin := cacheOrigin(http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Vary":          {"Accept-Language"},
+	}, []byte("hello"), &count)
+	defer origin.Close()
+	c, _ := NewCache(1<<20, "", 0)
+	rt := c.Wrap(http.DefaultTransport)
+
+	en := http.Header{"Accept-Language": {"en"}}
+	cacheGet(t, rt, origin.URL, en)
+	cacheGet(t, rt, origin.URL, http.Header{"Accept-Language": {"fr"}})
+	cacheGet(t, rt, origin.URL, en)
+	if count != 2 {
+		t.Fatalf("wrong fetches: %d", count)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	var count int64
+	origin := cacheOrigin(http.Header{"Cache-Control": {"max-age=60"}}, []byte("hello"), &count)
+	defer origin.Close()
+	c, _ := NewCache(1<<20, "", 0)
+	rt := c.Wrap(http.DefaultTransport)
+
+	cacheGet(t, rt, origin.URL, nil)
+	req, _ := http.NewRequest("POST", origin.URL, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cacheGet(t, rt, origin.URL, nil)
+	if count != 3 {
+		t.Fatalf("not invalidated: %d", count)
+	}
+}
+
+func TestCacheDisk(t *testing.T) {
+	var count int64
+	big := bytes.Repeat([]byte("x"), CACHE_MEMORY_OBJECT+1)
+	origin := cacheOrigin(http.Header{"Cache-Control": {"max-age=60"}}, big, &count)
+	defer origin.Close()
+	dir := t.TempDir()
+	c, err := NewCache(1<<10, dir, 5<<19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := c.Wrap(http.DefaultTransport)
+
+	cacheGet(t, rt, origin.URL+"/a", nil)
+	_, body := cacheGet(t, rt, origin.URL+"/a", nil)
+	if count != 1 || !bytes.Equal(body, big) {
+		t.Fatalf("not cached on disk: %d %d", count, len(body))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+CACHE_SUFFIX))
+	if len(files) != 1 {
+		t.Fatalf("wrong files: %v", files)
+	}
+
+	// least recently used is dropped when disk is full.
+	cacheGet(t, rt, origin.URL+"/b", nil)
+	cacheGet(t, rt, origin.URL+"/c", nil)
+	cacheGet(t, rt, origin.URL+"/a", nil)
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+CACHE_SUFFIX))
+	if count != 4 || len(files) != 2 {
+		t.Fatalf("wrong eviction: %d %v", count, files)
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Now()
+	header := http.Header{
+		"Date":          {now.UTC().Format(http.TimeFormat)},
+		"Last-Modified": {now.Add(-10 * time.Hour).UTC().Format(http.TimeFormat)},
+	}
+	if d := lifetime(200, header, now); d != time.Hour {
+		t.Fatalf("wrong heuristic: %s", d)
+	}
+	header.Set("Expires", now.Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d := lifetime(200, header, now); d != time.Minute {
+		t.Fatalf("wrong expires: %s", d)
+	}
+	header.Set("Cache-Control", "max-age=10, s-maxage=20")
+	if d := lifetime(200, header, now); d != 20*time.Second {
+		t.Fatalf("wrong s-maxage: %s", d)
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// heuristic freshness is 1/CACHE_HEURISTIC of time since
+	// Last-Modified, no longer than CACHE_HEURISTIC_MAX.
+	CACHE_HEURISTIC     = 10
+	CACHE_HEURISTIC_MAX = 24 * time.Hour
+)
+
+// status codes cacheable by default (RFC 7231 6.1, RFC 7538).
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheControl is directives of Cache-Control, value is empty if not
+// given.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) (cc cacheControl) {
+	cc = make(cacheControl)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(d, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			cc[name] = strings.Trim(strings.TrimSpace(value), "\"")
+		}
+	}
+	return
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns directive as duration, ok is false if not given or
+// malformed.
+func (cc cacheControl) seconds(name string) (d time.Duration, ok bool) {
+	v, ok := cc[name]
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// noCache tells if request asks to validate with server.
+func noCache(req *http.Request, reqcc cacheControl) bool {
+	if reqcc.has("no-cache") {
+		return true
+	}
+	// Pragma is only for http/1.0 clients without Cache-Control.
+	return req.Header.Get("Cache-Control") == "" &&
+		headerHasToken(req.Header, "Pragma", "no-cache")
+}
+
+// lifetime is freshness lifetime of response (RFC 7234 4.2.1).
+func lifetime(status int, header http.Header, respTime time.Time) time.Duration {
+	cc := parseCacheControl(header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = respTime
+	}
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// invalid date means already expired.
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if !cacheableStatus[status] {
+		return 0
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil || !modified.Before(date) {
+		return 0
+	}
+	d := date.Sub(modified) / CACHE_HEURISTIC
+	if d > CACHE_HEURISTIC_MAX {
+		d = CACHE_HEURISTIC_MAX
+	}
+	return d
+}
+
+// currentAge is age of response now (RFC 7234 4.2.3).
+func currentAge(header http.Header, reqTime, respTime, now time.Time) time.Duration {
+	var apparent time.Duration
+	if date, err := http.ParseTime(header.Get("Date")); err == nil && respTime.After(date) {
+		apparent = respTime.Sub(date)
+	}
+	var age time.Duration
+	if n, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && n > 0 {
+		age = time.Duration(n) * time.Second
+	}
+	corrected := age + respTime.Sub(reqTime)
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(respTime)
+}
+
+// storable tells if a shared cache can store response of req
+// (RFC 7234 3).
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return false
+	}
+	if !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	reqcc := parseCacheControl(req.Header)
+	respcc := parseCacheControl(resp.Header)
+	if reqcc.has("no-store") || respcc.has("no-store") || respcc.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !respcc.has("public") &&
+		!respcc.has("s-maxage") && !respcc.has("must-revalidate") {
+		return false
+	}
+	if headerHasToken(resp.Header, "Vary", "*") {
+		return false
+	}
+	// cookies of one client shouldn't be given to others.
+	if resp.Header.Get("Set-Cookie") != "" && !respcc.has("public") {
+		return false
+	}
+	// useless if neither fresh nor able to validate.
+	return lifetime(resp.StatusCode, resp.Header, time.Now()) > 0 ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// notModified tells if stored response satisfies conditions of req, so
+// 304 is enough.
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons of error pages.
+const (
+	REASON_CLIENT = "client not allowed"
+	REASON_AUTH   = "proxy auth required"
+	REASON_RULE   = "blocked by rule"
+	REASON_PORT   = "port not allowed"
+	REASON_DIAL   = "server unreachable"
+	REASON_SERVER = "server failed"
+	REASON_ICAP   = "content inspection failed"
+)
+
+// defaultPage is used for status without page in dir.
+const defaultPage = `<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Reason}}: {{.URL}}</p>
+{{if .Rule}}<p>rule: {{.Rule}}</p>{{end}}
+{{if .Error}}<p>error: {{.Error}}</p>{{end}}
+<hr><p>goproxy, {{.Time}}</p>
+</body></html>
+`
+
+// PageData is what templates of error pages get.
+type PageData struct {
+	Status     int
+	StatusText string
+	Reason     string
+	// Rule is the rule blocked request, empty if not by rule.
+	Rule   string
+	Method string
+	URL    string
+	Client string
+	Error  string
+	Time   string
+}
+
+// ErrorPages renders responses of proxy itself, by html templates in a
+// directory named by status, like 403.html, or error.html for any
+// status, so users know why requests failed.
+type ErrorPages struct {
+	pages    map[int]*template.Template
+	fallback *template.Template
+}
+
+func NewErrorPages(dir string) (ep *ErrorPages, err error) {
+	ep = &ErrorPages{pages: make(map[int]*template.Template, 0)}
+	ep.fallback = template.Must(template.New("default").Parse(defaultPage))
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		status, e := strconv.Atoi(name)
+		if e != nil && name != "error" {
+			continue
+		}
+		var data []byte
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return
+		}
+		var tmpl *template.Template
+		tmpl, err = template.New(name).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+		if name == "error" {
+			ep.fallback = tmpl
+		} else {
+			ep.pages[status] = tmpl
+		}
+	}
+	return
+}
+
+// Render writes page of data.Status to w.
+func (ep *ErrorPages) Render(w io.Writer, data *PageData) error {
+	tmpl, ok := ep.pages[data.Status]
+	if !ok {
+		tmpl = ep.fallback
+	}
+	return tmpl.Execute(w, data)
+}
+
+func newPageData(req *http.Request, status int, reason string, rule *Rule, err error) (data *PageData) {
+	data = &PageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Reason:     reason,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Client:     req.RemoteAddr,
+		Time:       time.Now().Format(time.RFC1123),
+	}
+	if req.Method == "CONNECT" {
+		data.URL = req.URL.Host
+	}
+	if rule != nil {
+		data.Rule = rule.String()
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	return
+}
+
+// errorPage replies status with page of reason, or plain text if no
+// ErrorPages set.
+func (p *Proxy) errorPage(w http.ResponseWriter, req *http.Request, status int, reason string, rule *Rule, err error) {
+	if p.ErrorPages == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	var buf bytes.Buffer
+	if e := p.ErrorPages.Render(&buf, newPageData(req, status, reason, rule, err)); e != nil {
+		logger.Errorf("render error page: %s", e.Error())
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// errorResponse writes status with page of reason to hijacked
+// connection, as errorPage.
+func (p *Proxy) errorResponse(w io.Writer, req *http.Request, status int, reason string, err error) {
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header:     make(http.Header),
+		Close:      true,
+	}
+	if p.ErrorPages != nil {
+		var buf bytes.Buffer
+		if e := p.ErrorPages.Render(&buf, newPageData(req, status, reason, nil, err)); e == nil {
+			resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+			resp.Body = ioutil.NopCloser(&buf)
+			resp.ContentLength = int64(buf.Len())
+		}
+	}
+	resp.Write(w)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "403.html"), []byte("blocked {{.URL}} by {{.Rule}}"), 0600)
+	ep, err := NewErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.ErrorPages = ep
+	p.Rules = []Rule{{Host: "ads.example.com", Dialer: RULE_REJECT}}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://ads.example.com/<x>", nil))
+	if w.Code != 403 || w.Body.String() != "blocked http://ads.example.com/%3Cx%3E by host=ads.example.com dialer=reject" {
+		t.Fatalf("wrong block page: %d %q", w.Code, w.Body.String())
+	}
+
+	// default page for status without its own.
+	p = NewProxy(netutil.DefaultTcpDialer, "user", "pass")
+	p.ErrorPages = ep
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != 407 || !strings.Contains(w.Body.String(), REASON_AUTH) {
+		t.Fatalf("wrong auth page: %d %q", w.Code, w.Body.String())
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "502.html"), []byte("{{.Broken"), 0600)
+	if _, err = NewErrorPages(dir); err == nil {
+		t.Fatal("broken template loaded")
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	ep, err := NewErrorPages(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{ErrorPages: ep}
+	client, server := net.Pipe()
+	defer client.Close()
+	req := httptest.NewRequest("CONNECT", "http://unreachable:443", nil)
+	go func() {
+		p.errorResponse(server, req, http.StatusBadGateway, REASON_DIAL, nil)
+		server.Close()
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 502 || !strings.Contains(string(body), REASON_DIAL) {
+		t.Fatalf("wrong response: %d %q", resp.StatusCode, body)
+	}
+}
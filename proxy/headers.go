@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderRule changes headers of requests to Host and of their
+// responses. Rules matched are applied in order, each removes headers
+// first, then sets, then adds, so a later rule sees what earlier ones
+// did. Names in Remove ending with "*" are prefixes.
+type HeaderRule struct {
+	// Host is domain matched with its subdomains, empty for all.
+	Host   string
+	Remove []string
+	Set    map[string]string
+	Add    map[string]string
+	// RespRemove, RespSet and RespAdd are for responses.
+	RespRemove []string
+	RespSet    map[string]string
+	RespAdd    map[string]string
+}
+
+func (hr *HeaderRule) Match(req *http.Request) bool {
+	return hr.Host == "" || matchDomain(req.URL.Hostname(), hr.Host)
+}
+
+func editHeader(h http.Header, remove []string, set, add map[string]string) {
+	for _, name := range remove {
+		if !strings.HasSuffix(name, "*") {
+			h.Del(name)
+			continue
+		}
+		prefix := http.CanonicalHeaderKey(strings.TrimSuffix(name, "*"))
+		for k := range h {
+			if strings.HasPrefix(k, prefix) {
+				delete(h, k)
+			}
+		}
+	}
+	for name, value := range set {
+		h.Set(name, value)
+	}
+	for name, value := range add {
+		h.Add(name, value)
+	}
+}
+
+// editRequest applies rules matched to headers of req.
+func (p *Proxy) editRequest(req *http.Request) {
+	for i := range p.HeaderRules {
+		hr := &p.HeaderRules[i]
+		if hr.Match(req) {
+			editHeader(req.Header, hr.Remove, hr.Set, hr.Add)
+		}
+	}
+}
+
+// editResponse applies rules matched with req to header of response.
+func (p *Proxy) editResponse(req *http.Request, header http.Header) {
+	for i := range p.HeaderRules {
+		hr := &p.HeaderRules[i]
+		if hr.Match(req) {
+			editHeader(header, hr.RespRemove, hr.RespSet, hr.RespAdd)
+		}
+	}
+}
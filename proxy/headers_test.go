@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestEditHeader(t *testing.T) {
+	h := http.Header{
+		"X-Forwarded-For": {"10.0.0.1"},
+		"X-Track-Id":      {"1"},
+		"X-Track-Session": {"2"},
+		"Via":             {"1.0 other"},
+	}
+	editHeader(h, []string{"x-forwarded-for", "X-Track-*"},
+		map[string]string{"Authorization": "Bearer t"},
+		map[string]string{"Via": "1.1 goproxy"})
+	if len(h) != 2 || h.Get("Authorization") != "Bearer t" {
+		t.Fatalf("wrong header: %v", h)
+	}
+	if via := strings.Join(h.Values("Via"), ", "); via != "1.0 other, 1.1 goproxy" {
+		t.Fatalf("wrong via: %s", via)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		w.Header().Set("X-Powered-By", "php")
+		w.Write([]byte(r.Header.Get("X-Step")))
+	}))
+	defer origin.Close()
+
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.HeaderRules = []HeaderRule{
+		{Set: map[string]string{"X-Step": "1"}, RespRemove: []string{"X-Powered-By"}},
+		{Host: "127.0.0.1", Set: map[string]string{"Authorization": "secret"}},
+		// applied after the first one.
+		{Add: map[string]string{"X-Step": "2"}, Remove: []string{"X-Step"}},
+	}
+	req := httptest.NewRequest("GET", origin.URL, nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Body.String() != "2" {
+		t.Fatalf("rules out of order: %q", w.Body.String())
+	}
+	if w.Header().Get("X-Auth") != "secret" || w.Header().Get("X-Powered-By") != "" {
+		t.Fatalf("wrong response header: %v", w.Header())
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	STATS_MAX_HOSTS = 1024
+	STATS_OTHER     = "other"
+)
+
+// HostTraffic is what clients did with a destination host. Errors are
+// requests failed without response, or 5xx.
+type HostTraffic struct {
+	Host     string
+	Requests int64
+	Errors   int64
+	Sent     int64 // bytes from clients, body of requests or in CONNECT
+	Recv     int64
+}
+
+// HostStats sums requests through proxy by destination host, for top
+// talkers. Hosts more than STATS_MAX_HOSTS are counted in STATS_OTHER.
+type HostStats struct {
+	lock  sync.Mutex
+	hosts map[string]*HostTraffic
+}
+
+func NewHostStats() (hs *HostStats) {
+	return &HostStats{
+		hosts: make(map[string]*HostTraffic, 0),
+	}
+}
+
+// Add counts a request to host with status, 0 if it failed.
+func (hs *HostStats) Add(host string, status int, sent, recv int64) {
+	if host == "" {
+		return
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	ht, ok := hs.hosts[host]
+	if !ok && len(hs.hosts) >= STATS_MAX_HOSTS {
+		host = STATS_OTHER
+		ht, ok = hs.hosts[host]
+	}
+	if !ok {
+		ht = &HostTraffic{Host: host}
+		hs.hosts[host] = ht
+	}
+	ht.Requests++
+	if status == 0 || status >= 500 {
+		ht.Errors++
+	}
+	ht.Sent += sent
+	ht.Recv += recv
+}
+
+// Top returns n hosts most bytes went through, all if n is 0.
+func (hs *HostStats) Top(n int) (traffic []HostTraffic) {
+	hs.lock.Lock()
+	traffic = make([]HostTraffic, 0, len(hs.hosts))
+	for _, ht := range hs.hosts {
+		traffic = append(traffic, *ht)
+	}
+	hs.lock.Unlock()
+
+	sort.Slice(traffic, func(i, j int) bool {
+		ti, tj := traffic[i].Sent+traffic[i].Recv, traffic[j].Sent+traffic[j].Recv
+		if ti != tj {
+			return ti > tj
+		}
+		return traffic[i].Host < traffic[j].Host
+	})
+	if n > 0 && n < len(traffic) {
+		traffic = traffic[:n]
+	}
+	return
+}
+
+// HandlerHosts lists hosts by bytes in json, the first top of them if
+// parameter top set.
+func (hs *HostStats) HandlerHosts(w http.ResponseWriter, req *http.Request) {
+	n, _ := strconv.Atoi(req.URL.Query().Get("top"))
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(hs.Top(n))
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// WriteMetrics writes counters in prometheus text format.
+func (hs *HostStats) WriteMetrics(w io.Writer) {
+	traffic := hs.Top(0)
+	sort.Slice(traffic, func(i, j int) bool {
+		return traffic[i].Host < traffic[j].Host
+	})
+	fmt.Fprintln(w, "# HELP goproxy_frontend_requests_total Requests of proxy clients by destination host.")
+	fmt.Fprintln(w, "# TYPE goproxy_frontend_requests_total counter")
+	for _, ht := range traffic {
+		fmt.Fprintf(w, "goproxy_frontend_requests_total{host=%q} %d\n", ht.Host, ht.Requests)
+	}
+	fmt.Fprintln(w, "# HELP goproxy_frontend_errors_total Requests of proxy clients failed by destination host.")
+	fmt.Fprintln(w, "# TYPE goproxy_frontend_errors_total counter")
+	for _, ht := range traffic {
+		fmt.Fprintf(w, "goproxy_frontend_errors_total{host=%q} %d\n", ht.Host, ht.Errors)
+	}
+	fmt.Fprintln(w, "# HELP goproxy_frontend_bytes_total Bytes of proxy clients by destination host.")
+	fmt.Fprintln(w, "# TYPE goproxy_frontend_bytes_total counter")
+	for _, ht := range traffic {
+		fmt.Fprintf(w, "goproxy_frontend_bytes_total{host=%q,direction=\"sent\"} %d\n",
+			ht.Host, ht.Sent)
+		fmt.Fprintf(w, "goproxy_frontend_bytes_total{host=%q,direction=\"recv\"} %d\n",
+			ht.Host, ht.Recv)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestHostStats(t *testing.T) {
+	hs := NewHostStats()
+	hs.Add("a.com", 200, 10, 100)
+	hs.Add("a.com", 502, 5, 0)
+	hs.Add("b.com", 200, 1000, 1000)
+	hs.Add("", 200, 1, 1)
+	top := hs.Top(1)
+	if len(top) != 1 || top[0].Host != "b.com" {
+		t.Fatalf("wrong top: %v", top)
+	}
+	want := HostTraffic{Host: "a.com", Requests: 2, Errors: 1, Sent: 15, Recv: 100}
+	if all := hs.Top(0); len(all) != 2 || all[1] != want {
+		t.Fatalf("wrong counters: %v", all)
+	}
+
+	for i := 0; i < STATS_MAX_HOSTS; i++ {
+		hs.Add(fmt.Sprintf("h%d.com", i), 200, 0, 0)
+	}
+	if len(hs.Top(0)) != STATS_MAX_HOSTS+1 {
+		t.Fatal("hosts over max not in other")
+	}
+
+	var buf bytes.Buffer
+	hs.WriteMetrics(&buf)
+	if !strings.Contains(buf.String(), `goproxy_frontend_errors_total{host="a.com"} 1`) {
+		t.Fatalf("wrong metrics: %s", buf.String())
+	}
+}
+
+func TestProxyHostStats(t *testing.T) {
+	origin := newBackend("origin")
+	defer origin.Close()
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.Stats = NewHostStats()
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", origin.URL+"/x", strings.NewReader("hello")))
+	top := p.Stats.Top(0)
+	if len(top) != 1 || top[0].Host != "127.0.0.1" || top[0].Sent != 5 || top[0].Recv != int64(w.Body.Len()) {
+		t.Fatalf("wrong stats: %v", top)
+	}
+}
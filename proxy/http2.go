@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// NewServer serves proxy in http/1 and http/2 without tls (h2c, prior
+// knowledge only) if http2 set.
+func (p *Proxy) NewServer(http2 bool) (srv *http.Server) {
+	srv = &http.Server{Handler: p}
+	p.Limits.Apply(srv)
+	if http2 {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		srv.Protocols = &protocols
+	}
+	return
+}
+
+// fixURL makes url of http/2 request absolute, its authority is server
+// to proxy, unless it is this proxy itself.
+func fixURL(req *http.Request) {
+	if req.ProtoMajor != 2 || req.URL.IsAbs() {
+		return
+	}
+	if req.Method == "CONNECT" && req.Header.Get(":protocol") == "" {
+		return
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.String() == req.Host {
+		return
+	}
+	req.URL.Scheme = "http"
+	if _, port, _ := net.SplitHostPort(req.Host); port == "443" {
+		req.URL.Scheme = "https"
+	}
+	req.URL.Host = req.Host
+}
+
+type strAddr string
+
+func (a strAddr) Network() string { return "tcp" }
+func (a strAddr) String() string  { return string(a) }
+
+// streamConn is a http/2 stream as connection, reading request body
+// and writing response.
+type streamConn struct {
+	io.ReadCloser
+	w      http.ResponseWriter
+	local  net.Addr
+	remote net.Addr
+}
+
+func newStreamConn(w http.ResponseWriter, req *http.Request) (sc *streamConn) {
+	sc = &streamConn{
+		ReadCloser: req.Body,
+		w:          w,
+		local:      strAddr(req.Host),
+		remote:     strAddr(req.RemoteAddr),
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		sc.local = addr
+	}
+	return
+}
+
+func (sc *streamConn) Write(b []byte) (n int, err error) {
+	n, err = sc.w.Write(b)
+	if f, ok := sc.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return
+}
+
+func (sc *streamConn) LocalAddr() net.Addr                { return sc.local }
+func (sc *streamConn) RemoteAddr() net.Addr               { return sc.remote }
+func (sc *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (sc *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (sc *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (sc *streamConn) accept() {
+	sc.w.WriteHeader(http.StatusOK)
+	if f, ok := sc.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// connectStream tunnels CONNECT in a http/2 stream, which can't be
+// hijacked.
+func (p *Proxy) connectStream(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Header.Get(":protocol") != "" {
+		p.extendedConnect(w, r, name)
+		return
+	}
+
+	host := r.URL.Host
+	srcconn := newStreamConn(w, r)
+	defer srcconn.Close()
+	if p.Mitm != nil && !p.Mitm.Bypassed(r.URL.Hostname()) {
+		srcconn.accept()
+		p.intercept(srcconn, host)
+		return
+	}
+	dstconn, err := netutil.DialContext(r.Context(), p.dialerOf(name), "tcp", host)
+	if err != nil {
+		logger.Errorf("dial failed: %s", err.Error())
+		p.errorPage(w, r, 502, REASON_DIAL, nil, err)
+		return
+	}
+	srcconn.accept()
+	netutil.RelayHalf(srcconn, dstconn)
+}
+
+// extendedConnect takes CONNECT with :protocol (RFC 8441) as upgrade
+// request in http/1.1 to server, stream is relayed with the connection
+// if server switched.
+func (p *Proxy) extendedConnect(w http.ResponseWriter, r *http.Request, name string) {
+	protocol := r.Header.Get(":protocol")
+	req := &http.Request{
+		Method:     "GET",
+		URL:        r.URL,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     r.Header.Clone(),
+		Host:       r.Host,
+	}
+	req = req.WithContext(r.Context())
+	req.Header.Del(":protocol")
+	req.Header.Set("Upgrade", protocol)
+	// websocket in http/2 has no key, http/1.1 needs one.
+	if protocol == "websocket" && req.Header.Get("Sec-WebSocket-Key") == "" {
+		var key [16]byte
+		rand.Read(key[:])
+		req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+	}
+
+	dstconn, dstbuf, resp, err := p.sendUpgrade(req, name)
+	if err != nil {
+		logger.Errorf("upgrade failed: %s", err.Error())
+		p.errorPage(w, r, 502, REASON_SERVER, nil, err)
+		return
+	}
+	defer dstconn.Close()
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	resp.Header.Del("Sec-WebSocket-Accept")
+	copyHeader(w.Header(), resp.Header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		w.WriteHeader(resp.StatusCode)
+		netutil.Copy(w, resp.Body)
+		return
+	}
+	logger.Infof("%s switched to %s.", req.URL, protocol)
+
+	srcconn := newStreamConn(w, r)
+	srcconn.accept()
+	if n := dstbuf.Buffered(); n > 0 {
+		b, _ := dstbuf.Peek(n)
+		srcconn.Write(b)
+	}
+	netutil.RelayHalf(srcconn, dstconn)
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func newH2Front(t *testing.T) (front *httptest.Server, client *http.Client) {
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	front = httptest.NewUnstartedServer(nil)
+	front.Config = p.NewServer(true)
+	front.Start()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client = &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	return
+}
+
+func TestHttp2Forward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer origin.Close()
+	front, client := newH2Front(t)
+	defer front.Close()
+
+	// authority is the server to proxy.
+	req, _ := http.NewRequest("GET", front.URL+"/x", nil)
+	req.Host = origin.Listener.Addr().String()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(body) != "hello /x" {
+		t.Fatalf("wrong response: %s %s", resp.Proto, body)
+	}
+}
+
+func TestHttp2Connect(t *testing.T) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	go func() {
+		conn, err := lsock.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	front, client := newH2Front(t)
+	defer front.Close()
+
+	pr, pw := io.Pipe()
+	frontURL, _ := url.Parse(front.URL)
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    frontURL,
+		Host:   lsock.Addr().String(),
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect failed: %d", resp.StatusCode)
+	}
+	pw.Write([]byte("ping"))
+	var buf [4]byte
+	if _, err = io.ReadFull(resp.Body, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:]) != "ping" {
+		t.Fatalf("wrong echo: %q", buf)
+	}
+	pw.Close()
+}
+
+// pipeWriter is response of a http/2 stream, written into a pipe.
+type pipeWriter struct {
+	*io.PipeWriter
+	header http.Header
+	status int
+}
+
+func (pw *pipeWriter) Header() http.Header    { return pw.header }
+func (pw *pipeWriter) WriteHeader(status int) { pw.status = status }
+func (pw *pipeWriter) Flush()                 {}
+
+// Go client can't send :protocol, so stream is given to handler directly.
+func TestHttp2ExtendedConnect(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer origin.Close()
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+
+	reqr, reqw := io.Pipe()
+	respr, respw := io.Pipe()
+	// as http/2 server gives, authority in Host and path in URL.
+	req := httptest.NewRequest("GET", "/ws", reqr)
+	req.Method = "CONNECT"
+	req.Host = origin.Listener.Addr().String()
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Set(":protocol", "echo")
+	w := &pipeWriter{PipeWriter: respw, header: make(http.Header)}
+	go func() {
+		p.ServeHTTP(w, req)
+		respw.Close()
+	}()
+
+	go func() {
+		reqw.Write([]byte("hello"))
+		// end of stream closes writing to server.
+		reqw.Close()
+	}()
+	data, err := ioutil.ReadAll(respr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.status != http.StatusOK || string(data) != "HELLO" {
+		t.Fatalf("wrong reply: %d %q", w.status, data)
+	}
+}
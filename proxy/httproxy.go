@@ -1,9 +1,12 @@
 package proxy
 
 import (
-	"io"
+	"context"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	logging "github.com/op/go-logging"
 	"github.com/shell909090/goproxy/netutil"
@@ -27,14 +30,60 @@ type Proxy struct {
 	dialer    netutil.Dialer
 	username  string
 	password  string
+	// Allow limits clients to networks in it if not nil.
+	Allow Matcher
+	// Users checks clients by Proxy-Authorization if not nil, as well
+	// as username and password.
+	Users Verifier
+	// Pac is served to requests of its path to this proxy, not through.
+	Pac *Pac
+	// Mitm intercepts https in CONNECT if not nil.
+	Mitm *Mitm
+	// AccessLog logs each request if not nil.
+	AccessLog *AccessLogger
+	// Recent keeps the last requests if not nil.
+	Recent *RecentLog
+	// HeaderRules change headers of requests and responses.
+	HeaderRules []HeaderRule
+	// ConnectPorts limits ports of CONNECT if not nil.
+	ConnectPorts *PortPolicy
+	// Limits of requests from clients, DefaultLimits by default.
+	Limits Limits
+	// Throttle limits bandwidth of each client if not nil.
+	Throttle *Throttle
+	// Cache answers GET from responses stored if not nil.
+	Cache *Cache
+	// Icap inspects requests and responses by external scanner if not
+	// nil, cached ones too.
+	Icap *Icap
+	// Stats counts requests by destination host if not nil.
+	Stats *HostStats
+	// ErrorPages renders responses of proxy itself if not nil.
+	ErrorPages *ErrorPages
+	// DnsHijack answers dns in connections to port 53 passed to Relay
+	// if not nil, instead of connecting them.
+	DnsHijack func(conn net.Conn)
+	// Rules route requests to dialers set, or reject them. Requests
+	// not matched go to the default dialer.
+	Rules      []Rule
+	lock       sync.Mutex
+	dialers    map[string]netutil.Dialer
+	transports map[string]http.RoundTripper
 }
 
 func NewProxy(dialer netutil.Dialer, username string, password string) (p *Proxy) {
 	p = &Proxy{
-		username:  username,
-		password:  password,
-		dialer:    dialer,
-		transport: http.Transport{Dial: dialer.Dial},
+		username:   username,
+		password:   password,
+		dialer:     dialer,
+		Limits:     DefaultLimits,
+		dialers:    make(map[string]netutil.Dialer, 0),
+		transports: make(map[string]http.RoundTripper, 0),
+	}
+	p.transport = http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return netutil.DialContext(ctx, dialer, network, address)
+		},
 	}
 	if username != "" && password != "" {
 		logger.Info("proxy-auth required")
@@ -50,44 +99,200 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	logger.Infof("http: %s %s", req.Method, req.URL)
+func (p *Proxy) authPass(req *http.Request) bool {
+	if !p.authRequired() {
+		return true
+	}
+	username, password, ok := ParseBasicAuth(req)
+	if !ok {
+		return false
+	}
+	return p.userPass(username, password)
+}
+
+func (p *Proxy) authRequired() bool {
+	return (p.username != "" && p.password != "") || p.Users != nil
+}
+
+// userPass checks username and password by static user or Users.
+func (p *Proxy) userPass(username, password string) bool {
+	static := p.username != "" && p.password != ""
+	if static && username == p.username && password == p.password {
+		return true
+	}
+	if p.Users != nil && VerifyUser(p.Users, username, password) {
+		return true
+	}
+	logger.Errorf("user %s auth failed.", username)
+	return false
+}
+
+// logged runs serve, and logs the request in AccessLog and Recent,
+// counts it in Stats.
+func (p *Proxy) logged(w http.ResponseWriter, req *http.Request, serve func(http.ResponseWriter, *http.Request)) {
+	if p.AccessLog == nil && p.Recent == nil && p.Stats == nil {
+		serve(w, req)
+		return
+	}
+	start := time.Now()
+	ctx, dt := netutil.WithDialTrace(req.Context())
+	req = req.WithContext(ctx)
+	r := &AccessRecord{
+		Time:      start,
+		Client:    req.RemoteAddr,
+		Method:    req.Method,
+		Host:      req.Host,
+		URL:       req.URL.String(),
+		Proto:     req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if req.Method == "CONNECT" {
+		r.URL = req.URL.Host
+	}
+	r.Username, _, _ = ParseBasicAuth(req)
 
-	if p.username != "" && p.password != "" {
-		if !BasicAuth(w, req, p.username, p.password) {
-			logger.Error("Http Auth Required")
-			w.Header().Set("Proxy-Authenticate", "Basic realm=\"GoProxy\"")
-			http.Error(w, http.StatusText(407), 407)
+	aw := &accessWriter{ResponseWriter: w}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countBody{ReadCloser: req.Body, n: &aw.sent}
+	}
+	serve(aw, req)
+
+	if p.Stats != nil {
+		p.Stats.Add(req.URL.Hostname(), aw.status, aw.sent, aw.bytes)
+	}
+	if p.AccessLog == nil && p.Recent == nil {
+		return
+	}
+	r.Status = aw.status
+	r.Bytes = aw.bytes
+	r.Duration = time.Since(start).Seconds()
+	r.Dialer = dt.Dialer()
+	p.log(r)
+}
+
+// log writes r to AccessLog and Recent, if they are set.
+func (p *Proxy) log(r *AccessRecord) {
+	if p.AccessLog != nil {
+		p.AccessLog.Log(r)
+	}
+	if p.Recent != nil {
+		p.Recent.Log(r)
+	}
+}
+
+// setAccess records status and bytes of hijacked connection, in
+// accessWriter under wrappers.
+func setAccess(w http.ResponseWriter, status int, sent, recv int64) {
+	for {
+		switch rw := w.(type) {
+		case *accessWriter:
+			rw.status = status
+			rw.sent = sent
+			rw.bytes = recv
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
 			return
 		}
 	}
+}
 
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fixURL(req)
+	p.logged(w, req, p.serve)
+}
+
+func (p *Proxy) serve(w http.ResponseWriter, req *http.Request) {
+	logger.Infof("http: %s %s", req.Method, req.URL)
+
+	if !p.clientAllowed(req) {
+		logger.Infof("client %s not allowed.", req.RemoteAddr)
+		p.errorPage(w, req, 403, REASON_CLIENT, nil, nil)
+		return
+	}
+
+	if p.Pac != nil && !req.URL.IsAbs() && req.URL.Path == p.Pac.Path {
+		p.Pac.ServeHTTP(w, req)
+		return
+	}
+
+	if !p.authPass(req) {
+		logger.Error("Http Auth Required")
+		w.Header().Set("Proxy-Authenticate", "Basic realm=\"GoProxy\"")
+		p.errorPage(w, req, 407, REASON_AUTH, nil, nil)
+		return
+	}
+
+	if p.Throttle != nil {
+		w, req = p.Throttle.Wrap(w, req)
+	}
+
+	if target, ok := masqueTarget(req); ok {
+		p.connectUdp(w, req, target)
+		return
+	}
 	if req.Method == "CONNECT" {
 		p.Connect(w, req)
 		return
 	}
+	p.forward(w, req)
+}
+
+// forward sends request to its server and response back.
+func (p *Proxy) forward(w http.ResponseWriter, req *http.Request) {
+	name := p.route(req)
+	if name == RULE_REJECT {
+		logger.Infof("%s rejected by rule.", req.URL)
+		p.errorPage(w, req, 403, REASON_RULE, p.matched(req), nil)
+		return
+	}
+
+	if !p.limitBody(w, req) {
+		return
+	}
 
 	req.RequestURI = ""
+	p.editRequest(req)
+	if isUpgrade(req) {
+		p.upgrade(w, req, name)
+		return
+	}
 	for _, h := range hopHeaders {
 		if req.Header.Get(h) != "" {
 			req.Header.Del(h)
 		}
 	}
 
-	resp, err := p.transport.RoundTrip(req)
+	var transport http.RoundTripper = p.transportOf(name)
+	if p.Cache != nil {
+		transport = p.Cache.Wrap(transport)
+	}
+	if p.Icap != nil {
+		transport = p.Icap.Wrap(transport)
+	}
+	resp, err := transport.RoundTrip(req)
 	if err != nil {
 		logger.Error(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		if isTooLarge(err) {
+			http.Error(w, http.StatusText(413), 413)
+			return
+		}
+		if isIcapError(err) {
+			p.errorPage(w, req, http.StatusBadGateway, REASON_ICAP, nil, err)
+			return
+		}
+		p.errorPage(w, req, http.StatusBadGateway, REASON_SERVER, nil, err)
 		return
 	}
 	defer resp.Body.Close()
 
+	p.editResponse(req, resp.Header)
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 
-	buf := netutil.BufferPool.Get().([]byte)
-	defer netutil.BufferPool.Put(buf)
-	_, err = io.CopyBuffer(w, resp.Body, buf)
+	_, err = netutil.Copy(w, resp.Body)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -96,6 +301,22 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Proxy) Connect(w http.ResponseWriter, r *http.Request) {
+	name := p.route(r)
+	if name == RULE_REJECT {
+		logger.Infof("%s rejected by rule.", r.URL.Host)
+		p.errorPage(w, r, 403, REASON_RULE, p.matched(r), nil)
+		return
+	}
+	if !p.portPermitted(r) {
+		logger.Infof("%s rejected by port.", r.URL.Host)
+		p.errorPage(w, r, 403, REASON_PORT, nil, nil)
+		return
+	}
+	if r.ProtoMajor == 2 {
+		p.connectStream(w, r, name)
+		return
+	}
+
 	hij, ok := w.(http.Hijacker)
 	if !ok {
 		logger.Error("httpserver does not support hijacking")
@@ -112,14 +333,23 @@ func (p *Proxy) Connect(w http.ResponseWriter, r *http.Request) {
 	if !strings.Contains(host, ":") {
 		host += ":80"
 	}
-	dstconn, err := p.dialer.Dial("tcp", host)
+
+	if p.Mitm != nil && !p.Mitm.Bypassed(r.URL.Hostname()) {
+		srcconn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		setAccess(w, http.StatusOK, 0, 0)
+		p.intercept(srcconn, host)
+		return
+	}
+	dstconn, err := netutil.DialContext(r.Context(), p.dialerOf(name), "tcp", host)
 	if err != nil {
 		logger.Errorf("dial failed: %s", err.Error())
-		srcconn.Write([]byte("HTTP/1.0 502 OK\r\n\r\n"))
+		p.errorResponse(srcconn, r, http.StatusBadGateway, REASON_DIAL, err)
+		setAccess(w, http.StatusBadGateway, 0, 0)
 		return
 	}
 	srcconn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 
-	netutil.CopyLink(srcconn, dstconn)
+	sent, recv, _ := netutil.Relay(srcconn, dstconn)
+	setAccess(w, http.StatusOK, sent, recv)
 	return
 }
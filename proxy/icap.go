@@ -0,0 +1,447 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ICAP_PORT = "1344"
+	// ICAP_MAX_BODY is default size of bodies kept for 204 of icap.
+	ICAP_MAX_BODY = 1 << 20
+	ICAP_TIMEOUT  = 30 * time.Second
+)
+
+var (
+	ErrIcapScheme       = errors.New("icap: url should be icap://host[:port]/service.")
+	ErrIcapEncapsulated = errors.New("icap: wrong encapsulated header.")
+)
+
+// IcapError is error talking to icap server, not to the origin.
+type IcapError struct {
+	Err error
+}
+
+func (ie *IcapError) Error() string {
+	return "icap: " + ie.Err.Error()
+}
+
+func (ie *IcapError) Unwrap() error {
+	return ie.Err
+}
+
+func isIcapError(err error) bool {
+	var ie *IcapError
+	return errors.As(err, &ie)
+}
+
+// Icap sends requests and responses of http proxy to external scanner
+// by ICAP, RFC 3507, and follows what it returns: unmodified, modified,
+// or a response instead of request, which blocks it.
+type Icap struct {
+	// ReqMod and RespMod are icap urls of services, empty to skip.
+	ReqMod  *url.URL
+	RespMod *url.URL
+	// Bypass passes requests and responses as they are if icap server
+	// failed, or they are answered by 502.
+	Bypass bool
+	// MaxBody is size of bodies kept, for icap to reply 204 without
+	// sending them back. Larger ones are sent without allowing 204.
+	MaxBody int64
+	Timeout time.Duration
+}
+
+func parseIcapURL(rawurl string) (u *url.URL, err error) {
+	if rawurl == "" {
+		return
+	}
+	u, err = url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return nil, ErrIcapScheme
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), ICAP_PORT)
+	}
+	return
+}
+
+func NewIcap(reqmod, respmod string) (ic *Icap, err error) {
+	ic = &Icap{MaxBody: ICAP_MAX_BODY, Timeout: ICAP_TIMEOUT}
+	ic.ReqMod, err = parseIcapURL(reqmod)
+	if err != nil {
+		return
+	}
+	ic.RespMod, err = parseIcapURL(respmod)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// Wrap returns transport inspecting requests before next, and responses
+// after it.
+func (ic *Icap) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &icapTransport{icap: ic, next: next}
+}
+
+type icapTransport struct {
+	icap *Icap
+	next http.RoundTripper
+}
+
+func (it *icapTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	ic := it.icap
+	if ic.ReqMod != nil {
+		var blocked *http.Response
+		req, blocked, err = ic.reqmod(req)
+		if err != nil {
+			return
+		}
+		if blocked != nil {
+			logger.Infof("%s blocked by icap.", req.URL)
+			return blocked, nil
+		}
+	}
+	resp, err = it.next.RoundTrip(req)
+	if err != nil || ic.RespMod == nil {
+		return
+	}
+	return ic.respmod(req, resp)
+}
+
+// keptBody reads body up to MaxBody. If it's all read, kept is true
+// and body can be read again by restore.
+type keptBody struct {
+	buf  []byte
+	rest io.ReadCloser
+	kept bool
+}
+
+func (ic *Icap) keep(body io.ReadCloser) (kb *keptBody, err error) {
+	kb = &keptBody{rest: body}
+	if body == nil || body == http.NoBody {
+		kb.kept = true
+		return
+	}
+	kb.buf, err = io.ReadAll(io.LimitReader(body, ic.MaxBody+1))
+	if err != nil {
+		return
+	}
+	kb.kept = int64(len(kb.buf)) <= ic.MaxBody
+	return
+}
+
+// reader reads body from the start, kept body is not consumed by it.
+func (kb *keptBody) reader() io.Reader {
+	if kb.kept {
+		return bytes.NewReader(kb.buf)
+	}
+	return io.MultiReader(bytes.NewReader(kb.buf), kb.rest)
+}
+
+// restore makes body of request or response as it's not read.
+func (kb *keptBody) restore() io.ReadCloser {
+	if kb.rest == nil || kb.rest == http.NoBody {
+		return kb.rest
+	}
+	if kb.kept {
+		kb.rest.Close()
+		return io.NopCloser(bytes.NewReader(kb.buf))
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{kb.reader(), kb.rest}
+}
+
+func requestHeader(req *http.Request) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.Method, req.URL.String())
+	fmt.Fprintf(&b, "Host: %s\r\n", req.Host)
+	req.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func responseHeader(resp *http.Response) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// timeoutConn limits each read and write to icap server, bodies can
+// take long but not stall.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (tc *timeoutConn) Read(b []byte) (int, error) {
+	tc.SetReadDeadline(time.Now().Add(tc.timeout))
+	return tc.Conn.Read(b)
+}
+
+func (tc *timeoutConn) Write(b []byte) (int, error) {
+	tc.SetWriteDeadline(time.Now().Add(tc.timeout))
+	return tc.Conn.Write(b)
+}
+
+// icapSection is http header encapsulated in icap request.
+type icapSection struct {
+	name   string
+	header []byte
+}
+
+// icapReply is head of icap response, encapsulated http follows in r.
+type icapReply struct {
+	status       int
+	encapsulated map[string]int
+	r            *bufio.Reader
+	conn         net.Conn
+}
+
+// body reads encapsulated body in chunks, closes icap connection with
+// it.
+func (ir *icapReply) body() io.ReadCloser {
+	_, ok := ir.encapsulated["req-body"]
+	if _, res := ir.encapsulated["res-body"]; !ok && !res {
+		ir.conn.Close()
+		return http.NoBody
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{httputil.NewChunkedReader(ir.r), ir.conn}
+}
+
+// call sends method to service, with http headers and body named
+// encapsulated, body is nil if there is none.
+func (ic *Icap) call(method string, service *url.URL, headers []icapSection, name string, body io.Reader, allow204 bool) (ir *icapReply, err error) {
+	raw, err := net.DialTimeout("tcp", service.Host, ic.Timeout)
+	if err != nil {
+		return nil, &IcapError{Err: err}
+	}
+	conn := &timeoutConn{Conn: raw, timeout: ic.Timeout}
+
+	var head, sections bytes.Buffer
+	var parts []string
+	for _, h := range headers {
+		parts = append(parts, fmt.Sprintf("%s=%d", h.name, sections.Len()))
+		sections.Write(h.header)
+	}
+	if body != nil {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, sections.Len()))
+	} else {
+		parts = append(parts, fmt.Sprintf("null-body=%d", sections.Len()))
+	}
+	fmt.Fprintf(&head, "%s %s ICAP/1.0\r\n", method, service.String())
+	fmt.Fprintf(&head, "Host: %s\r\n", service.Host)
+	fmt.Fprintf(&head, "Encapsulated: %s\r\n", strings.Join(parts, ", "))
+	if allow204 {
+		head.WriteString("Allow: 204\r\n")
+	}
+	head.WriteString("\r\n")
+
+	// icap may reply before all sent, body is sent as it's read.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(append(head.Bytes(), sections.Bytes()...))
+		if err == nil && body != nil {
+			cw := httputil.NewChunkedWriter(conn)
+			_, err = io.Copy(cw, body)
+			if err == nil {
+				err = cw.Close()
+			}
+			if err == nil {
+				_, err = conn.Write([]byte("\r\n"))
+			}
+		}
+		errs <- err
+	}()
+
+	ir = &icapReply{r: bufio.NewReader(conn), conn: conn}
+	err = ir.readHead()
+	if err == nil && ir.status == http.StatusNoContent {
+		if !allow204 {
+			err = errors.New("204 not allowed.")
+		} else {
+			// unmodified, all should have been sent.
+			err = <-errs
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &IcapError{Err: err}
+	}
+	return
+}
+
+func (ir *icapReply) readHead() (err error) {
+	tp := textproto.NewReader(ir.r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return fmt.Errorf("wrong status line %q.", line)
+	}
+	code, _, _ := strings.Cut(status, " ")
+	ir.status, err = strconv.Atoi(code)
+	if err != nil {
+		return
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	switch ir.status {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return
+	default:
+		return fmt.Errorf("%s", status)
+	}
+
+	ir.encapsulated = make(map[string]int)
+	for _, part := range strings.Split(header.Get("Encapsulated"), ",") {
+		name, offset, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrIcapEncapsulated
+		}
+		ir.encapsulated[name], err = strconv.Atoi(offset)
+		if err != nil {
+			return ErrIcapEncapsulated
+		}
+	}
+	return
+}
+
+// bypass tells if request or response goes on unchecked by err.
+func (ic *Icap) bypass(err error, kb *keptBody) bool {
+	if !ic.Bypass || !kb.kept {
+		return false
+	}
+	logger.Errorf("%s, bypassed.", err.Error())
+	return true
+}
+
+// reqmod checks request, returns modified request, or response if it's
+// blocked.
+func (ic *Icap) reqmod(req *http.Request) (modified *http.Request, blocked *http.Response, err error) {
+	kb, err := ic.keep(req.Body)
+	if err != nil {
+		return
+	}
+	var body io.Reader
+	if req.Body != nil && req.Body != http.NoBody {
+		body = kb.reader()
+	}
+	headers := []icapSection{{"req-hdr", requestHeader(req)}}
+	ir, err := ic.call("REQMOD", ic.ReqMod, headers, "req-body", body, kb.kept)
+	if err != nil {
+		if ic.bypass(err, kb) {
+			req.Body = kb.restore()
+			return req, nil, nil
+		}
+		return
+	}
+	if ir.status == http.StatusNoContent {
+		ir.conn.Close()
+		req.Body = kb.restore()
+		return req, nil, nil
+	}
+	if kb.rest != nil {
+		kb.rest.Close()
+	}
+
+	if _, ok := ir.encapsulated["res-hdr"]; ok {
+		blocked, err = http.ReadResponse(ir.r, req)
+		if err != nil {
+			ir.conn.Close()
+			return nil, nil, &IcapError{Err: err}
+		}
+		blocked.Body = ir.body()
+		return req, blocked, nil
+	}
+	if _, ok := ir.encapsulated["req-hdr"]; !ok {
+		ir.conn.Close()
+		return nil, nil, &IcapError{Err: ErrIcapEncapsulated}
+	}
+	modified, err = http.ReadRequest(ir.r)
+	if err != nil {
+		ir.conn.Close()
+		return nil, nil, &IcapError{Err: err}
+	}
+	modified = modified.WithContext(req.Context())
+	modified.RequestURI = ""
+	if !modified.URL.IsAbs() {
+		modified.URL.Scheme = req.URL.Scheme
+		modified.URL.Host = req.URL.Host
+	}
+	modified.Body = ir.body()
+	if modified.Body != http.NoBody && modified.Header.Get("Content-Length") == "" {
+		modified.ContentLength = -1
+	}
+	return
+}
+
+// respmod checks response, returns it or modified one.
+func (ic *Icap) respmod(req *http.Request, resp *http.Response) (modified *http.Response, err error) {
+	kb, err := ic.keep(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return
+	}
+	var body io.Reader
+	if req.Method != "HEAD" && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified {
+		body = kb.reader()
+	}
+	headers := []icapSection{
+		{"req-hdr", requestHeader(req)},
+		{"res-hdr", responseHeader(resp)},
+	}
+	ir, err := ic.call("RESPMOD", ic.RespMod, headers, "res-body", body, kb.kept)
+	if err != nil {
+		if ic.bypass(err, kb) {
+			resp.Body = kb.restore()
+			return resp, nil
+		}
+		resp.Body.Close()
+		return
+	}
+	if ir.status == http.StatusNoContent {
+		ir.conn.Close()
+		resp.Body = kb.restore()
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	if _, ok := ir.encapsulated["res-hdr"]; !ok {
+		ir.conn.Close()
+		return nil, &IcapError{Err: ErrIcapEncapsulated}
+	}
+	modified, err = http.ReadResponse(ir.r, req)
+	if err != nil {
+		ir.conn.Close()
+		return nil, &IcapError{Err: err}
+	}
+	modified.Body = ir.body()
+	return
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// fakeIcap blocks requests to /blocked, redacts request bodies with
+// secret, and blocks responses with virus. Others are unmodified.
+func fakeIcap(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeIcap(conn)
+		}
+	}()
+	return listener
+}
+
+func chunked(body string) string {
+	var b bytes.Buffer
+	cw := httputil.NewChunkedWriter(&b)
+	io.WriteString(cw, body)
+	cw.Close()
+	return b.String() + "\r\n"
+}
+
+func serveFakeIcap(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	encapsulated := header.Get("Encapsulated")
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	var resp *http.Response
+	if strings.HasPrefix(line, "RESPMOD") {
+		resp, err = http.ReadResponse(br, req)
+		if err != nil {
+			return
+		}
+	}
+	var body []byte
+	if !strings.Contains(encapsulated, "null-body") {
+		body, _ = io.ReadAll(httputil.NewChunkedReader(br))
+	}
+
+	blocked := "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=43\r\n\r\n" +
+		"HTTP/1.1 403 Forbidden\r\nX-Scanner: fake\r\n\r\n" + chunked("blocked by scanner")
+	switch {
+	case resp == nil && req.URL.Path == "/blocked":
+		io.WriteString(conn, blocked)
+	case resp == nil && bytes.Contains(body, []byte("secret")):
+		hdr := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\nX-Redacted: 1\r\n\r\n", req.URL, req.Host)
+		fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\nEncapsulated: req-hdr=0, req-body=%d\r\n\r\n%s%s",
+			len(hdr), hdr, chunked("redacted"))
+	case resp != nil && bytes.Contains(body, []byte("virus")):
+		io.WriteString(conn, blocked)
+	case header.Get("Allow") == "204":
+		io.WriteString(conn, "ICAP/1.0 204 No Content\r\n\r\n")
+	default:
+		io.WriteString(conn, "ICAP/1.0 500 Server Error\r\n\r\n")
+	}
+}
+
+func TestIcap(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.URL.Path, r.Header.Get("X-Redacted"), body)
+	}))
+	defer origin.Close()
+	icap := fakeIcap(t)
+	defer icap.Close()
+
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	url := "icap://" + icap.Addr().String() + "/"
+	var err error
+	p.Icap, err = NewIcap(url+"reqmod", url+"respmod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"GET", "/ok", "", 200, "/ok  "},
+		{"POST", "/post", "hello", 200, "/post  hello"},
+		{"POST", "/post", "my secret", 200, "/post 1 redacted"},
+		{"GET", "/blocked", "", 403, "blocked by scanner"},
+		{"POST", "/echo", "a virus", 403, "blocked by scanner"},
+	} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(c.method, origin.URL+c.path, strings.NewReader(c.body)))
+		if w.Code != c.status || w.Body.String() != c.want {
+			t.Fatalf("%s %s: %d %q", c.method, c.path, w.Code, w.Body.String())
+		}
+	}
+
+	// bodies over MaxBody are sent without 204 allowed, fake fails.
+	p.Icap.MaxBody = 2
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", origin.URL+"/post", strings.NewReader("hello")))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("icap failure not 502: %d", w.Code)
+	}
+	p.Icap.MaxBody = ICAP_MAX_BODY
+
+	icap.Close()
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", origin.URL+"/ok", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("icap down not 502: %d", w.Code)
+	}
+	p.Icap.Bypass = true
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", origin.URL+"/ok", nil))
+	if w.Code != 200 {
+		t.Fatalf("not bypassed: %d", w.Code)
+	}
+
+	_, err = NewIcap("http://127.0.0.1/", "")
+	if err != ErrIcapScheme {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
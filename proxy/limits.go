@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	MAX_HEADER_BYTES = 64 << 10
+	HEADER_TIMEOUT   = 30 * time.Second
+	IDLE_TIMEOUT     = 2 * time.Minute
+)
+
+// Limits protect proxy from clients sending too much, or too slow to
+// hold connections. Zero means no limit.
+type Limits struct {
+	MaxHeaderBytes int
+	MaxBodyBytes   int64
+	// HeaderTimeout is time to read headers of a request, IdleTimeout
+	// is time to wait for next request in keep-alive.
+	HeaderTimeout time.Duration
+	IdleTimeout   time.Duration
+}
+
+var DefaultLimits = Limits{
+	MaxHeaderBytes: MAX_HEADER_BYTES,
+	HeaderTimeout:  HEADER_TIMEOUT,
+	IdleTimeout:    IDLE_TIMEOUT,
+}
+
+// Apply sets limits to srv.
+func (l *Limits) Apply(srv *http.Server) {
+	srv.MaxHeaderBytes = l.MaxHeaderBytes
+	srv.ReadHeaderTimeout = l.HeaderTimeout
+	srv.IdleTimeout = l.IdleTimeout
+}
+
+// limitBody replies 413 if body of req declared larger than
+// MaxBodyBytes, or makes reading fail after that.
+func (p *Proxy) limitBody(w http.ResponseWriter, req *http.Request) bool {
+	max := p.Limits.MaxBodyBytes
+	if max <= 0 || req.Body == nil {
+		return true
+	}
+	if req.ContentLength > max {
+		logger.Infof("body of %s too large: %d.", req.URL, req.ContentLength)
+		http.Error(w, http.StatusText(413), 413)
+		return false
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, max)
+	return true
+}
+
+func isTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestLimitBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer origin.Close()
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.Limits.MaxBodyBytes = 10
+
+	req := httptest.NewRequest("POST", origin.URL, strings.NewReader("0123456789abc"))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large body passed: %d", w.Code)
+	}
+
+	// no length declared, fails in reading.
+	req = httptest.NewRequest("POST", origin.URL, io.MultiReader(strings.NewReader("0123456789abc")))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large chunked body passed: %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", origin.URL, strings.NewReader("0123456789"))
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("body in limit failed: %d", w.Code)
+	}
+}
+
+func TestLimitHeader(t *testing.T) {
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.Limits.MaxHeaderBytes = 1 << 10
+	front := httptest.NewUnstartedServer(nil)
+	front.Config = p.NewServer(false)
+	front.Start()
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL+"/", nil)
+	req.Header.Set("X-Large", strings.Repeat("x", 8<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("large header passed: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	// MASQUE_UDP_PATH is the default uri template of connect-udp (RFC
+	// 9298), followed by host/port/.
+	MASQUE_UDP_PATH   = "/.well-known/masque/udp/"
+	PROTO_CONNECT_UDP = "connect-udp"
+	CAPSULE_DATAGRAM  = 0x00
+	// CAPSULE_MAX limits capsules from client, udp can't be larger.
+	CAPSULE_MAX = 65535 + 8
+)
+
+var ErrCapsuleSize = errors.New("masque: capsule too large.")
+
+// appendVarint appends v as variable length integer of quic.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func readVarint(r io.ByteReader) (v uint64, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	n := 1 << (b >> 6)
+	v = uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		v = v<<8 | uint64(b)
+	}
+	return
+}
+
+// readCapsule reads type, length and value of a capsule (RFC 9297).
+func readCapsule(r *bufio.Reader, buf []byte) (typ uint64, value []byte, err error) {
+	typ, err = readVarint(r)
+	if err != nil {
+		return
+	}
+	size, err := readVarint(r)
+	if err != nil {
+		return
+	}
+	if size > uint64(len(buf)) {
+		return 0, nil, ErrCapsuleSize
+	}
+	value = buf[:size]
+	_, err = io.ReadFull(r, value)
+	return
+}
+
+// masqueTarget returns host:port in path of connect-udp, by extended
+// CONNECT in http/2, or upgrade to proxy itself in http/1.1.
+func masqueTarget(req *http.Request) (target string, ok bool) {
+	switch {
+	case req.ProtoMajor == 2 && req.Method == "CONNECT" && req.Header.Get(":protocol") == PROTO_CONNECT_UDP:
+	case req.ProtoMajor == 1 && req.Method == "GET" && !req.URL.IsAbs() &&
+		isUpgrade(req) && strings.EqualFold(req.Header.Get("Upgrade"), PROTO_CONNECT_UDP):
+	default:
+		return
+	}
+	rest, ok := strings.CutPrefix(req.URL.Path, MASQUE_UDP_PATH)
+	if !ok {
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	// ipv6 in path has colons escaped, path is unescaped already.
+	return net.JoinHostPort(parts[0], parts[1]), true
+}
+
+// connectUdp relays udp to target in capsules of stream, in http/2
+// stream or connection upgraded. Rules route it by host of target.
+func (p *Proxy) connectUdp(w http.ResponseWriter, r *http.Request, target string) {
+	rreq := r.Clone(r.Context())
+	rreq.Method = "CONNECT"
+	rreq.URL = &url.URL{Host: target}
+	name := p.route(rreq)
+	if name == RULE_REJECT {
+		logger.Infof("udp %s rejected by rule.", target)
+		p.errorPage(w, r, 403, REASON_RULE, p.matched(rreq), nil)
+		return
+	}
+
+	dstconn, err := netutil.DialContext(r.Context(), p.dialerOf(name), "udp", target)
+	if err != nil {
+		logger.Errorf("dial failed: %s", err.Error())
+		p.errorPage(w, r, 502, REASON_DIAL, nil, err)
+		return
+	}
+	defer dstconn.Close()
+
+	var srcconn io.ReadWriteCloser
+	var srcbuf *bufio.Reader
+	if r.ProtoMajor == 2 {
+		w.Header().Set("Capsule-Protocol", "?1")
+		sc := newStreamConn(w, r)
+		sc.accept()
+		srcconn, srcbuf = sc, bufio.NewReader(sc)
+	} else {
+		hij, ok := w.(http.Hijacker)
+		if !ok {
+			logger.Error("httpserver does not support hijacking")
+			return
+		}
+		conn, rw, err := hij.Hijack()
+		if err != nil {
+			logger.Errorf("Cannot hijack connection: %s", err.Error())
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n" +
+			"Upgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n"))
+		srcconn, srcbuf = conn, rw.Reader
+	}
+	defer srcconn.Close()
+	logger.Infof("udp %s connected.", target)
+
+	var recv int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, netutil.MAX_PACKET)
+		for {
+			n, err := dstconn.Read(buf)
+			if err != nil {
+				return
+			}
+			// context id 0 is udp payload.
+			b := appendVarint(nil, CAPSULE_DATAGRAM)
+			b = appendVarint(b, uint64(n+1))
+			b = append(append(b, 0), buf[:n]...)
+			_, err = srcconn.Write(b)
+			if err != nil {
+				return
+			}
+			recv += int64(n)
+		}
+	}()
+
+	sent := p.udpCapsules(srcbuf, dstconn)
+	dstconn.Close()
+	<-done
+	setAccess(w, http.StatusOK, sent, recv)
+}
+
+// udpCapsules sends payload in datagram capsules to dstconn, until
+// stream ended. Other capsules are ignored.
+func (p *Proxy) udpCapsules(r *bufio.Reader, dstconn net.Conn) (sent int64) {
+	buf := make([]byte, CAPSULE_MAX)
+	for {
+		typ, value, err := readCapsule(r, buf)
+		if err != nil {
+			return
+		}
+		if typ != CAPSULE_DATAGRAM {
+			continue
+		}
+		vr := bytes.NewReader(value)
+		ctxid, err := readVarint(vr)
+		if err != nil || ctxid != 0 {
+			continue
+		}
+		payload := value[len(value)-vr.Len():]
+		_, err = dstconn.Write(payload)
+		if err != nil {
+			logger.Debugf("udp: %s", err.Error())
+			continue
+		}
+		sent += int64(len(payload))
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestVarint(t *testing.T) {
+	// examples in RFC 9000.
+	for _, v := range []uint64{37, 15293, 494878333, 151288809941952652} {
+		b := appendVarint(nil, v)
+		got, err := readVarint(bytes.NewReader(b))
+		if err != nil || got != v {
+			t.Fatalf("wrong varint %d: %x %d", v, b, got)
+		}
+	}
+	if b := appendVarint(nil, 15293); !bytes.Equal(b, []byte{0x7b, 0xbd}) {
+		t.Fatalf("wrong encoding: %x", b)
+	}
+}
+
+func udpEcho(t *testing.T) *net.UDPConn {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo
+}
+
+func datagram(payload string) []byte {
+	b := appendVarint(nil, CAPSULE_DATAGRAM)
+	b = appendVarint(b, uint64(len(payload)+1))
+	return append(append(b, 0), payload...)
+}
+
+func readDatagram(t *testing.T, r *bufio.Reader) string {
+	typ, value, err := readCapsule(r, make([]byte, CAPSULE_MAX))
+	if err != nil || typ != CAPSULE_DATAGRAM || len(value) == 0 || value[0] != 0 {
+		t.Fatalf("wrong capsule: %d %q %v", typ, value, err)
+	}
+	return string(value[1:])
+}
+
+func masquePath(echo *net.UDPConn) string {
+	addr := echo.LocalAddr().(*net.UDPAddr)
+	return fmt.Sprintf("%s%s/%d/", MASQUE_UDP_PATH, addr.IP, addr.Port)
+}
+
+func TestConnectUdp(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\n"+
+		"Upgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n", masquePath(echo), srv.Listener.Addr())
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("not switched: %v %v", resp, err)
+	}
+	// unknown capsules are skipped.
+	conn.Write(append([]byte{0x17, 0x01, 0xff}, datagram("ping")...))
+	if got := readDatagram(t, r); got != "ping" {
+		t.Fatalf("wrong datagram: %q", got)
+	}
+}
+
+func TestHttp2ConnectUdp(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.Rules = []Rule{{Host: "127.0.0.2", Dialer: RULE_REJECT}}
+
+	reqr, reqw := io.Pipe()
+	respr, respw := io.Pipe()
+	req := httptest.NewRequest("GET", masquePath(echo), reqr)
+	req.Method = "CONNECT"
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Set(":protocol", PROTO_CONNECT_UDP)
+	w := &pipeWriter{PipeWriter: respw, header: make(http.Header)}
+	go func() {
+		p.ServeHTTP(w, req)
+		respw.Close()
+	}()
+
+	reqw.Write(datagram("ping"))
+	if got := readDatagram(t, bufio.NewReader(respr)); got != "ping" {
+		t.Fatalf("wrong datagram: %q", got)
+	}
+	reqw.Close()
+	if w.status != http.StatusOK || w.header.Get("Capsule-Protocol") != "?1" {
+		t.Fatalf("wrong response: %d %v", w.status, w.header)
+	}
+
+	// rules apply to target.
+	rec := httptest.NewRecorder()
+	req = httptest.NewRequest("CONNECT", MASQUE_UDP_PATH+"127.0.0.2/53/", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Set(":protocol", PROTO_CONNECT_UDP)
+	p.ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Fatalf("not rejected: %d", rec.Code)
+	}
+}
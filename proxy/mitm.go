@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MITM_CACHE    = 1024
+	MITM_CA_DAYS  = 3650
+	MITM_CERT_TTL = 30 * 24 * time.Hour
+)
+
+var ErrCAFormat = errors.New("mitm: ca is not a certificate and ecdsa key.")
+
+// Mitm terminates tls of CONNECT by certificates signed by its own ca,
+// so requests in it can be seen and routed as plain http. Clients must
+// trust the ca. Domains in Bypass and their subdomains are relayed as
+// they are, for those pinning certificates.
+type Mitm struct {
+	ca     *x509.Certificate
+	key    *ecdsa.PrivateKey
+	Bypass []string
+	lock   sync.Mutex
+	certs  map[string]*tls.Certificate
+}
+
+// NewMitm loads ca from certfile and keyfile, or creates one and saves
+// in them if not exist.
+func NewMitm(certfile, keyfile string) (m *Mitm, err error) {
+	m = &Mitm{certs: make(map[string]*tls.Certificate, 0)}
+	_, err = os.Stat(certfile)
+	if os.IsNotExist(err) {
+		err = m.createCA(certfile, keyfile)
+		return
+	}
+	err = m.loadCA(certfile, keyfile)
+	return
+}
+
+func (m *Mitm) loadCA(certfile, keyfile string) (err error) {
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return
+	}
+	key, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return ErrCAFormat
+	}
+	m.ca, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	if !m.ca.IsCA {
+		return ErrCAFormat
+	}
+	m.key = key
+	return
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func (m *Mitm) createCA(certfile, keyfile string) (err error) {
+	m.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "goproxy mitm ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, MITM_CA_DAYS),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &m.key.PublicKey, m.key)
+	if err != nil {
+		return
+	}
+	m.ca, err = x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+
+	keyder, err := x509.MarshalECPrivateKey(m.key)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(certfile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return
+	}
+	logger.Noticef("mitm ca created in %s, install it in clients.", certfile)
+	return
+}
+
+// Bypassed tells if host should not be intercepted.
+func (m *Mitm) Bypassed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range m.Bypass {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// certFor returns certificate of host signed by ca, cached until near
+// expired.
+func (m *Mitm) certFor(host string) (cert *tls.Certificate, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cert, ok := m.certs[host]
+	if ok && time.Now().Before(cert.Leaf.NotAfter.Add(-time.Hour)) {
+		return
+	}
+	if len(m.certs) >= MITM_CACHE {
+		m.certs = make(map[string]*tls.Certificate, 0)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(MITM_CERT_TTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &key.PublicKey, m.key)
+	if err != nil {
+		return
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+	cert = &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	m.certs[host] = cert
+	return
+}
+
+// connListener gives out one connection, and closed with it.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+type listenedConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (lc *listenedConn) Close() error {
+	lc.once.Do(func() { close(lc.done) })
+	return lc.Conn.Close()
+}
+
+func newConnListener(conn net.Conn) (l *connListener) {
+	done := make(chan struct{})
+	return &connListener{
+		conn: &listenedConn{Conn: conn, done: done},
+		done: done,
+	}
+}
+
+func (l *connListener) Accept() (conn net.Conn, err error) {
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// intercept serves requests in tls of conn to host, as if they came in
+// plain http.
+func (p *Proxy) intercept(conn net.Conn, host string) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			return p.Mitm.certFor(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+	tlsconn := tls.Server(conn, config)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL.Scheme = "https"
+			req.URL.Host = req.Host
+			if req.URL.Host == "" {
+				req.URL.Host = host
+			}
+			logger.Infof("https: %s %s", req.Method, req.URL)
+			p.logged(w, req, p.forward)
+		}),
+	}
+	p.Limits.Apply(srv)
+	srv.Serve(newConnListener(tlsconn))
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestMitm(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	certfile := filepath.Join(dir, "ca.crt")
+	keyfile := filepath.Join(dir, "ca.key")
+	m, err := NewMitm(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// loaded again from files created.
+	m, err = NewMitm(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.Mitm = m
+	p.transport.TLSClientConfig = origin.Client().Transport.(*http.Transport).TLSClientConfig
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	proxyURL, _ := url.Parse(front.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	resp, err := client.Get(origin.URL + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello /path" {
+		t.Fatalf("wrong body: %s", body)
+	}
+	if resp.TLS.PeerCertificates[0].Issuer.CommonName != m.ca.Subject.CommonName {
+		t.Fatal("not intercepted")
+	}
+}
+
+func TestMitmBypass(t *testing.T) {
+	m := &Mitm{Bypass: []string{"example.com", ".bank.org"}}
+	for host, bypass := range map[string]bool{
+		"example.com":      true,
+		"www.example.com":  true,
+		"badexample.com":   false,
+		"login.bank.org.":  true,
+		"example.com.evil": false,
+	} {
+		if m.Bypassed(host) != bypass {
+			t.Errorf("%s should be %v", host, bypass)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const PAC_TYPE = "application/x-ns-proxy-autoconfig"
+
+// pacScript finds if ip of host in direct ranges by binary search,
+// PROXY_ADDR is replaced by address of this proxy.
+const pacScript = `var direct = [%s];
+
+function ip2int(ip) {
+	var parts = ip.split(".");
+	return ((parseInt(parts[0]) * 256 + parseInt(parts[1])) * 256 +
+		parseInt(parts[2])) * 256 + parseInt(parts[3]);
+}
+
+function isDirect(ip) {
+	var n = ip2int(ip);
+	var lo = 0, hi = direct.length - 1;
+	while (lo <= hi) {
+		var mid = (lo + hi) >> 1;
+		if (n < direct[mid][0]) {
+			hi = mid - 1;
+		} else if (n > direct[mid][1]) {
+			lo = mid + 1;
+		} else {
+			return true;
+		}
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host)) {
+		return "DIRECT";
+	}
+	var ip = dnsResolve(host);
+	if (ip && ip.indexOf(":") < 0 && isDirect(ip)) {
+		return "DIRECT";
+	}
+	return "PROXY PROXY_ADDR";
+}
+`
+
+// Pac serves pac file in Path for browsers. File given is sent as it
+// is, otherwise one is generated, ipv4 networks of filters go direct and
+// all others through this proxy.
+type Pac struct {
+	Path string
+	data []byte
+}
+
+func NewPacFile(path, file string) (pac *Pac, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	return &Pac{Path: path, data: data}, nil
+}
+
+type ipRange struct {
+	start uint32
+	end   uint32
+}
+
+func NewPac(path string, direct []*net.IPNet) (pac *Pac) {
+	var ranges []ipRange
+	for _, ipnet := range direct {
+		ip := ipnet.IP.To4()
+		if ip == nil {
+			continue
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits != 32 {
+			continue
+		}
+		mask := ^uint32(0) >> ones
+		start := binary.BigEndian.Uint32(ip) &^ mask
+		ranges = append(ranges, ipRange{start, start | mask})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	// merge overlapped ranges, so binary search works.
+	var merged []ipRange
+	for _, r := range ranges {
+		n := len(merged)
+		if n > 0 && uint64(r.start) <= uint64(merged[n-1].end)+1 {
+			if r.end > merged[n-1].end {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	items := make([]string, len(merged))
+	for i, r := range merged {
+		items[i] = fmt.Sprintf("[%d,%d]", r.start, r.end)
+	}
+	script := fmt.Sprintf(pacScript, strings.Join(items, ",\n"))
+	return &Pac{Path: path, data: []byte(script)}
+}
+
+// ServeHTTP sends pac, proxy in generated one is the host requested.
+func (pac *Pac) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data := pac.data
+	if req.Host != "" {
+		data = []byte(strings.Replace(
+			string(data), "PROXY_ADDR", req.Host, -1))
+	}
+	w.Header().Set("Content-Type", PAC_TYPE)
+	w.Write(data)
+}
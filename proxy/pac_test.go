@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPac(t *testing.T) {
+	var direct []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8", "192.168.0.0/16", "fd00::/8"} {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		direct = append(direct, ipnet)
+	}
+	pac := NewPac("/proxy.pac", direct)
+
+	p := NewProxy(nil, "admin", "secret")
+	p.Pac = pac
+	req := httptest.NewRequest("GET", "/proxy.pac", nil)
+	req.Host = "192.168.1.1:5233"
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	// pac needs no auth.
+	if w.Code != 200 || w.Header().Get("Content-Type") != PAC_TYPE {
+		t.Fatalf("pac not served: %d", w.Code)
+	}
+	body := w.Body.String()
+	// 10/8, 10.1/16 and 11/8 merged, ipv6 skipped.
+	if !strings.Contains(body, "var direct = [[167772160,201326591],\n[3232235520,3232301055]];") {
+		t.Fatalf("wrong ranges: %s", body)
+	}
+	if !strings.Contains(body, `"PROXY 192.168.1.1:5233"`) {
+		t.Fatal("proxy address not replaced")
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrPortRange = errors.New("port: range format error.")
+
+// PortRange is ports from Low to High.
+type PortRange struct {
+	Low  int
+	High int
+}
+
+// ParsePorts reads ports like "443", ranges like "8000-8999", or "*"
+// for all.
+func ParsePorts(specs []string) (ranges []PortRange, err error) {
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "*" {
+			ranges = append(ranges, PortRange{0, 65535})
+			continue
+		}
+		low, high, found := strings.Cut(spec, "-")
+		var pr PortRange
+		pr.Low, err = strconv.Atoi(low)
+		if err != nil {
+			return nil, ErrPortRange
+		}
+		pr.High = pr.Low
+		if found {
+			pr.High, err = strconv.Atoi(high)
+			if err != nil {
+				return nil, ErrPortRange
+			}
+		}
+		if pr.Low < 0 || pr.High > 65535 || pr.Low > pr.High {
+			return nil, ErrPortRange
+		}
+		ranges = append(ranges, pr)
+	}
+	return
+}
+
+func inRanges(ranges []PortRange, port int) bool {
+	for _, pr := range ranges {
+		if port >= pr.Low && port <= pr.High {
+			return true
+		}
+	}
+	return false
+}
+
+// PortPolicy allows CONNECT to ports in Allow, except those in Deny.
+// Empty Allow means all ports.
+type PortPolicy struct {
+	Allow []PortRange
+	Deny  []PortRange
+}
+
+func NewPortPolicy(allow, deny []string) (pp *PortPolicy, err error) {
+	pp = &PortPolicy{}
+	pp.Allow, err = ParsePorts(allow)
+	if err != nil {
+		return
+	}
+	pp.Deny, err = ParsePorts(deny)
+	return
+}
+
+func (pp *PortPolicy) Permit(port int) bool {
+	if inRanges(pp.Deny, port) {
+		return false
+	}
+	return len(pp.Allow) == 0 || inRanges(pp.Allow, port)
+}
+
+// portPermitted tells if CONNECT can go to port of r. Extended CONNECT
+// is http upgrade, not a raw tunnel, and not limited.
+func (p *Proxy) portPermitted(r *http.Request) bool {
+	if p.ConnectPorts == nil || r.Header.Get(":protocol") != "" {
+		return true
+	}
+	port, err := strconv.Atoi(r.URL.Port())
+	if err != nil {
+		port = 80
+	}
+	return p.ConnectPorts.Permit(port)
+}
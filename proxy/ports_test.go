@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	ranges, err := ParsePorts([]string{"443", "8000-8999", "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 3 || ranges[1] != (PortRange{8000, 8999}) || ranges[2] != (PortRange{0, 65535}) {
+		t.Fatalf("wrong ranges: %v", ranges)
+	}
+	for _, spec := range []string{"x", "10-", "9-8", "70000"} {
+		if _, err = ParsePorts([]string{spec}); err != ErrPortRange {
+			t.Errorf("%s parsed", spec)
+		}
+	}
+}
+
+func TestPortPolicy(t *testing.T) {
+	pp, err := NewPortPolicy([]string{"443", "8000-8999"}, []string{"8025"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, ok := range map[int]bool{443: true, 8080: true, 8025: false, 25: false, 22: false} {
+		if pp.Permit(port) != ok {
+			t.Errorf("port %d should be %v", port, ok)
+		}
+	}
+
+	pp, _ = NewPortPolicy(nil, []string{"25"})
+	if !pp.Permit(22) || pp.Permit(25) {
+		t.Error("empty allow should permit all but denied")
+	}
+}
+
+func TestConnectPort(t *testing.T) {
+	p := NewProxy(nil, "", "")
+	p.ConnectPorts, _ = NewPortPolicy([]string{"443"}, nil)
+	req := httptest.NewRequest("CONNECT", "mail.example.com:25", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("not rejected: %d", w.Code)
+	}
+}
@@ -2,25 +2,90 @@ package proxy
 
 import (
 	"encoding/base64"
+	"net"
 	"net/http"
 	"strings"
 )
 
-func BasicAuth(w http.ResponseWriter, r *http.Request, username string, password string) bool {
+// OTP_DIGITS is length of totp code appended to password.
+const OTP_DIGITS = 6
+
+// Verifier checks password of user, like connpool.UserDB.
+type Verifier interface {
+	Verify(username, password string) bool
+}
+
+// OtpVerifier checks one time password of user if it has one, passes if
+// not.
+type OtpVerifier interface {
+	VerifyOtp(username, code string) bool
+}
+
+// Matcher tells if ip is in networks, like ipfilter.IPFilter.
+type Matcher interface {
+	Contain(ip net.IP) bool
+}
+
+// clientAllowed tells if client of req is in Allow, all are if Allow is
+// nil.
+func (p *Proxy) clientAllowed(req *http.Request) bool {
+	return p.addrAllowed(req.RemoteAddr)
+}
+
+// addrAllowed tells if client in remote address is in Allow.
+func (p *Proxy) addrAllowed(remote string) bool {
+	if p.Allow == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && p.Allow.Contain(ip)
+}
+
+// ParseBasicAuth reads username and password in Proxy-Authorization.
+func ParseBasicAuth(r *http.Request) (username, password string, ok bool) {
 	pheader := r.Header["Proxy-Authorization"]
 	if pheader == nil || len(pheader) == 0 {
-		return false
+		return
 	}
 
 	auth := strings.SplitN(pheader[0], " ", 2)
 	if len(auth) != 2 || auth[0] != "Basic" {
-		return false
+		return
 	}
 
 	payload, _ := base64.StdEncoding.DecodeString(auth[1])
 	pair := strings.SplitN(string(payload), ":", 2)
 	if len(pair) != 2 {
+		return
+	}
+	return pair[0], pair[1], true
+}
+
+func BasicAuth(w http.ResponseWriter, r *http.Request, username string, password string) bool {
+	u, p, ok := ParseBasicAuth(r)
+	if !ok {
+		return false
+	}
+	return u == username && p == password
+}
+
+// VerifyUser checks password by users, user with totp appends code to
+// password.
+func VerifyUser(users Verifier, username, password string) bool {
+	ov, ok := users.(OtpVerifier)
+	if !ok {
+		return users.Verify(username, password)
+	}
+	if users.Verify(username, password) && ov.VerifyOtp(username, "") {
+		return true
+	}
+	n := len(password) - OTP_DIGITS
+	if n < 0 {
 		return false
 	}
-	return pair[0] == username && pair[1] == password
+	return users.Verify(username, password[:n]) && ov.VerifyOtp(username, password[n:])
 }
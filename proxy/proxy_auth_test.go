@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeUsers map[string]string
+
+func (fu fakeUsers) Verify(username, password string) bool {
+	p, ok := fu[username]
+	return ok && p == password
+}
+
+// user "otp" needs code 123456.
+func (fu fakeUsers) VerifyOtp(username, code string) bool {
+	return username != "otp" || code == "123456"
+}
+
+func TestAuthPass(t *testing.T) {
+	p := NewProxy(nil, "admin", "secret")
+	p.Users = fakeUsers{"user": "pass", "otp": "pass"}
+
+	for _, c := range []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{"admin", "secret", true},
+		{"user", "pass", true},
+		{"user", "wrong", false},
+		{"otp", "pass", false},
+		{"otp", "pass123456", true},
+		{"otp", "pass654321", false},
+		{"nobody", "pass", false},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.SetBasicAuth(c.username, c.password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		if p.authPass(req) != c.ok {
+			t.Errorf("%s:%s should be %v", c.username, c.password, c.ok)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if p.authPass(req) {
+		t.Error("passed without auth")
+	}
+}
+
+// loopback matches 127.0.0.0/8 only.
+type loopback struct{}
+
+func (loopback) Contain(ip net.IP) bool { return ip.IsLoopback() }
+
+func TestClientAllowed(t *testing.T) {
+	p := NewProxy(nil, "", "")
+	p.Allow = loopback{}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "192.168.1.2:1234"
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("client not rejected: %d", w.Code)
+	}
+
+	req.RemoteAddr = "127.0.0.1:1234"
+	if !p.clientAllowed(req) {
+		t.Fatal("client rejected")
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// VHOST_ANY as host of virtual host matches requests no other matched.
+const VHOST_ANY = "*"
+
+var ErrBackendURL = errors.New("reverse: backend is not a http or https url.")
+
+// VirtualHost sends requests to Host to server in Backend.
+type VirtualHost struct {
+	// Host is domain matched with its subdomains, or VHOST_ANY.
+	Host string
+	// Backend is url of server, like http://10.0.0.2:8080, path in it
+	// is prefixed to request.
+	Backend string
+	// Dialer is name of dialer set in reverse, empty for the default.
+	Dialer string
+	// PreserveHost sends Host of request to backend, not host of
+	// Backend.
+	PreserveHost bool
+	// CertFile and KeyFile are certificate of Host to terminate tls.
+	CertFile string
+	KeyFile  string
+}
+
+type vhost struct {
+	VirtualHost
+	handler http.Handler
+	cert    *tls.Certificate
+}
+
+// Reverse serves requests by Host to backends, as a reverse proxy.
+type Reverse struct {
+	dialer  netutil.Dialer
+	lock    sync.Mutex
+	dialers map[string]netutil.Dialer
+	hosts   []*vhost
+}
+
+func NewReverse(dialer netutil.Dialer) (r *Reverse) {
+	return &Reverse{
+		dialer:  dialer,
+		dialers: make(map[string]netutil.Dialer, 0),
+	}
+}
+
+// SetDialer names dialer for virtual hosts.
+func (r *Reverse) SetDialer(name string, dialer netutil.Dialer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dialers[name] = dialer
+}
+
+// AddHost adds virtual host after those added, the first matched serves
+// request.
+func (r *Reverse) AddHost(vh VirtualHost) (err error) {
+	target, err := url.Parse(vh.Backend)
+	if err != nil {
+		return
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return ErrBackendURL
+	}
+	r.lock.Lock()
+	dialer := r.dialer
+	if vh.Dialer != "" {
+		var ok bool
+		dialer, ok = r.dialers[vh.Dialer]
+		if !ok {
+			r.lock.Unlock()
+			return ErrRuleDialer
+		}
+	}
+	r.lock.Unlock()
+
+	h := &vhost{VirtualHost: vh}
+	if vh.CertFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(vh.CertFile, vh.KeyFile)
+		if err != nil {
+			return
+		}
+		h.cert = &cert
+	}
+	h.handler = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			if vh.PreserveHost {
+				pr.Out.Host = pr.In.Host
+			}
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return netutil.DialContext(ctx, dialer, network, address)
+			},
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logger.Errorf("backend of %s failed: %s", req.Host, err.Error())
+			http.Error(w, http.StatusText(502), 502)
+		},
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.hosts = append(r.hosts, h)
+	return
+}
+
+func (r *Reverse) lookup(host string) *vhost {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, h := range r.hosts {
+		if h.Host == VHOST_ANY || matchDomain(host, h.Host) {
+			return h
+		}
+	}
+	return nil
+}
+
+func (r *Reverse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h := r.lookup(req.Host)
+	if h == nil {
+		logger.Infof("reverse: no host %s.", req.Host)
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	logger.Infof("reverse: %s %s%s", req.Method, req.Host, req.URL)
+	h.handler.ServeHTTP(w, req)
+}
+
+// TlsConfig gives certificate of virtual host by server name, nil if no
+// host has one.
+func (r *Reverse) TlsConfig() (config *tls.Config) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, h := range r.hosts {
+		if h.cert != nil {
+			return &tls.Config{GetCertificate: r.getCertificate}
+		}
+	}
+	return nil
+}
+
+func (r *Reverse) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if h := r.lookup(hello.ServerName); h != nil && h.cert != nil {
+		return h.cert, nil
+	}
+	// the first one for clients without sni.
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, h := range r.hosts {
+		if h.cert != nil {
+			return h.cert, nil
+		}
+	}
+	return nil, nil
+}
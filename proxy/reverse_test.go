@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func newBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.Host + r.URL.Path + " " + r.Header.Get("X-Forwarded-Host")))
+	}))
+}
+
+func TestReverse(t *testing.T) {
+	b1 := newBackend("b1")
+	defer b1.Close()
+	b2 := newBackend("b2")
+	defer b2.Close()
+
+	r := NewReverse(netutil.DefaultTcpDialer)
+	r.SetDialer("direct", netutil.DefaultTcpDialer)
+	if err := r.AddHost(VirtualHost{Host: "a.example.com", Backend: b1.URL + "/app", Dialer: "direct"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddHost(VirtualHost{Host: "example.com", Backend: b2.URL, PreserveHost: true}); err != nil {
+		t.Fatal(err)
+	}
+	if r.AddHost(VirtualHost{Host: "x", Backend: b1.URL, Dialer: "none"}) != ErrRuleDialer {
+		t.Fatal("unknown dialer added")
+	}
+	if r.AddHost(VirtualHost{Host: "x", Backend: "ftp://x"}) != ErrBackendURL {
+		t.Fatal("wrong backend added")
+	}
+
+	for host, want := range map[string]string{
+		"a.example.com":   "b1 " + b1.Listener.Addr().String() + "/app/x a.example.com",
+		"b.example.com:8": "b2 b.example.com:8/x b.example.com:8",
+	} {
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Body.String() != want {
+			t.Errorf("%s: %q", host, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Host = "other.com"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown host served: %d", w.Code)
+	}
+}
+
+// writeKeyPair writes certificate of host signed by a new ca in dir.
+func writeKeyPair(t *testing.T, dir, host string) (certfile, keyfile string) {
+	m, err := NewMitm(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.certFor(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	certfile = filepath.Join(dir, host+".crt")
+	keyfile = filepath.Join(dir, host+".key")
+	ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+	return
+}
+
+func TestReverseTls(t *testing.T) {
+	certfile, keyfile := writeKeyPair(t, t.TempDir(), "a.example.com")
+
+	b1 := newBackend("b1")
+	defer b1.Close()
+	r := NewReverse(netutil.DefaultTcpDialer)
+	if r.TlsConfig() != nil {
+		t.Fatal("tls without certificate")
+	}
+	err := r.AddHost(VirtualHost{Host: "a.example.com", Backend: b1.URL, CertFile: certfile, KeyFile: keyfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := r.TlsConfig()
+	got, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if err != nil || got == nil {
+		t.Fatalf("no certificate: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// RULE_REJECT as dialer of rule refuses requests matched.
+const RULE_REJECT = "reject"
+
+var ErrRuleDialer = errors.New("rule: dialer not found.")
+
+// Rule routes requests matched to a dialer. All conditions set must
+// match. CONNECT has no path, rule with Path never matches it, unless
+// intercepted by Mitm.
+type Rule struct {
+	// Host is domain matched with its subdomains, empty for all.
+	Host string
+	// Path is prefix of url path.
+	Path string
+	// Header must have these values, empty value matches any.
+	Header map[string]string
+	// Dialer is name of dialer set in proxy, or reject.
+	Dialer string
+}
+
+func (r *Rule) Match(req *http.Request) bool {
+	if r.Host != "" && !matchDomain(req.URL.Hostname(), r.Host) {
+		return false
+	}
+	if r.Path != "" {
+		if req.Method == "CONNECT" || !strings.HasPrefix(req.URL.Path, r.Path) {
+			return false
+		}
+	}
+	for name, value := range r.Header {
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if value != "" && !containsString(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// String shows conditions and dialer of rule, for logs and pages.
+func (r *Rule) String() string {
+	var parts []string
+	if r.Host != "" {
+		parts = append(parts, "host="+r.Host)
+	}
+	if r.Path != "" {
+		parts = append(parts, "path="+r.Path)
+	}
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, "header="+name+":"+r.Header[name])
+	}
+	return strings.Join(append(parts, "dialer="+r.Dialer), " ")
+}
+
+// matchDomain tells if host is domain or its subdomain.
+func matchDomain(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDialer names dialer for rules.
+func (p *Proxy) SetDialer(name string, dialer netutil.Dialer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.dialers[name] = dialer
+}
+
+// CheckRules makes sure dialers of rules are set.
+func (p *Proxy) CheckRules() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, r := range p.Rules {
+		if r.Dialer == RULE_REJECT {
+			continue
+		}
+		if _, ok := p.dialers[r.Dialer]; !ok {
+			return ErrRuleDialer
+		}
+	}
+	return nil
+}
+
+// matched returns the first rule matched, nil if none.
+func (p *Proxy) matched(req *http.Request) *Rule {
+	for i := range p.Rules {
+		if p.Rules[i].Match(req) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// route returns name of dialer in the first rule matched, empty for
+// default.
+func (p *Proxy) route(req *http.Request) string {
+	if r := p.matched(req); r != nil {
+		return r.Dialer
+	}
+	return ""
+}
+
+// dialerOf returns dialer by name, default one if empty.
+func (p *Proxy) dialerOf(name string) netutil.Dialer {
+	if name == "" {
+		return p.dialer
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if dialer, ok := p.dialers[name]; ok {
+		return dialer
+	}
+	return p.dialer
+}
+
+// transportOf returns transport of dialer named, each dialer has its
+// own, so connections dialed by one are not reused by requests routed to
+// another.
+func (p *Proxy) transportOf(name string) http.RoundTripper {
+	if name == "" {
+		return &p.transport
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t, ok := p.transports[name]
+	if ok {
+		return t
+	}
+	dialer, ok := p.dialers[name]
+	if !ok {
+		return &p.transport
+	}
+	tr := p.transport.Clone()
+	tr.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return netutil.DialContext(ctx, dialer, network, address)
+	}
+	p.transports[name] = tr
+	return tr
+}
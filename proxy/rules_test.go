@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	rules := []Rule{
+		{Host: "example.com", Path: "/api/", Dialer: "tunnel"},
+		{Header: map[string]string{"X-Route": "direct"}, Dialer: "direct"},
+		{Header: map[string]string{"X-Block": ""}, Dialer: RULE_REJECT},
+		{Host: ".ads.net", Dialer: RULE_REJECT},
+	}
+	p := NewProxy(nil, "", "")
+	p.Rules = rules
+
+	for _, c := range []struct {
+		method string
+		url    string
+		header map[string]string
+		dialer string
+	}{
+		{"GET", "http://www.example.com/api/v1", nil, "tunnel"},
+		{"GET", "http://example.com/static/a.js", nil, ""},
+		{"GET", "http://other.com/", map[string]string{"X-Route": "direct"}, "direct"},
+		{"GET", "http://other.com/", map[string]string{"X-Route": "tunnel"}, ""},
+		{"GET", "http://other.com/", map[string]string{"X-Block": "1"}, RULE_REJECT},
+		{"CONNECT", "cdn.ads.net:443", nil, RULE_REJECT},
+		{"CONNECT", "example.com:443", nil, ""},
+	} {
+		req := httptest.NewRequest(c.method, c.url, nil)
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		if name := p.route(req); name != c.dialer {
+			t.Errorf("%s %s routed to %q", c.method, c.url, name)
+		}
+	}
+
+	if p.CheckRules() != ErrRuleDialer {
+		t.Fatal("rules with unknown dialer passed")
+	}
+	p.SetDialer("tunnel", nil)
+	p.SetDialer("direct", nil)
+	if err := p.CheckRules(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRuleReject(t *testing.T) {
+	p := NewProxy(nil, "", "")
+	p.Rules = []Rule{{Host: "blocked.com", Dialer: RULE_REJECT}}
+	req := httptest.NewRequest("GET", "http://blocked.com/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("not rejected: %d", w.Code)
+	}
+}
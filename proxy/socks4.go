@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	SOCKS4_VERSION  = 0x04
+	SOCKS4_CONNECT  = 0x01
+	SOCKS4_GRANTED  = 0x5a
+	SOCKS4_REJECTED = 0x5b
+	// SOCKS4_MAX_STRING limits user id and domain, ended by zero.
+	SOCKS4_MAX_STRING = 255
+)
+
+var (
+	ErrSocks4Command = errors.New("socks4: command not supported.")
+	ErrSocks4String  = errors.New("socks4: string too long.")
+	ErrSocks4Auth    = errors.New("socks4: no password, auth required.")
+)
+
+// readString reads bytes until zero.
+func readString(r io.Reader) (s string, err error) {
+	var buf [1]byte
+	b := make([]byte, 0, 16)
+	for {
+		_, err = io.ReadFull(r, buf[:])
+		if err != nil {
+			return
+		}
+		if buf[0] == 0 {
+			return string(b), nil
+		}
+		if len(b) >= SOCKS4_MAX_STRING {
+			return "", ErrSocks4String
+		}
+		b = append(b, buf[0])
+	}
+}
+
+// socks4Reply sends granted or rejected, address is not used by
+// clients.
+func socks4Reply(conn net.Conn, rep byte) (err error) {
+	_, err = conn.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+	return
+}
+
+// serveSocks4 serves socks4 and socks4a CONNECT after version. Socks4
+// has no password, it's rejected if auth required.
+func (p *Proxy) serveSocks4(conn net.Conn) (err error) {
+	var head [7]byte
+	_, err = io.ReadFull(conn, head[:])
+	if err != nil {
+		return
+	}
+	userid, err := readString(conn)
+	if err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(head[1:3])
+	host := net.IP(head[3:7]).String()
+	// 0.0.0.x is socks4a, domain follows user id.
+	if head[3] == 0 && head[4] == 0 && head[5] == 0 && head[6] != 0 {
+		host, err = readString(conn)
+		if err != nil {
+			return
+		}
+	}
+	if head[0] != SOCKS4_CONNECT {
+		socks4Reply(conn, SOCKS4_REJECTED)
+		return ErrSocks4Command
+	}
+	if p.authRequired() {
+		socks4Reply(conn, SOCKS4_REJECTED)
+		return ErrSocks4Auth
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	// user id is not authed, not for throttle.
+	conn, sr := p.acceptRelay(conn, "", "SOCKS4", address)
+	sr.Method = "CONNECT"
+	sr.Username = userid
+	p.connectRelay(conn, address, sr, func(rep byte, bound net.Addr) error {
+		if rep != netutil.SOCKS5_SUCCEEDED {
+			return socks4Reply(conn, SOCKS4_REJECTED)
+		}
+		return socks4Reply(conn, SOCKS4_GRANTED)
+	})
+	return
+}
@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// SOCKS5_UDP_TIMEOUT closes udp flow idle that long.
+const SOCKS5_UDP_TIMEOUT = 2 * time.Minute
+
+// ServeSocks5 serves socks5 (RFC 1928) clients in listener, CONNECT and
+// UDP ASSOCIATE by the default dialer, and socks4/4a CONNECT. Clients
+// are checked by Allow, and by username and password (RFC 1929) if http
+// needs auth. Throttle, Stats and AccessLog work as in http.
+func (p *Proxy) ServeSocks5(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveSocks(conn)
+	}
+}
+
+// serveSocks tells socks5 and socks4 by version in the first byte.
+func (p *Proxy) serveSocks(conn net.Conn) {
+	defer conn.Close()
+	if !p.addrAllowed(conn.RemoteAddr().String()) {
+		logger.Infof("client %s not allowed.", conn.RemoteAddr())
+		return
+	}
+	if p.Limits.HeaderTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.Limits.HeaderTimeout))
+	}
+	var version [1]byte
+	_, err := io.ReadFull(conn, version[:])
+	if err != nil {
+		return
+	}
+	switch version[0] {
+	case netutil.SOCKS5_VERSION:
+		err = p.serveSocks5(conn)
+	case SOCKS4_VERSION:
+		err = p.serveSocks4(conn)
+	default:
+		err = netutil.ErrSocksVersion
+	}
+	if err != nil {
+		logger.Infof("socks from %s: %s", conn.RemoteAddr(), err.Error())
+	}
+}
+
+// acceptRelay clears deadline of handshake, and throttles conn.
+func (p *Proxy) acceptRelay(conn net.Conn, username, proto, address string) (net.Conn, *relayRecord) {
+	conn.SetDeadline(time.Time{})
+	if p.Throttle != nil {
+		conn = p.Throttle.WrapConn(conn, username)
+	}
+	return conn, &relayRecord{AccessRecord: AccessRecord{
+		Time:     time.Now(),
+		Client:   conn.RemoteAddr().String(),
+		Username: username,
+		Host:     address,
+		URL:      address,
+		Proto:    proto,
+	}}
+}
+
+// serveSocks5 serves socks5 after version.
+func (p *Proxy) serveSocks5(conn net.Conn) (err error) {
+	username, err := p.socks5Auth(conn)
+	if err != nil {
+		return
+	}
+	var head [3]byte
+	_, err = io.ReadFull(conn, head[:])
+	if err != nil {
+		return
+	}
+	address, err := netutil.ReadSocks5Address(conn)
+	if err != nil {
+		socks5Reply(conn, netutil.SOCKS5_NOADDRESS, nil)
+		return
+	}
+
+	conn, sr := p.acceptRelay(conn, username, "SOCKS5", address)
+	reply := func(rep byte, bound net.Addr) error {
+		return socks5Reply(conn, rep, bound)
+	}
+	switch head[1] {
+	case netutil.SOCKS5_CONNECT:
+		sr.Method = "CONNECT"
+		p.connectRelay(conn, address, sr, reply)
+	case netutil.SOCKS5_UDP:
+		sr.Method = "UDP"
+		p.socks5Udp(conn, address, sr)
+	default:
+		socks5Reply(conn, netutil.SOCKS5_NOCOMMAND, nil)
+	}
+	return
+}
+
+// socks5Auth selects method, and checks username and password if auth
+// required.
+func (p *Proxy) socks5Auth(conn net.Conn) (username string, err error) {
+	var buf [2]byte
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return
+	}
+	methods := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return
+	}
+
+	method := byte(netutil.SOCKS5_NOAUTH)
+	if p.authRequired() {
+		method = netutil.SOCKS5_USERPASS
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{netutil.SOCKS5_VERSION, netutil.SOCKS5_NOACCEPT})
+		return "", netutil.ErrSocksAuth
+	}
+	_, err = conn.Write([]byte{netutil.SOCKS5_VERSION, method})
+	if err != nil || method == netutil.SOCKS5_NOAUTH {
+		return
+	}
+
+	_, err = io.ReadFull(conn, buf[:])
+	if err != nil {
+		return
+	}
+	user := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, user)
+	if err != nil {
+		return
+	}
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return
+	}
+	password := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return
+	}
+	if !p.userPass(string(user), string(password)) {
+		conn.Write([]byte{0x01, 0x01})
+		return "", netutil.ErrSocksAuth
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return string(user), err
+}
+
+// socks5Reply sends rep with address bound, zero if nil.
+func socks5Reply(conn net.Conn, rep byte, bound net.Addr) (err error) {
+	address := "0.0.0.0:0"
+	if bound != nil {
+		address = bound.String()
+	}
+	b, err := netutil.AppendSocks5Address(
+		[]byte{netutil.SOCKS5_VERSION, rep, 0x00}, address)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(b)
+	return
+}
+
+func socks5Rep(err error) byte {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return netutil.SOCKS5_UNREACHABLE
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return netutil.SOCKS5_REFUSED
+	}
+	return netutil.SOCKS5_FAILURE
+}
+
+// relayRecord is access of connection relayed, like socks, counted in
+// Stats and logged in AccessLog when done.
+type relayRecord struct {
+	AccessRecord
+	sent int64
+}
+
+func (p *Proxy) relayDone(sr *relayRecord, dt *netutil.DialTrace) {
+	host, _, err := net.SplitHostPort(sr.Host)
+	if err != nil {
+		host = sr.Host
+	}
+	if p.Stats != nil {
+		p.Stats.Add(host, sr.Status, sr.sent, sr.Bytes)
+	}
+	if p.AccessLog != nil || p.Recent != nil {
+		sr.Duration = time.Since(sr.Time).Seconds()
+		sr.Dialer = dt.Dialer()
+		p.log(&sr.AccessRecord)
+	}
+}
+
+// connectRelay relays conn with address, reply sends result in socks5
+// code.
+func (p *Proxy) connectRelay(conn net.Conn, address string, sr *relayRecord, reply func(rep byte, bound net.Addr) error) {
+	ctx, dt := netutil.WithDialTrace(context.Background())
+	defer p.relayDone(sr, dt)
+	dstconn, err := netutil.DialContext(ctx, p.dialer, "tcp", address)
+	if err != nil {
+		logger.Errorf("dial failed: %s", err.Error())
+		reply(socks5Rep(err), nil)
+		sr.Status = 502
+		return
+	}
+	err = reply(netutil.SOCKS5_SUCCEEDED, dstconn.LocalAddr())
+	if err != nil {
+		dstconn.Close()
+		return
+	}
+	logger.Infof("%s %s connected.", sr.Proto, address)
+	sr.Status = 200
+	sr.sent, sr.Bytes, _ = netutil.Relay(conn, dstconn)
+}
+
+// socksAssoc relays udp of a client in a socket, to flows by
+// destination, until tcp connection of client closed.
+type socksAssoc struct {
+	p      *Proxy
+	ctx    context.Context
+	sconn  *net.UDPConn
+	client net.IP
+	done   chan struct{}
+	wg     sync.WaitGroup
+	lock   sync.Mutex
+	addr   *net.UDPAddr // where client sends from, first packet decides
+	port   int
+	flows  map[string]net.Conn
+	sr     *relayRecord
+}
+
+func (p *Proxy) socks5Udp(conn net.Conn, address string, sr *relayRecord) {
+	ctx, dt := netutil.WithDialTrace(context.Background())
+	defer p.relayDone(sr, dt)
+
+	var local net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		local = addr.IP
+	}
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+	if err != nil {
+		logger.Error(err.Error())
+		socks5Reply(conn, netutil.SOCKS5_FAILURE, nil)
+		sr.Status = 502
+		return
+	}
+	defer sconn.Close()
+
+	sa := &socksAssoc{
+		p:     p,
+		ctx:   ctx,
+		sconn: sconn,
+		done:  make(chan struct{}),
+		flows: make(map[string]net.Conn, 0),
+		sr:    sr,
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		sa.client = addr.IP
+	}
+	// port client told to send from, ip of it is ignored as NAT may
+	// change it.
+	if _, port, err := net.SplitHostPort(address); err == nil && port != "0" {
+		sa.port, _ = net.LookupPort("udp", port)
+	}
+	err = socks5Reply(conn, netutil.SOCKS5_SUCCEEDED, sconn.LocalAddr())
+	if err != nil {
+		return
+	}
+	logger.Infof("socks5: udp associated in %s.", sconn.LocalAddr())
+	sr.Status = 200
+
+	go sa.loop()
+	io.Copy(ioutil.Discard, conn)
+	sa.close()
+}
+
+// close stops relay, and waits all flows done.
+func (sa *socksAssoc) close() {
+	sa.sconn.Close()
+	<-sa.done
+	sa.lock.Lock()
+	for _, dconn := range sa.flows {
+		dconn.Close()
+	}
+	sa.lock.Unlock()
+	sa.wg.Wait()
+}
+
+// from tells if packet from addr is of client.
+func (sa *socksAssoc) from(addr *net.UDPAddr) bool {
+	if sa.client != nil && !addr.IP.Equal(sa.client) {
+		return false
+	}
+	if sa.port != 0 && addr.Port != sa.port {
+		return false
+	}
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	if sa.addr == nil {
+		sa.addr = addr
+	}
+	return sa.addr.String() == addr.String()
+}
+
+func (sa *socksAssoc) loop() {
+	defer close(sa.done)
+	buf := make([]byte, netutil.MAX_PACKET)
+	for {
+		n, addr, err := sa.sconn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !sa.from(addr) {
+			logger.Debugf("socks5: udp from %s dropped.", addr)
+			continue
+		}
+		// RSV(2), FRAG(1), address, data. fragments not supported.
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		address, err := netutil.ReadSocks5Address(r)
+		if err != nil {
+			continue
+		}
+		dconn, err := sa.flow(address)
+		if err != nil {
+			logger.Errorf("dial failed: %s", err.Error())
+			continue
+		}
+		data := buf[n-r.Len() : n]
+		dconn.SetReadDeadline(time.Now().Add(SOCKS5_UDP_TIMEOUT))
+		if _, err = dconn.Write(data); err == nil {
+			sa.lock.Lock()
+			sa.sr.sent += int64(len(data))
+			sa.lock.Unlock()
+		}
+	}
+}
+
+// flow returns connection to address, dials it if not yet.
+func (sa *socksAssoc) flow(address string) (dconn net.Conn, err error) {
+	sa.lock.Lock()
+	dconn, ok := sa.flows[address]
+	sa.lock.Unlock()
+	if ok {
+		return
+	}
+	dconn, err = netutil.DialContext(sa.ctx, sa.p.dialer, "udp", address)
+	if err != nil {
+		return
+	}
+	sa.lock.Lock()
+	sa.flows[address] = dconn
+	sa.lock.Unlock()
+	sa.wg.Add(1)
+	go sa.recv(address, dconn)
+	return
+}
+
+// recv sends packets of flow back to client, with address of flow.
+func (sa *socksAssoc) recv(address string, dconn net.Conn) {
+	defer sa.wg.Done()
+	defer func() {
+		sa.lock.Lock()
+		delete(sa.flows, address)
+		sa.lock.Unlock()
+		dconn.Close()
+	}()
+	head, err := netutil.AppendSocks5Address([]byte{0, 0, 0}, address)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, netutil.MAX_PACKET)
+	n := copy(buf, head)
+	for {
+		nr, err := dconn.Read(buf[n:])
+		if err != nil {
+			return
+		}
+		dconn.SetReadDeadline(time.Now().Add(SOCKS5_UDP_TIMEOUT))
+		sa.lock.Lock()
+		addr := sa.addr
+		sa.sr.Bytes += int64(nr)
+		sa.lock.Unlock()
+		_, err = sa.sconn.WriteToUDP(buf[:n+nr], addr)
+		if err != nil {
+			return
+		}
+	}
+}
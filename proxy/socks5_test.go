@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func socks5Proxy(t *testing.T, username, password string) (p *Proxy, addr string, closer func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = NewProxy(netutil.DefaultTcpDialer, username, password)
+	p.Stats = NewHostStats()
+	go p.ServeSocks5(listener)
+	return p, listener.Addr().String(), func() { listener.Close() }
+}
+
+func tcpEcho(t *testing.T) net.Listener {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return echo
+}
+
+func TestSocks5Connect(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	p, addr, closer := socks5Proxy(t, "user", "pass")
+	defer closer()
+
+	_, err := netutil.NewSocks5Dialer(netutil.DefaultTcpDialer, addr, "", "").Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal("connected without auth")
+	}
+	_, err = netutil.NewSocks5Dialer(netutil.DefaultTcpDialer, addr, "user", "wrong").Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal("connected with wrong password")
+	}
+
+	conn, err := netutil.NewSocks5Dialer(netutil.DefaultTcpDialer, addr, "user", "pass").Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("not relayed: %q %v", buf, err)
+	}
+	conn.Close()
+
+	// stats are counted after relay done.
+	for i := 0; i < 100 && len(p.Stats.Top(0)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	top := p.Stats.Top(0)
+	if len(top) != 1 || top[0].Host != "127.0.0.1" || top[0].Sent != 5 || top[0].Recv != 5 {
+		t.Fatalf("wrong stats: %v", top)
+	}
+}
+
+func TestSocks5Udp(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	_, addr, closer := socks5Proxy(t, "", "")
+	defer closer()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{netutil.SOCKS5_VERSION, 1, netutil.SOCKS5_NOAUTH})
+	req, _ := netutil.AppendSocks5Address([]byte{netutil.SOCKS5_VERSION, netutil.SOCKS5_UDP, 0}, "0.0.0.0:0")
+	conn.Write(req)
+	var head [5]byte
+	io.ReadFull(conn, head[:2])
+	io.ReadFull(conn, head[:3])
+	if head[1] != netutil.SOCKS5_SUCCEEDED {
+		t.Fatalf("udp associate failed: %d", head[1])
+	}
+	bound, err := netutil.ReadSocks5Address(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uconn, err := net.Dial("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	packet, _ := netutil.AppendSocks5Address([]byte{0, 0, 0}, echo.LocalAddr().String())
+	uconn.Write(append(packet, "ping"...))
+
+	buf := make([]byte, 1500)
+	uconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := uconn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], append(packet, "ping"...)) {
+		t.Fatalf("wrong packet: %q", buf[:n])
+	}
+}
+
+func TestSocks4(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	_, addr, closer := socks5Proxy(t, "", "")
+	defer closer()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	portnum, _ := net.LookupPort("tcp", port)
+
+	for _, req := range [][]byte{
+		{SOCKS4_VERSION, SOCKS4_CONNECT, byte(portnum >> 8), byte(portnum), 127, 0, 0, 1, 'u', 0},
+		append([]byte{SOCKS4_VERSION, SOCKS4_CONNECT, byte(portnum >> 8), byte(portnum), 0, 0, 0, 1, 0}, "localhost\x00"...),
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(req)
+		reply := make([]byte, 8)
+		io.ReadFull(conn, reply)
+		if reply[1] != SOCKS4_GRANTED {
+			t.Fatalf("not granted: %v", reply)
+		}
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf) != "hello" {
+			t.Fatalf("not relayed: %q %v", buf, err)
+		}
+		conn.Close()
+	}
+
+	// no password in socks4.
+	_, addr, closer = socks5Proxy(t, "user", "pass")
+	defer closer()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{SOCKS4_VERSION, SOCKS4_CONNECT, byte(portnum >> 8), byte(portnum), 127, 0, 0, 1, 0})
+	reply := make([]byte, 8)
+	io.ReadFull(conn, reply)
+	if reply[1] != SOCKS4_REJECTED {
+		t.Fatalf("granted without auth: %v", reply)
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Swap serves by the proxy set last, so config reloaded applies to new
+// requests and connections, those in progress stay with the old one.
+type Swap struct {
+	p atomic.Pointer[Proxy]
+}
+
+func NewSwap(p *Proxy) (s *Swap) {
+	s = &Swap{}
+	s.p.Store(p)
+	return
+}
+
+func (s *Swap) Get() *Proxy {
+	return s.p.Load()
+}
+
+func (s *Swap) Set(p *Proxy) {
+	s.p.Store(p)
+}
+
+func (s *Swap) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Get().ServeHTTP(w, req)
+}
+
+// NewServer and NewTlsServer take Limits of the proxy now, as they are
+// applied to server, not requests.
+func (s *Swap) NewServer(http2 bool) (srv *http.Server) {
+	srv = s.Get().NewServer(http2)
+	srv.Handler = s
+	return
+}
+
+func (s *Swap) NewTlsServer(kp *KeyPair) (srv *http.Server) {
+	srv = s.Get().NewTlsServer(kp)
+	srv.Handler = s
+	return
+}
+
+func (s *Swap) ServeSocks5(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Get().serveSocks(conn)
+	}
+}
+
+func (s *Swap) ServeTransparent(listener net.Listener, mode string) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Get().serveTransparent(conn, mode, listener.Addr())
+	}
+}
+
+func (s *Swap) Relay(conn net.Conn, proto, address string) {
+	s.Get().Relay(conn, proto, address)
+}
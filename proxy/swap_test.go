@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestSwap(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	s := NewSwap(NewProxy(netutil.DefaultTcpDialer, "user", "pass"))
+	srv := httptest.NewServer(s.NewServer(false).Handler)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+	}}
+
+	for _, c := range []struct {
+		p      *Proxy
+		status int
+	}{
+		{nil, http.StatusProxyAuthRequired},
+		{NewProxy(netutil.DefaultTcpDialer, "", ""), http.StatusOK},
+	} {
+		if c.p != nil {
+			s.Set(c.p)
+		}
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("wrong status: %d", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	THROTTLE_IP   = "ip"
+	THROTTLE_USER = "user"
+	// buckets of clients not seen for THROTTLE_IDLE are dropped.
+	THROTTLE_IDLE = 10 * time.Minute
+)
+
+type clientBuckets struct {
+	up   *netutil.TokenBucket
+	down *netutil.TokenBucket
+	last time.Time
+}
+
+// Throttle limits bandwidth of each client, in bytes per second. Client
+// is its ip, or username authed if By is THROTTLE_USER. Zero rate means
+// no limit that way.
+type Throttle struct {
+	UpRate   int64
+	DownRate int64
+	Burst    int64
+	By       string
+	lock     sync.Mutex
+	clients  map[string]*clientBuckets
+	swept    time.Time
+}
+
+func NewThrottle(uprate, downrate, burst int64, by string) (t *Throttle) {
+	return &Throttle{
+		UpRate:   uprate,
+		DownRate: downrate,
+		Burst:    burst,
+		By:       by,
+		clients:  make(map[string]*clientBuckets, 0),
+		swept:    time.Now(),
+	}
+}
+
+func newBucket(rate, burst int64) *netutil.TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return netutil.NewTokenBucket(float64(rate), float64(burst))
+}
+
+func (t *Throttle) key(req *http.Request) string {
+	username, _, _ := ParseBasicAuth(req)
+	return t.clientKey(req.RemoteAddr, username)
+}
+
+func (t *Throttle) clientKey(remote, username string) string {
+	if t.By == THROTTLE_USER && username != "" {
+		return "user:" + username
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	return "ip:" + host
+}
+
+// buckets returns buckets of client, shared by all its requests.
+func (t *Throttle) buckets(key string) (cb *clientBuckets) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if now.Sub(t.swept) > THROTTLE_IDLE {
+		for k, c := range t.clients {
+			if now.Sub(c.last) > THROTTLE_IDLE {
+				delete(t.clients, k)
+			}
+		}
+		t.swept = now
+	}
+	cb, ok := t.clients[key]
+	if !ok {
+		cb = &clientBuckets{
+			up:   newBucket(t.UpRate, t.Burst),
+			down: newBucket(t.DownRate, t.Burst),
+		}
+		t.clients[key] = cb
+	}
+	cb.last = now
+	return
+}
+
+// Wrap limits body of req and response written to w, hijacked
+// connection as well.
+func (t *Throttle) Wrap(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request) {
+	cb := t.buckets(t.key(req))
+	if cb.up != nil && req.Body != nil {
+		req.Body = &shapedBody{ReadCloser: req.Body, bucket: cb.up}
+	}
+	return &shapedWriter{ResponseWriter: w, up: cb.up, down: cb.down}, req
+}
+
+// WrapConn limits conn of client as Wrap, username is empty if not
+// authed.
+func (t *Throttle) WrapConn(conn net.Conn, username string) net.Conn {
+	cb := t.buckets(t.clientKey(conn.RemoteAddr().String(), username))
+	return netutil.NewShapedConn(conn, cb.up, cb.down)
+}
+
+type shapedBody struct {
+	io.ReadCloser
+	bucket *netutil.TokenBucket
+}
+
+func (sb *shapedBody) Read(b []byte) (n int, err error) {
+	n, err = sb.ReadCloser.Read(b)
+	if n > 0 {
+		sb.bucket.Wait(n)
+	}
+	return
+}
+
+type shapedWriter struct {
+	http.ResponseWriter
+	up   *netutil.TokenBucket
+	down *netutil.TokenBucket
+}
+
+func (sw *shapedWriter) Write(b []byte) (int, error) {
+	if sw.down != nil {
+		sw.down.Wait(len(b))
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *shapedWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *shapedWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *shapedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hij, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hij.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return netutil.NewShapedConn(conn, sw.up, sw.down), rw, nil
+}
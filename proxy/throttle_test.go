@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestThrottleKey(t *testing.T) {
+	th := NewThrottle(100, 100, 0, THROTTLE_USER)
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "192.168.1.2:1234"
+	if key := th.key(req); key != "ip:192.168.1.2" {
+		t.Fatalf("wrong key: %s", key)
+	}
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	if key := th.key(req); key != "user:user" {
+		t.Fatalf("wrong key: %s", key)
+	}
+	if th.buckets("ip:a") != th.buckets("ip:a") || th.buckets("ip:a") == th.buckets("ip:b") {
+		t.Fatal("buckets not kept by client")
+	}
+}
+
+func TestThrottleDown(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 6000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.Throttle = NewThrottle(0, 10000, 1000, THROTTLE_IP)
+	start := time.Now()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", origin.URL, nil))
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("wrong body: %d", w.Body.Len())
+	}
+	// 5000 bytes over burst at 10000 per second.
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("not throttled: %s", d)
+	}
+}
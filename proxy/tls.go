@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// KEYPAIR_CHECK is interval to check if files of key pair modified.
+const KEYPAIR_CHECK = time.Minute
+
+// KeyPair is certificate and key in files, reloaded once modified, like
+// renewed by acme, without restart.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	modtime  time.Time
+	checked  time.Time
+	cert     *tls.Certificate
+}
+
+func NewKeyPair(certFile, keyFile string) (kp *KeyPair, err error) {
+	kp = &KeyPair{certFile: certFile, keyFile: keyFile}
+	err = kp.load()
+	return
+}
+
+func (kp *KeyPair) load() (err error) {
+	fi, err := os.Stat(kp.certFile)
+	if err != nil {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return
+	}
+	kp.cert, kp.modtime = &cert, fi.ModTime()
+	return
+}
+
+// GetCertificate is for tls.Config, the one loaded last if reload
+// failed.
+func (kp *KeyPair) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.lock.Lock()
+	defer kp.lock.Unlock()
+	now := time.Now()
+	if now.Sub(kp.checked) < KEYPAIR_CHECK {
+		return kp.cert, nil
+	}
+	kp.checked = now
+	fi, err := os.Stat(kp.certFile)
+	if err != nil || fi.ModTime().Equal(kp.modtime) {
+		return kp.cert, nil
+	}
+	err = kp.load()
+	if err != nil {
+		logger.Errorf("reload certificate %s failed: %s", kp.certFile, err.Error())
+		return kp.cert, nil
+	}
+	logger.Noticef("certificate %s reloaded.", kp.certFile)
+	return kp.cert, nil
+}
+
+// NewTlsServer serves proxy in tls, as a https proxy, so targets of
+// requests are not seen in network. Serve it by ServeTLS with empty
+// files, http/2 is negotiated by alpn.
+func (p *Proxy) NewTlsServer(kp *KeyPair) (srv *http.Server) {
+	srv = &http.Server{Handler: p}
+	p.Limits.Apply(srv)
+	srv.TLSConfig = &tls.Config{
+		GetCertificate: kp.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	return
+}
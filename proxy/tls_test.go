@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestTlsProxy(t *testing.T) {
+	certfile, keyfile := writeKeyPair(t, t.TempDir(), "proxy.example.com")
+	kp, err := NewKeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origin := newBackend("origin")
+	defer origin.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	srv := p.NewTlsServer(kp)
+	go srv.ServeTLS(listener, "", "")
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: listener.Addr().String()}),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get(origin.URL + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.HasPrefix(body, []byte("origin ")) {
+		t.Fatalf("not proxied: %q", body)
+	}
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir := t.TempDir()
+	certfile, keyfile := writeKeyPair(t, dir, "proxy.example.com")
+	kp, err := NewKeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := kp.GetCertificate(nil)
+
+	writeKeyPair(t, dir, "proxy.example.com")
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(certfile, later, later)
+	if cert, _ := kp.GetCertificate(nil); cert != old {
+		t.Fatal("reloaded before check interval")
+	}
+	kp.checked = time.Time{}
+	if cert, _ := kp.GetCertificate(nil); cert == old {
+		t.Fatal("not reloaded")
+	}
+
+	ioutil.WriteFile(certfile, []byte("broken"), 0600)
+	os.Chtimes(certfile, later.Add(time.Hour), later.Add(time.Hour))
+	kp.checked = time.Time{}
+	if cert, _ := kp.GetCertificate(nil); cert == nil {
+		t.Fatal("broken certificate replaced the good one")
+	}
+}
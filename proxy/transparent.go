@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// ServeTransparent relays connections redirected to listener by
+// iptables to their original destinations by the default dialer, in
+// mode of netutil.ListenTransparent. Allow, Throttle, Stats and
+// AccessLog work as in http.
+func (p *Proxy) ServeTransparent(listener net.Listener, mode string) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveTransparent(conn, mode, listener.Addr())
+	}
+}
+
+// looped tells if address is listener itself in this host, client
+// connected to it directly, relaying it makes a loop.
+func looped(address string, listener net.Addr) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	_, lport, err := net.SplitHostPort(listener.String())
+	if err != nil || port != lport {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) serveTransparent(conn net.Conn, mode string, laddr net.Addr) {
+	defer conn.Close()
+	address, err := netutil.OriginalDst(conn, mode)
+	if err != nil {
+		logger.Errorf("original destination of %s: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	if looped(address, laddr) {
+		logger.Infof("%s connected to transparent port directly.", conn.RemoteAddr())
+		return
+	}
+	p.Relay(conn, "TRANSPARENT", address)
+}
+
+// Relay relays conn, redirected by transparent proxy or tun, to address
+// by the default dialer. proto is logged in AccessLog. Allow, Throttle
+// and Stats work as in http. conn is not closed.
+func (p *Proxy) Relay(conn net.Conn, proto, address string) {
+	if !p.addrAllowed(conn.RemoteAddr().String()) {
+		logger.Infof("client %s not allowed.", conn.RemoteAddr())
+		return
+	}
+	if _, port, _ := net.SplitHostPort(address); port == "53" && p.DnsHijack != nil {
+		logger.Infof("dns from %s to %s hijacked.", conn.RemoteAddr(), address)
+		p.DnsHijack(conn)
+		return
+	}
+	conn, sr := p.acceptRelay(conn, "", proto, address)
+	sr.Method = "CONNECT"
+	p.connectRelay(conn, address, sr, func(rep byte, bound net.Addr) error {
+		return nil
+	})
+}
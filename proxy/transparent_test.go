@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestTransparentDirect(t *testing.T) {
+	if _, err := netutil.ListenTransparent("127.0.0.1:0", "nat"); err != netutil.ErrTransparentMode {
+		t.Fatal("wrong mode accepted")
+	}
+	// TPROXY can't be listened without CAP_NET_ADMIN, a plain listener
+	// works the same for connections not redirected.
+	for _, mode := range []string{netutil.TRANSPARENT_REDIRECT, netutil.TRANSPARENT_TPROXY} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		p := NewProxy(netutil.DefaultTcpDialer, "", "")
+		p.Stats = NewHostStats()
+		go p.ServeTransparent(listener, mode)
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+			t.Fatalf("%s: relayed to itself", mode)
+		}
+		if len(p.Stats.Top(0)) != 0 {
+			t.Fatalf("%s: relayed to itself", mode)
+		}
+	}
+}
+
+func TestLooped(t *testing.T) {
+	laddr := &net.TCPAddr{IP: net.IPv4zero, Port: 1080}
+	for address, want := range map[string]bool{
+		"127.0.0.1:1080":   true,
+		"[::1]:1080":       true,
+		"127.0.0.1:80":     false,
+		"93.184.216.34:80": false,
+		"example.com:1080": false,
+	} {
+		if looped(address, laddr) != want {
+			t.Errorf("%s looped should be %v", address, want)
+		}
+	}
+}
+
+func TestRelayDnsHijack(t *testing.T) {
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.DnsHijack = func(conn net.Conn) {
+		conn.Write([]byte("dns"))
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.Relay(server, "TUN", "8.8.8.8:53")
+		server.Close()
+	}()
+	buf, err := io.ReadAll(client)
+	if err != nil || string(buf) != "dns" {
+		t.Fatalf("not hijacked: %q %v", buf, err)
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// headerHasToken tells if comma separated values of header has token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isUpgrade tells if request asks to switch protocol, like websocket or
+// h2c.
+func isUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" &&
+		headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+// sendUpgrade sends request in a new connection by dialer named, and
+// reads response. Data after response are in dstbuf.
+func (p *Proxy) sendUpgrade(req *http.Request, name string) (dstconn net.Conn, dstbuf *bufio.Reader, resp *http.Response, err error) {
+	address := req.URL.Host
+	if req.URL.Port() == "" {
+		if req.URL.Scheme == "https" {
+			address = net.JoinHostPort(req.URL.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	dstconn, err = netutil.DialContext(req.Context(), p.dialerOf(name), "tcp", address)
+	if err != nil {
+		return
+	}
+	if req.URL.Scheme == "https" {
+		config := &tls.Config{}
+		if p.transport.TLSClientConfig != nil {
+			config = p.transport.TLSClientConfig.Clone()
+		}
+		config.ServerName = req.URL.Hostname()
+		config.NextProtos = []string{"http/1.1"}
+		dstconn = tls.Client(dstconn, config)
+	}
+
+	protocol := req.Header.Get("Upgrade")
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	err = req.Write(dstconn)
+	if err != nil {
+		dstconn.Close()
+		return
+	}
+	dstbuf = bufio.NewReader(dstconn)
+	resp, err = http.ReadResponse(dstbuf, req)
+	if err != nil {
+		dstconn.Close()
+		return
+	}
+	return
+}
+
+// upgrade sends request in a new connection by dialer named. If server
+// switches protocol, client and server are relayed as they are after
+// that, otherwise response is sent back and connection closed.
+func (p *Proxy) upgrade(w http.ResponseWriter, req *http.Request, name string) {
+	protocol := req.Header.Get("Upgrade")
+	dstconn, dstbuf, resp, err := p.sendUpgrade(req, name)
+	if err != nil {
+		logger.Errorf("upgrade failed: %s", err.Error())
+		p.errorPage(w, req, 502, REASON_SERVER, nil, err)
+		return
+	}
+	defer dstconn.Close()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for _, h := range hopHeaders {
+			resp.Header.Del(h)
+		}
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		netutil.Copy(w, resp.Body)
+		return
+	}
+
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Error("httpserver does not support hijacking")
+		return
+	}
+	srcconn, srcbuf, err := hij.Hijack()
+	if err != nil {
+		logger.Errorf("Cannot hijack connection: %s", err.Error())
+		return
+	}
+	defer srcconn.Close()
+	logger.Infof("%s switched to %s.", req.URL, protocol)
+
+	err = resp.Write(srcconn)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	// bytes read ahead in buffers go first.
+	if n := dstbuf.Buffered(); n > 0 {
+		b, _ := dstbuf.Peek(n)
+		srcconn.Write(b)
+	}
+	if n := srcbuf.Reader.Buffered(); n > 0 {
+		b, _ := srcbuf.Reader.Peek(n)
+		dstconn.Write(b)
+	}
+
+	sent, recv, _ := netutil.RelayHalf(srcconn, dstconn)
+	setAccess(w, http.StatusSwitchingProtocols, sent, recv)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// echoUpgrade switches to protocol echo, reads until client closed
+// writing, then sends all back in upper case.
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		http.Error(w, "no upgrade", http.StatusBadRequest)
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	buf.Flush()
+	data, _ := ioutil.ReadAll(buf)
+	conn.Write(bytes.ToUpper(data))
+}
+
+func upgradeThrough(t *testing.T, front, target, protocol string) (conn *net.TCPConn, resp *http.Response, reader *bufio.Reader) {
+	raw, err := net.Dial("tcp", front)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = raw.(*net.TCPConn)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive, Upgrade\r\nUpgrade: %s\r\n\r\n",
+		target, front, protocol)
+	reader = bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestUpgrade(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer origin.Close()
+	p := NewProxy(netutil.DefaultTcpDialer, "", "")
+	front := httptest.NewServer(p)
+	defer front.Close()
+	frontAddr := front.Listener.Addr().String()
+
+	conn, resp, reader := upgradeThrough(t, frontAddr, origin.URL+"/ws", "echo")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("not switched: %d", resp.StatusCode)
+	}
+	conn.Write([]byte("hello"))
+	// reply comes after half close.
+	conn.CloseWrite()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "HELLO" {
+		t.Fatalf("wrong reply: %q", data)
+	}
+
+	// refused upgrade is sent back as it is.
+	conn2, resp, _ := upgradeThrough(t, frontAddr, origin.URL+"/ws", "h2c")
+	defer conn2.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("wrong status: %d", resp.StatusCode)
+	}
+}
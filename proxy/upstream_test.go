@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// fakeUpstream is http proxy needs user:pass, it forwards plain http
+// only if forward set. It counts requests forwarded and tunneled.
+type fakeUpstream struct {
+	forward   bool
+	forwarded int32
+	tunneled  int32
+}
+
+func (fu *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := ParseBasicAuth(r)
+	if !ok || username != "user" || password != "pass" || (r.Method != "CONNECT" && !fu.forward) {
+		w.Header().Set("Proxy-Authenticate", "Basic realm=\"corp\"")
+		http.Error(w, http.StatusText(407), 407)
+		return
+	}
+	if r.Method != "CONNECT" {
+		atomic.AddInt32(&fu.forwarded, 1)
+		outreq := r.Clone(r.Context())
+		outreq.RequestURI = ""
+		outreq.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(outreq)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		netutil.Copy(w, resp.Body)
+		return
+	}
+
+	atomic.AddInt32(&fu.tunneled, 1)
+	dstconn, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	srcconn, _, _ := w.(http.Hijacker).Hijack()
+	srcconn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	netutil.Relay(srcconn, dstconn)
+}
+
+func upstreamProxy(t *testing.T, forward bool) (fu *fakeUpstream, p *Proxy, closer func()) {
+	fu = &fakeUpstream{forward: forward}
+	upstream := httptest.NewServer(fu)
+	addr := upstream.Listener.Addr().String()
+
+	p = NewProxy(netutil.DefaultTcpDialer, "", "")
+	p.SetDialer("corp", netutil.NewHttpConnectDialer(netutil.DefaultTcpDialer, addr, "user", "pass"))
+	err := p.SetUpstream("corp", netutil.DefaultTcpDialer, "http://user:pass@"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Rules = []Rule{{Dialer: "corp"}}
+	return fu, p, upstream.Close
+}
+
+func TestUpstreamForward(t *testing.T) {
+	origin := newBackend("origin")
+	defer origin.Close()
+	fu, p, closer := upstreamProxy(t, true)
+	defer closer()
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", origin.URL+"/x", nil))
+	if w.Code != 200 || fu.forwarded != 1 || fu.tunneled != 0 {
+		t.Fatalf("not forwarded: %d %d %d", w.Code, fu.forwarded, fu.tunneled)
+	}
+}
+
+func TestUpstreamAuthTunnel(t *testing.T) {
+	origin := newBackend("origin")
+	defer origin.Close()
+	fu, p, closer := upstreamProxy(t, false)
+	defer closer()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", origin.URL+"/x", nil))
+		if w.Code != 200 {
+			t.Fatalf("407 not handled: %d", w.Code)
+		}
+	}
+	// the second goes by tunnel directly, in the same connection.
+	if fu.forwarded != 0 || fu.tunneled != 1 {
+		t.Fatalf("wrong path: %d %d", fu.forwarded, fu.tunneled)
+	}
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	REDIS_TIMEOUT = 5 * time.Second
+)
+
+// Redis is a minimal redis client, enough for a Store.
+// Connection is created on demand, and recreated after any error.
+type Redis struct {
+	lock     sync.Mutex
+	addr     string
+	password string
+	db       int
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func NewRedis(addr, password string, db int) (r *Redis) {
+	return &Redis{
+		addr:     addr,
+		password: password,
+		db:       db,
+	}
+}
+
+// lock must be held.
+func (r *Redis) connect() (err error) {
+	conn, err := net.DialTimeout("tcp", r.addr, REDIS_TIMEOUT)
+	if err != nil {
+		return
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+
+	if r.password != "" {
+		_, err = r.do("AUTH", r.password)
+		if err != nil {
+			r.close()
+			return
+		}
+	}
+	if r.db != 0 {
+		_, err = r.do("SELECT", strconv.Itoa(r.db))
+		if err != nil {
+			r.close()
+			return
+		}
+	}
+	logger.Infof("redis %s connected.", r.addr)
+	return
+}
+
+// lock must be held.
+func (r *Redis) close() {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.conn = nil
+	r.reader = nil
+}
+
+func (r *Redis) Do(args ...string) (reply interface{}, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conn == nil {
+		err = r.connect()
+		if err != nil {
+			return
+		}
+	}
+
+	reply, err = r.do(args...)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		// connection broken, drop it.
+		r.close()
+	}
+	return
+}
+
+// lock must be held.
+func (r *Redis) do(args ...string) (reply interface{}, err error) {
+	r.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+	defer r.conn.SetDeadline(time.Time{})
+
+	buf := bufio.NewWriter(r.conn)
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	err = buf.Flush()
+	if err != nil {
+		return
+	}
+	return readReply(r.reader)
+}
+
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func readLine(reader *bufio.Reader) (line string, err error) {
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		err = ErrProtocol
+		return
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply returns string, int64, nil, []interface{} or RedisError.
+func readReply(reader *bufio.Reader) (reply interface{}, err error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		var size int
+		size, err = strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return
+		}
+		b := make([]byte, size+2)
+		_, err = io.ReadFull(reader, b)
+		if err != nil {
+			return
+		}
+		return string(b[:size]), nil
+	case '*':
+		var size int
+		size, err = strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return
+		}
+		replies := make([]interface{}, size)
+		for i := range replies {
+			replies[i], err = readReply(reader)
+			if _, ok := err.(RedisError); err != nil && !ok {
+				return
+			}
+		}
+		return replies, nil
+	}
+	return nil, ErrProtocol
+}
+
+func (r *Redis) Get(key string) (value string, ok bool, err error) {
+	reply, err := r.Do("GET", key)
+	if err != nil || reply == nil {
+		return
+	}
+	value, ok = reply.(string)
+	if !ok {
+		err = ErrProtocol
+	}
+	return
+}
+
+func (r *Redis) Set(key, value string) (err error) {
+	_, err = r.Do("SET", key, value)
+	return
+}
+
+func (r *Redis) IncrBy(key string, n int64) (total int64, err error) {
+	reply, err := r.Do("INCRBY", key, strconv.FormatInt(n, 10))
+	if err != nil {
+		return
+	}
+	total, ok := reply.(int64)
+	if !ok {
+		err = ErrProtocol
+	}
+	return
+}
+
+func (r *Redis) Del(key string) (err error) {
+	_, err = r.Do("DEL", key)
+	return
+}
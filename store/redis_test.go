@@ -0,0 +1,103 @@
+package store
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		reply interface{}
+		err   error
+	}{
+		{"+OK\r\n", "OK", nil},
+		{"-ERR wrong type\r\n", nil, RedisError("ERR wrong type")},
+		{":1024\r\n", int64(1024), nil},
+		{"$3\r\nfoo\r\n", "foo", nil},
+		{"$0\r\n\r\n", "", nil},
+		{"$-1\r\n", nil, nil},
+		{"*2\r\n$3\r\nfoo\r\n:1\r\n", []interface{}{"foo", int64(1)}, nil},
+		{"*2\r\n-ERR a\r\n+OK\r\n", []interface{}{nil, "OK"}, nil},
+		{"?\r\n", nil, ErrProtocol},
+		{"+OK\n", nil, ErrProtocol},
+		{"\r\n", nil, ErrProtocol},
+	} {
+		reply, err := readReply(bufio.NewReader(strings.NewReader(c.input)))
+		if err != c.err {
+			t.Errorf("%q: err %v, want %v", c.input, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(reply, c.reply) {
+			t.Errorf("%q: reply %#v, want %#v", c.input, reply, c.reply)
+		}
+	}
+
+	for _, input := range []string{":abc\r\n", "$5\r\nfoo\r\n", "*2\r\n+OK\r\n"} {
+		_, err := readReply(bufio.NewReader(strings.NewReader(input)))
+		if err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+// fakeRedis replies commands in order, and records commands got.
+func fakeRedis(t *testing.T, replies ...string) (addr string, commands chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	commands = make(chan []string, len(replies))
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for _, reply := range replies {
+			// commands are sent as array of bulk strings.
+			cmd, err := readReply(reader)
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, arg := range cmd.([]interface{}) {
+				args = append(args, arg.(string))
+			}
+			commands <- args
+			conn.Write([]byte(reply))
+		}
+	}()
+	return listener.Addr().String(), commands
+}
+
+func TestRedis(t *testing.T) {
+	addr, commands := fakeRedis(t, "+OK\r\n", "+OK\r\n", ":42\r\n", "$-1\r\n")
+	r := NewRedis(addr, "secret", 2)
+
+	total, err := r.IncrBy("key", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 42 {
+		t.Fatalf("total: %d", total)
+	}
+	_, ok, err := r.Get("none")
+	if err != nil || ok {
+		t.Fatalf("get none: %v %v", ok, err)
+	}
+
+	for _, want := range [][]string{
+		{"AUTH", "secret"}, {"SELECT", "2"},
+		{"INCRBY", "key", "40"}, {"GET", "none"},
+	} {
+		if cmd := <-commands; !reflect.DeepEqual(cmd, want) {
+			t.Fatalf("command %q, want %q", cmd, want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	logging "github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("store")
+
+var (
+	ErrProtocol = errors.New("store protocol error.")
+)
+
+// Store keeps state shared by several servers, like user passwords
+// and usage counters.
+type Store interface {
+	Get(key string) (value string, ok bool, err error)
+	Set(key, value string) error
+	IncrBy(key string, n int64) (total int64, err error)
+	Del(key string) error
+}
+
+// MemStore keeps everything in memory, shared by nobody.
+type MemStore struct {
+	lock   sync.Mutex
+	values map[string]string
+}
+
+func NewMemStore() (ms *MemStore) {
+	return &MemStore{
+		values: make(map[string]string, 0),
+	}
+}
+
+func (ms *MemStore) Get(key string) (value string, ok bool, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	value, ok = ms.values[key]
+	return
+}
+
+func (ms *MemStore) Set(key, value string) (err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.values[key] = value
+	return
+}
+
+func (ms *MemStore) IncrBy(key string, n int64) (total int64, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if value, ok := ms.values[key]; ok {
+		total, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	total += n
+	ms.values[key] = strconv.FormatInt(total, 10)
+	return
+}
+
+func (ms *MemStore) Del(key string) (err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.values, key)
+	return
+}
@@ -0,0 +1,19 @@
+package tun
+
+import (
+	"errors"
+	"os"
+)
+
+// DEFAULT_PREFIX is address of device, in range for benchmark, not used
+// in internet.
+const DEFAULT_PREFIX = "198.18.0.1/15"
+
+var ErrNotSupported = errors.New("tun: not supported in this platform.")
+
+// Device is a tun interface, read and written by ip packets without
+// header.
+type Device struct {
+	*os.File
+	Name string
+}
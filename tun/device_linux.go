@@ -0,0 +1,77 @@
+package tun
+
+import (
+	"net/netip"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Open creates tun interface by name, like goproxy0, or the kernel names
+// it if empty. Needs CAP_NET_ADMIN.
+func Open(name string) (dev *Device, err error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr)
+	if err != nil {
+		unix.Close(fd)
+		return
+	}
+	// nonblocking fd goes to poller, so Close stops Read.
+	return &Device{File: os.NewFile(uintptr(fd), "/dev/net/tun"), Name: ifr.Name()}, nil
+}
+
+// Setup sets address of interface, and brings it up.
+func (dev *Device) Setup(prefix netip.Prefix) (err error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	defer unix.Close(fd)
+
+	ioctl := func(req uint, set func(ifr *unix.Ifreq) error) error {
+		ifr, err := unix.NewIfreq(dev.Name)
+		if err != nil {
+			return err
+		}
+		if err = set(ifr); err != nil {
+			return err
+		}
+		return unix.IoctlIfreq(fd, req, ifr)
+	}
+	addr := prefix.Addr().As4()
+	err = ioctl(unix.SIOCSIFADDR, func(ifr *unix.Ifreq) error {
+		return ifr.SetInet4Addr(addr[:])
+	})
+	if err != nil {
+		return
+	}
+	bits := ^uint32(0) << (32 - prefix.Bits())
+	netmask := [4]byte{byte(bits >> 24), byte(bits >> 16), byte(bits >> 8), byte(bits)}
+	err = ioctl(unix.SIOCSIFNETMASK, func(ifr *unix.Ifreq) error {
+		return ifr.SetInet4Addr(netmask[:])
+	})
+	if err != nil {
+		return
+	}
+	ifr, err := unix.NewIfreq(dev.Name)
+	if err != nil {
+		return
+	}
+	err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr)
+	if err != nil {
+		return
+	}
+	return ioctl(unix.SIOCSIFFLAGS, func(up *unix.Ifreq) error {
+		up.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+		return nil
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package tun
+
+import "net/netip"
+
+func Open(name string) (dev *Device, err error) {
+	return nil, ErrNotSupported
+}
+
+func (dev *Device) Setup(prefix netip.Prefix) (err error) {
+	return ErrNotSupported
+}
@@ -0,0 +1,151 @@
+package tun
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	PROTO_TCP = 6
+	PROTO_UDP = 17
+	// IPV4_HEADER is length of header built, without options.
+	IPV4_HEADER = 20
+	UDP_HEADER  = 8
+	TCP_SYN     = 0x02
+	TCP_RST     = 0x04
+)
+
+// packet is an ipv4 packet of tcp or udp, not fragmented.
+type packet struct {
+	buf []byte
+	ihl int
+}
+
+// parsePacket checks buf is ipv4 tcp or udp, and not a fragment. Others
+// are not for stack.
+func parsePacket(buf []byte) (pkt packet, ok bool) {
+	if len(buf) < IPV4_HEADER || buf[0]>>4 != 4 {
+		return
+	}
+	ihl := int(buf[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(buf[2:4]))
+	if ihl < IPV4_HEADER || total < ihl || total > len(buf) {
+		return
+	}
+	// more fragments, or offset.
+	if binary.BigEndian.Uint16(buf[6:8])&0x3fff != 0 {
+		return
+	}
+	pkt = packet{buf: buf[:total], ihl: ihl}
+	switch pkt.proto() {
+	case PROTO_TCP:
+		ok = total-ihl >= 20
+	case PROTO_UDP:
+		n := int(binary.BigEndian.Uint16(buf[ihl+4:]))
+		ok = n >= UDP_HEADER && n <= total-ihl
+	}
+	return
+}
+
+func (pkt packet) proto() byte {
+	return pkt.buf[9]
+}
+
+func (pkt packet) src() netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(pkt.buf[12:16])
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(pkt.buf[pkt.ihl:]))
+}
+
+func (pkt packet) dst() netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(pkt.buf[16:20])
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(pkt.buf[pkt.ihl+2:]))
+}
+
+// flags of tcp.
+func (pkt packet) flags() byte {
+	return pkt.buf[pkt.ihl+13]
+}
+
+// payload of udp.
+func (pkt packet) payload() []byte {
+	n := int(binary.BigEndian.Uint16(pkt.buf[pkt.ihl+4:]))
+	return pkt.buf[pkt.ihl+UDP_HEADER : pkt.ihl+n]
+}
+
+// rewrite changes addresses and ports, and fixes checksums.
+func (pkt packet) rewrite(src, dst netip.AddrPort) {
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(pkt.buf[12:16], s[:])
+	copy(pkt.buf[16:20], d[:])
+	l4 := pkt.buf[pkt.ihl:]
+	binary.BigEndian.PutUint16(l4[0:2], src.Port())
+	binary.BigEndian.PutUint16(l4[2:4], dst.Port())
+	pkt.checksum()
+}
+
+// checksum computes checksums of ip header and tcp or udp.
+func (pkt packet) checksum() {
+	binary.BigEndian.PutUint16(pkt.buf[10:12], 0)
+	binary.BigEndian.PutUint16(pkt.buf[10:12], ^fold(sum(0, pkt.buf[:pkt.ihl])))
+
+	l4 := pkt.buf[pkt.ihl:]
+	off := 16
+	if pkt.proto() == PROTO_UDP {
+		off = 6
+	}
+	binary.BigEndian.PutUint16(l4[off:], 0)
+	var pseudo [12]byte
+	copy(pseudo[0:8], pkt.buf[12:20])
+	pseudo[9] = pkt.proto()
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(l4)))
+	cs := ^fold(sum(sum(0, pseudo[:]), l4))
+	// zero means no checksum in udp.
+	if cs == 0 && pkt.proto() == PROTO_UDP {
+		cs = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[off:], cs)
+}
+
+// valid tells if checksums are right.
+func (pkt packet) valid() bool {
+	if fold(sum(0, pkt.buf[:pkt.ihl])) != 0xffff {
+		return false
+	}
+	l4 := pkt.buf[pkt.ihl:]
+	var pseudo [12]byte
+	copy(pseudo[0:8], pkt.buf[12:20])
+	pseudo[9] = pkt.proto()
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(l4)))
+	return fold(sum(sum(0, pseudo[:]), l4)) == 0xffff
+}
+
+// udpPacket builds ipv4 udp packet of payload.
+func udpPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	buf := make([]byte, IPV4_HEADER+UDP_HEADER+len(payload))
+	buf[0] = 0x45
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	buf[8] = 64
+	buf[9] = PROTO_UDP
+	binary.BigEndian.PutUint16(buf[IPV4_HEADER+4:], uint16(UDP_HEADER+len(payload)))
+	copy(buf[IPV4_HEADER+UDP_HEADER:], payload)
+	packet{buf: buf, ihl: IPV4_HEADER}.rewrite(src, dst)
+	return buf
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
@@ -0,0 +1,354 @@
+package tun
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/op/go-logging"
+	"github.com/shell909090/goproxy/netutil"
+)
+
+var logger = logging.MustGetLogger("tun")
+
+const (
+	// NAT_PORT_MIN is the first port of nat, ports of flows are
+	// allocated in turn up to 65535, not reused soon.
+	NAT_PORT_MIN = 10000
+	// TCP_TIMEOUT removes nat of tcp idle that long, and not relaying.
+	TCP_TIMEOUT = 5 * time.Minute
+	// UDP_TIMEOUT closes udp flow idle that long.
+	UDP_TIMEOUT = 2 * time.Minute
+	// UDP_QUEUE is packets waiting for udp flow dialing, more are
+	// dropped.
+	UDP_QUEUE       = 16
+	DNS_PORT        = 53
+	EXPIRE_INTERVAL = time.Minute
+	PACKET_BUFFER   = 65535
+)
+
+var ErrNatFull = errors.New("tun: nat ports exhausted.")
+
+type flowKey struct {
+	src, dst netip.AddrPort
+}
+
+// natEntry is a tcp flow from client, translated to fake:port ->
+// addr:lport, so kernel terminates it in listener.
+type natEntry struct {
+	flowKey
+	port   uint16
+	last   time.Time
+	active bool
+}
+
+// Stack terminates tcp flows read from tun device in kernel, by nat to
+// a listener in address of device, and passes connections to Handler
+// with original destination. Udp flows are dialed by dialer in
+// userspace. Only ipv4 is supported.
+type Stack struct {
+	// Handler serves connection accepted, it's closed after Handler
+	// returned. RemoteAddr of conn is the client before nat.
+	Handler func(conn net.Conn, address string)
+	// Dns answers udp queries to port 53 if not nil, instead of
+	// relaying them.
+	Dns func(query []byte) (resp []byte, err error)
+
+	dev      io.ReadWriteCloser
+	dialer   netutil.Dialer
+	fake     netip.Addr
+	laddr    netip.AddrPort
+	listener *net.TCPListener
+	done     chan struct{}
+
+	wlock sync.Mutex
+	lock  sync.Mutex
+	next  uint16
+	flows map[flowKey]*natEntry
+	ports map[uint16]*natEntry
+	udps  map[flowKey]*udpFlow
+}
+
+// NewStack creates stack on dev, addr is address of device, and fake is
+// another address routed to device, as source of connections nat-ed.
+func NewStack(dev io.ReadWriteCloser, addr, fake netip.Addr, dialer netutil.Dialer) (s *Stack, err error) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: addr.AsSlice()})
+	if err != nil {
+		return
+	}
+	s = &Stack{
+		dev:      dev,
+		dialer:   dialer,
+		fake:     fake,
+		laddr:    listener.Addr().(*net.TCPAddr).AddrPort(),
+		listener: listener,
+		done:     make(chan struct{}),
+		next:     NAT_PORT_MIN,
+		flows:    make(map[flowKey]*natEntry),
+		ports:    make(map[uint16]*natEntry),
+		udps:     make(map[flowKey]*udpFlow),
+	}
+	s.laddr = netip.AddrPortFrom(s.laddr.Addr().Unmap(), s.laddr.Port())
+	return
+}
+
+// Serve reads packets from device until it's closed, and accepts
+// connections in background.
+func (s *Stack) Serve() (err error) {
+	go s.accept()
+	go s.expire()
+	buf := make([]byte, PACKET_BUFFER)
+	for {
+		var n int
+		n, err = s.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		pkt, ok := parsePacket(buf[:n])
+		if !ok {
+			continue
+		}
+		switch pkt.proto() {
+		case PROTO_TCP:
+			s.tcp(pkt)
+		case PROTO_UDP:
+			s.udp(pkt)
+		}
+	}
+}
+
+// Close stops listener and device, udp flows are closed.
+func (s *Stack) Close() error {
+	s.lock.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.lock.Unlock()
+	s.listener.Close()
+	return s.dev.Close()
+}
+
+func (s *Stack) write(buf []byte) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	_, err := s.dev.Write(buf)
+	if err != nil {
+		logger.Debugf("tun: write: %s", err.Error())
+	}
+}
+
+// tcp translates packet from client to listener, or reply from listener
+// back to client.
+func (s *Stack) tcp(pkt packet) {
+	src, dst := pkt.src(), pkt.dst()
+	s.lock.Lock()
+	if src == s.laddr {
+		e := s.ports[dst.Port()]
+		if e == nil || dst.Addr() != s.fake {
+			s.lock.Unlock()
+			return
+		}
+		e.last = time.Now()
+		s.lock.Unlock()
+		pkt.rewrite(e.dst, e.src)
+		s.write(pkt.buf)
+		return
+	}
+
+	key := flowKey{src: src, dst: dst}
+	e := s.flows[key]
+	if e == nil {
+		// not a new flow, nat may expired.
+		if pkt.flags()&TCP_SYN == 0 {
+			s.lock.Unlock()
+			return
+		}
+		var err error
+		e, err = s.allocate(key)
+		if err != nil {
+			s.lock.Unlock()
+			logger.Errorf("tun: %s -> %s: %s", src, dst, err.Error())
+			return
+		}
+	}
+	e.last = time.Now()
+	s.lock.Unlock()
+	pkt.rewrite(netip.AddrPortFrom(s.fake, e.port), s.laddr)
+	s.write(pkt.buf)
+}
+
+// allocate finds next port not used, in lock.
+func (s *Stack) allocate(key flowKey) (e *natEntry, err error) {
+	for i := NAT_PORT_MIN; i <= 65535; i++ {
+		port := s.next
+		s.next++
+		if s.next == 0 {
+			s.next = NAT_PORT_MIN
+		}
+		if _, ok := s.ports[port]; ok {
+			continue
+		}
+		e = &natEntry{flowKey: key, port: port}
+		s.flows[key] = e
+		s.ports[port] = e
+		return
+	}
+	return nil, ErrNatFull
+}
+
+func (s *Stack) expire() {
+	ticker := time.NewTicker(EXPIRE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.lock.Lock()
+		for key, e := range s.flows {
+			if !e.active && time.Since(e.last) > TCP_TIMEOUT {
+				delete(s.flows, key)
+				delete(s.ports, e.port)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *Stack) accept() {
+	for {
+		conn, err := s.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// natConn is connection accepted, with client address before nat.
+type natConn struct {
+	*net.TCPConn
+	remote net.Addr
+}
+
+func (c *natConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (s *Stack) serve(conn *net.TCPConn) {
+	defer conn.Close()
+	raddr := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	s.lock.Lock()
+	e := s.ports[raddr.Port()]
+	if e == nil || raddr.Addr().Unmap() != s.fake || s.Handler == nil {
+		s.lock.Unlock()
+		logger.Infof("tun: connection from %s not in nat.", raddr)
+		return
+	}
+	e.active = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		e.active = false
+		e.last = time.Now()
+		s.lock.Unlock()
+	}()
+	s.Handler(&natConn{TCPConn: conn, remote: net.TCPAddrFromAddrPort(e.src)}, e.dst.String())
+}
+
+// udpFlow relays udp from a client to a destination, by a connection of
+// dialer.
+type udpFlow struct {
+	s     *Stack
+	key   flowKey
+	queue chan []byte
+	last  int64
+}
+
+func (s *Stack) udp(pkt packet) {
+	key := flowKey{src: pkt.src(), dst: pkt.dst()}
+	if s.Dns != nil && key.dst.Port() == DNS_PORT {
+		go s.answer(key, append([]byte(nil), pkt.payload()...))
+		return
+	}
+	s.lock.Lock()
+	f := s.udps[key]
+	if f == nil {
+		f = &udpFlow{s: s, key: key, queue: make(chan []byte, UDP_QUEUE)}
+		s.udps[key] = f
+		go f.run()
+	}
+	s.lock.Unlock()
+	select {
+	case f.queue <- append([]byte(nil), pkt.payload()...):
+	default:
+		logger.Debugf("tun: udp %s -> %s dropped.", key.src, key.dst)
+	}
+}
+
+// answer replies query by Dns.
+func (s *Stack) answer(key flowKey, query []byte) {
+	resp, err := s.Dns(query)
+	if err != nil {
+		logger.Errorf("tun: dns from %s: %s", key.src, err.Error())
+		return
+	}
+	s.write(udpPacket(key.dst, key.src, resp))
+}
+
+func (f *udpFlow) run() {
+	defer func() {
+		f.s.lock.Lock()
+		delete(f.s.udps, f.key)
+		f.s.lock.Unlock()
+	}()
+	conn, err := f.s.dialer.Dial("udp", f.key.dst.String())
+	if err != nil {
+		logger.Errorf("tun: udp %s: %s", f.key.dst, err.Error())
+		return
+	}
+	defer conn.Close()
+	logger.Debugf("tun: udp %s -> %s relaying.", f.key.src, f.key.dst)
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+	go f.recv(conn)
+
+	ticker := time.NewTicker(UDP_TIMEOUT / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case b := <-f.queue:
+			atomic.StoreInt64(&f.last, time.Now().UnixNano())
+			_, err = conn.Write(b)
+			if err != nil {
+				logger.Debugf("tun: udp %s: %s", f.key.dst, err.Error())
+				return
+			}
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&f.last))) > UDP_TIMEOUT {
+				return
+			}
+		case <-f.s.done:
+			return
+		}
+	}
+}
+
+// recv writes replies back to client, until connection closed.
+func (f *udpFlow) recv(conn net.Conn) {
+	buf := make([]byte, PACKET_BUFFER)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&f.last, time.Now().UnixNano())
+		f.s.write(udpPacket(f.key.dst, f.key.src, buf[:n]))
+	}
+}
@@ -0,0 +1,167 @@
+package tun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// fakeDevice reads packets from in, and writes to out.
+type fakeDevice struct {
+	in   chan []byte
+	out  chan []byte
+	done chan struct{}
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{
+		in:   make(chan []byte, 16),
+		out:  make(chan []byte, 16),
+		done: make(chan struct{}),
+	}
+}
+
+func (d *fakeDevice) Read(b []byte) (n int, err error) {
+	select {
+	case pkt := <-d.in:
+		return copy(b, pkt), nil
+	case <-d.done:
+		return 0, io.EOF
+	}
+}
+
+func (d *fakeDevice) Write(b []byte) (n int, err error) {
+	d.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (d *fakeDevice) Close() error {
+	close(d.done)
+	return nil
+}
+
+func (d *fakeDevice) read(t *testing.T) packet {
+	select {
+	case buf := <-d.out:
+		pkt, ok := parsePacket(buf)
+		if !ok || !pkt.valid() {
+			t.Fatalf("wrong packet: %v", buf)
+		}
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet written")
+	}
+	return packet{}
+}
+
+// tcpPacket builds ipv4 tcp packet without payload.
+func tcpPacket(src, dst netip.AddrPort, flags byte) []byte {
+	buf := make([]byte, IPV4_HEADER+20)
+	buf[0] = 0x45
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	buf[8] = 64
+	buf[9] = PROTO_TCP
+	buf[IPV4_HEADER+12] = 5 << 4
+	buf[IPV4_HEADER+13] = flags
+	packet{buf: buf, ihl: IPV4_HEADER}.rewrite(src, dst)
+	return buf
+}
+
+func testStack(t *testing.T) (s *Stack, dev *fakeDevice) {
+	dev = newFakeDevice()
+	s, err := NewStack(dev, netip.MustParseAddr("127.0.0.1"),
+		netip.MustParseAddr("127.0.0.2"), netutil.DefaultTcpDialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return
+}
+
+func TestTcpNat(t *testing.T) {
+	s, dev := testStack(t)
+	defer s.Close()
+	got := make(chan string, 1)
+	s.Handler = func(conn net.Conn, address string) {
+		got <- conn.RemoteAddr().String() + " " + address
+	}
+
+	client := netip.MustParseAddrPort("10.0.0.1:1234")
+	server := netip.MustParseAddrPort("1.2.3.4:80")
+	dev.in <- tcpPacket(client, server, 0)
+	dev.in <- tcpPacket(client, server, TCP_SYN)
+	pkt := dev.read(t)
+	if pkt.dst() != s.laddr || pkt.src().Addr() != s.fake {
+		t.Fatalf("not translated: %s -> %s", pkt.src(), pkt.dst())
+	}
+	port := pkt.src().Port()
+
+	dev.in <- tcpPacket(s.laddr, netip.AddrPortFrom(s.fake, port), TCP_SYN)
+	pkt = dev.read(t)
+	if pkt.src() != server || pkt.dst() != client {
+		t.Fatalf("reply not translated: %s -> %s", pkt.src(), pkt.dst())
+	}
+
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: int(port)}}
+	conn, err := d.Dial("tcp", s.laddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case r := <-got:
+		if r != "10.0.0.1:1234 1.2.3.4:80" {
+			t.Fatalf("wrong destination: %s", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not handled")
+	}
+}
+
+func TestUdpRelay(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	s, dev := testStack(t)
+	defer s.Close()
+
+	client := netip.MustParseAddrPort("10.0.0.1:5000")
+	server := echo.LocalAddr().(*net.UDPAddr).AddrPort()
+	dev.in <- udpPacket(client, server, []byte("ping"))
+	pkt := dev.read(t)
+	if pkt.src() != server || pkt.dst() != client || string(pkt.payload()) != "ping" {
+		t.Fatalf("wrong reply: %s -> %s %q", pkt.src(), pkt.dst(), pkt.payload())
+	}
+}
+
+func TestDnsHijack(t *testing.T) {
+	s, dev := testStack(t)
+	defer s.Close()
+	s.Dns = func(query []byte) (resp []byte, err error) {
+		return append(query, "-answer"...), nil
+	}
+	client := netip.MustParseAddrPort("10.0.0.1:5000")
+	server := netip.MustParseAddrPort("8.8.8.8:53")
+	dev.in <- udpPacket(client, server, []byte("query"))
+	pkt := dev.read(t)
+	if pkt.src() != server || pkt.dst() != client || string(pkt.payload()) != "query-answer" {
+		t.Fatalf("wrong answer: %s -> %s %q", pkt.src(), pkt.dst(), pkt.payload())
+	}
+}
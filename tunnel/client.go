@@ -1,8 +1,11 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
@@ -14,6 +17,10 @@ type DialerCreator struct {
 	serveraddr string
 	username   string
 	password   string
+	// TotpSecret makes one time password sent in auth if not nil.
+	TotpSecret []byte
+	lock       sync.Mutex
+	laststep   uint64 // totp step used last time
 }
 
 func NewDialerCreator(raw netutil.Dialer, network, serveraddr, username, password string) (dc *DialerCreator) {
@@ -26,7 +33,36 @@ func NewDialerCreator(raw netutil.Dialer, network, serveraddr, username, passwor
 	}
 }
 
+// otpStep returns totp step to use at now, and time to wait for it if
+// step of now has been used.
+func otpStep(now time.Time, laststep uint64) (step uint64, wait time.Duration) {
+	step = uint64(now.Unix()) / TOTP_STEP
+	if step > laststep {
+		return
+	}
+	step = laststep + 1
+	return step, time.Unix(int64(step*TOTP_STEP), 0).Sub(now)
+}
+
+// nextOtp returns code of a step not used yet. Server takes each code
+// only once, so it waits for next step if this one used.
+func (dc *DialerCreator) nextOtp() string {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	step, wait := otpStep(time.Now(), dc.laststep)
+	if wait > 0 {
+		logger.Infof("totp code used, wait %s for next one.", wait)
+		time.Sleep(wait)
+	}
+	dc.laststep = step
+	return totpAt(dc.TotpSecret, step)
+}
+
 func (dc *DialerCreator) Create() (client *Client, err error) {
+	var otp string
+	if dc.TotpSecret != nil {
+		otp = dc.nextOtp()
+	}
 	logger.Noticef("msocks try to connect %s.", dc.serveraddr)
 
 	conn, err := dc.Dialer.Dial(dc.network, dc.serveraddr)
@@ -41,13 +77,14 @@ func (dc *DialerCreator) Create() (client *Client, err error) {
 	defer ti.Stop()
 
 	if dc.username != "" || dc.password != "" {
-		logger.Noticef("auth with username: %s, password: %s.",
-			dc.username, dc.password)
+		logger.Noticef("auth with username: %s.", dc.username)
 	}
 
 	auth := Auth{
 		Username: dc.username,
 		Password: dc.password,
+		Otp:      otp,
+		Features: FEATURES,
 	}
 	err = WriteFrame(conn, MSG_AUTH, 0, &auth)
 	if err != nil {
@@ -63,13 +100,14 @@ func (dc *DialerCreator) Create() (client *Client, err error) {
 	if frslt.Header.Type != MSG_RESULT {
 		return nil, ErrUnexpectedPkg
 	}
-	if errno != ERR_NONE {
+	if errno.Errno() != ERR_NONE {
 		conn.Close()
-		return nil, fmt.Errorf("create connection failed with code: %d.", errno)
+		return nil, fmt.Errorf("create connection failed with code: %d.", errno.Errno())
 	}
 
 	logger.Notice("auth passed.")
 	client = NewClient(conn)
+	client.Features = errno.Features()
 	return
 }
 
@@ -86,6 +124,10 @@ func NewClient(conn net.Conn) (client *Client) {
 }
 
 func (client *Client) Dial(network, address string) (conn net.Conn, err error) {
+	return client.DialContext(context.Background(), network, address)
+}
+
+func (client *Client) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
 	c := NewConn(client.Fabric)
 	c.streamid, err = client.Fabric.PutIntoNextId(c)
 	if err != nil {
@@ -94,12 +136,16 @@ func (client *Client) Dial(network, address string) (conn net.Conn, err error) {
 
 	logger.Debugf("%s try to dial %s:%s.", client.String(), network, address)
 
-	err = c.Connect(network, address)
+	err = c.ConnectContext(ctx, network, address)
 	if err != nil {
 		logger.Error(err.Error())
+		return nil, err
 	}
 	logger.Infof("%s connected.", c.String())
 	conn = c
+	if strings.HasPrefix(network, "udp") {
+		conn = netutil.NewPacketConn(c)
+	}
 	return
 }
 
@@ -1,10 +1,12 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
@@ -20,14 +22,20 @@ func (a *Addr) String() (s string) {
 }
 
 func RecvWithTimeout(ch chan uint32, t time.Duration) (errno uint32) {
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	defer cancel()
+	return RecvWithContext(ctx, ch)
+}
+
+// RecvWithContext returns ERR_TIMEOUT if ctx done before errno recved.
+func RecvWithContext(ctx context.Context, ch chan uint32) (errno uint32) {
 	var ok bool
-	ch_timeout := time.After(t)
 	select {
 	case errno, ok = <-ch:
 		if !ok {
 			return ERR_CLOSED
 		}
-	case <-ch_timeout:
+	case <-ctx.Done():
 		return ERR_TIMEOUT
 	}
 	return
@@ -43,10 +51,16 @@ type Conn struct {
 	ch_syn    chan uint32
 	t_closing *time.Timer
 
+	r_buf  []byte
 	r_rest []byte
+	r_size int32
+	recved int64
+	sent   int64
+	hstat  *HostCounter
 	rqueue *Queue
 	window int32
 	wev    *sync.Cond
+	class  Classifier
 
 	Network string
 	Address string
@@ -89,9 +103,39 @@ func (c *Conn) GetTarget() (s string) {
 	return fmt.Sprintf("%s:%s", c.Network, c.Address)
 }
 
+func (c *Conn) GetBytesRecv() int64 {
+	// used by manager
+	return atomic.LoadInt64(&c.recved)
+}
+
+func (c *Conn) GetBytesSent() int64 {
+	// used by manager
+	return atomic.LoadInt64(&c.sent)
+}
+
+// IsInteractive tells if stream looks like interactive traffic,
+// which is sent before bulk traffic.
+func (c *Conn) IsInteractive() bool {
+	// used by manager
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.interactive()
+}
+
+// lock must be held.
+func (c *Conn) interactive() bool {
+	return atomic.LoadInt64(&c.recved) > 0 && c.class.Interactive()
+}
+
 func (c *Conn) Connect(network, address string) (err error) {
+	return c.ConnectContext(context.Background(), network, address)
+}
+
+// ConnectContext waits result of syn for DIAL_TIMEOUT, or until ctx done.
+func (c *Conn) ConnectContext(ctx context.Context, network, address string) (err error) {
 	c.Network = network
 	c.Address = address
+	c.hstat = DefaultHostStats.Get(address)
 
 	c.ch_syn = make(chan uint32, 0)
 	defer func() {
@@ -114,7 +158,9 @@ func (c *Conn) Connect(network, address string) (err error) {
 		return
 	}
 
-	errno := RecvWithTimeout(c.ch_syn, DIAL_TIMEOUT*time.Millisecond)
+	ctx, cancel := context.WithTimeout(ctx, DIAL_TIMEOUT*time.Millisecond)
+	defer cancel()
+	errno := RecvWithContext(ctx, c.ch_syn)
 
 	if errno != ERR_NONE {
 		errtxt, ok := ErrnoText[errno]
@@ -125,7 +171,10 @@ func (c *Conn) Connect(network, address string) (err error) {
 			"%s connect %s:%s failed for %s",
 			c.String(), network, address, errtxt)
 		c.Final()
-		return
+		if errno == ERR_TIMEOUT && ctx.Err() == context.Canceled {
+			return ctx.Err()
+		}
+		return fmt.Errorf("connect %s failed for %s.", address, errtxt)
 	}
 	err = c.CheckAndSetStatus(ST_SYN_SENT, ST_EST)
 	return
@@ -171,39 +220,96 @@ func (c *Conn) CheckAndSetStatus(old uint8, new uint8) (err error) {
 }
 
 func (c *Conn) Read(data []byte) (n int, err error) {
-	var v interface{}
 	target := data[:]
 	for len(target) > 0 {
 		if c.r_rest == nil {
 			// when data isn't empty, reader should return.
 			// when it is empty, reader should be blocked in here.
-			v, err = c.rqueue.Pop(n == 0)
+			var ok bool
+			ok, err = c.nextChunk(n == 0)
 			if err != nil {
 				return
 			}
-
-			if v == nil {
-				// when rqueue not blocked
-				// it will return v=nil, err=nil
+			if !ok {
 				break
 			}
-			c.r_rest = v.([]byte)
 		}
 
 		size := copy(target, c.r_rest)
 		target = target[size:]
 		n += size
+		c.consume(size)
+	}
 
-		if len(c.r_rest) > size {
-			c.r_rest = c.r_rest[size:]
-		} else {
-			// take all data in rest
-			c.r_rest = nil
+	logger.Debugf("%s readed %d bytes.", c.String(), n)
+	err = c.ackWindow(n)
+	return
+}
+
+// DrainTo writes received data to w chunk by chunk, without copying it
+// into a buffer first. Window is given back only after w took the data,
+// so a slow writer keeps the peer waiting instead of queuing more.
+func (c *Conn) DrainTo(w io.Writer) (written int64, err error) {
+	for {
+		if c.r_rest == nil {
+			_, err = c.nextChunk(true)
+			switch err {
+			case io.EOF:
+				err = nil
+				return
+			case nil:
+			default:
+				return
+			}
+		}
+
+		var n int
+		n, err = w.Write(c.r_rest)
+		written += int64(n)
+		c.consume(n)
+		if err != nil {
+			return
+		}
+
+		err = c.ackWindow(n)
+		if err != nil {
+			return
 		}
 	}
+}
 
-	logger.Debugf("%s readed %d bytes.", c.String(), n)
+// nextChunk takes the next received buffer from rqueue.
+// ok is false if nothing queued and block is false.
+func (c *Conn) nextChunk(block bool) (ok bool, err error) {
+	v, err := c.rqueue.Pop(block)
+	if err != nil {
+		return
+	}
+	if v == nil {
+		// when rqueue not blocked
+		// it will return v=nil, err=nil
+		return
+	}
+	c.r_buf = v.([]byte)
+	c.r_rest = c.r_buf
+	return true, nil
+}
+
+// consume drops size bytes from the chunk in reading. The buffer goes back
+// to pool when it is all taken.
+func (c *Conn) consume(size int) {
+	atomic.AddInt32(&c.r_size, -int32(size))
+	if len(c.r_rest) > size {
+		c.r_rest = c.r_rest[size:]
+		return
+	}
+	// take all data in rest
+	freeData(c.r_buf)
+	c.r_buf = nil
+	c.r_rest = nil
+}
 
+func (c *Conn) ackWindow(n int) (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -266,12 +372,18 @@ func (c *Conn) writeSlice(data []byte) (err error) {
 		c.wev.Wait()
 	}
 
-	err = c.fab.SendFrame(fdata)
+	c.class.Add(len(data))
+	err = c.fab.SendFramePriority(fdata, !c.interactive())
 	if err != nil {
 		return
 	}
 
 	c.window -= int32(len(data))
+	atomic.AddInt64(&c.sent, int64(len(data)))
+	atomic.AddInt64(&c.fab.sent, int64(len(data)))
+	if c.hstat != nil {
+		c.hstat.AddSent(len(data))
+	}
 	return
 }
 
@@ -290,6 +402,16 @@ func (c *Conn) Reset() {
 	}
 }
 
+// Kill resets the stream on both sides, no matter what status it in.
+func (c *Conn) Kill() {
+	err := SendFrame(c.fab, MSG_RST, c.streamid, nil)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	logger.Noticef("%s killed.", c.String())
+	c.Reset()
+}
+
 func (c *Conn) Final() {
 	err := c.fab.CloseFiber(c.streamid)
 	if err != nil {
@@ -412,16 +534,34 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 		}
 
 	case MSG_DATA:
+		// peer should never send more than the window we gave.
+		size := len(f.Data)
+		// only this stream is reset, others in fabric go on.
+		if atomic.AddInt32(&c.r_size, int32(size)) > WINDOWSIZE {
+			atomic.AddInt32(&c.r_size, -int32(size))
+			f.free()
+			logger.Errorf("%s: %s", c.String(), ErrWindowOverflow.Error())
+			c.Kill()
+			return
+		}
+
 		err = c.rqueue.Push(f.Data)
 		switch err {
 		default:
 			return
 		case io.ErrClosedPipe:
 			// Drop data here
+			atomic.AddInt32(&c.r_size, -int32(size))
+			f.free()
 			err = nil
 		case nil:
 		}
-		logger.Debugf("%s recved %d bytes.", c.String(), len(f.Data))
+		atomic.AddInt64(&c.recved, int64(size))
+		atomic.AddInt64(&c.fab.recved, int64(size))
+		if c.hstat != nil {
+			c.hstat.AddRecv(size)
+		}
+		logger.Debugf("%s recved %d bytes.", c.String(), size)
 
 	case MSG_WND:
 		var window Wnd
@@ -430,6 +570,8 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 			return
 		}
 
+		f.free()
+
 		c.lock.Lock()
 		c.window += int32(window)
 		c.wev.Signal()
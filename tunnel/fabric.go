@@ -1,29 +1,44 @@
 package tunnel
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Fabric struct {
+	// bytes of all streams, first for atomic alignment.
+	sent   int64
+	recved int64
 	net.Conn
 	startTime time.Time
-	wlock     sync.Mutex
+	idleSince time.Time // last time weaves became empty
+	wlock     *PriorityLock
+	wbuf      bytes.Buffer
 	closed    bool
 	plock     sync.RWMutex
 	next_id   uint16
 	weaves    map[uint16]Fiber
 	dft_fiber Fiber
+	ch_pong   chan struct{}
+	pinglock  sync.Mutex
+	// Features are what peer supports, from auth.
+	Features uint32
+	// Username is the user authed for this fabric, on server side.
+	Username string
 }
 
 func NewFabric(conn net.Conn, next_id uint16) (fab *Fabric) {
 	fab = &Fabric{
 		Conn:      conn,
 		startTime: time.Now(),
+		idleSince: time.Now(),
+		wlock:     NewPriorityLock(),
 		closed:    false,
 		next_id:   next_id,
 		weaves:    make(map[uint16]Fiber, 0),
@@ -43,6 +58,25 @@ func (fab *Fabric) Uptime() (d time.Duration) {
 	return d
 }
 
+// Idle returns how long fabric has no stream, zero if it has any.
+func (fab *Fabric) Idle() time.Duration {
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
+	if len(fab.weaves) != 0 {
+		return 0
+	}
+	return time.Since(fab.idleSince)
+}
+
+// GetBytesSent and GetBytesRecv count data of all streams ever in fabric.
+func (fab *Fabric) GetBytesSent() int64 {
+	return atomic.LoadInt64(&fab.sent)
+}
+
+func (fab *Fabric) GetBytesRecv() int64 {
+	return atomic.LoadInt64(&fab.recved)
+}
+
 func (fab *Fabric) GetSize() int {
 	fab.plock.Lock()
 	defer fab.plock.Unlock()
@@ -107,26 +141,85 @@ func (fab *Fabric) PutIntoId(id uint16, f Fiber) (err error) {
 }
 
 func (fab *Fabric) SendFrame(f *Frame) (err error) {
-	logger.Debugf("sent %s", f.Debug())
+	return fab.SendFramePriority(f, false)
+}
 
-	b := f.Pack()
+// SendFramePriority sends frame, bulk frames wait until all others sent.
+func (fab *Fabric) SendFramePriority(f *Frame, bulk bool) (err error) {
+	logger.Debugf("sent %s", f.Debug())
 
-	fab.wlock.Lock()
+	// pack into a buffer owned by fabric, a stream hold no write buffer.
+	fab.wlock.Lock(bulk)
+	fab.wbuf.Reset()
+	f.PackInto(&fab.wbuf)
+	size := fab.wbuf.Len()
 	fab.Conn.SetWriteDeadline(
 		time.Now().Add(WRITE_TIMEOUT * time.Millisecond))
-	n, err := fab.Conn.Write(b)
+	n, err := fab.Conn.Write(fab.wbuf.Bytes())
 	fab.wlock.Unlock()
 
 	if err != nil {
 		return
 	}
-	if n != len(b) {
+	if n != size {
 		return io.ErrShortWrite
 	}
-	logger.Debugf("%s wrote len(%d).", fab.String(), len(b))
+	logger.Debugf("%s wrote len(%d).", fab.String(), size)
 	return
 }
 
+// Ping sends a ping to the other side and waits for pong.
+// A session which can't answer in PING_TIMEOUT should be thrown away.
+// Pings are sent one by one, so they won't take pong of each other.
+func (fab *Fabric) Ping() (err error) {
+	if fab.Features&FEATURE_PING == 0 {
+		return ErrPingNotSupport
+	}
+	fab.pinglock.Lock()
+	defer fab.pinglock.Unlock()
+
+	ch := make(chan struct{}, 1)
+	fab.plock.Lock()
+	fab.ch_pong = ch
+	fab.plock.Unlock()
+
+	start := time.Now()
+	err = SendFrame(fab, MSG_PING, 0, nil)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(PING_TIMEOUT * time.Millisecond):
+		return ErrPingTimeout
+	}
+	logger.Debugf("%s ping in %s.", fab.String(), time.Since(start))
+	return
+}
+
+// Validate makes fabric a member of pool, it pings. Peers of old
+// versions can't answer ping, they are taken as usable.
+func (fab *Fabric) Validate() error {
+	if fab.Features&FEATURE_PING == 0 {
+		return nil
+	}
+	return fab.Ping()
+}
+
+func (fab *Fabric) onPong() {
+	fab.plock.RLock()
+	ch := fab.ch_pong
+	fab.plock.RUnlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
 func (fab *Fabric) CloseFiber(streamid uint16) (err error) {
 	fab.plock.Lock()
 	defer fab.plock.Unlock()
@@ -134,6 +227,9 @@ func (fab *Fabric) CloseFiber(streamid uint16) (err error) {
 		return fmt.Errorf("streamid(%d) not exist.", streamid)
 	}
 	delete(fab.weaves, streamid)
+	if len(fab.weaves) == 0 {
+		fab.idleSince = time.Now()
+	}
 
 	logger.Infof("%s remove port %d.", fab.String(), streamid)
 	return
@@ -183,6 +279,25 @@ func (fab *Fabric) Loop() {
 
 		logger.Debugf("recv %s", f.Debug())
 
+		switch f.Header.Type {
+		case MSG_PING:
+			err = SendFrame(fab, MSG_PONG, 0, nil)
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+			continue
+		case MSG_PONG:
+			fab.onPong()
+			continue
+		}
+		if f.Header.Type == MSG_UNKNOWN || f.Header.Type > MSG_PONG {
+			// types of newer versions, ignore them to keep session.
+			logger.Warningf("%s ignore %s", fab.String(), f.Debug())
+			f.free()
+			continue
+		}
+
 		fab.plock.RLock()
 		fiber, ok := fab.weaves[f.Header.Streamid]
 		fab.plock.RUnlock()
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+
+	"github.com/shell909090/goproxy/netutil"
 )
 
 type Header struct {
@@ -21,9 +23,20 @@ func (hdr *Header) Debug() string {
 
 type Result uint32
 
+// Errno of result, features of server are in the high bits.
+func (r Result) Errno() uint32 {
+	return uint32(r) & (1<<RESULT_FEATURE_SHIFT - 1)
+}
+
+func (r Result) Features() uint32 {
+	return uint32(r) >> RESULT_FEATURE_SHIFT
+}
+
 type Auth struct {
 	Username string
 	Password string
+	Otp      string `json:",omitempty"`
+	Features uint32 `json:",omitempty"`
 }
 
 type Syn struct {
@@ -46,7 +59,14 @@ func ReadFrame(r io.Reader, v interface{}) (f *Frame, err error) {
 		return
 	}
 
-	f.Data = make([]byte, f.Header.Length)
+	// data frames are taken from the pool and given back by the reader
+	// once consumed, so idle streams hold no buffers.
+	pool := netutil.BufferPool
+	if int(f.Header.Length) <= pool.Size() {
+		f.Data = pool.Get()[:f.Header.Length]
+	} else {
+		f.Data = make([]byte, f.Header.Length)
+	}
 	_, err = io.ReadFull(r, f.Data)
 	if err != nil {
 		logger.Error(err.Error())
@@ -119,10 +139,26 @@ func (f *Frame) Unmarshal(v interface{}) (err error) {
 
 func (f *Frame) Pack() (b []byte) {
 	var buf bytes.Buffer
+	f.PackInto(&buf)
+	return buf.Bytes()
+}
+
+// PackInto appends the packed frame to buf, so callers can reuse it.
+func (f *Frame) PackInto(buf *bytes.Buffer) {
 	buf.Grow(int(5 + f.Header.Length))
-	binary.Write(&buf, binary.BigEndian, f.Header)
+	binary.Write(buf, binary.BigEndian, f.Header)
 	buf.Write(f.Data)
-	return buf.Bytes()
+}
+
+// free gives the data of a received frame back to the buffer pool.
+// Data must not be used after that.
+func (f *Frame) free() {
+	freeData(f.Data)
+	f.Data = nil
+}
+
+func freeData(b []byte) {
+	netutil.BufferPool.Put(b)
 }
 
 func (f *Frame) WriteTo(stream io.Writer) (err error) {
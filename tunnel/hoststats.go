@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MAX_HOSTS  = 1024
+	OTHER_HOST = "other"
+)
+
+type HostCounter struct {
+	Host string
+	Sent int64
+	Recv int64
+}
+
+func (hc *HostCounter) AddSent(n int) {
+	atomic.AddInt64(&hc.Sent, int64(n))
+}
+
+func (hc *HostCounter) AddRecv(n int) {
+	atomic.AddInt64(&hc.Recv, int64(n))
+}
+
+// HostStats sums bytes of streams by destination host.
+// Hosts more than MAX_HOSTS are counted in OTHER_HOST.
+type HostStats struct {
+	lock  sync.Mutex
+	hosts map[string]*HostCounter
+}
+
+var DefaultHostStats = NewHostStats()
+
+func NewHostStats() (hs *HostStats) {
+	return &HostStats{
+		hosts: make(map[string]*HostCounter, 0),
+	}
+}
+
+// Get returns counter of host in address.
+func (hs *HostStats) Get(address string) (hc *HostCounter) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hc, ok := hs.hosts[host]
+	if ok {
+		return
+	}
+	if len(hs.hosts) >= MAX_HOSTS {
+		host = OTHER_HOST
+		if hc, ok = hs.hosts[host]; ok {
+			return
+		}
+	}
+	hc = &HostCounter{Host: host}
+	hs.hosts[host] = hc
+	return
+}
+
+func (hs *HostStats) GetCounters() (counters []HostCounter) {
+	hs.lock.Lock()
+	for _, hc := range hs.hosts {
+		counters = append(counters, HostCounter{
+			Host: hc.Host,
+			Sent: atomic.LoadInt64(&hc.Sent),
+			Recv: atomic.LoadInt64(&hc.Recv),
+		})
+	}
+	hs.lock.Unlock()
+
+	sort.Slice(counters, func(i, j int) bool {
+		return counters[i].Host < counters[j].Host
+	})
+	return
+}
+
+// WriteMetrics writes counters in prometheus text format.
+func (hs *HostStats) WriteMetrics(w io.Writer) {
+	counters := hs.GetCounters()
+	fmt.Fprintln(w, "# HELP goproxy_host_bytes_total Bytes of msocks streams by destination host.")
+	fmt.Fprintln(w, "# TYPE goproxy_host_bytes_total counter")
+	for _, hc := range counters {
+		fmt.Fprintf(w, "goproxy_host_bytes_total{host=%q,direction=\"sent\"} %d\n",
+			hc.Host, hc.Sent)
+		fmt.Fprintf(w, "goproxy_host_bytes_total{host=%q,direction=\"recv\"} %d\n",
+			hc.Host, hc.Recv)
+	}
+}
@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHostStats(t *testing.T) {
+	hs := NewHostStats()
+	hs.Get("a.com:443").AddSent(10)
+	hs.Get("a.com:80").AddRecv(100)
+	hs.Get("b.com").AddSent(1)
+	if hs.Get("a.com:443") != hs.Get("a.com") {
+		t.Fatal("ports of host counted apart")
+	}
+	want := []HostCounter{{"a.com", 10, 100}, {"b.com", 1, 0}}
+	if counters := hs.GetCounters(); fmt.Sprint(counters) != fmt.Sprint(want) {
+		t.Fatalf("wrong counters: %v", counters)
+	}
+
+	for i := 0; i < MAX_HOSTS; i++ {
+		hs.Get(fmt.Sprintf("h%d.com:80", i)).AddSent(1)
+	}
+	if len(hs.GetCounters()) != MAX_HOSTS+1 {
+		t.Fatal("hosts over max not in other")
+	}
+	if hc := hs.Get("c.com:80"); hc.Host != OTHER_HOST || hc.Sent != 2 {
+		t.Fatalf("wrong other: %v", hc)
+	}
+
+	var buf bytes.Buffer
+	hs.WriteMetrics(&buf)
+	for _, line := range []string{
+		`goproxy_host_bytes_total{host="a.com",direction="sent"} 10`,
+		`goproxy_host_bytes_total{host="a.com",direction="recv"} 100`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("wrong metrics: %s", buf.String())
+		}
+	}
+}
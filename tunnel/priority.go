@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	INTERACTIVE_SIZE = 512
+	INTERACTIVE_RATE = 64 * 1024
+)
+
+// BULK_WAIT is the longest time a bulk locker gives way to urgent ones,
+// after that it goes first.
+const BULK_WAIT = 200 * time.Millisecond
+
+// PriorityLock lets urgent lockers go before the bulk ones waiting.
+type PriorityLock struct {
+	lock    sync.Mutex
+	ev      *sync.Cond
+	locked  bool
+	urgents int
+	starved int // bulk lockers waited longer than BULK_WAIT
+}
+
+func NewPriorityLock() (pl *PriorityLock) {
+	pl = &PriorityLock{}
+	pl.ev = sync.NewCond(&pl.lock)
+	return
+}
+
+func (pl *PriorityLock) Lock(bulk bool) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	if !bulk {
+		pl.urgents++
+		defer func() { pl.urgents-- }()
+	}
+
+	var timer *time.Timer
+	starved, done := false, false
+	for pl.locked || (!starved && (pl.starved > 0 || (bulk && pl.urgents > 0))) {
+		if bulk && timer == nil {
+			timer = time.AfterFunc(BULK_WAIT, func() {
+				pl.lock.Lock()
+				defer pl.lock.Unlock()
+				if done {
+					return
+				}
+				starved = true
+				pl.starved++
+				pl.ev.Broadcast()
+			})
+		}
+		pl.ev.Wait()
+	}
+	done = true
+	if timer != nil {
+		timer.Stop()
+	}
+	if starved {
+		pl.starved--
+	}
+	pl.locked = true
+}
+
+func (pl *PriorityLock) Unlock() {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.locked = false
+	pl.ev.Broadcast()
+}
+
+// Classifier guesses if a stream is interactive, like ssh or rdp.
+// Those send small packets at low rate, in both directions.
+type Classifier struct {
+	avgSize int
+	start   time.Time
+	bucket  int
+	rate    int
+}
+
+// Add counts one write of size bytes.
+func (cl *Classifier) Add(size int) {
+	now := time.Now()
+	if now.Sub(cl.start) >= time.Second {
+		cl.rate = cl.bucket
+		cl.bucket = 0
+		cl.start = now
+	}
+	cl.bucket += size
+	// moving average, new write weights 1/8.
+	cl.avgSize += (size - cl.avgSize) / 8
+}
+
+func (cl *Classifier) Interactive() bool {
+	return cl.avgSize <= INTERACTIVE_SIZE &&
+		cl.rate <= INTERACTIVE_RATE && cl.bucket <= INTERACTIVE_RATE
+}
@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitUrgents waits till n urgent lockers waiting.
+func waitUrgents(pl *PriorityLock, n int) {
+	for {
+		pl.lock.Lock()
+		urgents := pl.urgents
+		pl.lock.Unlock()
+		if urgents == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPriorityLock(t *testing.T) {
+	pl := NewPriorityLock()
+	pl.Lock(false)
+
+	order := make(chan string, 2)
+	go func() {
+		pl.Lock(true)
+		order <- "bulk"
+		pl.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		pl.Lock(false)
+		order <- "urgent"
+		pl.Unlock()
+	}()
+	waitUrgents(pl, 1)
+	pl.Unlock()
+
+	if first := <-order; first != "urgent" {
+		t.Fatalf("%s locked first", first)
+	}
+	if second := <-order; second != "bulk" {
+		t.Fatalf("%s locked second", second)
+	}
+}
+
+func TestPriorityLockStarved(t *testing.T) {
+	pl := NewPriorityLock()
+	pl.Lock(false)
+
+	locked := make(chan struct{})
+	go func() {
+		pl.Lock(true)
+		close(locked)
+		pl.Unlock()
+	}()
+
+	// urgent lockers always waiting, bulk one never goes without bound.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				pl.Lock(false)
+				time.Sleep(time.Millisecond)
+				pl.Unlock()
+			}
+		}()
+	}
+	waitUrgents(pl, 2)
+	pl.Unlock()
+
+	select {
+	case <-locked:
+	case <-time.After(10 * BULK_WAIT):
+		t.Fatal("bulk locker starved")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestClassifier(t *testing.T) {
+	var cl Classifier
+	for i := 0; i < 16; i++ {
+		cl.Add(100)
+	}
+	if !cl.Interactive() {
+		t.Fatal("small writes not interactive")
+	}
+	for i := 0; i < 16; i++ {
+		cl.Add(8192)
+	}
+	if cl.Interactive() {
+		t.Fatal("bulk writes interactive")
+	}
+}
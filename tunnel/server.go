@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,13 +12,31 @@ type PasswordAuthenticator interface {
 	AuthPass(string, string) bool
 }
 
-func AuthConn(auth PasswordAuthenticator, conn net.Conn) (err error) {
+// OtpAuthenticator checks one time password after password passed,
+// if authenticator has it.
+type OtpAuthenticator interface {
+	AuthOtp(string, string) bool
+}
+
+func authFrame(author PasswordAuthenticator, auth *Auth) bool {
+	if !author.AuthPass(auth.Username, auth.Password) {
+		return false
+	}
+	if oa, ok := author.(OtpAuthenticator); ok {
+		return oa.AuthOtp(auth.Username, auth.Otp)
+	}
+	return true
+}
+
+// AuthConn reads auth frame from conn and return the username passed.
+// Username is returned on auth failure too, if there is one.
+func AuthConn(auth PasswordAuthenticator, conn net.Conn) (username string, err error) {
 	ti := time.AfterFunc(AUTH_TIMEOUT*time.Millisecond, func() {
 		logger.Errorf("auth timeout %s.", conn.RemoteAddr())
 		conn.Close()
 	})
 
-	err = onAuth(auth, conn)
+	username, err = onAuth(auth, conn)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -27,7 +46,7 @@ func AuthConn(auth PasswordAuthenticator, conn net.Conn) (err error) {
 	return
 }
 
-func onAuth(author PasswordAuthenticator, stream io.ReadWriteCloser) (err error) {
+func onAuth(author PasswordAuthenticator, stream io.ReadWriteCloser) (username string, err error) {
 	var auth Auth
 	fauth, err := ReadFrame(stream, &auth)
 	if err != nil {
@@ -36,24 +55,27 @@ func onAuth(author PasswordAuthenticator, stream io.ReadWriteCloser) (err error)
 	}
 
 	if fauth.Header.Type != MSG_AUTH {
-		return ErrUnexpectedPkg
+		err = ErrUnexpectedPkg
+		return
 	}
+	username = auth.Username
 
-	if !author.AuthPass(auth.Username, auth.Password) {
-		logger.Errorf("user %s auth failed with password: %s.",
-			auth.Username, auth.Password)
+	if !authFrame(author, &auth) {
 		err = WriteFrame(
 			stream, MSG_RESULT, fauth.Header.Streamid, ERR_AUTH)
 		if err != nil {
 			return
 		}
-		err = fmt.Errorf("user %s auth failed, password:%s.",
-			auth.Username, auth.Password)
+		err = fmt.Errorf("user %s %w", auth.Username, ErrAuthFailed)
 		return
 	}
 
+	// features are only replied to clients asked, old ones take
+	// result as errno.
+	result := Result(ERR_NONE) |
+		Result(auth.Features&FEATURES)<<RESULT_FEATURE_SHIFT
 	err = WriteFrame(
-		stream, MSG_RESULT, fauth.Header.Streamid, ERR_NONE)
+		stream, MSG_RESULT, fauth.Header.Streamid, result)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -75,6 +97,9 @@ func init() {
 		"tcp":  p,
 		"tcp4": p,
 		"tcp6": p,
+		"udp":  p,
+		"udp4": p,
+		"udp6": p,
 	}
 }
 
@@ -97,6 +122,9 @@ func (server *Server) Serve(listener net.Listener) (err error) {
 	for {
 		conn, err = listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			logger.Error(err.Error())
 			continue
 		}
@@ -173,6 +201,7 @@ func (s *TunnelServer) accept(streamid uint16, syn *Syn) (c *Conn, err error) {
 	c.streamid = streamid
 	c.Network = syn.Network
 	c.Address = syn.Address
+	c.hstat = DefaultHostStats.Get(syn.Address)
 
 	err = s.Fabric.PutIntoId(streamid, c)
 	if err != nil {
@@ -2,11 +2,14 @@ package tunnel
 
 import (
 	"net"
+	"strings"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
 )
 
+// TcpProxy connects streams to tcp or udp targets. Packets of udp are
+// framed by netutil.PacketConn in stream.
 type TcpProxy struct {
 }
 
@@ -29,20 +32,32 @@ func (p *TcpProxy) Handle(fabconn net.Conn) (err error) {
 
 	logger.Debugf("%s try to connect %s:%s.",
 		c.String(), c.Network, c.Address)
+	record := NewStreamRecord(c)
 
 	conn, err = p.DialMaybeTimeout(c.Network, c.Address)
 	if err != nil {
 		logger.Error(err.Error())
 		c.Deny()
+		record.Finish(err)
 		return
 	}
 
 	err = c.Accept()
 	if err != nil {
+		conn.Close()
+		record.Finish(err)
 		return
 	}
 
-	go netutil.CopyLink(conn, c)
+	var peer net.Conn = c
+	if strings.HasPrefix(c.Network, "udp") {
+		peer = netutil.NewPacketConn(c)
+	}
+	go func() {
+		var err error
+		record.Sent, record.Recv, err = netutil.Relay(peer, conn)
+		record.Finish(err)
+	}()
 	logger.Noticef("%s connected to %s:%s.",
 		c.String(), c.Network, c.Address)
 	return
@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// StreamRecord describes one stream server opened for client.
+type StreamRecord struct {
+	Start    time.Time
+	Username string
+	Client   string
+	Target   string
+	Sent     int64 // bytes from client to target
+	Recv     int64 // bytes from target to client
+	Duration float64
+	Reason   string
+}
+
+type StreamLogger interface {
+	LogStream(*StreamRecord)
+}
+
+// DefaultStreamLogger receives a record when a proxied stream ends.
+var DefaultStreamLogger StreamLogger = &TextStreamLogger{}
+
+type TextStreamLogger struct {
+}
+
+func (tsl *TextStreamLogger) LogStream(r *StreamRecord) {
+	logger.Noticef("stream %s from %s to %s, sent %d, recv %d, in %.3fs, %s.",
+		r.Username, r.Client, r.Target, r.Sent, r.Recv, r.Duration, r.Reason)
+}
+
+// JsonStreamLogger writes one json object per line.
+type JsonStreamLogger struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func NewJsonStreamLogger(w io.Writer) (jsl *JsonStreamLogger) {
+	return &JsonStreamLogger{enc: json.NewEncoder(w)}
+}
+
+func (jsl *JsonStreamLogger) LogStream(r *StreamRecord) {
+	jsl.lock.Lock()
+	defer jsl.lock.Unlock()
+	err := jsl.enc.Encode(r)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func NewStreamRecord(c *Conn) (r *StreamRecord) {
+	return &StreamRecord{
+		Start:    time.Now(),
+		Username: c.fab.Username,
+		Client:   c.fab.RemoteAddr().String(),
+		Target:   c.GetTarget(),
+	}
+}
+
+// Finish fills duration and reason, then sends record to DefaultStreamLogger.
+func (r *StreamRecord) Finish(err error) {
+	r.Duration = time.Since(r.Start).Seconds()
+	if err != nil {
+		r.Reason = err.Error()
+	} else {
+		r.Reason = "closed"
+	}
+	DefaultStreamLogger.LogStream(r)
+}
@@ -31,7 +31,7 @@ func (m *MockServer) AuthPass(username, password string) bool {
 }
 
 func (m *MockServer) Handle(conn net.Conn) (err error) {
-	err = AuthConn(m, conn)
+	_, err = AuthConn(m, conn)
 	if err != nil {
 		logger.Error(err.Error())
 		return
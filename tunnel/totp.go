@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	TOTP_STEP   = 30
+	TOTP_DIGITS = 6
+	TOTP_SKEW   = 1
+)
+
+// DecodeTotpSecret decodes secret in base32 as authenticator apps show,
+// spaces and padding are optional.
+func DecodeTotpSecret(s string) (secret []byte, err error) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	s = strings.TrimRight(s, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+}
+
+func totpAt(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// TotpCode makes code of RFC 6238 at time t, with sha1, 6 digits and
+// 30 seconds a step.
+func TotpCode(secret []byte, t time.Time) string {
+	return totpAt(secret, uint64(t.Unix())/TOTP_STEP)
+}
+
+// TotpVerify accepts code of current step, and TOTP_SKEW steps around
+// for clock drift.
+func TotpVerify(secret []byte, code string, t time.Time) bool {
+	_, ok := TotpStep(secret, code, t)
+	return ok
+}
+
+// TotpStep is TotpVerify, and returns step of code, for callers to
+// refuse code used.
+func TotpStep(secret []byte, code string, t time.Time) (step uint64, ok bool) {
+	if len(code) != TOTP_DIGITS {
+		return
+	}
+	counter := uint64(t.Unix()) / TOTP_STEP
+	for i := counter - TOTP_SKEW; i <= counter+TOTP_SKEW; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpAt(secret, i)), []byte(code)) == 1 {
+			step, ok = i, true
+		}
+	}
+	return
+}
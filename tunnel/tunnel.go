@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"errors"
+	"time"
 
 	logging "github.com/op/go-logging"
 )
@@ -11,6 +12,7 @@ const (
 	DIAL_TIMEOUT  = 20000
 	WRITE_TIMEOUT = 10000
 	CLOSE_TIMEOUT = 30000
+	PING_TIMEOUT  = 10000
 	WINDOWSIZE    = 4 * 1024 * 1024
 	// WINDOWSIZE = 100
 )
@@ -24,6 +26,20 @@ const (
 	MSG_WND
 	MSG_FIN
 	MSG_RST
+	MSG_PING
+	MSG_PONG
+)
+
+// FEATURE_* are bits of what peer supports. Client lists them in auth,
+// and server replies those it supports too in high bits of result, only
+// if client listed any. So peers of old versions see nothing new.
+const (
+	FEATURE_PING = 1 << iota
+)
+
+const (
+	FEATURES             = FEATURE_PING
+	RESULT_FEATURE_SHIFT = 16
 )
 
 const (
@@ -70,6 +86,10 @@ var (
 	ErrUnexpectedPkg  = errors.New("unexpected package.")
 	ErrIdExist        = errors.New("frame sync stream id exist.")
 	ErrState          = errors.New("status error.")
+	ErrWindowOverflow = errors.New("peer sent over window.")
+	ErrPingTimeout    = errors.New("ping timeout.")
+	ErrPingNotSupport = errors.New("peer not support ping.")
+	ErrAuthFailed     = errors.New("auth failed.")
 )
 
 var (
@@ -79,6 +99,10 @@ var (
 type Tunnel interface {
 	String() string
 	GetSize() int
+	GetConnections() ConnSlice
+	Uptime() time.Duration
+	Idle() time.Duration
 	Loop()
+	Validate() error
 	Close() error
 }
@@ -3,9 +3,12 @@ package tunnel
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/shell909090/goproxy/netutil"
 )
@@ -86,6 +89,47 @@ func multi_client(t *testing.T, client *Client, wg *sync.WaitGroup) {
 // 	return
 // }
 
+// udp_client checks packets keep their boundaries through stream.
+func udp_client(t *testing.T, client *Client) {
+	uconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer uconn.Close()
+	go func() {
+		var buf [100]byte
+		for {
+			n, addr, err := uconn.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			uconn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := client.Dial("udp", uconn.LocalAddr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(PAYLOAD))
+	conn.Write([]byte(PAYLOAD + "1"))
+	for _, want := range []string{PAYLOAD, PAYLOAD + "1"} {
+		var buf [100]byte
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("udp packet not match: %q", buf[:n])
+			return
+		}
+	}
+}
+
 func TestTunnel(t *testing.T) {
 	var wg sync.WaitGroup
 	SetLogging()
@@ -113,6 +157,14 @@ func TestTunnel(t *testing.T) {
 		logger.Warning("client loop quit")
 	}()
 
+	err = client.Ping()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	udp_client(t, client)
+
 	// get_myip(t, client, &wg)
 
 	multi_client(t, client, &wg)
@@ -122,3 +174,243 @@ func TestTunnel(t *testing.T) {
 	client.Close()
 	wg.Wait()
 }
+
+func TestTotp(t *testing.T) {
+	// test vector of RFC 6238, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	if code := TotpCode(secret, time.Unix(59, 0)); code != "287082" {
+		t.Fatalf("totp code wrong: %s", code)
+	}
+	if !TotpVerify(secret, "287082", time.Unix(59+TOTP_STEP, 0)) {
+		t.Fatal("totp of last step refused.")
+	}
+	if TotpVerify(secret, "287082", time.Unix(59+3*TOTP_STEP, 0)) {
+		t.Fatal("totp too old passed.")
+	}
+}
+
+func TestOtpStep(t *testing.T) {
+	now := time.Unix(10*TOTP_STEP+5, 0)
+	if step, wait := otpStep(now, 9); step != 10 || wait != 0 {
+		t.Fatalf("step %d, wait %s", step, wait)
+	}
+	// step used, wait for the next.
+	if step, wait := otpStep(now, 10); step != 11 || wait != (TOTP_STEP-5)*time.Second {
+		t.Fatalf("step %d, wait %s", step, wait)
+	}
+}
+
+// startServer runs mock server in a random port, and returns client
+// connected to it.
+func startServer(t *testing.T) (client *Client) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := Server{Handler: &MockServer{}}
+	go server.Serve(listener)
+
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp4",
+		listener.Addr().String(), "", "")
+	client, err = dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Loop()
+	t.Cleanup(func() { client.Close() })
+	return
+}
+
+// chanStreamLogger sends records of target to channel, streams of other
+// tests may end in the meantime.
+type chanStreamLogger struct {
+	target  string
+	records chan *StreamRecord
+}
+
+func (csl *chanStreamLogger) LogStream(r *StreamRecord) {
+	if r.Target == csl.target {
+		csl.records <- r
+	}
+}
+
+func TestStreamRecordDirection(t *testing.T) {
+	// target reads 3 bytes, and replies 5 bytes.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	records := &chanStreamLogger{
+		target:  "tcp:" + target.Addr().String(),
+		records: make(chan *StreamRecord, 1),
+	}
+	orig := DefaultStreamLogger
+	DefaultStreamLogger = records
+	defer func() { DefaultStreamLogger = orig }()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var buf [3]byte
+		io.ReadFull(conn, buf[:])
+		conn.Write([]byte("12345"))
+	}()
+
+	client := startServer(t)
+	conn, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("abc"))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if string(b) != "12345" {
+		t.Fatalf("reply not match: %q", b)
+	}
+
+	select {
+	case r := <-records.records:
+		if r.Sent != 3 || r.Recv != 5 {
+			t.Fatalf("sent %d recv %d, want 3 and 5.", r.Sent, r.Recv)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not logged.")
+	}
+}
+
+func TestPingNegotiate(t *testing.T) {
+	client := startServer(t)
+	if client.Features&FEATURE_PING == 0 {
+		t.Fatal("ping not negotiated.")
+	}
+
+	// frames of unknown type are ignored, not closing session.
+	err := client.Fabric.SendFrame(NewFrame(MSG_PONG+10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPingOldServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// old servers reply errno only, and fail on frames they don't know.
+	ch := make(chan *Frame, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var auth Auth
+		_, err = ReadFrame(conn, &auth)
+		if err != nil {
+			return
+		}
+		WriteFrame(conn, MSG_RESULT, 0, ERR_NONE)
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		f, err := ReadFrame(conn, nil)
+		if err == nil {
+			ch <- f
+		}
+		close(ch)
+	}()
+
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp4",
+		listener.Addr().String(), "", "")
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.Features != 0 {
+		t.Fatalf("features of old server: %d.", client.Features)
+	}
+	if client.Ping() != ErrPingNotSupport {
+		t.Fatal("ping old server.")
+	}
+	if client.Validate() != nil {
+		t.Fatal("old server not usable.")
+	}
+	if f := <-ch; f != nil {
+		t.Fatalf("old server got %s", f.Debug())
+	}
+}
+
+func writeData(t *testing.T, w io.Writer, streamid uint16, size int) {
+	f := NewFrame(MSG_DATA, streamid)
+	f.Data = make([]byte, size)
+	f.Header.Length = uint16(size)
+	err := f.WriteTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWindowOverflow(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	fab := NewFabric(local, 0)
+	c := NewConn(fab)
+	c.status = ST_EST
+	c.streamid = 1
+	fab.PutIntoId(1, c)
+	go fab.Loop()
+
+	// data in window are all taken, frames are handled in order.
+	size := netutil.BufferPool.Size()
+	for n := 0; n < WINDOWSIZE; n += size {
+		writeData(t, remote, 1, size)
+	}
+	writeData(t, remote, 1, 1)
+	f, err := ReadFrame(remote, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Header.Type != MSG_RST || f.Header.Streamid != 1 {
+		t.Fatalf("overflow got %s", f.Debug())
+	}
+	if atomic.LoadInt32(&c.r_size) != WINDOWSIZE {
+		t.Fatal("data over window counted")
+	}
+
+	// fabric goes on.
+	err = WriteFrame(remote, MSG_PING, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = ReadFrame(remote, nil)
+	if err != nil || f.Header.Type != MSG_PONG {
+		t.Fatal("fabric closed by overflow")
+	}
+
+	// buffer of frame over window goes back to pool.
+	c = NewConn(fab)
+	c.streamid = 3
+	c.r_size = WINDOWSIZE
+	fab.PutIntoId(3, c)
+	go ReadFrame(remote, nil)
+	f = NewFrame(MSG_DATA, 3)
+	f.Data = netutil.BufferPool.Get()[:1]
+	err = c.SendFrame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Data != nil {
+		t.Fatal("buffer not freed")
+	}
+}